@@ -38,6 +38,33 @@ type Bundle struct {
 	Port      int
 }
 
+// BundleLoader loads a bundle. It's used to refresh a resolver's bundle, e.g. after its certificates are rotated.
+type BundleLoader func() (*Bundle, error)
+
+// BundleLoaderFromPath creates a loader that re-reads a bundle file.
+func BundleLoaderFromPath(path string) BundleLoader {
+	return func() (*Bundle, error) {
+		return LoadBundleZipFromPath(path)
+	}
+}
+
+// BundleLoaderFromURL creates a loader that downloads the bundle of one of a database's regions from the Astra API. The
+// region is identified using the host of its current bundle.
+func BundleLoaderFromURL(url, databaseID, token string, timeout time.Duration, host string) BundleLoader {
+	return func() (*Bundle, error) {
+		bundles, err := LoadBundleZipsFromURL(url, databaseID, token, timeout)
+		if err != nil {
+			return nil, err
+		}
+		for _, bundle := range bundles {
+			if bundle.Host == host {
+				return bundle, nil
+			}
+		}
+		return nil, fmt.Errorf("no bundle found for %s in database %s", host, databaseID)
+	}
+}
+
 func LoadBundleZip(reader *zip.Reader) (*Bundle, error) {
 	contents, err := extract(reader)
 	if err != nil {
@@ -96,12 +123,43 @@ func LoadBundleZipFromURL(url, databaseID, token string, timeout time.Duration)
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	credsURL, err := generateSecureBundleURLWithResponse(url, databaseID, token, ctx)
+	credsURLs, err := generateSecureBundleURLWithResponse(url, databaseID, token, ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error generating secure bundle zip URLs: %v", err)
 	}
 
-	resp, err := http.Get(credsURL.DownloadURL)
+	return downloadBundleZip(credsURLs[0].DownloadURL, ctx)
+}
+
+// LoadBundleZipsFromURL loads the bundles of all the regions of a database. The bundles are in the order returned by the
+// Astra API, starting with the database's primary region.
+func LoadBundleZipsFromURL(url, databaseID, token string, timeout time.Duration) ([]*Bundle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	credsURLs, err := generateSecureBundleURLWithResponse(url, databaseID, token, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error generating secure bundle zip URLs: %v", err)
+	}
+
+	bundles := make([]*Bundle, 0, len(credsURLs))
+	for _, credsURL := range credsURLs {
+		bundle, err := downloadBundleZip(credsURL.DownloadURL, ctx)
+		if err != nil {
+			return nil, err
+		}
+		bundles = append(bundles, bundle)
+	}
+	return bundles, nil
+}
+
+func downloadBundleZip(url string, ctx context.Context) (*Bundle, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading secure bundle zip: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error downloading secure bundle zip: %v", err)
 	}
@@ -138,7 +196,7 @@ func readAllWithTimeout(r io.Reader, ctx context.Context) (bytes []byte, err err
 	return bytes, err
 }
 
-func generateSecureBundleURLWithResponse(url, databaseID, token string, ctx context.Context) (*astra.CredsURL, error) {
+func generateSecureBundleURLWithResponse(url, databaseID, token string, ctx context.Context) ([]astra.CredsURL, error) {
 	client, err := astra.NewClientWithResponses(url, func(c *astra.Client) error {
 		c.RequestEditors = append(c.RequestEditors, func(ctx context.Context, req *http.Request) error {
 			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
@@ -163,7 +221,11 @@ func generateSecureBundleURLWithResponse(url, databaseID, token string, ctx cont
 		return nil, fmt.Errorf("unable to generate bundle urls, failed with status code %d", res.StatusCode())
 	}
 
-	return &(*res.JSON200)[0], nil
+	if res.JSON200 == nil || len(*res.JSON200) == 0 {
+		return nil, errors.New("no bundle urls returned")
+	}
+
+	return *res.JSON200, nil
 }
 
 func extract(reader *zip.Reader) (map[string][]byte, error) {
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/datastax/cql-proxy/proxycore"
@@ -32,37 +33,110 @@ type astraResolver struct {
 	sniProxyAddress string
 	region          string
 	bundle          *Bundle
+	loadBundle      BundleLoader // Reloads the bundle, it's nil if the bundle isn't refreshed
+	refreshInterval time.Duration
+	loadedAt        time.Time
+	needsRefresh    int32       // Set to 1 after a certificate verification error (atomic)
+	refreshMu       *sync.Mutex // Serializes reloading the bundle
 	mu              *sync.Mutex
 	timeout         time.Duration
 }
 
 type astraEndpoint struct {
-	addr      string
-	key       string
-	tlsConfig *tls.Config
+	addr     string
+	key      string         // The host ID, it doesn't include the SNI proxy address so that it's stable if the address changes
+	resolver *astraResolver // Provides the TLS configuration of the current bundle
 }
 
 func NewResolver(bundle *Bundle, timeout time.Duration) proxycore.EndpointResolver {
+	return newResolver(bundle, timeout, nil, 0)
+}
+
+// NewResolverWithRefresh creates a resolver that reloads its bundle every refresh interval, and after a certificate
+// verification error, so that new connections use rotated certificates. The refresh interval is checked when the
+// endpoints are resolved and before connecting to an endpoint, and it's disabled if zero.
+func NewResolverWithRefresh(bundle *Bundle, timeout time.Duration, load BundleLoader, refreshInterval time.Duration) proxycore.EndpointResolver {
+	return newResolver(bundle, timeout, load, refreshInterval)
+}
+
+func newResolver(bundle *Bundle, timeout time.Duration, load BundleLoader, refreshInterval time.Duration) *astraResolver {
 	return &astraResolver{
-		bundle:  bundle,
-		mu:      &sync.Mutex{},
-		timeout: timeout,
+		bundle:          bundle,
+		loadBundle:      load,
+		refreshInterval: refreshInterval,
+		loadedAt:        time.Now(),
+		refreshMu:       &sync.Mutex{},
+		mu:              &sync.Mutex{},
+		timeout:         timeout,
 	}
 }
 
 func (r *astraResolver) Resolve(ctx context.Context) ([]proxycore.Endpoint, error) {
+	refreshErr := r.maybeRefreshBundle(false)
+	endpoints, err := r.resolve(ctx)
+	if err != nil && isCertificateError(err) && r.loadBundle != nil {
+		// The bundle's certificates might have expired or been rotated
+		if refreshErr = r.maybeRefreshBundle(true); refreshErr == nil {
+			endpoints, err = r.resolve(ctx)
+		}
+	}
+	if err != nil && refreshErr != nil {
+		return nil, fmt.Errorf("%w (unable to refresh bundle: %v)", err, refreshErr)
+	}
+	return endpoints, err
+}
+
+// maybeRefreshBundle reloads the bundle if it's forced, if a certificate verification error happened or if the refresh
+// interval has elapsed. Concurrent callers wait for a reload in progress instead of reloading the bundle again.
+func (r *astraResolver) maybeRefreshBundle(force bool) error {
+	if r.loadBundle == nil {
+		return nil
+	}
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	r.mu.Lock()
+	due := r.refreshInterval > 0 && time.Since(r.loadedAt) >= r.refreshInterval
+	r.mu.Unlock()
+	if !force && !due && atomic.LoadInt32(&r.needsRefresh) == 0 {
+		return nil
+	}
+
+	bundle, err := r.loadBundle()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.bundle = bundle
+	r.loadedAt = time.Now()
+	r.mu.Unlock()
+	atomic.StoreInt32(&r.needsRefresh, 0)
+	return nil
+}
+
+func (r *astraResolver) currentBundle() *Bundle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bundle
+}
+
+func (r *astraResolver) resolve(ctx context.Context) ([]proxycore.Endpoint, error) {
 	var metadata *astraMetadata
 
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
+	bundle := r.currentBundle()
 	httpsClient := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: r.bundle.TLSConfig.Clone(),
+			TLSClientConfig: bundle.TLSConfig.Clone(),
 		},
 	}
+	// The metadata is refreshed periodically so the client's connections shouldn't outlive the request
+	defer httpsClient.CloseIdleConnections()
 
-	url := fmt.Sprintf("https://%s:%d/metadata", r.bundle.Host, r.bundle.Port)
+	url := fmt.Sprintf("https://%s:%d/metadata", bundle.Host, bundle.Port)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
 	if err != nil {
 		return nil, err
@@ -72,6 +146,11 @@ func (r *astraResolver) Resolve(ctx context.Context) ([]proxycore.Endpoint, erro
 	if err != nil {
 		return nil, fmt.Errorf("unable to get metadata from %s: %w", url, err)
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get metadata from %s: unexpected status %s", url, response.Status)
+	}
 
 	body, err := readAllWithTimeout(response.Body, ctx)
 	if err != nil {
@@ -84,6 +163,9 @@ func (r *astraResolver) Resolve(ctx context.Context) ([]proxycore.Endpoint, erro
 	}
 
 	sniProxyAddress := metadata.ContactInfo.SniProxyAddress
+	if len(sniProxyAddress) == 0 {
+		return nil, fmt.Errorf("no SNI proxy address in metadata from %s", url)
+	}
 
 	r.mu.Lock()
 	r.sniProxyAddress = sniProxyAddress
@@ -93,9 +175,9 @@ func (r *astraResolver) Resolve(ctx context.Context) ([]proxycore.Endpoint, erro
 	var endpoints []proxycore.Endpoint
 	for _, cp := range metadata.ContactInfo.ContactPoints {
 		endpoints = append(endpoints, &astraEndpoint{
-			addr:      sniProxyAddress,
-			key:       fmt.Sprintf("%s:%s", sniProxyAddress, cp),
-			tlsConfig: copyTLSConfig(r.bundle, cp),
+			addr:     sniProxyAddress,
+			key:      cp,
+			resolver: r,
 		})
 	}
 
@@ -128,15 +210,15 @@ func (r *astraResolver) NewEndpoint(row proxycore.Row) (proxycore.Endpoint, erro
 		return nil, err
 	} else {
 		return &astraEndpoint{
-			addr:      sniProxyAddress,
-			key:       fmt.Sprintf("%s:%s", sniProxyAddress, &hostId),
-			tlsConfig: copyTLSConfig(r.bundle, hostId.String()),
+			addr:     sniProxyAddress,
+			key:      hostId.String(),
+			resolver: r,
 		}, nil
 	}
 }
 
 func (a astraEndpoint) String() string {
-	return a.Key()
+	return fmt.Sprintf("%s:%s", a.addr, a.key)
 }
 
 func (a astraEndpoint) Key() string {
@@ -151,11 +233,16 @@ func (a astraEndpoint) IsResolved() bool {
 	return false
 }
 
+// TLSConfig returns the TLS configuration of the resolver's current bundle so that new connections use the refreshed
+// bundle. The bundle is reloaded first if a previous connection had a certificate verification error, or if the refresh
+// interval has elapsed. If it can't be reloaded the current bundle is used and reloading is retried by the next
+// connection. The host ID is used as the server name.
 func (a astraEndpoint) TLSConfig() *tls.Config {
-	return a.tlsConfig
+	_ = a.resolver.maybeRefreshBundle(false)
+	return a.resolver.copyTLSConfig(a.resolver.currentBundle(), a.key)
 }
 
-func copyTLSConfig(bundle *Bundle, serverName string) *tls.Config {
+func (r *astraResolver) copyTLSConfig(bundle *Bundle, serverName string) *tls.Config {
 	tlsConfig := bundle.TLSConfig.Clone()
 	tlsConfig.ServerName = serverName
 	tlsConfig.InsecureSkipVerify = true
@@ -180,11 +267,25 @@ func copyTLSConfig(bundle *Bundle, serverName string) *tls.Config {
 		}
 		var err error
 		verifiedChains, err = certs[0].Verify(opts)
+		if err != nil {
+			atomic.StoreInt32(&r.needsRefresh, 1)
+		}
 		return err
 	}
 	return tlsConfig
 }
 
+// isCertificateError returns true if an error is caused by an invalid certificate, or if the server rejected the
+// client's certificate.
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var alertErr tls.AlertError
+	return errors.As(err, &verificationErr) || errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &alertErr)
+}
+
 type contactInfo struct {
 	TypeName        string   `json:"type"`
 	LocalDc         string   `json:"local_dc"`
@@ -17,11 +17,13 @@ package astra
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -99,7 +101,8 @@ func TestAstraResolver_NewEndpoint(t *testing.T) {
 	endpoint, err := resolver.NewEndpoint(rs.Row(0))
 	assert.NotNil(t, endpoint)
 	assert.Nil(t, err)
-	assert.Contains(t, endpoint.Key(), hostId)
+	assert.Equal(t, hostId, endpoint.Key(), "the key shouldn't change if the SNI proxy address changes")
+	assert.Equal(t, sniProxyAddr, endpoint.Addr())
 }
 
 func TestAstraResolver_NewEndpoint_Ignored(t *testing.T) {
@@ -176,6 +179,103 @@ func TestAstraResolver_Timeout(t *testing.T) {
 	assert.ErrorIs(t, err, context.DeadlineExceeded) // Expect a timeout
 }
 
+func TestAstraResolver_RefreshBundle(t *testing.T) {
+	path, err := writeBundle("127.0.0.1", 8080)
+	require.NoError(t, err)
+
+	loads := 0
+	var loaded *Bundle
+	load := func() (*Bundle, error) {
+		loads++
+		loaded, err = BundleLoaderFromPath(path)()
+		return loaded, err
+	}
+
+	bundle, err := load()
+	require.NoError(t, err)
+
+	resolver := NewResolverWithRefresh(bundle, 10*time.Second, load, time.Hour)
+	endpoints, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, loads, "the bundle shouldn't be reloaded before the refresh interval")
+
+	// Expired or rotated certificates cause a verification error and the bundle is reloaded
+	stale := *bundle
+	stale.TLSConfig = bundle.TLSConfig.Clone()
+	stale.TLSConfig.RootCAs = x509.NewCertPool()
+	resolver = NewResolverWithRefresh(&stale, 10*time.Second, load, time.Hour)
+	endpoints, err = resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, loads)
+
+	// Endpoints use the refreshed bundle for new connections
+	require.NotEmpty(t, endpoints)
+	assert.Same(t, loaded.TLSConfig.RootCAs, endpoints[0].TLSConfig().RootCAs)
+
+	// The bundle is reloaded once the refresh interval elapses
+	resolver = NewResolverWithRefresh(bundle, 10*time.Second, load, time.Nanosecond)
+	_, err = resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, loads)
+}
+
+func TestAstraResolver_RefreshBundleOnConnect(t *testing.T) {
+	path, err := writeBundle("127.0.0.1", 8080)
+	require.NoError(t, err)
+
+	loads := 0
+	var loaded *Bundle
+	load := func() (*Bundle, error) {
+		loads++
+		loaded, err = BundleLoaderFromPath(path)()
+		return loaded, err
+	}
+
+	bundle, err := load()
+	require.NoError(t, err)
+
+	resolver := newResolver(bundle, 10*time.Second, load, time.Hour)
+	endpoints, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	require.NotEmpty(t, endpoints)
+
+	endpoints[0].TLSConfig()
+	assert.Equal(t, 1, loads, "the bundle shouldn't be reloaded without a certificate error")
+
+	// A certificate verification error on a node connection reloads the bundle before the next connection, without
+	// waiting for the endpoints to be resolved again
+	atomic.StoreInt32(&resolver.needsRefresh, 1)
+	tlsConfig := endpoints[0].TLSConfig()
+	assert.Equal(t, 2, loads)
+	assert.Same(t, loaded.TLSConfig.RootCAs, tlsConfig.RootCAs)
+
+	endpoints[0].TLSConfig()
+	assert.Equal(t, 2, loads)
+
+	// The refresh interval is also checked before connecting
+	resolver = newResolver(bundle, 10*time.Second, load, time.Nanosecond)
+	endpoint := &astraEndpoint{addr: "127.0.0.1:9042", key: "host", resolver: resolver}
+	endpoint.TLSConfig()
+	assert.Equal(t, 3, loads)
+}
+
+func TestAstraResolver_RefreshBundleError(t *testing.T) {
+	path, err := writeBundle("127.0.0.1", 8080)
+	require.NoError(t, err)
+	bundle, err := LoadBundleZipFromPath(path)
+	require.NoError(t, err)
+
+	stale := *bundle
+	stale.TLSConfig = bundle.TLSConfig.Clone()
+	stale.TLSConfig.RootCAs = x509.NewCertPool()
+	resolver := NewResolverWithRefresh(&stale, 10*time.Second, func() (*Bundle, error) {
+		return nil, errors.New("unavailable")
+	}, time.Hour)
+	_, err = resolver.Resolve(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to refresh bundle: unavailable")
+}
+
 func createResolver(t *testing.T) proxycore.EndpointResolver {
 	path, err := writeBundle("127.0.0.1", 8080)
 	require.NoError(t, err)
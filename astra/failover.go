@@ -0,0 +1,78 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package astra
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+)
+
+// failoverResolver resolves the endpoints of a multi-region Astra database using a bundle for each region. Only the
+// nodes of the active region are used.
+type failoverResolver struct {
+	resolvers []*astraResolver
+	active    int32 // (atomic)
+}
+
+// NewFailoverResolver creates a resolver for a multi-region Astra database using the bundles of its regions, in order of
+// preference. The cluster fails over to the next region if the active region is unavailable.
+func NewFailoverResolver(bundles []*Bundle, timeout time.Duration) proxycore.EndpointResolver {
+	return NewFailoverResolverWithRefresh(bundles, timeout, nil, 0)
+}
+
+// NewFailoverResolverWithRefresh creates a failover resolver whose bundles are refreshed, see NewResolverWithRefresh.
+// There's a loader for each bundle.
+func NewFailoverResolverWithRefresh(bundles []*Bundle, timeout time.Duration, loads []BundleLoader, refreshInterval time.Duration) proxycore.EndpointResolver {
+	resolvers := make([]*astraResolver, len(bundles))
+	for i, bundle := range bundles {
+		var load BundleLoader
+		if i < len(loads) {
+			load = loads[i]
+		}
+		resolvers[i] = newResolver(bundle, timeout, load, refreshInterval)
+	}
+	return &failoverResolver{resolvers: resolvers}
+}
+
+func (r *failoverResolver) activeResolver() *astraResolver {
+	return r.resolvers[atomic.LoadInt32(&r.active)]
+}
+
+func (r *failoverResolver) Resolve(ctx context.Context) ([]proxycore.Endpoint, error) {
+	return r.activeResolver().Resolve(ctx)
+}
+
+func (r *failoverResolver) NewEndpoint(row proxycore.Row) (proxycore.Endpoint, error) {
+	return r.activeResolver().NewEndpoint(row)
+}
+
+func (r *failoverResolver) Alternatives() int {
+	return len(r.resolvers)
+}
+
+func (r *failoverResolver) Alternative(index int) string {
+	return r.resolvers[index].currentBundle().Host
+}
+
+func (r *failoverResolver) Active() int {
+	return int(atomic.LoadInt32(&r.active))
+}
+
+func (r *failoverResolver) SetActive(index int) {
+	atomic.StoreInt32(&r.active, int32(index))
+}
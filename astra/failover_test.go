@@ -0,0 +1,57 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package astra
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverResolver(t *testing.T) {
+	var bundles []*Bundle
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		path, err := writeBundle(host, 8080)
+		require.NoError(t, err)
+		bundle, err := LoadBundleZipFromPath(path)
+		require.NoError(t, err)
+		bundles = append(bundles, bundle)
+	}
+	// The second region's metadata service is unavailable
+	bundles[1].Port = 8081
+
+	resolver := NewFailoverResolver(bundles, 10*time.Second).(proxycore.FailoverEndpointResolver)
+	assert.Equal(t, 2, resolver.Alternatives())
+	assert.Equal(t, "127.0.0.1", resolver.Alternative(0))
+	assert.Equal(t, "localhost", resolver.Alternative(1))
+	assert.Equal(t, 0, resolver.Active())
+
+	endpoints, err := resolver.Resolve(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, endpoints, len(contactPoints))
+
+	resolver.SetActive(1)
+	assert.Equal(t, 1, resolver.Active())
+	_, err = resolver.Resolve(context.Background())
+	assert.Error(t, err)
+
+	resolver.SetActive(0)
+	_, err = resolver.Resolve(context.Background())
+	assert.NoError(t, err)
+}
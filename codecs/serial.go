@@ -0,0 +1,146 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+// SerialConsistency returns the serial consistency level of a partial QUERY, EXECUTE or BATCH message. It returns false
+// if the message doesn't set a serial consistency level.
+func SerialConsistency(msg message.Message, version primitive.ProtocolVersion) (primitive.ConsistencyLevel, bool, error) {
+	params, offset, err := serialConsistencyOffset(msg, version)
+	if err != nil || offset < 0 {
+		return 0, false, err
+	}
+	return primitive.ConsistencyLevel(binary.BigEndian.Uint16(params[offset:])), true, nil
+}
+
+// SetSerialConsistency replaces the serial consistency level of a partial QUERY, EXECUTE or BATCH message. It does
+// nothing if the message doesn't set a serial consistency level. The message's parameters are copied so that they don't
+// modify the frame they were decoded from.
+func SetSerialConsistency(msg message.Message, version primitive.ProtocolVersion, consistency primitive.ConsistencyLevel) error {
+	params, offset, err := serialConsistencyOffset(msg, version)
+	if err != nil || offset < 0 {
+		return err
+	}
+	params = append([]byte(nil), params...)
+	binary.BigEndian.PutUint16(params[offset:], uint16(consistency))
+	switch m := msg.(type) {
+	case *PartialQuery:
+		m.Parameters = params
+	case *PartialExecute:
+		m.Parameters = params
+	case *PartialBatch:
+		m.Parameters = params
+	}
+	return nil
+}
+
+// serialConsistencyOffset returns a message's parameters and the position of the serial consistency level within them,
+// or -1 if it's not set.
+func serialConsistencyOffset(msg message.Message, version primitive.ProtocolVersion) (params []byte, offset int, err error) {
+	switch m := msg.(type) {
+	case *PartialQuery:
+		params = m.Parameters
+		offset, err = querySerialConsistencyOffset(params, version)
+	case *PartialExecute:
+		params = m.Parameters
+		offset, err = querySerialConsistencyOffset(params, version)
+	case *PartialBatch:
+		params = m.Parameters
+		offset, err = batchSerialConsistencyOffset(params, version)
+	default:
+		return nil, -1, fmt.Errorf("unsupported message type %T", msg)
+	}
+	if err == nil && offset >= 0 && offset+primitive.LengthOfShort > len(params) {
+		return nil, -1, errors.New("cannot read serial consistency level: unexpected end of parameters")
+	}
+	return params, offset, err
+}
+
+// querySerialConsistencyOffset skips the query parameters that precede the serial consistency level: the flags, the
+// values, the page size and the paging state.
+func querySerialConsistencyOffset(params []byte, version primitive.ProtocolVersion) (int, error) {
+	reader := NewFrameBodyReader(params)
+	flags, err := readQueryFlags(reader, version)
+	if err != nil {
+		return -1, err
+	}
+	if flags&primitive.QueryFlagSerialConsistency == 0 {
+		return -1, nil
+	}
+	if flags&primitive.QueryFlagValues != 0 {
+		var count uint16
+		if count, err = primitive.ReadShort(reader); err != nil {
+			return -1, fmt.Errorf("cannot read values count: %w", err)
+		}
+		for i := uint16(0); i < count; i++ {
+			if flags&primitive.QueryFlagValueNames != 0 {
+				if _, err = primitive.ReadString(reader); err != nil {
+					return -1, fmt.Errorf("cannot read value name %d: %w", i, err)
+				}
+			}
+			if err = skipValue(reader); err != nil {
+				return -1, err
+			}
+		}
+	}
+	if flags&primitive.QueryFlagPageSize != 0 {
+		if _, err = primitive.ReadInt(reader); err != nil {
+			return -1, fmt.Errorf("cannot read page size: %w", err)
+		}
+	}
+	if flags&primitive.QueryFlagPagingState != 0 {
+		if _, err = primitive.ReadBytes(reader); err != nil {
+			return -1, fmt.Errorf("cannot read paging state: %w", err)
+		}
+	}
+	return int(reader.Position()), nil
+}
+
+// batchSerialConsistencyOffset skips the batch flags, the serial consistency level immediately follows them.
+func batchSerialConsistencyOffset(params []byte, version primitive.ProtocolVersion) (int, error) {
+	reader := NewFrameBodyReader(params)
+	flags, err := readQueryFlags(reader, version)
+	if err != nil {
+		return -1, err
+	}
+	if flags&primitive.QueryFlagSerialConsistency == 0 {
+		return -1, nil
+	}
+	return int(reader.Position()), nil
+}
+
+func readQueryFlags(source io.Reader, version primitive.ProtocolVersion) (primitive.QueryFlag, error) {
+	if version.Uses4BytesQueryFlags() {
+		flags, err := primitive.ReadInt(source)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read flags: %w", err)
+		}
+		return primitive.QueryFlag(flags), nil
+	}
+	flags, err := primitive.ReadByte(source)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read flags: %w", err)
+	}
+	return primitive.QueryFlag(flags), nil
+}
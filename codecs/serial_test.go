@@ -0,0 +1,128 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codecs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerialConsistency_Query(t *testing.T) {
+	serial := primitive.ConsistencyLevelSerial
+
+	tests := []struct {
+		name    string
+		version primitive.ProtocolVersion
+		options *message.QueryOptions
+	}{
+		{"no options", primitive.ProtocolVersion4, &message.QueryOptions{SerialConsistency: &serial}},
+		{"positional values", primitive.ProtocolVersion4, &message.QueryOptions{
+			SerialConsistency: &serial,
+			PositionalValues:  []*primitive.Value{primitive.NewValue([]byte{1, 2, 3}), primitive.NewNullValue()},
+			PageSize:          100,
+			PagingState:       []byte{4, 5, 6},
+		}},
+		{"named values", primitive.ProtocolVersion4, &message.QueryOptions{
+			SerialConsistency: &serial,
+			NamedValues:       map[string]*primitive.Value{"k": primitive.NewValue([]byte{1})},
+		}},
+		{"v5 flags", primitive.ProtocolVersion5, &message.QueryOptions{
+			SerialConsistency: &serial,
+			PositionalValues:  []*primitive.Value{primitive.NewValue([]byte{1, 2, 3})},
+			Keyspace:          "ks",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := builtinQueryCodec.Encode(&message.Query{Query: "SELECT * FROM t", Options: tt.options}, &buf, tt.version)
+			require.NoError(t, err)
+
+			codec := &partialQueryCodec{}
+			msg, err := codec.Decode(NewFrameBodyReader(buf.Bytes()), tt.version)
+			require.NoError(t, err)
+			original := append([]byte(nil), msg.(*PartialQuery).Parameters...)
+
+			consistency, ok, err := SerialConsistency(msg, tt.version)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, primitive.ConsistencyLevelSerial, consistency)
+
+			require.NoError(t, SetSerialConsistency(msg, tt.version, primitive.ConsistencyLevelLocalSerial))
+			assert.Equal(t, original, buf.Bytes()[len(buf.Bytes())-len(original):], "the original frame should not be modified")
+
+			var encoded bytes.Buffer
+			require.NoError(t, codec.Encode(msg, &encoded, tt.version))
+			decoded, err := builtinQueryCodec.Decode(&encoded, tt.version)
+			require.NoError(t, err)
+			options := decoded.(*message.Query).Options
+			assert.Equal(t, primitive.ConsistencyLevelLocalSerial, *options.SerialConsistency)
+			assert.Equal(t, tt.options.PositionalValues, options.PositionalValues)
+			assert.Equal(t, tt.options.PagingState, options.PagingState)
+		})
+	}
+}
+
+func TestSerialConsistency_NotSet(t *testing.T) {
+	var buf bytes.Buffer
+	err := builtinQueryCodec.Encode(&message.Query{Query: "SELECT * FROM t", Options: &message.QueryOptions{PageSize: 10}},
+		&buf, primitive.ProtocolVersion4)
+	require.NoError(t, err)
+
+	msg, err := (&partialQueryCodec{}).Decode(NewFrameBodyReader(buf.Bytes()), primitive.ProtocolVersion4)
+	require.NoError(t, err)
+
+	_, ok, err := SerialConsistency(msg, primitive.ProtocolVersion4)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSerialConsistency_Batch(t *testing.T) {
+	serial := primitive.ConsistencyLevelSerial
+	batch := &message.Batch{
+		Type: primitive.BatchTypeLogged,
+		Children: []*message.BatchChild{
+			{Query: "INSERT INTO t (k) VALUES (?)", Values: []*primitive.Value{primitive.NewValue([]byte{1})}},
+		},
+		Consistency:       primitive.ConsistencyLevelQuorum,
+		SerialConsistency: &serial,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, builtinBatchCodec.Encode(batch, &buf, primitive.ProtocolVersion4))
+
+	codec := &partialBatchCodec{}
+	msg, err := codec.Decode(NewFrameBodyReader(buf.Bytes()), primitive.ProtocolVersion4)
+	require.NoError(t, err)
+
+	consistency, ok, err := SerialConsistency(msg, primitive.ProtocolVersion4)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, primitive.ConsistencyLevelSerial, consistency)
+
+	require.NoError(t, SetSerialConsistency(msg, primitive.ProtocolVersion4, primitive.ConsistencyLevelLocalSerial))
+
+	var encoded bytes.Buffer
+	require.NoError(t, codec.Encode(msg, &encoded, primitive.ProtocolVersion4))
+	decoded, err := builtinBatchCodec.Decode(&encoded, primitive.ProtocolVersion4)
+	require.NoError(t, err)
+	assert.Equal(t, primitive.ConsistencyLevelLocalSerial, *decoded.(*message.Batch).SerialConsistency)
+}
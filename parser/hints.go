@@ -0,0 +1,78 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	idempotentHint    = "@idempotent"
+	nonIdempotentHint = "@non-idempotent"
+)
+
+// IdempotenceHint returns the idempotence hint found in a query's leading comments, e.g.
+// `/* @idempotent */ UPDATE ...` or `-- @non-idempotent`. `ok` is false if the query doesn't have a hint.
+func IdempotenceHint(query string) (idempotent bool, ok bool) {
+	comments, _ := splitLeadingComments(query)
+	for _, comment := range comments {
+		for _, word := range strings.Fields(comment) {
+			switch strings.ToLower(word) {
+			case idempotentHint:
+				return true, true
+			case nonIdempotentHint:
+				return false, true
+			}
+		}
+	}
+	return false, false
+}
+
+// Fingerprint normalizes a query so that queries that only differ by their leading comments, whitespace or a trailing
+// semicolon are equal.
+func Fingerprint(query string) string {
+	_, rest := splitLeadingComments(query)
+	rest = strings.TrimRightFunc(rest, unicode.IsSpace)
+	rest = strings.TrimSuffix(rest, ";")
+	return strings.Join(strings.Fields(rest), " ")
+}
+
+// splitLeadingComments returns the contents of the comments at the start of a query and the rest of the query.
+// Block (`/* */`) and line (`--` and `//`) comments are supported.
+func splitLeadingComments(query string) (comments []string, rest string) {
+	rest = query
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return comments, rest // Unterminated comment
+			}
+			comments = append(comments, rest[2:end+2])
+			rest = rest[end+4:]
+		case strings.HasPrefix(rest, "--"), strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				return append(comments, rest[2:]), ""
+			}
+			comments = append(comments, rest[2:end])
+			rest = rest[end+1:]
+		default:
+			return comments, rest
+		}
+	}
+}
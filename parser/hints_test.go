@@ -0,0 +1,60 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotenceHint(t *testing.T) {
+	var tests = []struct {
+		query      string
+		idempotent bool
+		ok         bool
+	}{
+		{"/* @idempotent */ UPDATE ks.t SET c = c + 1 WHERE k = 1", true, true},
+		{"/*@idempotent*/UPDATE ks.t SET c = c + 1 WHERE k = 1", true, true},
+		{"  /* some comment @IDEMPOTENT */ INSERT INTO t (k, v) VALUES (1, now())", true, true},
+		{"-- @non-idempotent\nINSERT INTO t (k) VALUES (1)", false, true},
+		{"// first\n/* @non-idempotent */ DELETE FROM t WHERE k = 1", false, true},
+		{"/* no hint */ UPDATE t SET v = 1 WHERE k = 1", false, false},
+		{"UPDATE t SET v = 1 WHERE k = 1 /* @idempotent */", false, false},
+		{"/* @idempotent UPDATE t SET v = 1", false, false}, // Unterminated
+		{"", false, false},
+	}
+
+	for _, tt := range tests {
+		idempotent, ok := IdempotenceHint(tt.query)
+		assert.Equal(t, tt.ok, ok, tt.query)
+		assert.Equal(t, tt.idempotent, idempotent, tt.query)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	var tests = []struct {
+		query       string
+		fingerprint string
+	}{
+		{"UPDATE ks.t SET c = c + 1 WHERE k = ?", "UPDATE ks.t SET c = c + 1 WHERE k = ?"},
+		{"  UPDATE ks.t\n\tSET c = c + 1\n  WHERE k = ? ;  ", "UPDATE ks.t SET c = c + 1 WHERE k = ?"},
+		{"/* @idempotent */ UPDATE ks.t SET c = c + 1 WHERE k = ?;", "UPDATE ks.t SET c = c + 1 WHERE k = ?"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.fingerprint, Fingerprint(tt.query), tt.query)
+	}
+}
@@ -58,3 +58,17 @@ func (i Identifier) ID() string {
 	}
 	return strings.ReplaceAll(i.id, "\"\"", "\"")
 }
+
+// QuoteID returns an ID (i.e. the exact name) as an identifier that can be used in a query. It's only quoted if
+// required.
+func QuoteID(id string) string {
+	for i, c := range id {
+		if !(c >= 'a' && c <= 'z' || c == '_' || i > 0 && c >= '0' && c <= '9') {
+			return "\"" + strings.ReplaceAll(id, "\"", "\"\"") + "\""
+		}
+	}
+	if len(id) == 0 {
+		return "\"\""
+	}
+	return id
+}
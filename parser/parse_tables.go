@@ -0,0 +1,265 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"errors"
+	"strings"
+)
+
+// TableRef is a table referenced by a query.
+type TableRef struct {
+	Keyspace Identifier // Empty if the table isn't qualified with a keyspace
+	Table    Identifier
+}
+
+// QualifiedID returns the table's keyspace and table names, using `keyspace` if the table isn't qualified.
+func (t TableRef) QualifiedID(keyspace string) (string, string) {
+	if t.Keyspace.isEmpty() {
+		return IdentifierFromString(keyspace).ID(), t.Table.ID()
+	}
+	return t.Keyspace.ID(), t.Table.ID()
+}
+
+// ErrUnsupportedStatement is returned when the tables and keyspaces referenced by a statement can't be determined.
+var ErrUnsupportedStatement = errors.New("unsupported statement")
+
+// FindTableRefs parses the query string and returns the tables referenced by the query, e.g. by SELECT, INSERT, UPDATE,
+// DELETE, TRUNCATE and BATCH statements or by schema changes to tables. ErrUnsupportedStatement is returned if the
+// statement's type isn't recognized.
+func FindTableRefs(query string) (tables []TableRef, err error) {
+	err = scanTableRefs(query, func(ref TableRef, isTable bool, _, _ int) {
+		if isTable {
+			tables = append(tables, ref)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// RewriteKeyspaces replaces the keyspaces referenced by a query: the keyspace of qualified tables, types, indexes,
+// functions and materialized views, and the keyspaces of keyspace schema changes and permissions. The rewrite function
+// is called with the keyspace's ID and returns the ID of the replacement keyspace, or false if the keyspace shouldn't
+// be replaced. It returns true if the query was changed. ErrUnsupportedStatement is returned if the statement's type
+// isn't recognized so that the caller can refuse a query that might use a keyspace that wasn't rewritten.
+func RewriteKeyspaces(query string, rewrite func(keyspace string) (string, bool)) (string, bool, error) {
+	var sb strings.Builder
+	last := 0
+	err := scanTableRefs(query, func(ref TableRef, _ bool, start, end int) {
+		if ref.Keyspace.isEmpty() {
+			return
+		}
+		if keyspace, ok := rewrite(ref.Keyspace.ID()); ok {
+			sb.WriteString(query[last:start])
+			sb.WriteString(QuoteID(keyspace))
+			last = end
+		}
+	})
+	if err != nil || last == 0 {
+		return query, false, err
+	}
+	sb.WriteString(query[last:])
+	return sb.String(), true, nil
+}
+
+// refFunc is called for each table, or other keyspace object, referenced by a query with the start and end positions
+// of its keyspace in the query string. The positions are only valid if the reference has a keyspace. `isTable` is false
+// for keyspaces, types, indexes and functions, where only `ref.Keyspace` and the object's name in `ref.Table` are set.
+type refFunc func(ref TableRef, isTable bool, start, end int)
+
+// scanTableRefs calls `onRef` for each table, or other keyspace object, referenced by the query.
+func scanTableRefs(query string, onRef refFunc) error {
+	var l lexer
+	l.init(query)
+
+	t := l.next()
+	switch {
+	case t == tkSelect, t == tkInsert, t == tkUpdate, t == tkDelete, t == tkBegin:
+		return scanDMLRefs(&l, t, onRef)
+	case t == tkUse: // The proxy handles the keyspace of USE statements
+		return nil
+	case t == tkCreate, t == tkAlter, t == tkDrop:
+		return scanSchemaRefs(&l, t, onRef)
+	case isUnreservedKeyword(&l, t, "truncate"):
+		if t = l.next(); isUnreservedKeyword(&l, t, "table") {
+			t = l.next()
+		}
+		_, err := scanQualifiedRef(&l, t, true, onRef)
+		return err
+	case isUnreservedKeyword(&l, t, "grant"), isUnreservedKeyword(&l, t, "revoke"), isUnreservedKeyword(&l, t, "list"):
+		return scanPermissionRefs(&l, onRef)
+	case t == tkInvalid:
+		return errors.New("invalid token")
+	}
+	return ErrUnsupportedStatement
+}
+
+// scanDMLRefs reports the tables after FROM, INTO and UPDATE.
+func scanDMLRefs(l *lexer, t token, onRef refFunc) (err error) {
+	for tkEOF != t {
+		switch t {
+		case tkFrom, tkInto, tkUpdate:
+			if t = l.next(); tkIdentifier == t {
+				t, err = scanQualifiedRef(l, t, true, onRef)
+				if err != nil {
+					return err
+				}
+			}
+		case tkInvalid:
+			return errors.New("invalid token")
+		default:
+			t = l.next()
+		}
+	}
+	return nil
+}
+
+// scanSchemaRefs reports the object created, altered or dropped by a schema change statement.
+func scanSchemaRefs(l *lexer, stmt token, onRef refFunc) (err error) {
+	t := l.next()
+	if tkCreate == stmt && isUnreservedKeyword(l, t, "or") { // CREATE OR REPLACE FUNCTION and AGGREGATE
+		if t = l.next(); !isUnreservedKeyword(l, t, "replace") {
+			return errors.New("expected 'REPLACE' after 'OR'")
+		}
+		t = l.next()
+	}
+	if tkCreate == stmt && isUnreservedKeyword(l, t, "custom") {
+		t = l.next()
+	}
+
+	switch {
+	case isUnreservedKeyword(l, t, "keyspace"), isUnreservedKeyword(l, t, "schema"):
+		return scanKeyspaceRef(l, skipIfExists(l, l.next()), onRef)
+	case isUnreservedKeyword(l, t, "table"), isUnreservedKeyword(l, t, "columnfamily"):
+		_, err = scanQualifiedRef(l, skipIfExists(l, l.next()), true, onRef)
+		return err
+	case isUnreservedKeyword(l, t, "materialized"):
+		if t = l.next(); !isUnreservedKeyword(l, t, "view") {
+			return errors.New("expected 'VIEW' after 'MATERIALIZED'")
+		}
+		if t, err = scanQualifiedRef(l, skipIfExists(l, l.next()), true, onRef); err != nil {
+			return err
+		}
+		return scanDMLRefs(l, t, onRef) // The view's base table
+	case isUnreservedKeyword(l, t, "type"), isUnreservedKeyword(l, t, "function"), isUnreservedKeyword(l, t, "aggregate"):
+		_, err = scanQualifiedRef(l, skipIfExists(l, l.next()), false, onRef)
+		return err
+	case isUnreservedKeyword(l, t, "index"):
+		t = skipIfExists(l, l.next())
+		if tkCreate != stmt {
+			_, err = scanQualifiedRef(l, t, false, onRef)
+			return err
+		}
+		return scanOnTableRef(l, t, onRef) // CREATE INDEX [name] ON table
+	case isUnreservedKeyword(l, t, "trigger"):
+		return scanOnTableRef(l, skipIfExists(l, l.next()), onRef) // Triggers are named within their table
+	case isUnreservedKeyword(l, t, "role"), isUnreservedKeyword(l, t, "user"):
+		return nil
+	case tkInvalid == t:
+		return errors.New("invalid token")
+	}
+	return ErrUnsupportedStatement
+}
+
+// scanOnTableRef reports the table after an optional name followed by ON.
+func scanOnTableRef(l *lexer, t token, onRef refFunc) error {
+	if tkIdentifier == t && !isUnreservedKeyword(l, t, "on") {
+		t = l.next()
+	}
+	if !isUnreservedKeyword(l, t, "on") {
+		return errors.New("expected 'ON'")
+	}
+	_, err := scanQualifiedRef(l, l.next(), true, onRef)
+	return err
+}
+
+// scanPermissionRefs reports the resource after the ON of GRANT, REVOKE and LIST statements. Statements without ON,
+// e.g. granting a role, don't reference a keyspace.
+func scanPermissionRefs(l *lexer, onRef refFunc) (err error) {
+	t := l.next()
+	for tkEOF != t && !isUnreservedKeyword(l, t, "on") {
+		if tkInvalid == t {
+			return errors.New("invalid token")
+		}
+		t = l.next()
+	}
+	if tkEOF == t {
+		return nil
+	}
+
+	t = l.next()
+	switch {
+	case isUnreservedKeyword(l, t, "all"):
+		if t = l.next(); isUnreservedKeyword(l, t, "functions") {
+			if t = l.next(); tkIn == t { // ALL FUNCTIONS IN KEYSPACE ks
+				if t = l.next(); !isUnreservedKeyword(l, t, "keyspace") {
+					return errors.New("expected 'KEYSPACE' after 'IN'")
+				}
+				return scanKeyspaceRef(l, l.next(), onRef)
+			}
+		}
+		return nil // ALL KEYSPACES, ALL ROLES or ALL MBEANS
+	case isUnreservedKeyword(l, t, "keyspace"):
+		return scanKeyspaceRef(l, l.next(), onRef)
+	case isUnreservedKeyword(l, t, "table"):
+		_, err = scanQualifiedRef(l, l.next(), true, onRef)
+		return err
+	case isUnreservedKeyword(l, t, "function"):
+		_, err = scanQualifiedRef(l, l.next(), false, onRef)
+		return err
+	case isUnreservedKeyword(l, t, "role"), isUnreservedKeyword(l, t, "mbean"), isUnreservedKeyword(l, t, "mbeans"):
+		return nil
+	}
+	_, err = scanQualifiedRef(l, t, true, onRef) // The TABLE keyword is optional
+	return err
+}
+
+func scanKeyspaceRef(l *lexer, t token, onRef refFunc) error {
+	if tkIdentifier != t {
+		return errors.New("expected keyspace identifier")
+	}
+	onRef(TableRef{Keyspace: l.identifier()}, false, l.p-len(l.id), l.p)
+	return nil
+}
+
+// scanQualifiedRef reports a possibly qualified identifier and returns the token that follows it.
+func scanQualifiedRef(l *lexer, t token, isTable bool, onRef refFunc) (token, error) {
+	if tkIdentifier != t {
+		return tkInvalid, errors.New("expected identifier")
+	}
+	start, end := l.p-len(l.id), l.p
+	keyspace, name, t, err := parseQualifiedIdentifier(l)
+	if err != nil {
+		return tkInvalid, err
+	}
+	onRef(TableRef{Keyspace: keyspace, Table: name}, isTable, start, end)
+	return t, nil
+}
+
+// skipIfExists skips IF EXISTS or IF NOT EXISTS.
+func skipIfExists(l *lexer, t token) token {
+	if tkIf != t {
+		return t
+	}
+	if t = l.next(); tkNot == t {
+		t = l.next()
+	}
+	if isUnreservedKeyword(l, t, "exists") {
+		t = l.next()
+	}
+	return t
+}
@@ -0,0 +1,140 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindTableRefs(t *testing.T) {
+	var tests = []struct {
+		query    string
+		tables   []TableRef
+		hasError bool
+	}{
+		{"SELECT * FROM ks.tbl WHERE k = ?", []TableRef{{IdentifierFromString("ks"), IdentifierFromString("tbl")}}, false},
+		{"SELECT * FROM tbl", []TableRef{{Identifier{}, IdentifierFromString("tbl")}}, false},
+		{"SELECT * FROM \"Ks\".\"Tbl\"", []TableRef{{IdentifierFromString("\"Ks\""), IdentifierFromString("\"Tbl\"")}}, false},
+		{"INSERT INTO ks.tbl (k, v) VALUES (?, ?)", []TableRef{{IdentifierFromString("ks"), IdentifierFromString("tbl")}}, false},
+		{"UPDATE tbl SET v = 1 WHERE k = 'from'", []TableRef{{Identifier{}, IdentifierFromString("tbl")}}, false},
+		{"DELETE v FROM ks.tbl WHERE k = 1", []TableRef{{IdentifierFromString("ks"), IdentifierFromString("tbl")}}, false},
+		{"TRUNCATE TABLE ks.tbl", []TableRef{{IdentifierFromString("ks"), IdentifierFromString("tbl")}}, false},
+		{"TRUNCATE tbl", []TableRef{{Identifier{}, IdentifierFromString("tbl")}}, false},
+		{"BEGIN BATCH INSERT INTO ks.a (k) VALUES (1); UPDATE b SET v = 1 WHERE k = 1; APPLY BATCH", []TableRef{
+			{IdentifierFromString("ks"), IdentifierFromString("a")},
+			{Identifier{}, IdentifierFromString("b")},
+		}, false},
+		{"DROP TABLE IF EXISTS ks.tbl", []TableRef{{IdentifierFromString("ks"), IdentifierFromString("tbl")}}, false},
+		{"CREATE INDEX idx ON tbl (v)", []TableRef{{Identifier{}, IdentifierFromString("tbl")}}, false},
+		{"DROP KEYSPACE ks", nil, false}, // Only tables are returned
+		{"DROP TYPE ks.typ", nil, false},
+		{"SELECT * FROM ks.", nil, true},
+		{"SELECT * FROM tbl WHERE k = 1 / 2", nil, true},
+		{"DESCRIBE TABLE ks.tbl", nil, true},
+	}
+
+	for _, tt := range tests {
+		tables, err := FindTableRefs(tt.query)
+		assert.Equal(t, tt.tables, tables, "invalid tables for query: %s", tt.query)
+		assert.Equal(t, tt.hasError, err != nil, "unexpected error result for query: %s", tt.query)
+	}
+}
+
+func TestTableRef_QualifiedID(t *testing.T) {
+	keyspace, table := TableRef{Table: IdentifierFromString("Tbl")}.QualifiedID("\"Ks\"")
+	assert.Equal(t, "Ks", keyspace)
+	assert.Equal(t, "tbl", table)
+
+	keyspace, table = TableRef{Keyspace: IdentifierFromString("ks1"), Table: IdentifierFromString("tbl")}.QualifiedID("ks2")
+	assert.Equal(t, "ks1", keyspace)
+	assert.Equal(t, "tbl", table)
+}
+
+func TestRewriteKeyspaces(t *testing.T) {
+	rewrite := func(keyspace string) (string, bool) {
+		switch keyspace {
+		case "orders":
+			return "staging_orders", true
+		case "Mixed":
+			return "Staging Mixed", true
+		}
+		return "", false
+	}
+
+	var tests = []struct {
+		query     string
+		rewritten string
+		changed   bool
+		hasError  bool
+	}{
+		{"SELECT * FROM orders.tbl WHERE k = ?", "SELECT * FROM staging_orders.tbl WHERE k = ?", true, false},
+		{"SELECT * FROM ORDERS.tbl", "SELECT * FROM staging_orders.tbl", true, false},
+		{"SELECT * FROM \"Mixed\".tbl", "SELECT * FROM \"Staging Mixed\".tbl", true, false},
+		{"SELECT * FROM other.tbl", "SELECT * FROM other.tbl", false, false},
+		{"SELECT * FROM orders", "SELECT * FROM orders", false, false}, // Table named "orders"
+		{"UPDATE orders.tbl SET v = 'orders.tbl' WHERE k = 1", "UPDATE staging_orders.tbl SET v = 'orders.tbl' WHERE k = 1", true, false},
+		{"TRUNCATE orders.tbl", "TRUNCATE staging_orders.tbl", true, false},
+		{"BEGIN BATCH INSERT INTO orders.a (k) VALUES (1); DELETE FROM other.b WHERE k = 1; UPDATE orders.c SET v = 1 WHERE k = 1; APPLY BATCH",
+			"BEGIN BATCH INSERT INTO staging_orders.a (k) VALUES (1); DELETE FROM other.b WHERE k = 1; UPDATE staging_orders.c SET v = 1 WHERE k = 1; APPLY BATCH", true, false},
+		{"SELECT * FROM orders.", "SELECT * FROM orders.", false, true},
+		{"USE orders", "USE orders", false, false}, // The proxy handles the keyspace of USE statements
+		{"CREATE KEYSPACE IF NOT EXISTS orders WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}",
+			"CREATE KEYSPACE IF NOT EXISTS staging_orders WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}", true, false},
+		{"ALTER KEYSPACE orders WITH durable_writes = false", "ALTER KEYSPACE staging_orders WITH durable_writes = false", true, false},
+		{"DROP KEYSPACE orders", "DROP KEYSPACE staging_orders", true, false},
+		{"CREATE TABLE orders.t (k int PRIMARY KEY, v text)", "CREATE TABLE staging_orders.t (k int PRIMARY KEY, v text)", true, false},
+		{"CREATE TABLE IF NOT EXISTS orders.t (k int PRIMARY KEY)", "CREATE TABLE IF NOT EXISTS staging_orders.t (k int PRIMARY KEY)", true, false},
+		{"ALTER TABLE orders.t ADD b int", "ALTER TABLE staging_orders.t ADD b int", true, false},
+		{"DROP TABLE orders.t", "DROP TABLE staging_orders.t", true, false},
+		{"DROP TABLE IF EXISTS orders.t", "DROP TABLE IF EXISTS staging_orders.t", true, false},
+		{"CREATE TYPE orders.address (street text)", "CREATE TYPE staging_orders.address (street text)", true, false},
+		{"ALTER TYPE orders.address ADD city text", "ALTER TYPE staging_orders.address ADD city text", true, false},
+		{"DROP TYPE orders.address", "DROP TYPE staging_orders.address", true, false},
+		{"CREATE INDEX idx ON orders.t (v)", "CREATE INDEX idx ON staging_orders.t (v)", true, false},
+		{"CREATE INDEX IF NOT EXISTS ON orders.t (v)", "CREATE INDEX IF NOT EXISTS ON staging_orders.t (v)", true, false},
+		{"CREATE CUSTOM INDEX idx ON orders.t (v) USING 'StorageAttachedIndex'",
+			"CREATE CUSTOM INDEX idx ON staging_orders.t (v) USING 'StorageAttachedIndex'", true, false},
+		{"DROP INDEX orders.idx", "DROP INDEX staging_orders.idx", true, false},
+		{"CREATE MATERIALIZED VIEW orders.v AS SELECT * FROM orders.t WHERE v IS NOT NULL PRIMARY KEY (v, k)",
+			"CREATE MATERIALIZED VIEW staging_orders.v AS SELECT * FROM staging_orders.t WHERE v IS NOT NULL PRIMARY KEY (v, k)", true, false},
+		{"ALTER MATERIALIZED VIEW orders.v WITH comment = 'v'", "ALTER MATERIALIZED VIEW staging_orders.v WITH comment = 'v'", true, false},
+		{"DROP MATERIALIZED VIEW orders.v", "DROP MATERIALIZED VIEW staging_orders.v", true, false},
+		{"CREATE OR REPLACE FUNCTION orders.f (a int) RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS 'return a;'",
+			"CREATE OR REPLACE FUNCTION staging_orders.f (a int) RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS 'return a;'", true, false},
+		{"GRANT SELECT ON orders.t TO r", "GRANT SELECT ON staging_orders.t TO r", true, false},
+		{"GRANT MODIFY ON TABLE orders.t TO r", "GRANT MODIFY ON TABLE staging_orders.t TO r", true, false},
+		{"GRANT ALL PERMISSIONS ON KEYSPACE orders TO r", "GRANT ALL PERMISSIONS ON KEYSPACE staging_orders TO r", true, false},
+		{"REVOKE SELECT ON orders.t FROM r", "REVOKE SELECT ON staging_orders.t FROM r", true, false},
+		{"REVOKE EXECUTE ON ALL FUNCTIONS IN KEYSPACE orders FROM r", "REVOKE EXECUTE ON ALL FUNCTIONS IN KEYSPACE staging_orders FROM r", true, false},
+		{"LIST ALL PERMISSIONS ON orders.t OF r", "LIST ALL PERMISSIONS ON staging_orders.t OF r", true, false},
+		{"GRANT SELECT ON ALL KEYSPACES TO r", "GRANT SELECT ON ALL KEYSPACES TO r", false, false},
+		{"GRANT admin TO r", "GRANT admin TO r", false, false},
+		{"CREATE ROLE r WITH LOGIN = true", "CREATE ROLE r WITH LOGIN = true", false, false},
+		{"DESCRIBE TABLE orders.t", "DESCRIBE TABLE orders.t", false, true}, // Unsupported statements aren't passed through
+		{"", "", false, true},
+	}
+
+	for _, tt := range tests {
+		rewritten, changed, err := RewriteKeyspaces(tt.query, rewrite)
+		assert.Equal(t, tt.rewritten, rewritten, "invalid rewrite for query: %s", tt.query)
+		assert.Equal(t, tt.changed, changed, "invalid changed result for query: %s", tt.query)
+		assert.Equal(t, tt.hasError, err != nil, "unexpected error result for query: %s", tt.query)
+	}
+
+	_, _, err := RewriteKeyspaces("DESCRIBE TABLE orders.t", rewrite)
+	assert.ErrorIs(t, err, ErrUnsupportedStatement)
+}
@@ -27,7 +27,19 @@ func main() {
 
 	defer cancel()
 
-	os.Exit(proxy.Run(ctx, os.Args[1:]))
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "doctor":
+			os.Exit(proxy.Doctor(ctx, args[1:]))
+		case "replay":
+			os.Exit(proxy.Replay(ctx, args[1:]))
+		case "validate":
+			os.Exit(proxy.Validate(ctx, args[1:]))
+		}
+	}
+
+	os.Exit(proxy.Run(ctx, args))
 }
 
 // signalContext is a simplified version of `signal.NotifyContext()` for  golang 1.15 and earlier
@@ -0,0 +1,169 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+// defaultBackendName is the name of the backend configured using `Config.Resolver` and `Config.Auth`.
+const defaultBackendName = "default"
+
+// BackendConfig is an additional backend cluster. Keyspaces are routed to it using `Config.Routes`.
+type BackendConfig struct {
+	Name     string
+	Resolver proxycore.EndpointResolver
+	Auth     proxycore.Authenticator
+}
+
+// backend is a cluster fronted by the proxy. Each backend has its own cluster connection, load balancer and sessions.
+type backend struct {
+	proxy      *Proxy
+	name       string
+	resolver   proxycore.EndpointResolver
+	auth       proxycore.Authenticator
+	cluster    *proxycore.Cluster
+	lb         proxycore.LoadBalancer
+	sessionsMu *sync.RWMutex
+	sessions   map[sessionKey]*proxycore.Session // Cache sessions per protocol version, compression, keyspace
+}
+
+func newBackend(p *Proxy, config BackendConfig) *backend {
+	return &backend{
+		proxy:      p,
+		name:       config.Name,
+		resolver:   config.Resolver,
+		auth:       config.Auth,
+		sessionsMu: &sync.RWMutex{},
+		sessions:   make(map[sessionKey]*proxycore.Session),
+	}
+}
+
+// connect connects to the backend's cluster and creates an initial session. Schema events from the cluster are
+// forwarded to the proxy's clients.
+func (b *backend) connect() (err error) {
+	p := b.proxy
+	b.cluster, err = proxycore.ConnectCluster(p.ctx, proxycore.ClusterConfig{
+		Version:           p.config.Version,
+		Auth:              b.auth,
+		Resolver:          b.resolver,
+		ReconnectPolicy:   p.config.ReconnectPolicy,
+		HeartBeatInterval: p.config.HeartBeatInterval,
+		ConnectTimeout:    p.config.ConnectTimeout,
+		IdleTimeout:       p.config.IdleTimeout,
+		ResolveInterval:   p.config.ResolveInterval,
+		FailoverDelay:     p.config.FailoverDelay,
+		Logger:            p.logger,
+	})
+
+	if err != nil {
+		return fmt.Errorf("unable to connect to cluster %w", err)
+	}
+
+	err = b.cluster.Listen(b)
+	if err != nil {
+		return fmt.Errorf("unable to register to listen for schema events %w", err)
+	}
+
+	b.lb = proxycore.NewRoundRobinLoadBalancer()
+	err = b.cluster.Listen(b.lb)
+	if err != nil {
+		return err
+	}
+
+	sess, err := proxycore.ConnectSession(p.ctx, b.cluster, b.sessionConfig(b.cluster.NegotiatedVersion, "", ""))
+
+	if err != nil {
+		return fmt.Errorf("unable to connect session %w", err)
+	}
+
+	b.sessions[sessionKey{version: b.cluster.NegotiatedVersion}] = sess // No keyspace/compression
+	return nil
+}
+
+// OnEvent forwards schema events to the proxy. Events for keyspaces that are routed to a different backend are
+// ignored so that clients don't receive events for keyspaces that exist on multiple backends more than once (e.g. the
+// "system_*" keyspaces).
+func (b *backend) OnEvent(event proxycore.Event) {
+	if evt, ok := event.(*proxycore.SchemaChangeEvent); ok {
+		if b.proxy.routeID(evt.Message.Keyspace) == b {
+			b.proxy.OnEvent(event)
+		}
+	}
+}
+
+func (b *backend) maybeCreateSession(version primitive.ProtocolVersion, keyspace, compression string) (*proxycore.Session, error) {
+	b.sessionsMu.RLock()
+	defer b.sessionsMu.RUnlock()
+	return b.maybeCreateSessionUnlocked(version, keyspace, compression)
+}
+
+func (b *backend) findSession(version primitive.ProtocolVersion, keyspace, compression string) (*proxycore.Session, error) {
+	b.sessionsMu.RLock()
+	defer b.sessionsMu.RUnlock()
+	key := sessionKey{version: version, keyspace: keyspace, compression: compression}
+	if s, ok := b.sessions[key]; ok {
+		return s, nil
+	} else {
+		return b.maybeCreateSessionUnlocked(version, keyspace, compression)
+	}
+}
+
+func (b *backend) sessionConfig(version primitive.ProtocolVersion, keyspace, compression string) proxycore.SessionConfig {
+	p := b.proxy
+	return proxycore.SessionConfig{
+		ReconnectPolicy:      p.config.ReconnectPolicy,
+		NumConns:             p.config.NumConns,
+		MaxConns:             p.config.MaxConns,
+		RemoteNumConns:       p.config.RemoteNumConns,
+		RemoteMaxConns:       p.config.RemoteMaxConns,
+		ScaleUpInflight:      p.config.ConnScaleUpInflight,
+		ScaleDownIdle:        p.config.ConnScaleDownIdle,
+		Version:              version,
+		Auth:                 b.auth,
+		PreparedCache:        p.preparedCache,
+		Keyspace:             keyspace,
+		HeartBeatInterval:    p.config.HeartBeatInterval,
+		ConnectTimeout:       p.config.ConnectTimeout,
+		IdleTimeout:          p.config.IdleTimeout,
+		Logger:               p.logger,
+		Compression:          compression,
+		PrepareOnAllHosts:    p.config.PrepareOnAllHosts,
+		ReprepareConcurrency: p.config.ReprepareConcurrency,
+	}
+}
+
+func (b *backend) maybeCreateSessionUnlocked(version primitive.ProtocolVersion, keyspace, compression string) (*proxycore.Session, error) {
+	key := sessionKey{version: version, keyspace: keyspace, compression: compression}
+	if cachedSession, ok := b.sessions[key]; ok {
+		return cachedSession, nil
+	} else {
+		sess, err := proxycore.ConnectSession(b.proxy.ctx, b.cluster, b.sessionConfig(version, keyspace, compression))
+		if err != nil {
+			return nil, err
+		}
+
+		b.sessions[key] = sess
+		return sess, nil
+	}
+}
+
+func (b *backend) newQueryPlan() proxycore.QueryPlan {
+	return b.lb.NewQueryPlan()
+}
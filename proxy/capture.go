@@ -0,0 +1,372 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	captureRecordRequest  = "request"
+	captureRecordPrepared = "prepared"
+
+	defaultCaptureQueueSize = 10000
+)
+
+// CaptureConfig configures the recording of client requests, and their responses, to a capture file. Captures are
+// played back using the "replay" command.
+type CaptureConfig struct {
+	// Path is the capture file. It's truncated if it already exists.
+	Path string
+	// Duration is how long requests are captured after the proxy starts. Requests are captured until the proxy is
+	// closed if it's zero.
+	Duration time.Duration
+	// Clients limits the capture to clients connecting from a list of CIDRs. All clients are captured if it's empty.
+	Clients []string
+	// QueueSize is the maximum number of records waiting to be written to the capture file. Records are dropped when
+	// the queue is full so that a slow disk doesn't delay client requests.
+	QueueSize int
+}
+
+// captureRecord is a line of a capture file. Request records contain an uncompressed request frame along with the
+// timing and the result of its response. Prepared records contain the prepared statements used by the captured requests
+// so that they can be prepared when they're replayed.
+type captureRecord struct {
+	Type     string                    `json:"type"`
+	Offset   time.Duration             `json:"offset,omitempty"` // Time since the start of the capture
+	Client   string                    `json:"client,omitempty"`
+	Version  primitive.ProtocolVersion `json:"version"`
+	OpCode   string                    `json:"opcode,omitempty"`
+	Keyspace string                    `json:"keyspace,omitempty"` // The client's keyspace or the prepared statement's keyspace
+	Frame    []byte                    `json:"frame,omitempty"`
+	Latency  time.Duration             `json:"latency,omitempty"`
+	Response string                    `json:"response,omitempty"` // The response's opcode
+	Error    string                    `json:"error,omitempty"`    // The response's error code, if it's an error
+	ID       string                    `json:"id,omitempty"`       // Hex encoded prepared ID
+	Query    string                    `json:"query,omitempty"`
+}
+
+type captureKey struct {
+	client *client
+	stream int16
+}
+
+type pendingCapture struct {
+	start  time.Time
+	record captureRecord
+}
+
+// capture encodes records on the client goroutines and writes them to the capture file from a single writer goroutine.
+// The mutex only protects the pending requests and the prepared IDs.
+type capture struct {
+	logger   *zap.Logger
+	clients  []*net.IPNet
+	start    time.Time
+	file     *os.File
+	records  chan []byte   // Encoded records waiting to be written
+	closing  chan struct{} // Closed to stop the writer, which writes the queued records first
+	done     chan struct{} // Closed when the writer has flushed and closed the file
+	dropped  uint64
+	pending  map[captureKey]*pendingCapture
+	prepared map[string]struct{} // Prepared IDs already queued to be written
+	stopped  bool
+	mu       sync.Mutex
+}
+
+func newCapture(config CaptureConfig, logger *zap.Logger) (*capture, error) {
+	clients, err := parseClientCIDRs(config.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture client CIDR: %w", err)
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultCaptureQueueSize
+	}
+	file, err := os.Create(config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create capture file: %w", err)
+	}
+	c := &capture{
+		logger:   logger,
+		clients:  clients,
+		start:    time.Now(),
+		file:     file,
+		records:  make(chan []byte, config.QueueSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		pending:  make(map[captureKey]*pendingCapture),
+		prepared: make(map[string]struct{}),
+	}
+	go c.writeLoop()
+	if config.Duration > 0 {
+		time.AfterFunc(config.Duration, c.stop)
+	}
+	logger.Info("capturing client requests", zap.String("path", config.Path), zap.Duration("duration", config.Duration))
+	return c, nil
+}
+
+// isCaptured returns true if a client's requests are captured.
+func (c *capture) isCaptured(addr net.Addr) bool {
+	return clientsContain(c.clients, addrIP(addr))
+}
+
+// onRequest starts the capture of a client's request. The request is written to the capture file when its response is
+// sent.
+func (c *capture) onRequest(cl *client, raw *frame.RawFrame, body *frame.Body) {
+	// The client's connection might use compression so a new uncompressed frame is created from the decoded body.
+	frm := frame.NewFrame(raw.Header.Version, raw.Header.StreamId, body.Message)
+	if len(body.CustomPayload) > 0 {
+		frm.SetCustomPayload(body.CustomPayload)
+	}
+	var buf bytes.Buffer
+	if err := codecs.CustomRawCodec.EncodeFrame(frm, &buf); err != nil {
+		c.logger.Error("unable to encode request for capture", zap.Error(err))
+		return
+	}
+
+	switch msg := body.Message.(type) {
+	case *codecs.PartialExecute:
+		c.maybeWritePrepared(cl.proxy, msg.QueryId)
+	case *codecs.PartialBatch:
+		for _, query := range msg.Queries {
+			if id, ok := query.QueryOrId.([]byte); ok {
+				c.maybeWritePrepared(cl.proxy, id)
+			}
+		}
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	c.pending[captureKey{client: cl, stream: raw.Header.StreamId}] = &pendingCapture{
+		start: now,
+		record: captureRecord{
+			Type:     captureRecordRequest,
+			Offset:   now.Sub(c.start),
+			Client:   cl.conn.RemoteAddr().String(),
+			Version:  raw.Header.Version,
+			OpCode:   codeName(raw.Header.OpCode),
+			Keyspace: cl.keyspace,
+			Frame:    buf.Bytes(),
+		},
+	}
+}
+
+// maybeWritePrepared writes the prepared statement used by a captured request, if it isn't already written, so that it
+// can be prepared when the capture is replayed.
+func (c *capture) maybeWritePrepared(p *Proxy, id []byte) {
+	key := hex.EncodeToString(id)
+	val, ok := p.preparedMetadata.Load(preparedIdKey(id))
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	_, written := c.prepared[key]
+	if !written && !c.stopped {
+		c.prepared[key] = struct{}{}
+	}
+	stopped := c.stopped
+	c.mu.Unlock()
+	if written || stopped {
+		return
+	}
+	metadata := val.(preparedMetadata)
+	if !c.write(captureRecord{
+		Type:     captureRecordPrepared,
+		Version:  metadata.version,
+		Keyspace: metadata.keyspace,
+		ID:       key,
+		Query:    metadata.query,
+	}) {
+		// It's written with the next request that uses it instead
+		c.mu.Lock()
+		delete(c.prepared, key)
+		c.mu.Unlock()
+	}
+}
+
+// onResponse writes a captured request to the capture file along with its response.
+func (c *capture) onResponse(cl *client, stream int16, opCode primitive.OpCode, errorCode string) {
+	key := captureKey{client: cl, stream: stream}
+	c.mu.Lock()
+	pending, ok := c.pending[key]
+	delete(c.pending, key)
+	stopped := c.stopped
+	c.mu.Unlock()
+	if !ok || stopped {
+		return
+	}
+	pending.record.Latency = time.Since(pending.start)
+	pending.record.Response = codeName(opCode)
+	pending.record.Error = errorCode
+	c.write(pending.record)
+}
+
+// write encodes a record and queues it to be written to the capture file. The record is dropped, and false is
+// returned, if the queue is full.
+func (c *capture) write(record captureRecord) bool {
+	line, err := json.Marshal(record)
+	if err != nil {
+		c.logger.Error("unable to encode capture record", zap.Error(err))
+		return false
+	}
+	select {
+	case c.records <- append(line, '\n'):
+		return true
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		return false
+	}
+}
+
+// writeLoop writes queued records to the capture file until the capture is stopped. The remaining queued records are
+// written before the file is closed.
+func (c *capture) writeLoop() {
+	defer close(c.done)
+	writer := bufio.NewWriter(c.file)
+	var err error
+	write := func(line []byte) {
+		if _, writeErr := writer.Write(line); writeErr != nil && err == nil {
+			err = writeErr
+			c.logger.Error("unable to write capture record", zap.Error(err))
+		}
+	}
+	for {
+		select {
+		case line := <-c.records:
+			write(line)
+		case <-c.closing:
+			for {
+				select {
+				case line := <-c.records:
+					write(line)
+				default:
+					if flushErr := writer.Flush(); err == nil {
+						err = flushErr
+					}
+					if closeErr := c.file.Close(); err == nil {
+						err = closeErr
+					}
+					if err != nil {
+						c.logger.Error("unable to write capture file", zap.Error(err))
+					} else {
+						c.logger.Info("capture finished", zap.String("path", c.file.Name()),
+							zap.Uint64("dropped", atomic.LoadUint64(&c.dropped)))
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// removeClient discards the requests of a closed client that never received a response.
+func (c *capture) removeClient(cl *client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.pending {
+		if key.client == cl {
+			delete(c.pending, key)
+		}
+	}
+}
+
+// stop ends the capture and waits for the queued records to be written and the capture file to be closed. It's safe to
+// call more than once.
+func (c *capture) stop() {
+	c.mu.Lock()
+	if !c.stopped {
+		c.stopped = true
+		c.pending = make(map[captureKey]*pendingCapture)
+		close(c.closing)
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+// maybeCaptureRequest captures a client's request, if enabled. Only QUERY, PREPARE, EXECUTE and BATCH requests are
+// captured; connection setup is handled by the replaying sessions.
+func (c *client) maybeCaptureRequest(raw *frame.RawFrame, body *frame.Body) {
+	if !c.captured {
+		return
+	}
+	switch raw.Header.OpCode {
+	case primitive.OpCodeQuery, primitive.OpCodePrepare, primitive.OpCodeBatch:
+		c.proxy.capture.onRequest(c, raw, body)
+	case primitive.OpCodeExecute:
+		// System queries prepared by the proxy are never sent to the cluster so they can't be replayed
+		if msg, ok := body.Message.(*codecs.PartialExecute); ok {
+			if _, ok = c.preparedSystemQuery[preparedIdKey(msg.QueryId)]; !ok {
+				c.proxy.capture.onRequest(c, raw, body)
+			}
+		}
+	}
+}
+
+// maybeCaptureResponse records the response to a client's captured request.
+func (c *client) maybeCaptureResponse(stream int16, msg message.Message) {
+	if !c.captured {
+		return
+	}
+	errorCode := ""
+	if errMsg, ok := msg.(message.Error); ok {
+		errorCode = codeName(errMsg.GetErrorCode())
+	}
+	c.proxy.capture.onResponse(c, stream, msg.GetOpCode(), errorCode)
+}
+
+// maybeCaptureRawResponse records the response to a client's captured request. Only error responses are decoded.
+func (c *client) maybeCaptureRawResponse(stream int16, raw *frame.RawFrame) {
+	if !c.captured {
+		return
+	}
+	errorCode := ""
+	if raw.Header.OpCode == primitive.OpCodeError {
+		if frm, err := c.codec.ConvertFromRawFrame(raw); err == nil {
+			if errMsg, ok := frm.Body.Message.(message.Error); ok {
+				errorCode = codeName(errMsg.GetErrorCode())
+			}
+		}
+	}
+	c.proxy.capture.onResponse(c, stream, raw.Header.OpCode, errorCode)
+}
+
+// codeName returns the short name of an opcode or error code, e.g. "QUERY" instead of "OpCode QUERY [0x07]".
+func codeName(code fmt.Stringer) string {
+	name := code.String()
+	name = name[strings.IndexByte(name, ' ')+1:]
+	if i := strings.LastIndex(name, " ["); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
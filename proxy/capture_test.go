@@ -0,0 +1,211 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestProxy_CaptureAndReplay(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				if strings.Contains(frm.Body.Message.(*message.Query).Query, "fail") {
+					return &message.Invalid{ErrorMessage: "failure"}
+				}
+				return &message.VoidResult{}
+			},
+		},
+		capture: &CaptureConfig{Path: path},
+	})
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "INSERT INTO ks.t (k, v) VALUES (1, 1)"}))
+	require.NoError(t, err)
+
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "INSERT INTO ks.fail (k, v) VALUES (1, 1)"}))
+	require.NoError(t, err)
+
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "SELECT * FROM system.local"}))
+	require.NoError(t, err)
+
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Prepare{Query: "INSERT INTO ks.t (k, v) VALUES (?, ?)"}))
+	require.NoError(t, err)
+	preparedResult, ok := resp.Body.Message.(*message.PreparedResult)
+	require.True(t, ok, "expected prepared result")
+
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Execute{QueryId: preparedResult.PreparedQueryId}))
+	require.NoError(t, err)
+
+	tester.shutdown()
+
+	records, err := loadCapture(path)
+	require.NoError(t, err)
+
+	var requests []captureRecord
+	var prepared []captureRecord
+	for _, record := range records {
+		switch record.Type {
+		case captureRecordRequest:
+			requests = append(requests, record)
+		case captureRecordPrepared:
+			prepared = append(prepared, record)
+		}
+	}
+	require.Len(t, requests, 5)
+	assert.Equal(t, codeName(primitive.OpCodeQuery), requests[0].OpCode)
+	assert.Equal(t, codeName(primitive.OpCodeResult), requests[0].Response)
+	assert.Empty(t, requests[0].Error)
+	assert.Equal(t, codeName(primitive.ErrorCodeInvalid), requests[1].Error)
+	assert.Equal(t, codeName(primitive.OpCodePrepare), requests[3].OpCode)
+	assert.Equal(t, codeName(primitive.OpCodeExecute), requests[4].OpCode)
+	for i := 1; i < len(requests); i++ {
+		assert.GreaterOrEqual(t, int64(requests[i].Offset), int64(requests[i-1].Offset))
+	}
+	require.Len(t, prepared, 1)
+	assert.Equal(t, "INSERT INTO ks.t (k, v) VALUES (?, ?)", prepared[0].Query)
+
+	// Replay against a cluster that doesn't know the prepared statement and doesn't fail any query
+	var mu sync.Mutex
+	isPrepared := false
+	replayPort := generateTestPort()
+	replayCluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), replayPort)
+	replayCluster.Handlers = proxycore.NewMockRequestHandlers(proxycore.MockRequestHandlers{
+		primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+				return msg
+			}
+			return &message.VoidResult{}
+		},
+		primitive.OpCodePrepare: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			mu.Lock()
+			isPrepared = true
+			mu.Unlock()
+			return proxycore.MockDefaultPrepareHandler(cl, frm)
+		},
+		primitive.OpCodeExecute: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			mu.Lock()
+			defer mu.Unlock()
+			if !isPrepared {
+				return &message.Unprepared{Id: frm.Body.Message.(*message.Execute).QueryId}
+			}
+			return &message.VoidResult{}
+		},
+	})
+	defer replayCluster.Shutdown()
+	require.NoError(t, replayCluster.Add(ctx, 1))
+
+	r, err := newReplayer(ctx, replayerConfig{
+		ClusterConfig: proxycore.ClusterConfig{
+			Version:           version,
+			Resolver:          proxycore.NewResolverWithDefaultPort([]string{testAddr}, replayPort),
+			ReconnectPolicy:   proxycore.NewReconnectPolicyWithDelays(200*time.Millisecond, time.Second),
+			HeartBeatInterval: 30 * time.Second,
+			ConnectTimeout:    10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			Logger:            zap.L(),
+		},
+		numConns:    1,
+		speed:       0,
+		maxInflight: 1,
+		timeout:     10 * time.Second,
+	})
+	require.NoError(t, err)
+
+	report, err := r.replay(records)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, report.replayed)
+	assert.Equal(t, 1, report.skipped, "queries handled by the proxy should be skipped")
+	assert.Equal(t, map[replayDifference]int{
+		{
+			opCode:   codeName(primitive.OpCodeQuery),
+			captured: codeName(primitive.ErrorCodeInvalid),
+			replayed: replayResultOK,
+		}: 1,
+	}, report.differences)
+
+	var out bytes.Buffer
+	report.write(&out)
+	assert.Contains(t, out.String(), "Replayed 4 requests")
+	assert.Contains(t, out.String(), "Result differences")
+}
+
+func TestCapture_Clients(t *testing.T) {
+	c, err := newCapture(CaptureConfig{
+		Path:    filepath.Join(t.TempDir(), "capture.jsonl"),
+		Clients: []string{"10.0.0.0/8"},
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer c.stop()
+
+	assert.True(t, c.isCaptured(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}))
+	assert.False(t, c.isCaptured(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}))
+
+	_, err = newCapture(CaptureConfig{
+		Path:    filepath.Join(t.TempDir(), "capture.jsonl"),
+		Clients: []string{"invalid"},
+	}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestCapture_QueueFull(t *testing.T) {
+	// Without a writer, the queue fills up and records are dropped instead of blocking the client
+	c := &capture{logger: zap.NewNop(), records: make(chan []byte, 1)}
+	assert.True(t, c.write(captureRecord{Type: captureRecordRequest}))
+	assert.False(t, c.write(captureRecord{Type: captureRecordRequest}))
+	assert.Equal(t, uint64(1), c.dropped)
+	assert.Equal(t, "{\"type\":\"request\",\"version\":0}\n", string(<-c.records))
+}
+
+func TestCodeName(t *testing.T) {
+	assert.Equal(t, "QUERY", codeName(primitive.OpCodeQuery))
+	assert.Equal(t, "AUTH RESPONSE", codeName(primitive.OpCodeAuthResponse))
+	assert.Equal(t, "ReadTimeout", codeName(primitive.ErrorCodeReadTimeout))
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(t, time.Duration(5), percentile(sorted, 0.5))
+	assert.Equal(t, time.Duration(9), percentile(sorted, 0.9))
+	assert.Equal(t, time.Duration(10), percentile(sorted, 1))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
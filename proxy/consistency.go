@@ -0,0 +1,337 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/parser"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+// ConsistencyRule maps the consistency levels of requests. A rule applies to all requests unless it's scoped to
+// keyspaces or to clients connecting from specific CIDRs. Rules are evaluated in order and the first rule that matches a
+// request is used.
+type ConsistencyRule struct {
+	Keyspaces []string          `yaml:"keyspaces"`
+	Clients   []string          `yaml:"clients"` // CIDRs
+	Reads     map[string]string `yaml:"reads"`   // Consistency level of SELECT requests, e.g. ONE: LOCAL_ONE
+	Writes    map[string]string `yaml:"writes"`  // Consistency level of all other requests
+	Serial    map[string]string `yaml:"serial"`  // Serial consistency level, e.g. SERIAL: LOCAL_SERIAL
+	Minimum   string            `yaml:"minimum"` // The weakest non-serial consistency level allowed
+}
+
+type consistencyMap map[primitive.ConsistencyLevel]primitive.ConsistencyLevel
+
+type consistencyRule struct {
+	keyspaces map[string]struct{} // Keyspace IDs, matches all keyspaces if empty
+	clients   []*net.IPNet
+	reads     consistencyMap
+	writes    consistencyMap
+	serial    consistencyMap
+	minimum   *primitive.ConsistencyLevel
+}
+
+func newConsistencyRules(rules []ConsistencyRule) ([]consistencyRule, error) {
+	result := make([]consistencyRule, 0, len(rules))
+	for i, rule := range rules {
+		r := consistencyRule{keyspaces: make(map[string]struct{})}
+		for _, keyspace := range rule.Keyspaces {
+			r.keyspaces[parser.IdentifierFromString(keyspace).ID()] = struct{}{}
+		}
+		var err error
+		if r.clients, err = parseClientCIDRs(rule.Clients); err != nil {
+			return nil, fmt.Errorf("invalid client CIDR for consistency rule %d: %w", i, err)
+		}
+		if r.reads, err = parseConsistencyMap(rule.Reads, false); err != nil {
+			return nil, fmt.Errorf("invalid 'reads' for consistency rule %d: %w", i, err)
+		}
+		if r.writes, err = parseConsistencyMap(rule.Writes, false); err != nil {
+			return nil, fmt.Errorf("invalid 'writes' for consistency rule %d: %w", i, err)
+		}
+		if r.serial, err = parseConsistencyMap(rule.Serial, true); err != nil {
+			return nil, fmt.Errorf("invalid 'serial' for consistency rule %d: %w", i, err)
+		}
+		if len(rule.Minimum) > 0 {
+			var minimum clWrapper
+			if err = minimum.UnmarshalText([]byte(rule.Minimum)); err != nil {
+				return nil, fmt.Errorf("invalid 'minimum' for consistency rule %d: %w", i, err)
+			}
+			if minimum.IsSerial() {
+				return nil, fmt.Errorf("invalid 'minimum' for consistency rule %d: serial consistency level %v", i, minimum)
+			}
+			r.minimum = &minimum.ConsistencyLevel
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// parseConsistencyMap parses a mapping of consistency levels. Serial consistency levels can only be mapped to other
+// serial consistency levels.
+func parseConsistencyMap(m map[string]string, serial bool) (consistencyMap, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	result := make(consistencyMap)
+	for from, to := range m {
+		var fromCL, toCL clWrapper
+		if err := fromCL.UnmarshalText([]byte(from)); err != nil {
+			return nil, err
+		}
+		if err := toCL.UnmarshalText([]byte(to)); err != nil {
+			return nil, err
+		}
+		if fromCL.IsSerial() != serial || toCL.IsSerial() != serial {
+			if serial {
+				return nil, fmt.Errorf("only serial consistency levels can be mapped (%s: %s)", from, to)
+			}
+			return nil, fmt.Errorf("serial consistency levels must be mapped using 'serial' (%s: %s)", from, to)
+		}
+		result[fromCL.ConsistencyLevel] = toCL.ConsistencyLevel
+	}
+	return result, nil
+}
+
+func parseClientCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var clients []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, ipNet)
+	}
+	return clients, nil
+}
+
+// clientsContain returns true if the client list is empty or one of its CIDRs contains the IP.
+func clientsContain(clients []*net.IPNet, ip net.IP) bool {
+	if len(clients) == 0 {
+		return true
+	}
+	for _, ipNet := range clients {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+// clientConsistencyRules returns the consistency rules that apply to a client's address.
+func (p *Proxy) clientConsistencyRules(addr net.Addr) []consistencyRule {
+	ip := addrIP(addr)
+	var rules []consistencyRule
+	for _, rule := range p.consistencyRules {
+		if clientsContain(rule.clients, ip) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// consistencyStrength orders the non-serial consistency levels from the weakest to the strongest.
+func consistencyStrength(consistency primitive.ConsistencyLevel) int {
+	switch consistency {
+	case primitive.ConsistencyLevelAny:
+		return 0
+	case primitive.ConsistencyLevelOne, primitive.ConsistencyLevelLocalOne:
+		return 1
+	case primitive.ConsistencyLevelTwo:
+		return 2
+	case primitive.ConsistencyLevelThree:
+		return 3
+	case primitive.ConsistencyLevelLocalQuorum:
+		return 4
+	case primitive.ConsistencyLevelQuorum:
+		return 5
+	case primitive.ConsistencyLevelEachQuorum:
+		return 6
+	case primitive.ConsistencyLevelAll:
+		return 7
+	}
+	return -1
+}
+
+// mapConsistency returns the consistency level a rule maps a request's consistency level to.
+func (r *consistencyRule) mapConsistency(consistency primitive.ConsistencyLevel, isSelect bool) primitive.ConsistencyLevel {
+	if consistency.IsSerial() {
+		if to, ok := r.serial[consistency]; ok { // Serial reads use a serial consistency level
+			return to
+		}
+		return consistency
+	}
+	m := r.writes
+	if isSelect {
+		m = r.reads
+	}
+	if to, ok := m[consistency]; ok {
+		consistency = to
+	}
+	if r.minimum != nil && consistencyStrength(consistency) < consistencyStrength(*r.minimum) {
+		consistency = *r.minimum
+	}
+	return consistency
+}
+
+// allows returns false if a consistency level is weaker than the rule's minimum.
+func (r *consistencyRule) allows(consistency primitive.ConsistencyLevel) bool {
+	return r.minimum == nil || consistencyStrength(consistency) >= consistencyStrength(*r.minimum)
+}
+
+// findConsistencyRule returns the first of the client's consistency rules that matches the request's keyspace or nil if
+// none match.
+func (c *client) findConsistencyRule(body *frame.Body) *consistencyRule {
+	var keyspace *string
+	for i := range c.consistencyRules {
+		rule := &c.consistencyRules[i]
+		if len(rule.keyspaces) > 0 {
+			if keyspace == nil {
+				ks := c.requestKeyspace(body)
+				keyspace = &ks
+			}
+			if _, ok := rule.keyspaces[*keyspace]; !ok {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// requestKeyspace returns the keyspace ID of a request. It's the keyspace of the first qualified table; otherwise, the
+// client's keyspace.
+func (c *client) requestKeyspace(body *frame.Body) string {
+	keyspace := parser.IdentifierFromString(c.keyspace).ID()
+	var tables []tableKey
+	switch msg := body.Message.(type) {
+	case *codecs.PartialQuery:
+		tables = findTables(c.keyspace, msg.Query)
+	case *codecs.PartialExecute:
+		tables = c.proxy.preparedTables(msg.QueryId)
+	case *codecs.PartialBatch:
+		if len(msg.Queries) > 0 {
+			switch q := msg.Queries[0].QueryOrId.(type) {
+			case string:
+				tables = findTables(c.keyspace, q)
+			case []byte:
+				tables = c.proxy.preparedTables(q)
+			}
+		}
+	}
+	if len(tables) > 0 {
+		return tables[0].keyspace
+	}
+	return keyspace
+}
+
+// maybeOverrideConsistency changes the consistency level and serial consistency level of a request using its matching
+// consistency rule, if any. Unsupported write consistency levels are then overridden. The original raw frame is
+// returned if nothing changed.
+func (c *client) maybeOverrideConsistency(rule *consistencyRule, isSelect bool, raw *frame.RawFrame, body *frame.Body) (frm interface{}) {
+	var consistency primitive.ConsistencyLevel
+	switch m := body.Message.(type) {
+	case *codecs.PartialQuery:
+		consistency = m.Consistency
+	case *codecs.PartialExecute:
+		consistency = m.Consistency
+	case *codecs.PartialBatch:
+		consistency = m.Consistency
+	default:
+		return raw
+	}
+
+	changed := false
+	override := consistency
+	if rule != nil {
+		override = rule.mapConsistency(consistency, isSelect)
+		if len(rule.serial) > 0 {
+			changed = c.maybeOverrideSerialConsistency(rule, raw.Header.Version, body.Message)
+		}
+	}
+	if !isSelect && c.isUnsupportedWriteConsistency(override) {
+		override = c.proxy.config.UnsupportedWriteConsistencyOverride.ConsistencyLevel
+	}
+
+	if override != consistency {
+		c.proxy.logger.Debug("overriding request consistency",
+			zap.Stringer("request", body.Message.(fmt.Stringer)),
+			zap.Stringer("consistency", consistency),
+			zap.Stringer("override", override))
+		switch m := body.Message.(type) {
+		case *codecs.PartialQuery:
+			m.Consistency = override
+		case *codecs.PartialExecute:
+			m.Consistency = override
+		case *codecs.PartialBatch:
+			m.Consistency = override
+		}
+		changed = true
+	}
+
+	if !changed {
+		return raw
+	}
+	return &frame.Frame{
+		Header: raw.Header,
+		Body:   body,
+	}
+}
+
+// maybeOverrideSerialConsistency maps the serial consistency level of a request. It returns true if it was changed.
+func (c *client) maybeOverrideSerialConsistency(rule *consistencyRule, version primitive.ProtocolVersion, msg message.Message) bool {
+	serial, ok, err := codecs.SerialConsistency(msg, version)
+	if err != nil {
+		c.proxy.logger.Error("unable to read serial consistency of request", zap.Stringer("request", msg.(fmt.Stringer)), zap.Error(err))
+		return false
+	}
+	if !ok {
+		return false
+	}
+	override, ok := rule.serial[serial]
+	if !ok || override == serial {
+		return false
+	}
+	if err = codecs.SetSerialConsistency(msg, version, override); err != nil {
+		c.proxy.logger.Error("unable to override serial consistency of request", zap.Stringer("request", msg.(fmt.Stringer)), zap.Error(err))
+		return false
+	}
+	c.proxy.logger.Debug("overriding request serial consistency",
+		zap.Stringer("request", msg.(fmt.Stringer)),
+		zap.Stringer("serialConsistency", serial),
+		zap.Stringer("override", override))
+	return true
+}
+
+func (c *client) isUnsupportedWriteConsistency(consistency primitive.ConsistencyLevel) bool {
+	for _, unsupported := range c.proxy.config.UnsupportedWriteConsistencies {
+		if unsupported.ConsistencyLevel == consistency {
+			return true
+		}
+	}
+	return false
+}
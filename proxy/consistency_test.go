@@ -0,0 +1,120 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ConsistencyRules(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	received := make(chan *message.QueryOptions, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				received <- frm.Body.Message.(*message.Query).Options
+				return &message.VoidResult{}
+			},
+		},
+		consistencyRules: []ConsistencyRule{
+			{
+				Keyspaces: []string{"ks2"},
+				Clients:   []string{"10.0.0.0/8"}, // Doesn't match the test client
+				Writes:    map[string]string{"QUORUM": "ALL"},
+			},
+			{
+				Keyspaces: []string{"ks1"},
+				Minimum:   "LOCAL_QUORUM",
+			},
+			{
+				Reads:  map[string]string{"ONE": "LOCAL_ONE", "quorum": "local_quorum"},
+				Serial: map[string]string{"SERIAL": "LOCAL_SERIAL"},
+			},
+		},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	serial := primitive.ConsistencyLevelSerial
+
+	var tests = []struct {
+		msg               string
+		query             string
+		consistency       primitive.ConsistencyLevel
+		serialConsistency *primitive.ConsistencyLevel
+		expected          primitive.ConsistencyLevel
+		expectedSerial    primitive.ConsistencyLevel
+	}{
+		{"read mapped", "SELECT * FROM ks.t", primitive.ConsistencyLevelOne, nil, primitive.ConsistencyLevelLocalOne, 0},
+		{"read mapped, case insensitive", "SELECT * FROM ks.t", primitive.ConsistencyLevelQuorum, nil, primitive.ConsistencyLevelLocalQuorum, 0},
+		{"write not mapped", "INSERT INTO ks.t (k) VALUES (1)", primitive.ConsistencyLevelQuorum, nil, primitive.ConsistencyLevelQuorum, 0},
+		{"serial consistency mapped", "INSERT INTO ks.t (k) VALUES (1) IF NOT EXISTS", primitive.ConsistencyLevelQuorum, &serial, primitive.ConsistencyLevelQuorum, primitive.ConsistencyLevelLocalSerial},
+		{"serial read mapped", "SELECT * FROM ks.t", primitive.ConsistencyLevelSerial, nil, primitive.ConsistencyLevelLocalSerial, 0},
+		{"keyspace minimum", "SELECT * FROM ks1.t", primitive.ConsistencyLevelOne, nil, primitive.ConsistencyLevelLocalQuorum, 0},
+		{"keyspace minimum, stronger level unchanged", "SELECT * FROM ks1.t", primitive.ConsistencyLevelAll, nil, primitive.ConsistencyLevelAll, 0},
+		{"client doesn't match", "INSERT INTO ks2.t (k) VALUES (1)", primitive.ConsistencyLevelQuorum, nil, primitive.ConsistencyLevelQuorum, 0},
+	}
+
+	for _, tt := range tests {
+		_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{
+			Query:   tt.query,
+			Options: &message.QueryOptions{Consistency: tt.consistency, SerialConsistency: tt.serialConsistency},
+		}))
+		require.NoError(t, err, tt.msg)
+		options := <-received
+		assert.Equal(t, tt.expected, options.Consistency, tt.msg)
+		if tt.serialConsistency != nil {
+			require.NotNil(t, options.SerialConsistency, tt.msg)
+			assert.Equal(t, tt.expectedSerial, *options.SerialConsistency, tt.msg)
+		}
+	}
+}
+
+func TestNewConsistencyRules_Invalid(t *testing.T) {
+	var tests = []struct {
+		msg  string
+		rule ConsistencyRule
+	}{
+		{"invalid consistency level", ConsistencyRule{Reads: map[string]string{"ONE": "MOST"}}},
+		{"serial level in reads", ConsistencyRule{Reads: map[string]string{"SERIAL": "LOCAL_SERIAL"}}},
+		{"non-serial level in serial", ConsistencyRule{Serial: map[string]string{"ONE": "LOCAL_ONE"}}},
+		{"serial minimum", ConsistencyRule{Minimum: "SERIAL"}},
+		{"invalid client", ConsistencyRule{Clients: []string{"not-a-cidr"}}},
+	}
+
+	for _, tt := range tests {
+		_, err := newConsistencyRules([]ConsistencyRule{tt.rule})
+		assert.Error(t, err, tt.msg)
+	}
+}
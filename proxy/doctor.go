@@ -0,0 +1,449 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+const doctorLatencySamples = 3
+
+type doctorStatus string
+
+const (
+	doctorPass doctorStatus = "PASS"
+	doctorFail doctorStatus = "FAIL"
+	doctorSkip doctorStatus = "SKIP"
+)
+
+// doctorCheck is a step of the connectivity diagnostics.
+type doctorCheck struct {
+	status   doctorStatus
+	name     string
+	target   string
+	detail   string
+	hint     string // How to fix a failed check
+	duration time.Duration
+}
+
+// doctorHost is a host discovered using the system tables.
+type doctorHost struct {
+	dc      string
+	addr    string
+	latency time.Duration
+	err     error
+}
+
+// doctorBackend is the result of the diagnostics of a backend cluster.
+type doctorBackend struct {
+	name   string
+	checks []doctorCheck
+	hosts  []doctorHost
+}
+
+func (b *doctorBackend) add(check doctorCheck) {
+	b.checks = append(b.checks, check)
+}
+
+func (b *doctorBackend) passed() bool {
+	for _, check := range b.checks {
+		if check.status == doctorFail {
+			return false
+		}
+	}
+	for _, host := range b.hosts {
+		if host.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type doctor struct {
+	ctx            context.Context
+	version        primitive.ProtocolVersion
+	maxVersion     primitive.ProtocolVersion
+	connectTimeout time.Duration
+}
+
+// Doctor starts the doctor command. It uses the proxy's flags and configuration file to diagnose the connectivity to
+// the backend clusters step by step and prints a report. 'args' shouldn't include the executable or the command name.
+// It returns a non-zero exit code if any check failed.
+func Doctor(ctx context.Context, args []string) int {
+	cfg, cliCtx, ok := parseRunConfig(args, kong.Name("cql-proxy doctor"),
+		kong.Description("Diagnose the connectivity to the backend clusters using the proxy's configuration"))
+	if !ok {
+		return 1
+	}
+
+	backends, err := cfg.doctorBackends()
+	if err != nil {
+		cliCtx.Errorf("%v", err)
+		return 1
+	}
+
+	d := &doctor{
+		ctx:            ctx,
+		connectTimeout: cfg.ConnectTimeout,
+	}
+	if d.version, ok = parseProtocolVersion(cfg.ProtocolVersion); !ok {
+		cliCtx.Errorf("unsupported protocol version: %s", cfg.ProtocolVersion)
+		return 1
+	}
+	if d.maxVersion, ok = parseProtocolVersion(cfg.MaxProtocolVersion); !ok {
+		cliCtx.Errorf("unsupported max protocol version: %s", cfg.MaxProtocolVersion)
+		return 1
+	}
+
+	if !d.run(backends, cliCtx.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+// run diagnoses each backend, writes the report and returns true if all checks passed.
+func (d *doctor) run(targets []doctorTarget, w io.Writer) bool {
+	passed := true
+	for _, t := range targets {
+		if t.config.Resolver != nil {
+			d.diagnose(t.doctorBackend, t.config)
+		}
+		writeDoctorBackend(w, t.doctorBackend)
+		if !t.passed() {
+			passed = false
+		}
+	}
+	if !passed {
+		_, _ = fmt.Fprintln(w, "Some checks failed")
+	} else {
+		_, _ = fmt.Fprintln(w, "All checks passed")
+	}
+	return passed
+}
+
+type doctorTarget struct {
+	*doctorBackend
+	config BackendConfig
+}
+
+// doctorBackends creates the backends to diagnose from the proxy's configuration. A backend with an invalid
+// configuration is reported as a failed check instead of an error so that the other backends are still diagnosed.
+func (c *runConfig) doctorBackends() ([]doctorTarget, error) {
+	def := doctorTarget{doctorBackend: &doctorBackend{name: defaultBackendName}}
+	start := time.Now()
+	resolver, err := c.buildResolver()
+	if err != nil {
+		hint := "Set '--contact-points', '--astra-bundle' or '--astra-token' and '--astra-database-id'"
+		if len(c.AstraBundle) > 0 {
+			hint = "Check that '--astra-bundle' is the path of the secure connect bundle zip file downloaded from Astra"
+		} else if c.usesAstraToken() {
+			hint = "Check the token, the database ID and that the Astra API ('--astra-api-url') is reachable"
+		}
+		def.add(doctorCheck{status: doctorFail, name: "Load configuration", detail: err.Error(), hint: hint,
+			duration: time.Since(start)})
+	} else {
+		auth, err := c.buildAuth(nil)
+		if err != nil {
+			hint := "Check '--kerberos-keytab' and '--kerberos-config'"
+			if len(c.KerberosPrincipal) == 0 {
+				hint = "Check that the credential files, e.g. '--password-file', exist and aren't empty"
+			}
+			def.add(doctorCheck{status: doctorFail, name: "Load configuration", detail: err.Error(), hint: hint,
+				duration: time.Since(start)})
+		} else {
+			def.add(doctorCheck{status: doctorPass, name: "Load configuration", detail: c.describeSource(),
+				duration: time.Since(start)})
+			def.config = BackendConfig{Name: defaultBackendName, Resolver: resolver, Auth: auth}
+		}
+	}
+
+	targets := []doctorTarget{def}
+	backends, err := c.buildBackends()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range backends {
+		targets = append(targets, doctorTarget{doctorBackend: &doctorBackend{name: b.Name}, config: b})
+	}
+	return targets, nil
+}
+
+func (c *runConfig) describeSource() string {
+	if len(c.AstraBundle) > 0 {
+		return fmt.Sprintf("Astra bundle %s", c.AstraBundle)
+	} else if c.usesAstraToken() {
+		return fmt.Sprintf("Astra database %s", c.AstraDatabaseID)
+	}
+	return fmt.Sprintf("contact points %s", strings.Join(c.ContactPoints, ", "))
+}
+
+// diagnose resolves a backend's endpoints and checks each endpoint until one accepts a control connection. The hosts
+// discovered using the system tables are then checked.
+func (d *doctor) diagnose(b *doctorBackend, config BackendConfig) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.connectTimeout)
+	start := time.Now()
+	endpoints, err := config.Resolver.Resolve(ctx)
+	cancel()
+	if err != nil {
+		b.add(doctorCheck{status: doctorFail, name: "Resolve endpoints", detail: err.Error(), duration: time.Since(start),
+			hint: "Check that the contact points' DNS names resolve, or for Astra that the database is active and its metadata service is reachable"})
+		return
+	} else if len(endpoints) == 0 {
+		b.add(doctorCheck{status: doctorFail, name: "Resolve endpoints", detail: "no endpoints", duration: time.Since(start),
+			hint: "Check the contact points"})
+		return
+	}
+	b.add(doctorCheck{status: doctorPass, name: "Resolve endpoints", duration: time.Since(start),
+		detail: fmt.Sprintf("%d endpoint(s)", len(endpoints))})
+
+	for _, endpoint := range endpoints {
+		hosts, ok := d.diagnoseControlConn(b, endpoint, config)
+		if ok {
+			d.diagnoseHosts(b, hosts, config)
+			break
+		}
+	}
+}
+
+// diagnoseControlConn checks each step of opening a control connection to an endpoint: TCP, TLS, the protocol
+// handshake, authentication and the system tables.
+func (d *doctor) diagnoseControlConn(b *doctorBackend, endpoint proxycore.Endpoint, config BackendConfig) ([]*proxycore.Host, bool) {
+	target := endpoint.String()
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.connectTimeout)
+	defer cancel()
+
+	start := time.Now()
+	addr, err := proxycore.LookupEndpoint(endpoint)
+	if err != nil {
+		b.add(doctorCheck{status: doctorFail, name: "Lookup endpoint", target: target, detail: err.Error(),
+			duration: time.Since(start), hint: "Check that the endpoint's DNS name resolves from this host"})
+		return nil, false
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		b.add(doctorCheck{status: doctorFail, name: "TCP connect", target: target, detail: err.Error(),
+			duration: time.Since(start),
+			hint:     "Check that the node is listening for CQL on this port ('--port') and that firewalls or security groups allow the connection"})
+		return nil, false
+	}
+	b.add(doctorCheck{status: doctorPass, name: "TCP connect", target: target, detail: addr, duration: time.Since(start)})
+
+	if endpoint.TLSConfig() == nil {
+		_ = conn.Close()
+		b.add(doctorCheck{status: doctorSkip, name: "TLS handshake", target: target, detail: "TLS not configured"})
+	} else {
+		start = time.Now()
+		tlsConn := tls.Client(conn, endpoint.TLSConfig())
+		err = tlsConn.HandshakeContext(ctx)
+		_ = tlsConn.Close()
+		if err != nil {
+			b.add(doctorCheck{status: doctorFail, name: "TLS handshake", target: target, detail: err.Error(),
+				duration: time.Since(start),
+				hint:     "Check that the bundle's certificates are valid for the database and that the system clock is correct"})
+			return nil, false
+		}
+		b.add(doctorCheck{status: doctorPass, name: "TLS handshake", target: target, duration: time.Since(start)})
+	}
+
+	start = time.Now()
+	cc, err := proxycore.ConnectClient(ctx, endpoint, proxycore.ClientConnConfig{})
+	if err != nil {
+		b.add(doctorCheck{status: doctorFail, name: "Protocol handshake", target: target, detail: err.Error(),
+			duration: time.Since(start), hint: "The endpoint accepted a connection but then failed, retry or check the node's logs"})
+		return nil, false
+	}
+	defer cc.Close()
+
+	version, err := cc.Handshake(ctx, d.version, config.Auth)
+	var cqlErr *proxycore.CqlError
+	if errors.As(err, &cqlErr) && cqlErr.Message.GetErrorCode() == primitive.ErrorCodeAuthenticationError {
+		b.add(doctorCheck{status: doctorPass, name: "Protocol handshake", target: target, detail: version.String()})
+		b.add(doctorCheck{status: doctorFail, name: "Authenticate", target: target, detail: err.Error(),
+			duration: time.Since(start),
+			hint:     "Check '--username' and '--password'. Astra tokens use 'token' as the username and the token as the password"})
+		return nil, false
+	} else if err == proxycore.AuthExpected {
+		b.add(doctorCheck{status: doctorPass, name: "Protocol handshake", target: target, detail: version.String()})
+		b.add(doctorCheck{status: doctorFail, name: "Authenticate", target: target, detail: err.Error(),
+			duration: time.Since(start), hint: "The cluster requires authentication, set '--username' and '--password'"})
+		return nil, false
+	} else if err != nil {
+		b.add(doctorCheck{status: doctorFail, name: "Protocol handshake", target: target, detail: err.Error(),
+			duration: time.Since(start),
+			hint:     "Check that the node supports '--protocol-version', or lower it, and that this is a CQL port"})
+		return nil, false
+	}
+	detail := version.String()
+	if version != d.version {
+		detail = fmt.Sprintf("%v (downgraded from %v)", version, d.version)
+	}
+	if version > d.maxVersion {
+		b.add(doctorCheck{status: doctorFail, name: "Protocol handshake", target: target, detail: detail,
+			duration: time.Since(start), hint: "The negotiated version is greater than '--max-protocol-version'"})
+		return nil, false
+	}
+	b.add(doctorCheck{status: doctorPass, name: "Protocol handshake", target: target, detail: detail,
+		duration: time.Since(start)})
+	if config.Auth == nil {
+		b.add(doctorCheck{status: doctorSkip, name: "Authenticate", target: target, detail: "not required"})
+	} else {
+		b.add(doctorCheck{status: doctorPass, name: "Authenticate", target: target})
+	}
+
+	start = time.Now()
+	hosts, err := d.queryHosts(ctx, cc, version, config.Resolver)
+	if err != nil {
+		b.add(doctorCheck{status: doctorFail, name: "Query system tables", target: target, detail: err.Error(),
+			duration: time.Since(start),
+			hint:     "Check that the user is allowed to read 'system.local' and 'system.peers' and that the node has joined the cluster"})
+		return nil, false
+	}
+	b.add(doctorCheck{status: doctorPass, name: "Query system tables", target: target, duration: time.Since(start),
+		detail: fmt.Sprintf("%d host(s)", len(hosts))})
+	return hosts, true
+}
+
+func (d *doctor) queryHosts(ctx context.Context, cc *proxycore.ClientConn, version primitive.ProtocolVersion, resolver proxycore.EndpointResolver) ([]*proxycore.Host, error) {
+	var hosts []*proxycore.Host
+	for _, table := range []string{"system.local", "system.peers"} {
+		rs, err := cc.Query(ctx, version, &message.Query{
+			Query: "SELECT * FROM " + table,
+			Options: &message.QueryOptions{
+				Consistency: primitive.ConsistencyLevelOne,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < rs.RowCount(); i++ {
+			row := rs.Row(i)
+			endpoint, err := resolver.NewEndpoint(row)
+			if err == proxycore.IgnoreEndpoint {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid host in %s: %w", table, err)
+			}
+			host, err := proxycore.NewHostFromRow(endpoint, row)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host in %s: %w", table, err)
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts found in the system tables")
+	}
+	return hosts, nil
+}
+
+// diagnoseHosts connects to each discovered host and measures its latency using the average of a few "OPTIONS"
+// requests.
+func (d *doctor) diagnoseHosts(b *doctorBackend, hosts []*proxycore.Host, config BackendConfig) {
+	for _, host := range hosts {
+		h := doctorHost{dc: host.DC, addr: host.String()}
+		h.latency, h.err = d.measureLatency(host, config)
+		b.hosts = append(b.hosts, h)
+	}
+	sort.SliceStable(b.hosts, func(i, j int) bool {
+		return b.hosts[i].dc < b.hosts[j].dc
+	})
+}
+
+func (d *doctor) measureLatency(host *proxycore.Host, config BackendConfig) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.connectTimeout)
+	defer cancel()
+	cc, err := proxycore.ConnectClient(ctx, host.Endpoint, proxycore.ClientConnConfig{})
+	if err != nil {
+		return 0, err
+	}
+	defer cc.Close()
+	version, err := cc.Handshake(ctx, d.version, config.Auth)
+	if err != nil {
+		return 0, err
+	}
+	var total time.Duration
+	for i := 0; i < doctorLatencySamples; i++ {
+		start := time.Now()
+		if _, err = cc.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Options{})); err != nil {
+			return 0, err
+		}
+		total += time.Since(start)
+	}
+	return total / doctorLatencySamples, nil
+}
+
+func writeDoctorBackend(w io.Writer, b *doctorBackend) {
+	_, _ = fmt.Fprintf(w, "Backend %s\n", b.name)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, check := range b.checks {
+		duration := ""
+		if check.duration > 0 {
+			duration = check.duration.Round(time.Microsecond).String()
+		}
+		_, _ = fmt.Fprintf(tw, "  [%s]\t%s\t%s\t%s\t%s\n", check.status, check.name, check.target, check.detail, duration)
+	}
+	_ = tw.Flush()
+	for _, check := range b.checks {
+		if check.status == doctorFail && len(check.hint) > 0 {
+			_, _ = fmt.Fprintf(w, "  Hint (%s", check.name)
+			if len(check.target) > 0 {
+				_, _ = fmt.Fprintf(w, " %s", check.target)
+			}
+			_, _ = fmt.Fprintf(w, "): %s\n", check.hint)
+		}
+	}
+
+	if len(b.hosts) > 0 {
+		_, _ = fmt.Fprintln(w, "  Hosts")
+		dc := ""
+		for _, host := range b.hosts {
+			if host.dc != dc || dc == "" {
+				dc = host.dc
+				_, _ = fmt.Fprintf(tw, "    %s\n", dc)
+			}
+			if host.err != nil {
+				_, _ = fmt.Fprintf(tw, "      [%s]\t%s\t%v\n", doctorFail, host.addr, host.err)
+			} else {
+				_, _ = fmt.Fprintf(tw, "      [%s]\t%s\tlatency %s\n", doctorPass, host.addr, host.latency.Round(time.Microsecond))
+			}
+		}
+		_ = tw.Flush()
+		for _, host := range b.hosts {
+			if host.err != nil {
+				_, _ = fmt.Fprintln(w, "  Hint (hosts): Unreachable hosts were discovered using the system tables. Check that "+
+					"their broadcast RPC addresses are reachable from this host")
+				break
+			}
+		}
+	}
+	_, _ = fmt.Fprintln(w)
+}
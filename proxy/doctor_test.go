@@ -0,0 +1,105 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runTestDoctor(t *testing.T, ctx context.Context, args []string) (bool, *doctorBackend, string) {
+	cfg, _, ok := parseRunConfig(args)
+	require.True(t, ok)
+	targets, err := cfg.doctorBackends()
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+
+	d := &doctor{
+		ctx:            ctx,
+		version:        primitive.ProtocolVersion4,
+		maxVersion:     primitive.ProtocolVersion4,
+		connectTimeout: 2 * time.Second,
+	}
+	var out bytes.Buffer
+	passed := d.run(targets, &out)
+	return passed, targets[0].doctorBackend, out.String()
+}
+
+func TestDoctor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clusterPort, clusterAddr, _, _ := generateTestAddrs(testAddr)
+	cluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), clusterPort)
+	defer cluster.Shutdown()
+	require.NoError(t, cluster.Add(ctx, 1))
+	require.NoError(t, cluster.Add(ctx, 2))
+
+	passed, b, out := runTestDoctor(t, ctx, []string{"--contact-points", clusterAddr, "--port", strconv.Itoa(clusterPort)})
+	assert.True(t, passed, out)
+	assert.Contains(t, out, "All checks passed")
+
+	names := make(map[string]doctorStatus)
+	for _, check := range b.checks {
+		names[check.name] = check.status
+	}
+	assert.Equal(t, doctorPass, names["Load configuration"])
+	assert.Equal(t, doctorPass, names["Resolve endpoints"])
+	assert.Equal(t, doctorPass, names["TCP connect"])
+	assert.Equal(t, doctorSkip, names["TLS handshake"])
+	assert.Equal(t, doctorPass, names["Protocol handshake"])
+	assert.Equal(t, doctorSkip, names["Authenticate"])
+	assert.Equal(t, doctorPass, names["Query system tables"])
+
+	require.Len(t, b.hosts, 2)
+	for _, host := range b.hosts {
+		assert.NoError(t, host.err)
+		assert.Equal(t, "dc1", host.dc)
+	}
+}
+
+func TestDoctor_Unreachable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clusterPort, clusterAddr, _, _ := generateTestAddrs(testAddr)
+
+	passed, b, out := runTestDoctor(t, ctx, []string{"--contact-points", clusterAddr, "--port", strconv.Itoa(clusterPort)})
+	assert.False(t, passed)
+	assert.Contains(t, out, "Some checks failed")
+	assert.Contains(t, out, "Hint (TCP connect")
+
+	last := b.checks[len(b.checks)-1]
+	assert.Equal(t, "TCP connect", last.name)
+	assert.Equal(t, doctorFail, last.status)
+	assert.Empty(t, b.hosts)
+}
+
+func TestDoctor_MissingContactPoints(t *testing.T) {
+	passed, b, out := runTestDoctor(t, context.Background(), []string{})
+	assert.False(t, passed)
+	require.Len(t, b.checks, 1)
+	assert.Equal(t, doctorFail, b.checks[0].status)
+	assert.Contains(t, out, "Hint (Load configuration)")
+}
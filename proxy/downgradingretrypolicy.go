@@ -0,0 +1,134 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+// ConsistencyRetryPolicy is an optional interface implemented by retry policies that retry requests at a different
+// consistency level.
+type ConsistencyRetryPolicy interface {
+	// RetryConsistency returns the consistency level used to retry a request that failed with the error `msg`. It's only
+	// called when the policy has decided to retry the request, and it returns false if the consistency level is unchanged.
+	RetryConsistency(msg message.Error) (primitive.ConsistencyLevel, bool)
+}
+
+type downgradingConsistencyRetryPolicy struct{}
+
+// NewDowngradingConsistencyRetryPolicy creates a retry policy that retries read timeouts, write timeouts and unavailable
+// errors at the highest consistency level the replicas that responded, or are alive, are able to satisfy. Requests are
+// retried at most once.
+//
+// This policy can silently weaken the guarantees of a workload and should only be used by applications that prefer a
+// result at a lower consistency level to an error. Requests that are retried at a lower consistency level receive a
+// warning in their response (protocol v4+).
+func NewDowngradingConsistencyRetryPolicy() RetryPolicy {
+	return &downgradingConsistencyRetryPolicy{}
+}
+
+// OnReadTimeout retries on the same coordinator at a lower consistency level if not enough replicas responded. If enough
+// replicas responded, but without data, then it's retried at the same consistency level.
+func (d downgradingConsistencyRetryPolicy) OnReadTimeout(msg *message.ReadTimeout, retryCount int) RetryDecision {
+	if retryCount != 0 || msg.Consistency.IsSerial() {
+		return ReturnError
+	}
+	if msg.Received < msg.BlockFor {
+		if _, ok := maxLikelyToWorkConsistency(msg.Received, msg.Consistency); ok {
+			return RetrySame
+		}
+		return ReturnError
+	}
+	if !msg.DataPresent {
+		return RetrySame
+	}
+	return ReturnError
+}
+
+// OnWriteTimeout retries unlogged batches at a lower consistency level and batch log writes at the same consistency
+// level. Other writes may have been partially applied so their error is returned.
+func (d downgradingConsistencyRetryPolicy) OnWriteTimeout(msg *message.WriteTimeout, retryCount int) RetryDecision {
+	if retryCount != 0 {
+		return ReturnError
+	}
+	switch msg.WriteType {
+	case primitive.WriteTypeUnloggedBatch:
+		if _, ok := maxLikelyToWorkConsistency(msg.Received, msg.Consistency); ok {
+			return RetrySame
+		}
+	case primitive.WriteTypeBatchLog:
+		return RetrySame
+	}
+	return ReturnError
+}
+
+// OnUnavailable retries on the same coordinator at the highest consistency level the alive replicas can satisfy. Serial
+// consistency levels can't be downgraded so those requests are retried on the next coordinator instead.
+func (d downgradingConsistencyRetryPolicy) OnUnavailable(msg *message.Unavailable, retryCount int) RetryDecision {
+	if retryCount != 0 {
+		return ReturnError
+	}
+	if msg.Consistency.IsSerial() {
+		return RetryNext
+	}
+	if _, ok := maxLikelyToWorkConsistency(msg.Alive, msg.Consistency); ok {
+		return RetrySame
+	}
+	return ReturnError
+}
+
+// OnErrorResponse uses the default retry policy's behavior.
+func (d downgradingConsistencyRetryPolicy) OnErrorResponse(msg message.Error, retryCount int) RetryDecision {
+	return defaultRetryPolicyInstance.OnErrorResponse(msg, retryCount)
+}
+
+func (d downgradingConsistencyRetryPolicy) RetryConsistency(msg message.Error) (primitive.ConsistencyLevel, bool) {
+	var consistency primitive.ConsistencyLevel
+	var ok bool
+	switch m := msg.(type) {
+	case *message.ReadTimeout:
+		if m.Received < m.BlockFor {
+			consistency, ok = maxLikelyToWorkConsistency(m.Received, m.Consistency)
+		}
+		return consistency, ok && consistency != m.Consistency
+	case *message.WriteTimeout:
+		if m.WriteType == primitive.WriteTypeUnloggedBatch {
+			consistency, ok = maxLikelyToWorkConsistency(m.Received, m.Consistency)
+		}
+		return consistency, ok && consistency != m.Consistency
+	case *message.Unavailable:
+		if !m.Consistency.IsSerial() {
+			consistency, ok = maxLikelyToWorkConsistency(m.Alive, m.Consistency)
+		}
+		return consistency, ok && consistency != m.Consistency
+	}
+	return consistency, false
+}
+
+// maxLikelyToWorkConsistency returns the highest consistency level that's likely to succeed given the number of
+// replicas that responded, or are alive.
+func maxLikelyToWorkConsistency(knownOk int32, current primitive.ConsistencyLevel) (primitive.ConsistencyLevel, bool) {
+	switch {
+	case knownOk >= 3:
+		return primitive.ConsistencyLevelThree, true
+	case knownOk == 2:
+		return primitive.ConsistencyLevelTwo, true
+	case knownOk == 1 || current == primitive.ConsistencyLevelEachQuorum:
+		// "EACH_QUORUM" doesn't report a global number of replicas so there might be replicas in other datacenters
+		return primitive.ConsistencyLevelOne, true
+	}
+	return current, false
+}
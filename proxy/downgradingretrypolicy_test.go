@@ -0,0 +1,268 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDowngradingConsistencyRetryPolicy(t *testing.T) {
+	policy := NewDowngradingConsistencyRetryPolicy()
+	downgrading := policy.(ConsistencyRetryPolicy)
+
+	var tests = []struct {
+		msg         string
+		err         message.Error
+		retryCount  int
+		decision    RetryDecision
+		consistency primitive.ConsistencyLevel
+		downgraded  bool
+	}{
+		{"read timeout, not enough replicas",
+			&message.ReadTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 1, BlockFor: 2},
+			0, RetrySame, primitive.ConsistencyLevelOne, true},
+		{"read timeout, enough replicas without data",
+			&message.ReadTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 2, BlockFor: 2},
+			0, RetrySame, 0, false},
+		{"read timeout, enough replicas with data",
+			&message.ReadTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 2, BlockFor: 2, DataPresent: true},
+			0, ReturnError, 0, false},
+		{"read timeout, no replicas",
+			&message.ReadTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 0, BlockFor: 2},
+			0, ReturnError, 0, false},
+		{"read timeout, already retried",
+			&message.ReadTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 1, BlockFor: 2},
+			1, ReturnError, 0, false},
+		{"write timeout, unlogged batch",
+			&message.WriteTimeout{Consistency: primitive.ConsistencyLevelAll, Received: 2, BlockFor: 3, WriteType: primitive.WriteTypeUnloggedBatch},
+			0, RetrySame, primitive.ConsistencyLevelTwo, true},
+		{"write timeout, batch log",
+			&message.WriteTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 0, BlockFor: 2, WriteType: primitive.WriteTypeBatchLog},
+			0, RetrySame, 0, false},
+		{"write timeout, simple",
+			&message.WriteTimeout{Consistency: primitive.ConsistencyLevelQuorum, Received: 1, BlockFor: 2, WriteType: primitive.WriteTypeSimple},
+			0, ReturnError, 0, false},
+		{"unavailable",
+			&message.Unavailable{Consistency: primitive.ConsistencyLevelAll, Required: 5, Alive: 4},
+			0, RetrySame, primitive.ConsistencyLevelThree, true},
+		{"unavailable, each quorum",
+			&message.Unavailable{Consistency: primitive.ConsistencyLevelEachQuorum, Required: 2, Alive: 0},
+			0, RetrySame, primitive.ConsistencyLevelOne, true},
+		{"unavailable, serial",
+			&message.Unavailable{Consistency: primitive.ConsistencyLevelSerial, Required: 2, Alive: 1},
+			0, RetryNext, 0, false},
+		{"unavailable, no replicas",
+			&message.Unavailable{Consistency: primitive.ConsistencyLevelQuorum, Required: 2, Alive: 0},
+			0, ReturnError, 0, false},
+	}
+
+	for _, tt := range tests {
+		var decision RetryDecision
+		switch msg := tt.err.(type) {
+		case *message.ReadTimeout:
+			decision = policy.OnReadTimeout(msg, tt.retryCount)
+		case *message.WriteTimeout:
+			decision = policy.OnWriteTimeout(msg, tt.retryCount)
+		case *message.Unavailable:
+			decision = policy.OnUnavailable(msg, tt.retryCount)
+		}
+		assert.Equal(t, tt.decision, decision, tt.msg)
+		if decision != ReturnError {
+			consistency, downgraded := downgrading.RetryConsistency(tt.err)
+			assert.Equal(t, tt.downgraded, downgraded, tt.msg)
+			if tt.downgraded {
+				assert.Equal(t, tt.consistency, consistency, tt.msg)
+			}
+		}
+	}
+}
+
+func TestProxy_DowngradingConsistencyRetryPolicy(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	var received []primitive.ConsistencyLevel
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				consistency := frm.Body.Message.(*message.Query).Options.Consistency
+				mu.Lock()
+				received = append(received, consistency)
+				mu.Unlock()
+				if consistency == primitive.ConsistencyLevelQuorum {
+					return &message.Unavailable{ErrorMessage: "Unavailable", Consistency: consistency, Required: 2, Alive: 1}
+				}
+				return &message.VoidResult{}
+			},
+		},
+		retryPolicy: NewDowngradingConsistencyRetryPolicy(),
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{
+		Query:   "SELECT * FROM ks.t",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelQuorum},
+	}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.VoidResult{}, resp.Body.Message)
+	require.Len(t, resp.Body.Warnings, 1)
+	assert.Contains(t, resp.Body.Warnings[0], "ONE")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []primitive.ConsistencyLevel{primitive.ConsistencyLevelQuorum, primitive.ConsistencyLevelOne}, received)
+}
+
+func TestProxy_DowngradingConsistencyRetryPolicyWithMinimum(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	var received []primitive.ConsistencyLevel
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				consistency := frm.Body.Message.(*message.Query).Options.Consistency
+				mu.Lock()
+				received = append(received, consistency)
+				mu.Unlock()
+				if consistency == primitive.ConsistencyLevelQuorum {
+					return &message.Unavailable{ErrorMessage: "Unavailable", Consistency: consistency, Required: 2, Alive: 1}
+				}
+				return &message.VoidResult{}
+			},
+		},
+		retryPolicy:      NewDowngradingConsistencyRetryPolicy(),
+		consistencyRules: []ConsistencyRule{{Minimum: "LOCAL_QUORUM"}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	// The request isn't retried at ONE because it's weaker than the rule's minimum
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{
+		Query:   "SELECT * FROM ks.t",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelQuorum},
+	}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.Unavailable{}, resp.Body.Message)
+	assert.Empty(t, resp.Body.Warnings)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []primitive.ConsistencyLevel{primitive.ConsistencyLevelQuorum}, received)
+}
+
+func TestProxy_DowngradingConsistencyRetryPolicyWithMirror(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	var mirrored []primitive.ConsistencyLevel
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mirrorPort := generateTestPort()
+	mirrorCluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), mirrorPort)
+	mirrorCluster.Handlers = proxycore.NewMockRequestHandlers(proxycore.MockRequestHandlers{
+		primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+				return msg
+			}
+			mu.Lock()
+			mirrored = append(mirrored, frm.Body.Message.(*message.Query).Options.Consistency)
+			mu.Unlock()
+			return &message.VoidResult{}
+		},
+	})
+	require.NoError(t, mirrorCluster.Add(ctx, 1))
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				consistency := frm.Body.Message.(*message.Query).Options.Consistency
+				if consistency == primitive.ConsistencyLevelQuorum {
+					return &message.Unavailable{ErrorMessage: "Unavailable", Consistency: consistency, Required: 2, Alive: 1}
+				}
+				return &message.VoidResult{}
+			},
+		},
+		retryPolicy: NewDowngradingConsistencyRetryPolicy(),
+		mirror: &MirrorConfig{
+			Resolver: proxycore.NewResolverWithDefaultPort([]string{testAddr}, mirrorPort),
+		},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+		mirrorCluster.Shutdown()
+	}()
+	require.NoError(t, err)
+
+	require.True(t, waitUntil(10*time.Second, func() bool {
+		return tester.proxy.mirror.lb.NewQueryPlan().Next() != nil
+	}))
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{
+		Query:   "INSERT INTO ks.t (k, v) VALUES (1, 1)",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelQuorum},
+	}))
+	require.NoError(t, err)
+	require.Len(t, resp.Body.Warnings, 1)
+
+	// The mirror receives the client's consistency level, not the downgraded level of the retry
+	require.True(t, waitUntil(5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(mirrored) == 1
+	}))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, primitive.ConsistencyLevelQuorum, mirrored[0])
+}
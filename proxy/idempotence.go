@@ -0,0 +1,94 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"strings"
+
+	"github.com/datastax/cql-proxy/parser"
+	"go.uber.org/zap"
+)
+
+// idempotentPayloadKey is the custom payload key clients use to set the idempotence of a request. Its value is either a
+// single byte (non-zero is idempotent) or the string "true" or "false".
+const idempotentPayloadKey = "idempotent"
+
+// IdempotenceOverride forces the idempotence of a query. Queries are matched using their fingerprint, which ignores
+// leading comments, whitespace and a trailing semicolon.
+type IdempotenceOverride struct {
+	Query      string `yaml:"query"`
+	Idempotent bool   `yaml:"idempotent"`
+}
+
+func (p *Proxy) buildIdempotenceOverrides() {
+	if len(p.config.IdempotenceOverrides) == 0 {
+		return
+	}
+	p.idempotenceOverrides = make(map[string]bool)
+	for _, override := range p.config.IdempotenceOverrides {
+		p.idempotenceOverrides[parser.Fingerprint(override.Query)] = override.Idempotent
+	}
+}
+
+// idempotenceHint returns the idempotence of a request set by the client, using the custom payload or a comment in the
+// query, or by a configured override. The custom payload has precedence over the query's comment, which has precedence
+// over the overrides. It returns `notDetermined` if there's no hint.
+func (p *Proxy) idempotenceHint(customPayload map[string][]byte, query string) idempotentState {
+	if value, ok := customPayload[idempotentPayloadKey]; ok {
+		if state := parsePayloadIdempotence(value); state != notDetermined {
+			return state
+		}
+		p.logger.Debug("ignoring invalid idempotent custom payload value", zap.ByteString("value", value))
+	}
+	if len(query) == 0 {
+		return notDetermined
+	}
+	if idempotent, ok := parser.IdempotenceHint(query); ok {
+		return idempotentStateOf(idempotent)
+	}
+	if idempotent, ok := p.idempotenceOverrides[parser.Fingerprint(query)]; ok {
+		return idempotentStateOf(idempotent)
+	}
+	return notDetermined
+}
+
+// isPreparedIdempotent determines the idempotence of a query being prepared using the client's hints, the configured
+// overrides, or the query itself.
+func (p *Proxy) isPreparedIdempotent(customPayload map[string][]byte, query string) (bool, error) {
+	if state := p.idempotenceHint(customPayload, query); state != notDetermined {
+		return state == isIdempotent, nil
+	}
+	return parser.IsQueryIdempotent(query)
+}
+
+func parsePayloadIdempotence(value []byte) idempotentState {
+	if len(value) == 1 {
+		return idempotentStateOf(value[0] != 0)
+	}
+	switch strings.ToLower(string(value)) {
+	case "true":
+		return isIdempotent
+	case "false":
+		return notIdempotent
+	}
+	return notDetermined
+}
+
+func idempotentStateOf(idempotent bool) idempotentState {
+	if idempotent {
+		return isIdempotent
+	}
+	return notIdempotent
+}
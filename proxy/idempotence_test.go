@@ -0,0 +1,98 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestProxy_IdempotenceHint(t *testing.T) {
+	const counterUpdate = "UPDATE ks.counters SET c = c + 1 WHERE k = ?"
+
+	p := NewProxy(context.Background(), Config{
+		Logger:               zap.NewNop(),
+		IdempotenceOverrides: []IdempotenceOverride{{Query: counterUpdate, Idempotent: true}},
+	})
+	p.buildIdempotenceOverrides()
+
+	var tests = []struct {
+		name     string
+		payload  map[string][]byte
+		query    string
+		expected idempotentState
+	}{
+		{"no hint", nil, "SELECT * FROM ks.t", notDetermined},
+		{"payload true", map[string][]byte{"idempotent": []byte("true")}, "", isIdempotent},
+		{"payload false", map[string][]byte{"idempotent": []byte("FALSE")}, "", notIdempotent},
+		{"payload byte", map[string][]byte{"idempotent": {1}}, "", isIdempotent},
+		{"payload zero byte", map[string][]byte{"idempotent": {0}}, "", notIdempotent},
+		{"payload non-zero byte", map[string][]byte{"idempotent": {0x02}}, "", isIdempotent},
+		{"payload max byte", map[string][]byte{"idempotent": {0xFF}}, "", isIdempotent},
+		{"invalid payload", map[string][]byte{"idempotent": []byte("maybe")}, "", notDetermined},
+		{"comment", nil, "/* @idempotent */ INSERT INTO ks.t (k, v) VALUES (?, now())", isIdempotent},
+		{"line comment", nil, "-- @non-idempotent\nSELECT * FROM ks.t", notIdempotent},
+		{"override", nil, "  UPDATE ks.counters\n  SET c = c + 1 WHERE k = ?;", isIdempotent},
+		{"comment over override", nil, "/* @non-idempotent */ " + counterUpdate, notIdempotent},
+		{"payload over comment", map[string][]byte{"idempotent": []byte("true")}, "/* @non-idempotent */ SELECT * FROM ks.t", isIdempotent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, p.idempotenceHint(tt.payload, tt.query))
+		})
+	}
+}
+
+func TestProxy_PreparedIdempotenceHint(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		idempotenceOverrides: []IdempotenceOverride{{Query: "UPDATE ks.counters SET c = c + 1 WHERE k = ?", Idempotent: true}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	prepare := func(query string, payload map[string][]byte) []byte {
+		frm := frame.NewFrame(version, 0, &message.Prepare{Query: query})
+		frm.SetCustomPayload(payload)
+		resp, err := cl.SendAndReceive(ctx, frm)
+		require.NoError(t, err)
+		prepared, ok := resp.Body.Message.(*message.PreparedResult)
+		require.True(t, ok, "expected prepared result")
+		return prepared.PreparedQueryId
+	}
+
+	assert.False(t, tester.proxy.isIdempotent(prepare("INSERT INTO ks.t (k, v) VALUES (?, now())", nil)))
+	assert.True(t, tester.proxy.isIdempotent(prepare("/* @idempotent */ INSERT INTO ks.t (k, v) VALUES (?, now())", nil)))
+	assert.True(t, tester.proxy.isIdempotent(prepare("INSERT INTO ks.t (k, v) VALUES (?, uuid())",
+		map[string][]byte{idempotentPayloadKey: []byte("true")})))
+	assert.True(t, tester.proxy.isIdempotent(prepare("UPDATE ks.counters SET c = c + 1 WHERE k = ?", nil)))
+	assert.False(t, tester.proxy.isIdempotent(prepare("UPDATE ks.t SET v = ? WHERE k = ?",
+		map[string][]byte{idempotentPayloadKey: {0}})))
+}
@@ -0,0 +1,386 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMirrorQueueSize   = 10000
+	defaultMirrorMaxInflight = 1024
+)
+
+var errMirrorPreparedIdMismatch = errors.New("mirror returned unprepared after re-preparing, prepared IDs differ between clusters")
+
+// MirrorConfig configures a secondary cluster that receives a copy of the proxy's traffic. Mirrored requests are sent
+// asynchronously and their results are never returned to the client.
+type MirrorConfig struct {
+	Resolver proxycore.EndpointResolver
+	Auth     proxycore.Authenticator
+	// Reads enables mirroring of SELECT queries. Only writes are mirrored by default.
+	Reads bool
+	// QueueSize is the maximum number of requests waiting to be sent to the mirror. Requests are dropped when the queue
+	// is full.
+	QueueSize int
+	// MaxInflight is the maximum number of requests in-flight to the mirror at one time.
+	MaxInflight int
+	// CompareReads is the ratio of SELECT queries that are run against both clusters and whose results are compared.
+	// Mismatches are logged. Comparison is disabled if it's zero.
+	CompareReads float64
+	// CompareIgnoreOrder compares rows without regard to their order.
+	CompareIgnoreOrder bool
+}
+
+// MirrorStats are the mirror's counters. Latencies only include requests that received a response.
+type MirrorStats struct {
+	Sent         uint64  `json:"sent"`
+	Succeeded    uint64  `json:"succeeded"`
+	Failed       uint64  `json:"failed"`
+	Dropped      uint64  `json:"dropped"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+	MaxLatencyMs float64 `json:"maxLatencyMs"`
+	Compared     uint64  `json:"compared"`
+	Mismatches   uint64  `json:"mismatches"`
+}
+
+type mirrorSessionKey struct {
+	version  primitive.ProtocolVersion
+	keyspace string
+}
+
+type mirrorItem struct {
+	frm        *frame.Frame
+	keyspace   string
+	comparison *readComparison
+}
+
+type mirror struct {
+	ctx           context.Context
+	proxyConfig   Config
+	config        MirrorConfig
+	logger        *zap.Logger
+	cluster       *proxycore.Cluster
+	lb            proxycore.LoadBalancer
+	sessions      map[mirrorSessionKey]*proxycore.Session // Only accessed by the dispatch goroutine
+	preparedCache proxycore.PreparedCache
+	queue         chan *mirrorItem
+	inflight      chan struct{}
+	sent          uint64
+	succeeded     uint64
+	failed        uint64
+	dropped       uint64
+	latencyTotal  int64
+	latencyCount  uint64
+	latencyMax    int64
+	compared      uint64
+	mismatches    uint64
+}
+
+func newMirror(ctx context.Context, proxyConfig Config, logger *zap.Logger) (*mirror, error) {
+	config := *proxyConfig.Mirror
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultMirrorQueueSize
+	}
+	if config.MaxInflight <= 0 {
+		config.MaxInflight = defaultMirrorMaxInflight
+	}
+	preparedCache, err := NewDefaultPreparedCache(1e8 / 256)
+	if err != nil {
+		return nil, err
+	}
+	return &mirror{
+		ctx:           ctx,
+		proxyConfig:   proxyConfig,
+		config:        config,
+		logger:        logger.With(zap.String("component", "mirror")),
+		lb:            proxycore.NewRoundRobinLoadBalancer(),
+		sessions:      make(map[mirrorSessionKey]*proxycore.Session),
+		preparedCache: preparedCache,
+		queue:         make(chan *mirrorItem, config.QueueSize),
+		inflight:      make(chan struct{}, config.MaxInflight),
+	}, nil
+}
+
+// start connects to the mirror cluster and dispatches queued requests. The mirror never prevents the proxy from
+// starting; requests are dropped until the mirror cluster is connected.
+func (m *mirror) start() {
+	go func() {
+		if !m.connect() {
+			return
+		}
+		m.dispatch()
+	}()
+}
+
+func (m *mirror) connect() bool {
+	reconnectPolicy := m.proxyConfig.ReconnectPolicy.Clone()
+	for {
+		cluster, err := proxycore.ConnectCluster(m.ctx, proxycore.ClusterConfig{
+			Version:           m.proxyConfig.Version,
+			Auth:              m.config.Auth,
+			Resolver:          m.config.Resolver,
+			ReconnectPolicy:   m.proxyConfig.ReconnectPolicy,
+			HeartBeatInterval: m.proxyConfig.HeartBeatInterval,
+			ConnectTimeout:    m.proxyConfig.ConnectTimeout,
+			IdleTimeout:       m.proxyConfig.IdleTimeout,
+			Logger:            m.logger,
+		})
+		if err == nil {
+			if err = cluster.Listen(m.lb); err == nil {
+				m.cluster = cluster
+				return true
+			}
+		}
+		delay := reconnectPolicy.NextDelay()
+		m.logger.Error("unable to connect to mirror cluster, retrying after delay", zap.Error(err), zap.Duration("delay", delay))
+		select {
+		case <-m.ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (m *mirror) dispatch() {
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case item := <-m.queue:
+			session, err := m.findSession(item.frm.Header.Version, item.keyspace)
+			if err != nil {
+				m.logger.Debug("unable to create mirror session", zap.String("keyspace", item.keyspace), zap.Error(err))
+				atomic.AddUint64(&m.failed, 1)
+				continue
+			}
+			select {
+			case m.inflight <- struct{}{}:
+			case <-m.ctx.Done():
+				return
+			}
+			atomic.AddUint64(&m.sent, 1)
+			req := &mirrorRequest{
+				mirror:     m,
+				session:    session,
+				frm:        item.frm,
+				comparison: item.comparison,
+				qp:         m.lb.NewQueryPlan(),
+				start:      time.Now(),
+			}
+			req.Execute(true)
+		}
+	}
+}
+
+func (m *mirror) findSession(version primitive.ProtocolVersion, keyspace string) (*proxycore.Session, error) {
+	key := mirrorSessionKey{version: version, keyspace: keyspace}
+	if session, ok := m.sessions[key]; ok {
+		return session, nil
+	}
+	session, err := proxycore.ConnectSession(m.ctx, m.cluster, proxycore.SessionConfig{
+		ReconnectPolicy:   m.proxyConfig.ReconnectPolicy,
+		NumConns:          m.proxyConfig.NumConns,
+		Version:           version,
+		Auth:              m.config.Auth,
+		PreparedCache:     m.preparedCache,
+		Keyspace:          keyspace,
+		HeartBeatInterval: m.proxyConfig.HeartBeatInterval,
+		ConnectTimeout:    m.proxyConfig.ConnectTimeout,
+		IdleTimeout:       m.proxyConfig.IdleTimeout,
+		Logger:            m.logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.sessions[key] = session
+	return session, nil
+}
+
+// maybeMirror queues a copy of a client's QUERY, EXECUTE or BATCH request. SELECT queries are only mirrored if reads
+// are enabled or if they're sampled for comparison. It returns the comparison the request's result needs to be added
+// to, if any.
+func (c *client) maybeMirror(raw *frame.RawFrame, isSelect bool, body *frame.Body) *readComparison {
+	m := c.proxy.mirror
+	var cmp *readComparison
+	if isSelect && m.config.CompareReads > 0 && rand.Float64() < m.config.CompareReads {
+		cmp = c.newReadComparison(raw.Header.Version, body)
+	}
+	if m.enqueue(raw.Header.Version, c.keyspace, isSelect, body, cmp) {
+		return cmp
+	}
+	return nil
+}
+
+func (m *mirror) enqueue(version primitive.ProtocolVersion, keyspace string, isSelect bool, body *frame.Body, cmp *readComparison) bool {
+	switch body.Message.(type) {
+	case *codecs.PartialQuery, *codecs.PartialExecute, *codecs.PartialBatch:
+	default:
+		return false
+	}
+	if isSelect && !m.config.Reads && cmp == nil {
+		return false
+	}
+	// The mirror's connections don't use compression so a new uncompressed frame is created from the decoded body. The
+	// message is copied because the primary request can change it, e.g. to retry it at a lower consistency level.
+	frm := frame.NewFrame(version, 0, copyRequestMessage(body.Message))
+	if len(body.CustomPayload) > 0 {
+		frm.SetCustomPayload(body.CustomPayload)
+	}
+	select {
+	case m.queue <- &mirrorItem{frm: frm, keyspace: keyspace, comparison: cmp}:
+		return true
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		return false
+	}
+}
+
+// storePrepared adds a query prepared on the primary cluster to the mirror's prepared cache so that it can be
+// prepared on the mirror when the mirror responds with an unprepared error.
+func (m *mirror) storePrepared(id []byte, version primitive.ProtocolVersion, prepare *message.Prepare) {
+	raw, err := codecs.CustomRawCodec.ConvertToRawFrame(frame.NewFrame(version, 0, prepare))
+	if err != nil {
+		m.logger.Error("unable to encode prepare request for mirror", zap.Error(err))
+		return
+	}
+	m.preparedCache.Store(hex.EncodeToString(id), &proxycore.PreparedEntry{PreparedFrame: raw})
+}
+
+func (m *mirror) record(start time.Time, err error) {
+	<-m.inflight
+	if err != nil {
+		atomic.AddUint64(&m.failed, 1)
+		m.logger.Debug("mirrored request failed", zap.Error(err))
+	} else {
+		atomic.AddUint64(&m.succeeded, 1)
+	}
+	latency := int64(time.Since(start))
+	atomic.AddInt64(&m.latencyTotal, latency)
+	atomic.AddUint64(&m.latencyCount, 1)
+	for {
+		max := atomic.LoadInt64(&m.latencyMax)
+		if latency <= max || atomic.CompareAndSwapInt64(&m.latencyMax, max, latency) {
+			break
+		}
+	}
+}
+
+func (m *mirror) stats() MirrorStats {
+	stats := MirrorStats{
+		Sent:         atomic.LoadUint64(&m.sent),
+		Succeeded:    atomic.LoadUint64(&m.succeeded),
+		Failed:       atomic.LoadUint64(&m.failed),
+		Dropped:      atomic.LoadUint64(&m.dropped),
+		MaxLatencyMs: float64(atomic.LoadInt64(&m.latencyMax)) / float64(time.Millisecond),
+		Compared:     atomic.LoadUint64(&m.compared),
+		Mismatches:   atomic.LoadUint64(&m.mismatches),
+	}
+	if count := atomic.LoadUint64(&m.latencyCount); count > 0 {
+		stats.AvgLatencyMs = float64(atomic.LoadInt64(&m.latencyTotal)) / float64(count) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// mirrorRequest is a request sent to the mirror cluster. Unlike client requests it's never retried on error.
+type mirrorRequest struct {
+	mirror     *mirror
+	session    *proxycore.Session
+	frm        *frame.Frame
+	comparison *readComparison
+	qp         proxycore.QueryPlan
+	host       *proxycore.Host
+	start      time.Time
+	reprepared bool
+	done       bool
+	mu         sync.Mutex
+}
+
+func (r *mirrorRequest) Execute(next bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !next {
+		// Called after the query was prepared because of an unprepared error
+		if r.reprepared {
+			r.finish(errMirrorPreparedIdMismatch)
+			return
+		}
+		r.reprepared = true
+	}
+	for !r.done {
+		if next {
+			r.host = r.qp.Next()
+		}
+		if r.host == nil {
+			r.finish(errors.New("no more hosts available to try on mirror"))
+		} else if err := r.session.Send(r.host, r); err == nil {
+			break
+		} else {
+			next = true
+		}
+	}
+}
+
+func (r *mirrorRequest) Frame() interface{} {
+	return r.frm
+}
+
+func (r *mirrorRequest) IsPrepareRequest() bool {
+	return false
+}
+
+func (r *mirrorRequest) OnClose(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(err)
+}
+
+func (r *mirrorRequest) OnResult(raw *frame.RawFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if raw.Header.OpCode == primitive.OpCodeError {
+		err = errors.New("error response")
+		if frm, decodeErr := codecs.CustomRawCodec.ConvertFromRawFrame(raw); decodeErr == nil {
+			if msg, ok := frm.Body.Message.(message.Error); ok {
+				err = &proxycore.CqlError{Message: msg}
+			}
+		}
+	} else if r.comparison != nil && !r.done {
+		r.comparison.setSecondary(raw)
+	}
+	r.finish(err)
+}
+
+// lock before using
+func (r *mirrorRequest) finish(err error) {
+	if !r.done {
+		r.done = true
+		r.mirror.record(r.start, err)
+	}
+}
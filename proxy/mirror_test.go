@@ -0,0 +1,145 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Mirror(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	mirrored := make(map[string]int)
+	prepared := make(map[string]bool)
+
+	mirroredCount := func(query string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return mirrored[query]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mirrorPort := generateTestPort()
+	mirrorCluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), mirrorPort)
+	mirrorCluster.Handlers = proxycore.NewMockRequestHandlers(proxycore.MockRequestHandlers{
+		primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+				return msg
+			}
+			query := frm.Body.Message.(*message.Query).Query
+			mu.Lock()
+			mirrored[query]++
+			mu.Unlock()
+			if strings.Contains(query, "fail") {
+				return &message.Invalid{ErrorMessage: "mirror failure"}
+			}
+			return &message.VoidResult{}
+		},
+		primitive.OpCodePrepare: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			mu.Lock()
+			prepared[cl.Local().IP] = true
+			mu.Unlock()
+			return proxycore.MockDefaultPrepareHandler(cl, frm)
+		},
+		primitive.OpCodeExecute: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			ex := frm.Body.Message.(*message.Execute)
+			mu.Lock()
+			defer mu.Unlock()
+			if !prepared[cl.Local().IP] {
+				return &message.Unprepared{Id: ex.QueryId}
+			}
+			mirrored["execute"]++
+			return &message.VoidResult{}
+		},
+	})
+	require.NoError(t, mirrorCluster.Add(ctx, 1))
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				return &message.VoidResult{}
+			},
+		},
+		mirror: &MirrorConfig{
+			Resolver: proxycore.NewResolverWithDefaultPort([]string{testAddr}, mirrorPort),
+		},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+		mirrorCluster.Shutdown()
+	}()
+	require.NoError(t, err)
+
+	// Wait for the mirror to connect; requests are dropped until it's connected
+	require.True(t, waitUntil(10*time.Second, func() bool {
+		return tester.proxy.mirror.lb.NewQueryPlan().Next() != nil
+	}))
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	query := func(query string) {
+		resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: query}))
+		require.NoError(t, err)
+		assert.Equal(t, primitive.OpCodeResult, resp.Header.OpCode, "mirror errors should never be returned to the client")
+	}
+
+	query("INSERT INTO ks.t (k, v) VALUES (1, 1)")
+	query("INSERT INTO ks.fail (k, v) VALUES (1, 1)")
+	query("SELECT * FROM ks.t") // Reads aren't mirrored by default
+
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Prepare{Query: "INSERT INTO ks.t (k, v) VALUES (?, ?)"}))
+	require.NoError(t, err)
+	preparedResult, ok := resp.Body.Message.(*message.PreparedResult)
+	require.True(t, ok, "expected prepared result")
+
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Execute{QueryId: preparedResult.PreparedQueryId}))
+	require.NoError(t, err)
+	assert.Equal(t, primitive.OpCodeResult, resp.Header.OpCode)
+
+	assert.True(t, waitUntil(10*time.Second, func() bool {
+		stats, _ := tester.proxy.MirrorStats()
+		return stats.Succeeded+stats.Failed == 3
+	}))
+
+	assert.Equal(t, 1, mirroredCount("INSERT INTO ks.t (k, v) VALUES (1, 1)"))
+	assert.Equal(t, 1, mirroredCount("INSERT INTO ks.fail (k, v) VALUES (1, 1)"))
+	assert.Equal(t, 0, mirroredCount("SELECT * FROM ks.t"))
+	assert.Equal(t, 1, mirroredCount("execute"), "the mirror should prepare the query when it's unprepared")
+
+	stats, ok := tester.proxy.MirrorStats()
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), stats.Sent)
+	assert.Equal(t, uint64(2), stats.Succeeded)
+	assert.Equal(t, uint64(1), stats.Failed)
+	assert.Equal(t, uint64(0), stats.Dropped)
+}
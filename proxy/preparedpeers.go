@@ -0,0 +1,205 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"go.uber.org/zap"
+)
+
+const (
+	preparedPath               = "/prepared/"
+	defaultPreparedPeerTimeout = 500 * time.Millisecond
+	// preparedPeerMissTTL is how long a prepared ID that wasn't found on any peer is not looked up again
+	preparedPeerMissTTL = 30 * time.Second
+)
+
+// PreparedHandler returns an HTTP handler that serves the proxy's prepared statements to its peers. Statements are
+// requested using `GET /prepared/<hex encoded prepared ID>` with the `Config.PreparedSharingToken` as a bearer token.
+func (p *Proxy) PreparedHandler() http.Handler {
+	return http.HandlerFunc(p.servePrepared)
+}
+
+func (p *Proxy) servePrepared(writer http.ResponseWriter, request *http.Request) {
+	token := p.config.PreparedSharingToken
+	authorization := []byte(request.Header.Get("Authorization"))
+	if len(token) == 0 || subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) != 1 {
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := hex.DecodeString(strings.TrimPrefix(request.URL.Path, preparedPath))
+	if err != nil || len(id) != preparedIdSize {
+		http.Error(writer, "invalid prepared ID", http.StatusBadRequest)
+		return
+	}
+	val, ok := p.preparedMetadata.Load(preparedIdKey(id))
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	writeJSON(writer, val.(preparedMetadata).storeEntry(id))
+}
+
+// buildPreparedPeers creates the list of URLs used to fetch prepared statements from peers. The proxy's own entry in
+// `Peers` is skipped.
+func (p *Proxy) buildPreparedPeers() {
+	for _, peer := range p.config.Peers {
+		if len(peer.HttpAddr) == 0 || peer.RPCAddr == p.config.RPCAddr {
+			continue
+		}
+		url := strings.TrimSuffix(peer.HttpAddr, "/")
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			url = "http://" + url
+		}
+		p.preparedPeers = append(p.preparedPeers, url+preparedPath)
+	}
+	if len(p.preparedPeers) > 0 {
+		timeout := p.config.PreparedPeerTimeout
+		if timeout <= 0 {
+			timeout = defaultPreparedPeerTimeout
+		}
+		p.peerClient = &http.Client{Timeout: timeout}
+	}
+}
+
+// maybeFetchPrepared fetches prepared statements that the proxy has never seen from its peers, e.g. because the client
+// prepared them using a different proxy. This allows the proxy to re-prepare the statements and to determine whether
+// they're idempotent. It waits for the statements, at most the peer timeout, so that the request that needs them
+// doesn't fail with an unprepared error; slower lookups complete in the background and are used by later requests. A
+// statement that isn't found isn't looked up again for a while.
+func (p *Proxy) maybeFetchPrepared(ids ...[]byte) {
+	if len(p.preparedPeers) == 0 {
+		return
+	}
+	var lookups []chan struct{}
+	for _, id := range ids {
+		if lookup := p.startPeerLookup(id); lookup != nil {
+			lookups = append(lookups, lookup)
+		}
+	}
+	if len(lookups) == 0 {
+		return
+	}
+	timer := time.NewTimer(p.peerClient.Timeout)
+	defer timer.Stop()
+	for _, lookup := range lookups {
+		select {
+		case <-lookup:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// startPeerLookup fetches a prepared statement from the proxy's peers in the background, unless it's already known or
+// being fetched. It returns a channel that's closed once the lookup is done, or nil if the statement is known.
+func (p *Proxy) startPeerLookup(id []byte) chan struct{} {
+	key := preparedIdKey(id)
+	if _, ok := p.preparedMetadata.Load(key); ok {
+		return nil
+	}
+	done := make(chan struct{})
+	if lookup, loaded := p.peerLookups.LoadOrStore(key, done); loaded {
+		return lookup.(chan struct{}) // Already closed if the statement was recently not found
+	}
+	go func() {
+		found := p.fetchPreparedFromPeers(id)
+		close(done)
+		if found {
+			p.peerLookups.Delete(key)
+		} else {
+			time.AfterFunc(preparedPeerMissTTL, func() {
+				p.peerLookups.Delete(key)
+			})
+		}
+	}()
+	return done
+}
+
+// fetchPreparedFromPeers tries each peer until one returns the prepared statement. It returns true if it was found.
+func (p *Proxy) fetchPreparedFromPeers(id []byte) bool {
+	for _, url := range p.preparedPeers {
+		entry, err := p.fetchPrepared(url, id)
+		if err != nil {
+			p.logger.Debug("unable to fetch prepared statement from peer",
+				zap.String("url", url),
+				zap.String("preparedID", hex.EncodeToString(id)),
+				zap.Error(err))
+			continue
+		}
+		if _, err = p.restorePrepared(entry); err != nil {
+			p.logger.Warn("invalid prepared statement received from peer",
+				zap.String("url", url),
+				zap.String("preparedID", hex.EncodeToString(id)),
+				zap.Error(err))
+			continue
+		}
+		p.logger.Debug("fetched prepared statement from peer",
+			zap.String("url", url),
+			zap.String("preparedID", hex.EncodeToString(id)))
+		return true
+	}
+	return false
+}
+
+// maybeFetchBatchPrepared fetches the unknown prepared statements of a batch from the proxy's peers.
+func (p *Proxy) maybeFetchBatchPrepared(batch *codecs.PartialBatch) {
+	if len(p.preparedPeers) == 0 {
+		return
+	}
+	var ids [][]byte
+	for _, query := range batch.Queries {
+		if id, ok := query.QueryOrId.([]byte); ok {
+			ids = append(ids, id)
+		}
+	}
+	p.maybeFetchPrepared(ids...)
+}
+
+func (p *Proxy) fetchPrepared(url string, id []byte) (entry preparedStoreEntry, err error) {
+	encodedID := hex.EncodeToString(id)
+	request, err := http.NewRequest(http.MethodGet, url+encodedID, nil)
+	if err != nil {
+		return entry, err
+	}
+	request.Header.Set("Authorization", "Bearer "+p.config.PreparedSharingToken)
+	resp, err := p.peerClient.Do(request)
+	if err != nil {
+		return entry, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return entry, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		return entry, err
+	}
+	if entry.ID != encodedID {
+		return entry, fmt.Errorf("peer returned a different prepared ID '%s'", entry.ID)
+	}
+	return entry, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_FetchPreparedFromPeer(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+	const query = "UPDATE ks.t SET v = ? WHERE k = ?"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{preparedSharingToken: "secret"})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Prepare{Query: query}))
+	require.NoError(t, err)
+	prepared, ok := resp.Body.Message.(*message.PreparedResult)
+	require.True(t, ok, "expected prepared result")
+
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		tester.proxy.PreparedHandler().ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+
+	// Requests without the token are rejected
+	httpResp, err := http.Get(server.URL + preparedPath + hex.EncodeToString(prepared.PreparedQueryId))
+	require.NoError(t, err)
+	_ = httpResp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, httpResp.StatusCode)
+
+	config := tester.proxy.config
+	config.RPCAddr = "127.0.0.1"
+	config.Peers = []PeerConfig{
+		{RPCAddr: "127.0.0.1", HttpAddr: "127.0.0.1:1"}, // The proxy's own entry is skipped
+		{RPCAddr: "127.0.0.2", HttpAddr: server.URL},
+	}
+	peer := NewProxy(ctx, config)
+	require.NoError(t, peer.Connect())
+	defer func() { _ = peer.Close() }()
+	require.Len(t, peer.preparedPeers, 1)
+
+	// The request that needs the statement waits for it to be fetched
+	peer.maybeFetchPrepared(prepared.PreparedQueryId)
+	_, ok = peer.preparedMetadata.Load(preparedIdKey(prepared.PreparedQueryId))
+	assert.True(t, ok, "expected the prepared statement to be fetched")
+	assert.True(t, peer.isIdempotent(prepared.PreparedQueryId))
+	assert.Equal(t, query, peer.preparedQuery(prepared.PreparedQueryId))
+	_, ok = peer.preparedCache.Load(hex.EncodeToString(prepared.PreparedQueryId))
+	assert.True(t, ok, "expected the prepared statement to be in the prepared cache")
+
+	unknown := make([]byte, preparedIdSize)
+	atomic.StoreInt32(&lookups, 0)
+	peer.maybeFetchPrepared(unknown)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+	_, ok = peer.preparedMetadata.Load(preparedIdKey(unknown))
+	assert.False(t, ok, "unknown prepared statements should not be added")
+
+	// A statement that wasn't found isn't looked up again until the miss expires
+	peer.maybeFetchPrepared(unknown)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+}
+
+func TestProxy_FetchPreparedFromSlowPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, _, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-request.Context().Done():
+		}
+		http.NotFound(writer, request)
+	}))
+	defer server.Close()
+
+	config := tester.proxy.config
+	config.RPCAddr = "127.0.0.1"
+	config.Peers = []PeerConfig{{RPCAddr: "127.0.0.2", HttpAddr: server.URL}}
+	config.PreparedSharingToken = "secret"
+	config.PreparedPeerTimeout = 100 * time.Millisecond
+	peer := NewProxy(ctx, config)
+	require.NoError(t, peer.Connect())
+	defer func() { _ = peer.Close() }()
+
+	// Requests only wait for the peer timeout
+	start := time.Now()
+	peer.maybeFetchPrepared(make([]byte, preparedIdSize))
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,410 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	lru "github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPreparedStoreFlushInterval = 10 * time.Second
+	defaultPreparedStoreMaxEntries    = 100000
+)
+
+// preparedStoreEntry is a prepared statement persisted to disk. The statement's PREPARE frame is persisted so that its
+// flags and custom payload are restored, entries without a frame have it rebuilt from their query and keyspace. The
+// table keyspace is used for unqualified table names, it's either the PREPARE request's keyspace or the client's
+// keyspace.
+type preparedStoreEntry struct {
+	ID            string                    `json:"id"` // Hex encoded
+	Version       primitive.ProtocolVersion `json:"version"`
+	Query         string                    `json:"query"`
+	Keyspace      string                    `json:"keyspace,omitempty"` // The keyspace of the PREPARE request (protocol v5+)
+	TableKeyspace string                    `json:"table_keyspace,omitempty"`
+	Idempotent    bool                      `json:"idempotent"`
+	IsSelect      bool                      `json:"is_select"`
+	Backend       string                    `json:"backend,omitempty"`
+	Frame         string                    `json:"frame,omitempty"` // Base64 encoded, uncompressed PREPARE frame
+}
+
+// preparedStore persists prepared statements and their metadata to a file so that they survive a restart of the
+// proxy. Entries are added as statements are prepared and the file is rewritten periodically if there are changes.
+type preparedStore struct {
+	path    string
+	logger  *zap.Logger
+	entries *lru.Cache
+	dirty   bool
+	mu      sync.Mutex
+}
+
+func newPreparedStore(path string, maxEntries int, logger *zap.Logger) (*preparedStore, error) {
+	if maxEntries <= 0 {
+		maxEntries = defaultPreparedStoreMaxEntries
+	}
+	entries, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedStore{
+		path:    path,
+		logger:  logger,
+		entries: entries,
+	}, nil
+}
+
+// load reads the entries from the store's file. A missing file is not an error.
+func (s *preparedStore) load() ([]preparedStoreEntry, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []preparedStoreEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse prepared store '%s': %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		s.entries.Add(entry.ID, entry)
+	}
+	return entries, nil
+}
+
+func (s *preparedStore) add(entry preparedStoreEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if val, ok := s.entries.Get(entry.ID); ok && val.(preparedStoreEntry) == entry {
+		return
+	}
+	s.entries.Add(entry.ID, entry)
+	s.dirty = true
+}
+
+// flush writes the entries to the store's file if they've changed. The file is replaced atomically.
+func (s *preparedStore) flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	keys := s.entries.Keys() // Oldest to newest so that the most recent entries are kept when loaded
+	entries := make([]preparedStoreEntry, 0, len(keys))
+	for _, key := range keys {
+		if val, ok := s.entries.Peek(key); ok {
+			entries = append(entries, val.(preparedStoreEntry))
+		}
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *preparedStore) maybeFlush() {
+	if err := s.flush(); err != nil {
+		s.logger.Error("unable to write prepared store", zap.String("path", s.path), zap.Error(err))
+	}
+}
+
+// run periodically flushes the store until the proxy is closed.
+func (s *preparedStore) run(p *Proxy, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultPreparedStoreFlushInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.maybeFlush()
+			case <-p.closed:
+				return
+			case <-p.ctx.Done():
+				s.maybeFlush()
+				return
+			}
+		}
+	}()
+}
+
+// maybeLoadPreparedStore restores the prepared statements persisted by a previous run of the proxy and re-prepares
+// them on their backends.
+func (p *Proxy) maybeLoadPreparedStore() error {
+	if len(p.config.PreparedStorePath) == 0 {
+		return nil
+	}
+	store, err := newPreparedStore(p.config.PreparedStorePath, p.config.PreparedStoreMaxEntries, p.logger)
+	if err != nil {
+		return fmt.Errorf("unable to create prepared store %w", err)
+	}
+	entries, err := store.load()
+	if err != nil {
+		return err
+	}
+	p.preparedStore = store
+
+	var loaded []*reprepareRequest
+	for _, entry := range entries {
+		req, err := p.restorePrepared(entry)
+		if err != nil {
+			p.logger.Warn("ignoring invalid prepared store entry", zap.String("id", entry.ID), zap.Error(err))
+			continue
+		}
+		loaded = append(loaded, req)
+	}
+
+	p.logger.Info("loaded prepared statements from prepared store",
+		zap.String("path", store.path),
+		zap.Int("count", len(loaded)))
+
+	// Re-preparing can create sessions so it's done asynchronously to avoid delaying the proxy's startup.
+	go func() {
+		for _, req := range loaded {
+			req.start()
+		}
+	}()
+
+	store.run(p, p.config.PreparedStoreFlushInterval)
+	return nil
+}
+
+// restorePrepared adds a prepared statement persisted to disk, or received from a peer, to the prepared cache and the
+// prepared metadata. It returns a request that can be used to re-prepare the statement on its backend.
+func (p *Proxy) restorePrepared(entry preparedStoreEntry) (*reprepareRequest, error) {
+	id, err := hex.DecodeString(entry.ID)
+	if err != nil || len(id) != preparedIdSize {
+		return nil, fmt.Errorf("invalid prepared ID '%s'", entry.ID)
+	}
+	b := p.backendByName(entry.Backend)
+	if b == nil {
+		b = p.defaultBackend
+	}
+	raw, prepare, err := entry.prepareFrame()
+	if err != nil {
+		return nil, err
+	}
+	p.preparedCache.Store(entry.ID, &proxycore.PreparedEntry{PreparedFrame: raw})
+	if p.mirror != nil {
+		p.mirror.storePrepared(id, entry.Version, prepare)
+	}
+	p.preparedMetadata.Store(preparedIdKey(id), preparedMetadata{
+		idempotent:    entry.Idempotent,
+		isSelect:      entry.IsSelect,
+		tables:        findTables(entry.TableKeyspace, entry.Query),
+		query:         entry.Query,
+		backend:       b,
+		version:       entry.Version,
+		keyspace:      entry.Keyspace,
+		tableKeyspace: entry.TableKeyspace,
+	})
+	req := &reprepareRequest{
+		proxy:   p,
+		id:      id,
+		backend: b,
+		version: entry.Version,
+		frm:     raw,
+	}
+	if len(entry.TableKeyspace) > 0 && p.route(entry.TableKeyspace) == b {
+		req.keyspace = entry.TableKeyspace // Unqualified tables require a session using the keyspace
+	}
+	return req, nil
+}
+
+// prepareFrame decodes the entry's PREPARE frame, or rebuilds it from the entry's query and keyspace if the entry
+// doesn't have a frame.
+func (e preparedStoreEntry) prepareFrame() (*frame.RawFrame, *message.Prepare, error) {
+	if len(e.Frame) == 0 {
+		prepare := &message.Prepare{Query: e.Query}
+		if e.Version >= primitive.ProtocolVersion5 {
+			prepare.Keyspace = e.Keyspace
+		}
+		raw, err := codecs.CustomRawCodec.ConvertToRawFrame(frame.NewFrame(e.Version, 0, prepare))
+		return raw, prepare, err
+	}
+	data, err := base64.StdEncoding.DecodeString(e.Frame)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid prepare frame: %w", err)
+	}
+	raw, err := codecs.CustomRawCodec.DecodeRawFrame(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid prepare frame: %w", err)
+	}
+	frm, err := codecs.CustomRawCodec.ConvertFromRawFrame(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid prepare frame: %w", err)
+	}
+	prepare, ok := frm.Body.Message.(*message.Prepare)
+	if !ok || raw.Header.Version != e.Version {
+		return nil, nil, fmt.Errorf("invalid prepare frame: unexpected %v (version %v)", frm.Body.Message, raw.Header.Version)
+	}
+	return raw, prepare, nil
+}
+
+// encodePrepareFrame encodes a PREPARE frame for the prepared store. Compressed frames are decompressed using the
+// client's codec because restored statements are re-prepared using sessions without compression.
+func encodePrepareFrame(codec frame.RawCodec, raw *frame.RawFrame) (string, error) {
+	if raw.Header.Flags.Contains(primitive.HeaderFlagCompressed) {
+		frm, err := codec.ConvertFromRawFrame(raw)
+		if err != nil {
+			return "", err
+		}
+		header := *frm.Header
+		header.Flags = header.Flags.Remove(primitive.HeaderFlagCompressed)
+		if raw, err = codecs.CustomRawCodec.ConvertToRawFrame(&frame.Frame{Header: &header, Body: frm.Body}); err != nil {
+			return "", err
+		}
+	}
+	var buf bytes.Buffer
+	if err := codecs.CustomRawCodec.EncodeRawFrame(raw, &buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// storeEntry returns the prepared store entry for a prepared statement's metadata.
+func (m preparedMetadata) storeEntry(id []byte) preparedStoreEntry {
+	return preparedStoreEntry{
+		ID:            hex.EncodeToString(id),
+		Version:       m.version,
+		Query:         m.query,
+		Keyspace:      m.keyspace,
+		TableKeyspace: m.tableKeyspace,
+		Idempotent:    m.idempotent,
+		IsSelect:      m.isSelect,
+		Backend:       m.backend.name,
+		Frame:         m.frame,
+	}
+}
+
+// maybeStorePrepared adds a prepared statement to the prepared store, if enabled.
+func (p *Proxy) maybeStorePrepared(id []byte, metadata preparedMetadata) {
+	if p.preparedStore != nil {
+		p.preparedStore.add(metadata.storeEntry(id))
+	}
+}
+
+// reprepareRequest prepares a statement loaded from the prepared store on a single backend host. It's not retried;
+// hosts that didn't receive the statement prepare it on demand when they return an unprepared error.
+type reprepareRequest struct {
+	proxy    *Proxy
+	id       []byte
+	backend  *backend
+	version  primitive.ProtocolVersion
+	keyspace string
+	frm      *frame.RawFrame
+	done     bool
+	mu       sync.Mutex
+}
+
+func (r *reprepareRequest) start() {
+	sess, err := r.backend.findSession(r.version, r.keyspace, "")
+	if err != nil {
+		r.proxy.logger.Warn("unable to create session to re-prepare statement",
+			zap.String("id", hex.EncodeToString(r.id)), zap.Error(err))
+		return
+	}
+	host := r.backend.newQueryPlan().Next()
+	if host == nil {
+		r.proxy.logger.Warn("no hosts available to re-prepare statement", zap.String("id", hex.EncodeToString(r.id)))
+		return
+	}
+	if err = sess.Send(host, r); err != nil {
+		r.proxy.logger.Warn("unable to re-prepare statement",
+			zap.String("id", hex.EncodeToString(r.id)), zap.Error(err))
+	}
+}
+
+func (r *reprepareRequest) Execute(_ bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(errors.New("unexpected unprepared error"))
+}
+
+func (r *reprepareRequest) Frame() interface{} {
+	return r.frm
+}
+
+func (r *reprepareRequest) IsPrepareRequest() bool {
+	return true
+}
+
+func (r *reprepareRequest) OnClose(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(err)
+}
+
+func (r *reprepareRequest) OnResult(raw *frame.RawFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if frm, decodeErr := codecs.CustomRawCodec.ConvertFromRawFrame(raw); decodeErr != nil {
+		err = decodeErr
+	} else if result, ok := frm.Body.Message.(*message.PreparedResult); !ok {
+		err = fmt.Errorf("unexpected response %v", frm.Body.Message)
+	} else if !bytes.Equal(result.PreparedQueryId, r.id) {
+		err = fmt.Errorf("prepared ID changed to %s", hex.EncodeToString(result.PreparedQueryId))
+	}
+	r.finish(err)
+}
+
+// lock before using
+func (r *reprepareRequest) finish(err error) {
+	if !r.done {
+		r.done = true
+		if err != nil {
+			r.proxy.logger.Warn("unable to re-prepare statement from prepared store",
+				zap.String("id", hex.EncodeToString(r.id)), zap.Error(err))
+		} else {
+			r.proxy.logger.Debug("re-prepared statement from prepared store", zap.String("id", hex.EncodeToString(r.id)))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPreparedStore_FlushAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prepared.json")
+
+	store, err := newPreparedStore(path, 2, zap.NewNop())
+	require.NoError(t, err)
+
+	for _, id := range []string{"01", "02", "03"} {
+		store.add(preparedStoreEntry{ID: id, Version: primitive.ProtocolVersion4, Query: "SELECT * FROM ks.t" + id, IsSelect: true, Idempotent: true})
+	}
+	require.NoError(t, store.flush())
+
+	loaded, err := newPreparedStore(path, 2, zap.NewNop())
+	require.NoError(t, err)
+	entries, err := loaded.load()
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "the oldest entry should be evicted")
+	assert.Equal(t, "02", entries[0].ID)
+	assert.Equal(t, "03", entries[1].ID)
+	assert.Equal(t, "SELECT * FROM ks.t03", entries[1].Query)
+	assert.True(t, entries[1].IsSelect)
+	assert.True(t, entries[1].Idempotent)
+
+	missing, err := newPreparedStore(filepath.Join(t.TempDir(), "missing.json"), 2, zap.NewNop())
+	require.NoError(t, err)
+	entries, err = missing.load()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestProxy_PreparedStore(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+	const query = "INSERT INTO ks.t (k) VALUES (?)"
+
+	path := filepath.Join(t.TempDir(), "prepared.json")
+
+	var prepares int32
+	payloads := make(chan map[string][]byte, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodePrepare: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				atomic.AddInt32(&prepares, 1)
+				payloads <- frm.Body.CustomPayload
+				return proxycore.MockDefaultPrepareHandler(cl, frm)
+			},
+		},
+		preparedStorePath: path,
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	// The custom payload of the PREPARE request is persisted with the statement
+	payload := map[string][]byte{"k": []byte("v")}
+	prepare := frame.NewFrame(version, 0, &message.Prepare{Query: query})
+	prepare.SetCustomPayload(payload)
+	resp, err := cl.SendAndReceive(ctx, prepare)
+	require.NoError(t, err)
+	assert.Equal(t, payload, <-payloads)
+	prepared, ok := resp.Body.Message.(*message.PreparedResult)
+	require.True(t, ok, "expected prepared result")
+	require.Equal(t, int32(1), atomic.LoadInt32(&prepares))
+
+	// Closing the proxy writes the prepared store
+	require.NoError(t, tester.proxy.Close())
+
+	restarted := NewProxy(ctx, tester.proxy.config)
+	require.NoError(t, restarted.Connect())
+	defer func() { _ = restarted.Close() }()
+
+	assert.True(t, restarted.isIdempotent(prepared.PreparedQueryId))
+	assert.Equal(t, query, restarted.preparedQuery(prepared.PreparedQueryId))
+	_, ok = restarted.preparedCache.Load(hex.EncodeToString(prepared.PreparedQueryId))
+	assert.True(t, ok, "expected the prepared statement to be in the prepared cache")
+
+	assert.True(t, waitUntil(10*time.Second, func() bool {
+		return atomic.LoadInt32(&prepares) == 2
+	}), "expected the prepared statement to be re-prepared")
+	assert.Equal(t, payload, <-payloads)
+}
+
+func TestPreparedStoreEntry_PrepareFrame(t *testing.T) {
+	const query = "SELECT * FROM t"
+
+	// Entries written without a frame have it rebuilt from their query and keyspace
+	entry := preparedStoreEntry{Version: primitive.ProtocolVersion5, Query: query, Keyspace: "ks"}
+	raw, prepare, err := entry.prepareFrame()
+	require.NoError(t, err)
+	assert.Equal(t, primitive.ProtocolVersion5, raw.Header.Version)
+	assert.Equal(t, &message.Prepare{Query: query, Keyspace: "ks"}, prepare)
+
+	frm := frame.NewFrame(primitive.ProtocolVersion4, 0, &message.Prepare{Query: query})
+	frm.SetCustomPayload(map[string][]byte{"k": []byte("v")})
+	raw, err = codecs.CustomRawCodec.ConvertToRawFrame(frm)
+	require.NoError(t, err)
+	entry = preparedStoreEntry{Version: primitive.ProtocolVersion4, Query: query}
+	entry.Frame, err = encodePrepareFrame(codecs.CustomRawCodec, raw)
+	require.NoError(t, err)
+
+	restored, prepare, err := entry.prepareFrame()
+	require.NoError(t, err)
+	assert.Equal(t, raw, restored)
+	assert.Equal(t, &message.Prepare{Query: query}, prepare)
+
+	entry.Frame = "invalid"
+	_, _, err = entry.prepareFrame()
+	assert.Error(t, err)
+}
@@ -26,6 +26,7 @@ import (
 	"math"
 	"math/big"
 	"net"
+	"net/http"
 	"reflect"
 	"sort"
 	"strconv"
@@ -41,6 +42,8 @@ import (
 	"github.com/datastax/go-cassandra-native-protocol/message"
 	"github.com/datastax/go-cassandra-native-protocol/primitive"
 	lru "github.com/hashicorp/golang-lru"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -58,6 +61,9 @@ type PeerConfig struct {
 	RPCAddr string   `yaml:"rpc-address"`
 	DC      string   `yaml:"data-center,omitempty"`
 	Tokens  []string `yaml:"tokens,omitempty"`
+	// HttpAddr is the address of the peer's HTTP server. If set, prepared statements unknown to the proxy are fetched
+	// from the peer.
+	HttpAddr string `yaml:"http-address,omitempty"`
 }
 
 type Config struct {
@@ -82,6 +88,68 @@ type Config struct {
 	// PreparedCache a cache that stores prepared queries. If not set it uses the default implementation with a max
 	// capacity of ~100MB.
 	PreparedCache proxycore.PreparedCache
+	// MaxConns is the maximum number of connections per local host a pool grows to under sustained load. If it's
+	// less than or equal to NumConns pools have a fixed size.
+	MaxConns int
+	// RemoteNumConns and RemoteMaxConns are the pool sizes used for hosts outside the local data center. If not set,
+	// NumConns and MaxConns are used.
+	RemoteNumConns int
+	RemoteMaxConns int
+	// ConnScaleUpInflight is the average number of inflight requests per connection that causes a pool to grow.
+	ConnScaleUpInflight int32
+	// ConnScaleDownIdle is how long a pool needs to be idle before it shrinks.
+	ConnScaleDownIdle time.Duration
+	// ResultCacheTables are the tables whose SELECT results are cached. Result caching is disabled if empty.
+	ResultCacheTables []ResultCacheTable
+	// ResultCacheSize is the maximum number of results stored in the result cache.
+	ResultCacheSize int
+	// TracerProvider is used to create spans for client requests and backend attempts. If not set tracing is disabled.
+	TracerProvider trace.TracerProvider
+	// Mirror is a secondary cluster that receives a copy of client requests, e.g. to validate a migration. If not set
+	// mirroring is disabled.
+	Mirror *MirrorConfig
+	// Backends are additional backend clusters. The backend configured using Resolver and Auth is named "default".
+	Backends []BackendConfig
+	// Routes maps keyspaces to the name of the backend that stores them. Keyspaces without a route use the default
+	// backend.
+	Routes map[string]string
+	// KeyspaceRewrites rename keyspaces for clients. Keyspace names are rewritten in requests sent to the backend and
+	// in results and schema events sent back to the client.
+	KeyspaceRewrites []KeyspaceRewrite
+	// PreparedStorePath is the file used to persist prepared statements across restarts. Persisted statements are
+	// loaded and re-prepared on startup. The prepared store is disabled if not set.
+	PreparedStorePath string
+	// PreparedStoreFlushInterval is how often changes to the prepared store are written to its file.
+	PreparedStoreFlushInterval time.Duration
+	// PreparedStoreMaxEntries is the maximum number of prepared statements kept in the prepared store.
+	PreparedStoreMaxEntries int
+	// PrepareOnAllHosts sends new PREPARE requests to all hosts in the background and re-prepares cached statements on
+	// hosts that are added or come back up.
+	PrepareOnAllHosts bool
+	// ReprepareConcurrency is the maximum number of inflight requests used to re-prepare statements on a host.
+	ReprepareConcurrency int
+	// PreparedPeerTimeout is the timeout for fetching a prepared statement from a peer.
+	PreparedPeerTimeout time.Duration
+	// PreparedSharingToken is the shared secret that peers send to fetch prepared statements. The prepared handler
+	// rejects all requests if it's empty.
+	PreparedSharingToken string
+	// IdempotenceOverrides force the idempotence of specific queries.
+	IdempotenceOverrides []IdempotenceOverride
+	// ConsistencyRules map the consistency levels of requests.
+	ConsistencyRules []ConsistencyRule
+	// Capture records client requests, and the results of their responses, to a file so that they can be replayed. If
+	// not set capturing is disabled.
+	Capture *CaptureConfig
+	// ResolveInterval is the interval between re-resolving the backend clusters' endpoints, e.g. to refresh the Astra
+	// metadata if the SNI proxy address is rotated. Periodic re-resolution is disabled if it's zero.
+	ResolveInterval time.Duration
+	// FailoverDelay is how long a backend cluster needs to be unreachable before failing over to its resolver's
+	// alternative endpoints, e.g. the next region of a multi-region Astra database. The default is used if it's zero.
+	FailoverDelay time.Duration
+	// ProxyExecute requires clients to authenticate with a username and password, which are verified by the default
+	// backend, and executes their requests as their role using DSE proxy authorization. The backend connections are
+	// shared by all clients so the role is sent with each request, using the "ProxyExecute" custom payload.
+	ProxyExecute bool
 }
 
 type sessionKey struct {
@@ -91,45 +159,76 @@ type sessionKey struct {
 }
 
 type Proxy struct {
-	ctx               context.Context
-	config            Config
-	logger            *zap.Logger
-	cluster           *proxycore.Cluster
-	sessionsMu        *sync.RWMutex
-	sessions          map[sessionKey]*proxycore.Session // Cache sessions per protocol version, compression, keyspace
-	mu                *sync.Mutex
-	isConnected       bool
-	isClosing         bool
-	clients           map[*client]struct{}
-	listeners         map[*net.Listener]struct{}
-	eventClients      sync.Map
-	preparedCache     proxycore.PreparedCache
-	preparedMetadata  sync.Map
-	lb                proxycore.LoadBalancer
-	systemLocalValues map[string]message.Column
-	closed            chan struct{}
-	localNode         *node
-	nodes             []*node
-	onceUsingGraphLog sync.Once
+	ctx                  context.Context
+	config               Config
+	logger               *zap.Logger
+	cluster              *proxycore.Cluster // The default backend's cluster, used for the proxy's system tables
+	defaultBackend       *backend
+	backends             []*backend // All backends, starting with the default backend
+	routes               map[string]*backend
+	mu                   *sync.Mutex
+	isConnected          bool
+	isClosing            bool
+	clients              map[*client]struct{}
+	listeners            map[*net.Listener]struct{}
+	eventClients         sync.Map
+	preparedCache        proxycore.PreparedCache
+	preparedMetadata     sync.Map
+	systemLocalValues    map[string]message.Column
+	closed               chan struct{}
+	localNode            *node
+	nodes                []*node
+	onceUsingGraphLog    sync.Once
+	resultCache          *resultCache
+	tracer               trace.Tracer
+	mirror               *mirror
+	rewriteRules         []keyspaceRewriteRule
+	preparedStore        *preparedStore
+	preparedPeers        []string // URLs used to fetch prepared statements from peers
+	peerClient           *http.Client
+	peerLookups          sync.Map        // Prepared IDs being fetched from peers or recently not found -> chan closed when done
+	idempotenceOverrides map[string]bool // Query fingerprint -> idempotent
+	consistencyRules     []consistencyRule
+	capture              *capture
 }
 
 type preparedMetadata struct {
-	idempotent bool
-	isSelect   bool
+	idempotent    bool
+	isSelect      bool
+	tables        []tableKey
+	query         string
+	backend       *backend // The backend the query was prepared on
+	version       primitive.ProtocolVersion
+	keyspace      string // The keyspace of the PREPARE request (protocol v5+)
+	tableKeyspace string // The keyspace used for unqualified table names
+	frame         string // The encoded PREPARE frame, it's only set if the prepared store or sharing are enabled
 }
 
 type node struct {
 	addr   *net.IPAddr
-	dc     string
+	dc     string // Empty if the node is in the cluster's current local DC
 	tokens []string
 }
 
 func (p *Proxy) OnEvent(event proxycore.Event) {
 	switch evt := event.(type) {
 	case *proxycore.SchemaChangeEvent:
+		if p.resultCache != nil {
+			if evt.Message.Target == primitive.SchemaChangeTargetTable {
+				p.resultCache.invalidate(evt.Message.Keyspace, evt.Message.Object)
+			} else {
+				p.resultCache.invalidate(evt.Message.Keyspace, "")
+			}
+		}
 		frm := frame.NewFrame(p.cluster.NegotiatedVersion, -1, evt.Message)
 		p.eventClients.Range(func(key, _ interface{}) bool {
 			cl := key.(*client)
+			frm := frm
+			if cl.rewriter != nil {
+				if rewritten := cl.rewriter.rewriteEvent(evt.Message); rewritten != nil {
+					frm = frame.NewFrame(p.cluster.NegotiatedVersion, -1, rewritten)
+				}
+			}
 			err := cl.conn.Write(proxycore.SenderFunc(func(writer io.Writer) error {
 				return cl.codec.EncodeFrame(frm, writer)
 			}))
@@ -156,15 +255,14 @@ func NewProxy(ctx context.Context, config Config) *Proxy {
 		config.RetryPolicy = NewDefaultRetryPolicy()
 	}
 	return &Proxy{
-		ctx:        ctx,
-		config:     config,
-		logger:     proxycore.GetOrCreateNopLogger(config.Logger),
-		sessionsMu: &sync.RWMutex{},
-		sessions:   make(map[sessionKey]*proxycore.Session),
-		mu:         &sync.Mutex{},
-		clients:    make(map[*client]struct{}),
-		listeners:  make(map[*net.Listener]struct{}),
-		closed:     make(chan struct{}),
+		ctx:       ctx,
+		config:    config,
+		logger:    proxycore.GetOrCreateNopLogger(config.Logger),
+		mu:        &sync.Mutex{},
+		clients:   make(map[*client]struct{}),
+		listeners: make(map[*net.Listener]struct{}),
+		closed:    make(chan struct{}),
+		tracer:    getOrCreateNoopTracerProvider(config.TracerProvider).Tracer(tracerName),
 	}
 }
 
@@ -182,26 +280,53 @@ func (p *Proxy) Connect() error {
 		return fmt.Errorf("unable to create prepared cache %w", err)
 	}
 
-	p.cluster, err = proxycore.ConnectCluster(p.ctx, proxycore.ClusterConfig{
-		Version:           p.config.Version,
-		Auth:              p.config.Auth,
-		Resolver:          p.config.Resolver,
-		ReconnectPolicy:   p.config.ReconnectPolicy,
-		HeartBeatInterval: p.config.HeartBeatInterval,
-		ConnectTimeout:    p.config.ConnectTimeout,
-		IdleTimeout:       p.config.IdleTimeout,
-		Logger:            p.logger,
+	if len(p.config.ResultCacheTables) > 0 {
+		p.resultCache, err = newResultCache(p.config.ResultCacheSize, p.config.ResultCacheTables)
+		if err != nil {
+			return fmt.Errorf("unable to create result cache %w", err)
+		}
+	}
+
+	p.defaultBackend = newBackend(p, BackendConfig{
+		Name:     defaultBackendName,
+		Resolver: p.config.Resolver,
+		Auth:     p.config.Auth,
 	})
+	p.backends = []*backend{p.defaultBackend}
+	for _, config := range p.config.Backends {
+		p.backends = append(p.backends, newBackend(p, config))
+	}
 
+	err = p.buildRoutes()
 	if err != nil {
-		return fmt.Errorf("unable to connect to cluster %w", err)
+		return err
+	}
+
+	p.rewriteRules, err = newKeyspaceRewriteRules(p.config.KeyspaceRewrites)
+	if err != nil {
+		return err
 	}
 
-	err = p.cluster.Listen(p)
+	p.buildIdempotenceOverrides()
+
+	p.consistencyRules, err = newConsistencyRules(p.config.ConsistencyRules)
 	if err != nil {
-		return fmt.Errorf("unable to register to listen for schema events %w", err)
+		return err
 	}
 
+	if p.config.Capture != nil {
+		p.capture, err = newCapture(*p.config.Capture, p.logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.defaultBackend.connect()
+	if err != nil {
+		return err
+	}
+	p.cluster = p.defaultBackend.cluster
+
 	err = p.buildNodes()
 	if err != nil {
 		return fmt.Errorf("unable to build node information: %w", err)
@@ -209,37 +334,57 @@ func (p *Proxy) Connect() error {
 
 	p.buildLocalRow()
 
-	p.lb = proxycore.NewRoundRobinLoadBalancer()
-	err = p.cluster.Listen(p.lb)
-	if err != nil {
-		return err
+	for _, b := range p.backends[1:] {
+		err = b.connect()
+		if err != nil {
+			return fmt.Errorf("unable to connect to backend '%s': %w", b.name, err)
+		}
 	}
 
-	sess, err := proxycore.ConnectSession(p.ctx, p.cluster, proxycore.SessionConfig{
-		ReconnectPolicy:   p.config.ReconnectPolicy,
-		NumConns:          p.config.NumConns,
-		Version:           p.cluster.NegotiatedVersion,
-		Auth:              p.config.Auth,
-		HeartBeatInterval: p.config.HeartBeatInterval,
-		ConnectTimeout:    p.config.ConnectTimeout,
-		IdleTimeout:       p.config.IdleTimeout,
-		PreparedCache:     p.preparedCache,
-		Logger:            p.logger,
-	})
+	if p.config.Mirror != nil {
+		p.mirror, err = newMirror(p.ctx, p.config, p.logger)
+		if err != nil {
+			return fmt.Errorf("unable to create mirror %w", err)
+		}
+		p.mirror.start()
+	}
 
+	err = p.maybeLoadPreparedStore()
 	if err != nil {
-		return fmt.Errorf("unable to connect session %w", err)
+		return err
 	}
 
-	p.sessions[sessionKey{version: p.cluster.NegotiatedVersion}] = sess // No keyspace/compression
+	p.buildPreparedPeers()
 
 	p.isConnected = true
 	return nil
 }
 
+// ListenerOptions are the options of a single listener served by the proxy.
+type ListenerOptions struct {
+	// RPCAddr is the address advertised in the "system.local" table to the listener's clients. The proxy's RPC address
+	// is used if not set.
+	RPCAddr string
+}
+
 // Serve the proxy using the specified listener. It can be called multiple times with different listeners allowing
 // them to share the same backend clusters.
 func (p *Proxy) Serve(l net.Listener) (err error) {
+	return p.ServeWithOptions(l, ListenerOptions{})
+}
+
+// ServeWithOptions serves the proxy using the specified listener and listener specific options. Like Serve, it can be
+// called multiple times with different listeners.
+func (p *Proxy) ServeWithOptions(l net.Listener, options ListenerOptions) (err error) {
+	var rpcAddr *net.IPAddr
+	if len(options.RPCAddr) > 0 {
+		rpcAddr, err = net.ResolveIPAddr("ip", options.RPCAddr)
+		if err != nil {
+			_ = l.Close()
+			return fmt.Errorf("invalid listener RPC address: %w", err)
+		}
+	}
+
 	l = &closeOnceListener{Listener: l}
 	defer l.Close()
 
@@ -258,7 +403,7 @@ func (p *Proxy) Serve(l net.Listener) (err error) {
 				return err
 			}
 		}
-		p.handle(conn)
+		p.handle(conn, rpcAddr)
 	}
 }
 
@@ -300,6 +445,12 @@ func (p *Proxy) Close() error {
 		p.eventClients.Delete(cl)
 		delete(p.clients, cl)
 	}
+	if p.preparedStore != nil {
+		p.preparedStore.maybeFlush()
+	}
+	if p.capture != nil {
+		p.capture.stop()
+	}
 	return err
 }
 
@@ -311,8 +462,12 @@ func (p *Proxy) OutageDuration() time.Duration {
 	return p.cluster.OutageDuration()
 }
 
-func (p *Proxy) handle(conn net.Conn) {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
+func (p *Proxy) handle(conn net.Conn, rpcAddr *net.IPAddr) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if ppConn, isProxyProtocol := conn.(*proxyProtocolConn); isProxyProtocol {
+		tcpConn, ok = ppConn.NetConn().(*net.TCPConn)
+	}
+	if ok {
 		if err := tcpConn.SetKeepAlive(false); err != nil {
 			p.logger.Warn("failed to disable keepalive on connection", zap.Error(err))
 		}
@@ -324,85 +479,75 @@ func (p *Proxy) handle(conn net.Conn) {
 	cl := &client{
 		ctx:                 p.ctx,
 		proxy:               p,
+		rpcAddr:             rpcAddr,
 		preparedSystemQuery: make(map[[preparedIdSize]byte]interface{}),
 		codec:               codecs.CustomRawCodec,
+		rewriter:            p.newKeyspaceRewriter(conn.RemoteAddr()),
+		consistencyRules:    p.clientConsistencyRules(conn.RemoteAddr()),
+		captured:            p.capture != nil && p.capture.isCaptured(conn.RemoteAddr()),
 	}
 	p.addClient(cl)
 	cl.conn = proxycore.NewConn(conn, cl)
 	cl.conn.Start()
 }
 
-func (p *Proxy) maybeCreateSession(version primitive.ProtocolVersion, keyspace, compression string) (*proxycore.Session, error) {
-	p.sessionsMu.RLock()
-	defer p.sessionsMu.RUnlock()
-	return p.maybeCreateSessionUnlocked(version, keyspace, compression)
-}
+var (
+	schemaVersion, _ = primitive.ParseUuid("4f2b29e6-59b5-4e2d-8fd6-01e32e67f0d7")
+)
 
-func (p *Proxy) findSession(version primitive.ProtocolVersion, keyspace, compression string) (*proxycore.Session, error) {
-	p.sessionsMu.RLock()
-	defer p.sessionsMu.RUnlock()
-	key := sessionKey{version: version, keyspace: keyspace, compression: compression}
-	if s, ok := p.sessions[key]; ok {
-		return s, nil
-	} else {
-		return p.maybeCreateSessionUnlocked(version, keyspace, compression)
+// validatePeers checks the configuration of the peer proxies. Peers require the proxy's RPC address and, if the proxy's
+// tokens are provided, their own tokens. Peers with the proxy's RPC address are ignored.
+func validatePeers(rpcAddr string, tokens []string, peers []PeerConfig) error {
+	var localAddr *net.IPAddr
+	if len(rpcAddr) > 0 {
+		var err error
+		localAddr, err = net.ResolveIPAddr("ip", rpcAddr)
+		if err != nil {
+			return fmt.Errorf("invalid RPC address: %w", err)
+		}
+	} else if len(peers) > 0 {
+		return errors.New("peers provided, but RPC address is not set")
 	}
-}
 
-func (p *Proxy) maybeCreateSessionUnlocked(version primitive.ProtocolVersion, keyspace, compression string) (*proxycore.Session, error) {
-	key := sessionKey{version: version, keyspace: keyspace, compression: compression}
-	if cachedSession, ok := p.sessions[key]; ok {
-		return cachedSession, nil
-	} else {
-		sess, err := proxycore.ConnectSession(p.ctx, p.cluster, proxycore.SessionConfig{
-			ReconnectPolicy:   p.config.ReconnectPolicy,
-			NumConns:          p.config.NumConns,
-			Version:           version,
-			Auth:              p.config.Auth,
-			PreparedCache:     p.preparedCache,
-			Keyspace:          keyspace,
-			HeartBeatInterval: p.config.HeartBeatInterval,
-			ConnectTimeout:    p.config.ConnectTimeout,
-			IdleTimeout:       p.config.IdleTimeout,
-			Logger:            p.logger,
-			Compression:       compression,
-		})
+	for i, peer := range peers {
+		if len(peer.RPCAddr) == 0 {
+			return fmt.Errorf("no 'rpc-address' provided for peer #%d", i+1)
+		}
+		addr, err := net.ResolveIPAddr("ip", peer.RPCAddr)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("invalid peer address: %w", err)
+		}
+		if compareIPAddr(localAddr, addr) == 0 {
+			continue
+		}
+		if len(tokens) > 0 && len(peer.Tokens) == 0 {
+			return errors.New("tokens must be provided for all peer proxies if tokens are provided for this proxy")
 		}
-
-		p.sessions[key] = sess
-		return sess, nil
 	}
+	return nil
 }
 
-func (p *Proxy) newQueryPlan() proxycore.QueryPlan {
-	return p.lb.NewQueryPlan()
-}
-
-var (
-	schemaVersion, _ = primitive.ParseUuid("4f2b29e6-59b5-4e2d-8fd6-01e32e67f0d7")
-)
-
 func (p *Proxy) buildNodes() (err error) {
 	numPeers := len(p.config.Peers)
 	nodes := make([]*node, 0, numPeers+1)
 
+	if err = validatePeers(p.config.RPCAddr, p.config.Tokens, p.config.Peers); err != nil {
+		return err
+	}
+
 	var localAddr *net.IPAddr
 	if len(p.config.RPCAddr) > 0 {
 		localAddr, err = net.ResolveIPAddr("ip", p.config.RPCAddr)
 		if err != nil {
 			return fmt.Errorf("invalid RPC address: %w", err)
 		}
-	} else if numPeers > 0 {
-		return errors.New("peers provided, but RPC address is not set")
 	}
 
+	// Nodes without a DC use the cluster's current local DC, so that it changes when the cluster fails over or back
 	localDC := p.config.DC
 	if len(localDC) == 0 {
-		localDC = p.cluster.Info.LocalDC
-		p.logger.Info("no local DC configured using DC from the first successful contact point",
-			zap.String("dc", localDC))
+		p.logger.Info("no local DC configured using DC from the cluster's control connection",
+			zap.String("dc", p.cluster.LocalDC()))
 	}
 
 	var localTokens []string
@@ -421,10 +566,7 @@ func (p *Proxy) buildNodes() (err error) {
 	}
 	nodes = append(nodes, p.localNode)
 
-	for i, peer := range p.config.Peers {
-		if len(peer.RPCAddr) == 0 {
-			return fmt.Errorf("no 'rpc-address' provided for peer #%d", i+1)
-		}
+	for _, peer := range p.config.Peers {
 		addr, err := net.ResolveIPAddr("ip", peer.RPCAddr)
 		if err != nil {
 			return fmt.Errorf("invalid peer address: %w", err)
@@ -437,9 +579,6 @@ func (p *Proxy) buildNodes() (err error) {
 		if len(dc) == 0 {
 			dc = localDC
 		}
-		if !calculateTokens && len(peer.Tokens) == 0 {
-			return errors.New("tokens must be provided for all peer proxies if tokens are provided for this proxy")
-		}
 		nodes = append(nodes, &node{
 			addr:   addr,
 			dc:     dc,
@@ -473,7 +612,6 @@ func (p *Proxy) buildNodes() (err error) {
 func (p *Proxy) buildLocalRow() {
 	p.systemLocalValues = map[string]message.Column{
 		"key":                     p.encodeTypeFatal(datatype.Varchar, "local"),
-		"data_center":             p.encodeTypeFatal(datatype.Varchar, p.localNode.dc),
 		"rack":                    p.encodeTypeFatal(datatype.Varchar, "rack1"),
 		"tokens":                  p.encodeTypeFatal(datatype.NewList(datatype.Varchar), p.localNode.tokens),
 		"release_version":         p.encodeTypeFatal(datatype.Varchar, p.cluster.Info.ReleaseVersion),
@@ -486,6 +624,15 @@ func (p *Proxy) buildLocalRow() {
 	}
 }
 
+// nodeDC returns the data center of a node. Nodes without a configured data center are in the cluster's current local
+// data center.
+func (p *Proxy) nodeDC(n *node) string {
+	if len(n.dc) > 0 {
+		return n.dc
+	}
+	return p.cluster.LocalDC()
+}
+
 func (p *Proxy) encodeTypeFatal(dt datatype.DataType, val interface{}) []byte {
 	encoded, err := codecs.EncodeType(dt, p.cluster.NegotiatedVersion, val)
 	if err != nil {
@@ -507,6 +654,36 @@ func (p *Proxy) isIdempotent(id []byte) bool {
 	}
 }
 
+// ResultCacheStats returns the result cache's counters. The second return value is false if result caching is disabled.
+func (p *Proxy) ResultCacheStats() (ResultCacheStats, bool) {
+	if p.resultCache == nil {
+		return ResultCacheStats{}, false
+	}
+	return p.resultCache.stats(), true
+}
+
+// MirrorStats returns the mirror's counters. The second return value is false if mirroring is disabled.
+func (p *Proxy) MirrorStats() (MirrorStats, bool) {
+	if p.mirror == nil {
+		return MirrorStats{}, false
+	}
+	return p.mirror.stats(), true
+}
+
+func (p *Proxy) preparedTables(id []byte) []tableKey {
+	if val, ok := p.preparedMetadata.Load(preparedIdKey(id)); ok {
+		return val.(preparedMetadata).tables
+	}
+	return nil
+}
+
+func (p *Proxy) preparedQuery(id []byte) string {
+	if val, ok := p.preparedMetadata.Load(preparedIdKey(id)); ok {
+		return val.(preparedMetadata).query
+	}
+	return ""
+}
+
 func (p *Proxy) isSelect(id [16]byte) bool {
 	if val, ok := p.preparedMetadata.Load(id); !ok {
 		// This should only happen if the proxy has never had a "PREPARE" request for this query ID.
@@ -546,12 +723,17 @@ func (p *Proxy) removeClient(cl *client) {
 type client struct {
 	ctx                 context.Context
 	proxy               *Proxy
+	rpcAddr             *net.IPAddr // The listener's advertised RPC address, nil if not configured
 	conn                *proxycore.Conn
 	keyspace            string
 	compression         string
 	preparedSystemQuery map[[16]byte]interface{}
 	preparedSelectQuery map[[16]byte]interface{}
 	codec               frame.RawCodec
+	rewriter            *keyspaceRewriter // Rewrites keyspace names for the client, nil if not configured
+	consistencyRules    []consistencyRule // The consistency rules that apply to the client's address
+	captured            bool              // The client's requests are captured
+	role                string            // The role the client's requests are executed as, empty if not authenticated
 }
 
 func (c *client) Receive(reader io.Reader) error {
@@ -563,7 +745,11 @@ func (c *client) Receive(reader io.Reader) error {
 		return err
 	}
 
-	if raw.Header.Version > c.proxy.config.MaxVersion || raw.Header.Version < primitive.ProtocolVersion3 {
+	minVersion := primitive.ProtocolVersion3
+	if c.proxy.config.ProxyExecute {
+		minVersion = primitive.ProtocolVersion4 // Custom payloads were added in protocol v4
+	}
+	if raw.Header.Version > c.proxy.config.MaxVersion || raw.Header.Version < minVersion {
 		c.send(raw.Header, &message.ProtocolError{
 			ErrorMessage: fmt.Sprintf("Invalid or unsupported protocol version %d", raw.Header.Version),
 		})
@@ -576,6 +762,27 @@ func (c *client) Receive(reader io.Reader) error {
 		return err
 	}
 
+	if c.requiresAuthentication(body.Message) {
+		c.send(raw.Header, &message.Unauthorized{ErrorMessage: "You have not logged in"})
+		return nil
+	}
+
+	raw, err = c.maybeRewriteRequest(raw, body)
+	if err != nil {
+		c.proxy.logger.Error("unable to encode request with rewritten keyspaces", zap.Error(err))
+		return err
+	} else if raw == nil { // The request was rejected
+		return nil
+	}
+
+	raw, err = c.maybeAddProxyExecute(raw, body)
+	if err != nil {
+		c.proxy.logger.Error("unable to encode request with proxy execute payload", zap.Error(err))
+		return err
+	}
+
+	c.maybeCaptureRequest(raw, body)
+
 	switch msg := body.Message.(type) {
 	case *message.Options:
 		c.send(raw.Header, &message.Supported{Options: map[string][]string{
@@ -594,7 +801,17 @@ func (c *client) Receive(reader io.Reader) error {
 				c.send(raw.Header, &message.ProtocolError{ErrorMessage: errMsg})
 			}
 		}
-		c.send(raw.Header, &message.Ready{})
+		if c.proxy.config.ProxyExecute {
+			c.send(raw.Header, &message.Authenticate{Authenticator: clientAuthenticator})
+		} else {
+			c.send(raw.Header, &message.Ready{})
+		}
+	case *message.AuthResponse:
+		if c.proxy.config.ProxyExecute {
+			c.handleAuthResponse(raw, msg)
+		} else {
+			c.send(raw.Header, &message.ProtocolError{ErrorMessage: "Unexpected AUTH_RESPONSE, authentication isn't required"})
+		}
 	case *message.Register:
 		for _, t := range msg.EventTypes {
 			if t == primitive.EventTypeSchemaChange {
@@ -603,13 +820,14 @@ func (c *client) Receive(reader io.Reader) error {
 		}
 		c.send(raw.Header, &message.Ready{})
 	case *message.Prepare:
-		c.handlePrepare(raw, msg, body)
+		c.handlePrepare(raw, msg, body, c.startSpan(raw, body))
 	case *codecs.PartialExecute:
-		c.handleExecute(raw, msg, body)
+		c.handleExecute(raw, msg, body, c.startSpan(raw, body))
 	case *codecs.PartialQuery:
-		c.handleQuery(raw, msg, body)
+		c.handleQuery(raw, msg, body, c.startSpan(raw, body))
 	case *codecs.PartialBatch:
-		c.execute(raw, notDetermined, false, c.keyspace, body)
+		c.proxy.maybeFetchBatchPrepared(msg)
+		c.execute(raw, c.proxy.idempotenceHint(body.CustomPayload, ""), false, c.keyspace, body, c.startSpan(raw, body))
 	default:
 		c.send(raw.Header, &message.ProtocolError{ErrorMessage: "Unsupported operation"})
 	}
@@ -617,28 +835,54 @@ func (c *client) Receive(reader io.Reader) error {
 	return nil
 }
 
-func (c *client) execute(raw *frame.RawFrame, state idempotentState, isSelect bool, keyspace string, body *frame.Body) {
-	if sess, err := c.proxy.findSession(raw.Header.Version, c.keyspace, c.compression); err == nil {
+func (c *client) execute(raw *frame.RawFrame, state idempotentState, isSelect bool, keyspace string, body *frame.Body, span trace.Span) {
+	if c.maybeFanOutSchemaQuery(raw, body, span) {
+		return
+	}
+	b, err := c.findBackend(body)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		c.send(raw.Header, &message.Invalid{ErrorMessage: err.Error()})
+		return
+	}
+	if sess, err := b.findSession(raw.Header.Version, c.sessionKeyspace(b), c.compression); err == nil {
+		rule := c.findConsistencyRule(body)
 		req := &request{
 			client:   c,
+			backend:  b,
 			session:  sess,
 			state:    state,
 			msg:      body.Message,
+			payload:  body.CustomPayload,
 			keyspace: keyspace,
 			done:     false,
 			stream:   raw.Header.StreamId,
 			version:  raw.Header.Version,
-			qp:       c.proxy.newQueryPlan(),
-			frm:      c.maybeOverrideUnsupportedWriteConsistency(isSelect, raw, body),
+			qp:       b.newQueryPlan(),
+			frm:      c.maybeOverrideConsistency(rule, isSelect, raw, body),
 			isSelect: isSelect,
+			span:     span,
+			rule:     rule,
+		}
+		if c.proxy.resultCache != nil && c.maybeUseResultCache(req, raw, body) {
+			span.AddEvent("result cache hit")
+			span.End()
+			return
+		}
+		// Results from the cache aren't mirrored because there's no primary result to compare with the mirror's
+		if c.proxy.mirror != nil {
+			req.comparison = c.maybeMirror(raw, isSelect, body)
 		}
 		req.Execute(true)
 	} else {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
 		c.send(raw.Header, &message.ServerError{ErrorMessage: "Attempted to use invalid keyspace"})
 	}
 }
 
-func (c *client) handlePrepare(raw *frame.RawFrame, msg *message.Prepare, body *frame.Body) {
+func (c *client) handlePrepare(raw *frame.RawFrame, msg *message.Prepare, body *frame.Body, span trace.Span) {
 	c.proxy.logger.Debug("handling prepare", zap.String("query", msg.Query), zap.Int16("stream", raw.Header.StreamId))
 
 	keyspace := c.keyspace
@@ -648,6 +892,7 @@ func (c *client) handlePrepare(raw *frame.RawFrame, msg *message.Prepare, body *
 	handled, stmt, err := parser.IsQueryHandled(parser.IdentifierFromString(keyspace), msg.Query)
 
 	if handled {
+		defer span.End()
 		hdr := raw.Header
 
 		if err != nil {
@@ -686,23 +931,26 @@ func (c *client) handlePrepare(raw *frame.RawFrame, msg *message.Prepare, body *
 
 	} else {
 		_, isSelect := stmt.(*parser.SelectStatement)
-		c.execute(raw, isIdempotent, isSelect, keyspace, body) // Prepared statements can be retried themselves
+		c.execute(raw, isIdempotent, isSelect, keyspace, body, span) // Prepared statements can be retried themselves
 	}
 }
 
-func (c *client) handleExecute(raw *frame.RawFrame, msg *codecs.PartialExecute, body *frame.Body) {
+func (c *client) handleExecute(raw *frame.RawFrame, msg *codecs.PartialExecute, body *frame.Body, span trace.Span) {
 	id := preparedIdKey(msg.QueryId)
 	if stmt, ok := c.preparedSystemQuery[id]; ok {
 		c.interceptSystemQuery(raw.Header, stmt)
+		span.End()
 	} else {
+		c.proxy.maybeFetchPrepared(msg.QueryId)
 		isSelect := c.proxy.isSelect(id)
-		c.execute(raw, c.getDefaultIdempotency(body.CustomPayload), isSelect, "", body)
+		c.execute(raw, c.getDefaultIdempotency(body.CustomPayload, ""), isSelect, "", body, span)
 	}
 }
 
-func (c *client) handleQuery(raw *frame.RawFrame, msg *codecs.PartialQuery, body *frame.Body) {
+func (c *client) handleQuery(raw *frame.RawFrame, msg *codecs.PartialQuery, body *frame.Body, span trace.Span) {
 	handled, stmt, err := parser.IsQueryHandled(parser.IdentifierFromString(c.keyspace), msg.Query)
 	if handled {
+		defer span.End()
 		c.proxy.logger.Debug("query handled by proxy", zap.String("query", msg.Query), zap.Int16("stream", raw.Header.StreamId))
 		if err != nil {
 			c.proxy.logger.Error("error parsing query to see if it's handled", zap.Error(err))
@@ -713,11 +961,14 @@ func (c *client) handleQuery(raw *frame.RawFrame, msg *codecs.PartialQuery, body
 	} else {
 		c.proxy.logger.Debug("query not handled by proxy, forwarding", zap.String("query", msg.Query), zap.Int16("stream", raw.Header.StreamId))
 		_, isSelect := stmt.(*parser.SelectStatement)
-		c.execute(raw, c.getDefaultIdempotency(body.CustomPayload), isSelect, c.keyspace, body)
+		c.execute(raw, c.getDefaultIdempotency(body.CustomPayload, msg.Query), isSelect, c.keyspace, body, span)
 	}
 }
 
-func (c *client) getDefaultIdempotency(customPayload map[string][]byte) idempotentState {
+func (c *client) getDefaultIdempotency(customPayload map[string][]byte, query string) idempotentState {
+	if state := c.proxy.idempotenceHint(customPayload, query); state != notDetermined {
+		return state
+	}
 	state := notDetermined
 	if _, ok := customPayload["graph-source"]; ok { // Graph queries default to non-idempotent unless overridden
 		c.proxy.maybeLogUsingGraph()
@@ -736,6 +987,8 @@ func (c *client) filterSystemLocalValues(stmt *parser.SelectStatement, filtered
 			return codecs.EncodeType(datatype.Inet, c.proxy.cluster.NegotiatedVersion, c.localIP())
 		} else if name == "host_id" {
 			return codecs.EncodeType(datatype.Uuid, c.proxy.cluster.NegotiatedVersion, nameBasedUUID(c.localIP().String()))
+		} else if name == "data_center" {
+			return codecs.EncodeType(datatype.Varchar, c.proxy.cluster.NegotiatedVersion, c.proxy.nodeDC(c.proxy.localNode))
 		} else if val, ok := c.proxy.systemLocalValues[name]; ok {
 			return val, nil
 		} else if name == parser.CountValueName {
@@ -747,7 +1000,9 @@ func (c *client) filterSystemLocalValues(stmt *parser.SelectStatement, filtered
 }
 
 func (c *client) localIP() net.IP {
-	if c.proxy.localNode.addr != nil {
+	if c.rpcAddr != nil {
+		return c.rpcAddr.IP
+	} else if c.proxy.localNode.addr != nil {
 		return c.proxy.localNode.addr.IP
 	} else {
 		switch a := c.conn.LocalAddr().(type) {
@@ -755,6 +1010,9 @@ func (c *client) localIP() net.IP {
 			return a.IP
 		case *net.IPAddr:
 			return a.IP
+		case *net.UnixAddr:
+			// Clients connected using a unix socket are on the same host
+			return net.IPv4(127, 0, 0, 1)
 		default:
 			panic("unhandled local address type")
 		}
@@ -764,7 +1022,7 @@ func (c *client) localIP() net.IP {
 func (c *client) filterSystemPeerValues(stmt *parser.SelectStatement, filtered []*message.ColumnMetadata, peer *node, peerCount int) (row []message.Column, err error) {
 	return parser.FilterValues(stmt, filtered, func(name string) (value message.Column, err error) {
 		if name == "data_center" {
-			return codecs.EncodeType(datatype.Varchar, c.proxy.cluster.NegotiatedVersion, peer.dc)
+			return codecs.EncodeType(datatype.Varchar, c.proxy.cluster.NegotiatedVersion, c.proxy.nodeDC(peer))
 		} else if name == "host_id" {
 			return codecs.EncodeType(datatype.Uuid, c.proxy.cluster.NegotiatedVersion, nameBasedUUID(peer.addr.String()))
 		} else if name == "tokens" {
@@ -846,7 +1104,11 @@ func (c *client) interceptSystemQuery(hdr *frame.Header, stmt interface{}) {
 			c.send(hdr, &message.Invalid{ErrorMessage: "Doesn't exist"})
 		}
 	case *parser.UseStatement:
-		if _, err := c.proxy.maybeCreateSession(hdr.Version, s.Keyspace, c.compression); err != nil {
+		keyspace := s.Keyspace
+		if c.rewriter != nil {
+			keyspace = c.rewriter.backendKeyspace(keyspace)
+		}
+		if _, err := c.proxy.route(keyspace).maybeCreateSession(hdr.Version, keyspace, c.compression); err != nil {
 			errMsg := "Proxy unable to create new session for keyspace"
 			var cqlError *proxycore.CqlError
 			if errors.As(err, &cqlError) {
@@ -855,7 +1117,7 @@ func (c *client) interceptSystemQuery(hdr *frame.Header, stmt interface{}) {
 			}
 			c.send(hdr, &message.ServerError{ErrorMessage: errMsg})
 		} else {
-			c.keyspace = s.Keyspace
+			c.keyspace = keyspace
 			// We might have received a quoted keyspace name in the UseStatement so remove any
 			// quotes before sending back this result message.  This keeps us consistent with
 			// how Cassandra implements the same functionality and avoids any issues with
@@ -870,6 +1132,7 @@ func (c *client) interceptSystemQuery(hdr *frame.Header, stmt interface{}) {
 }
 
 func (c *client) send(hdr *frame.Header, msg message.Message) {
+	c.maybeCaptureResponse(hdr.StreamId, msg)
 	_ = c.conn.Write(proxycore.SenderFunc(func(writer io.Writer) error {
 		return c.codec.EncodeFrame(frame.NewFrame(hdr.Version, hdr.StreamId, msg), writer)
 	}))
@@ -877,79 +1140,14 @@ func (c *client) send(hdr *frame.Header, msg message.Message) {
 
 func (c *client) Closing(_ error) {
 	c.proxy.removeClient(c)
-}
-
-func (c *client) maybeOverrideUnsupportedWriteConsistency(isSelect bool, raw *frame.RawFrame, body *frame.Body) (frm interface{}) {
-	if !isSelect {
-		overrideConsistency := c.proxy.config.UnsupportedWriteConsistencyOverride.ConsistencyLevel
-
-		switch m := body.Message.(type) {
-		case *codecs.PartialExecute:
-			if c.isUnsupportedWriteConsistency(m.Consistency) {
-				c.proxy.logger.Debug("overriding unsupported write consistency for execute",
-					zap.Stringer("request", m),
-					zap.Stringer("unsupported", m.Consistency),
-					zap.Stringer("override", overrideConsistency))
-				m.Consistency = overrideConsistency
-				return &frame.Frame{
-					Header: raw.Header,
-					Body:   body,
-				}
-			} else {
-				c.proxy.logger.Debug("no override required for execute write consistency",
-					zap.Stringer("request", m),
-					zap.Stringer("consistency", m.Consistency))
-			}
-		case *codecs.PartialQuery:
-			if c.isUnsupportedWriteConsistency(m.Consistency) {
-				c.proxy.logger.Debug("overriding unsupported write consistency for query",
-					zap.Stringer("request", m),
-					zap.Stringer("unsupported", m.Consistency),
-					zap.Stringer("override", overrideConsistency))
-				m.Consistency = overrideConsistency
-				return &frame.Frame{
-					Header: raw.Header,
-					Body:   body,
-				}
-			} else {
-				c.proxy.logger.Debug("no override required for query write consistency",
-					zap.Stringer("request", m),
-					zap.Stringer("consistency", m.Consistency))
-			}
-		case *codecs.PartialBatch:
-			if c.isUnsupportedWriteConsistency(m.Consistency) {
-				c.proxy.logger.Debug("overriding unsupported write consistency for batch",
-					zap.Stringer("request", m),
-					zap.Stringer("unsupported", m.Consistency),
-					zap.Stringer("override", overrideConsistency))
-				m.Consistency = overrideConsistency
-				return &frame.Frame{
-					Header: raw.Header,
-					Body:   body,
-				}
-			} else {
-				c.proxy.logger.Debug("no override required for batch write consistency",
-					zap.Stringer("request", m),
-					zap.Stringer("consistency", m.Consistency))
-			}
-		}
-	}
-
-	return raw
-}
-
-func (c *client) isUnsupportedWriteConsistency(consistency primitive.ConsistencyLevel) bool {
-	for _, unsupported := range c.proxy.config.UnsupportedWriteConsistencies {
-		if unsupported.ConsistencyLevel == consistency {
-			return true
-		}
+	if c.captured {
+		c.proxy.capture.removeClient(c)
 	}
-	return false
 }
 
 // maybeStorePreparedMetadata stores the idempotence of a "PREPARE" request's query.
 // This information is used by future "EXECUTE" requests when they need to be retried.
-func (c *client) maybeStorePreparedMetadata(raw *frame.RawFrame, isSelect bool, msg message.Message) {
+func (c *client) maybeStorePreparedMetadata(raw *frame.RawFrame, prepareFrame *frame.RawFrame, isSelect bool, keyspace string, b *backend, msg message.Message, customPayload map[string][]byte) {
 	logger := c.proxy.logger
 
 	if prepareMsg, ok := msg.(*message.Prepare); ok && raw.Header.OpCode == primitive.OpCodeResult { // Prepared result
@@ -962,14 +1160,30 @@ func (c *client) maybeStorePreparedMetadata(raw *frame.RawFrame, isSelect bool,
 			logger.Debug("prepared request",
 				zap.Stringer("request", prepareMsg),
 				zap.Stringer("response", preparedResultMsg))
-			idempotent, err := parser.IsQueryIdempotent(prepareMsg.Query)
+			idempotent, err := c.proxy.isPreparedIdempotent(customPayload, prepareMsg.Query)
 			if err != nil {
 				logger.Error("error parsing query for idempotence", zap.Error(err))
 			} else if result, ok := frm.Body.Message.(*message.PreparedResult); ok {
-				c.proxy.preparedMetadata.Store(preparedIdKey(result.PreparedQueryId), preparedMetadata{
-					idempotent: idempotent,
-					isSelect:   isSelect,
-				})
+				metadata := preparedMetadata{
+					idempotent:    idempotent,
+					isSelect:      isSelect,
+					tables:        findTables(keyspace, prepareMsg.Query),
+					query:         prepareMsg.Query,
+					backend:       b,
+					version:       raw.Header.Version,
+					keyspace:      prepareMsg.Keyspace,
+					tableKeyspace: keyspace,
+				}
+				if c.proxy.preparedStore != nil || len(c.proxy.config.PreparedSharingToken) > 0 {
+					if metadata.frame, err = encodePrepareFrame(c.codec, prepareFrame); err != nil {
+						logger.Error("unable to encode prepare frame", zap.Error(err))
+					}
+				}
+				c.proxy.preparedMetadata.Store(preparedIdKey(result.PreparedQueryId), metadata)
+				c.proxy.maybeStorePrepared(result.PreparedQueryId, metadata)
+				if c.proxy.mirror != nil {
+					c.proxy.mirror.storePrepared(result.PreparedQueryId, raw.Header.Version, prepareMsg)
+				}
 			} else {
 				logger.Error("expected prepared result, but got some other type of message",
 					zap.Stringer("type", reflect.TypeOf(frm.Body.Message)))
@@ -1009,6 +1223,16 @@ func (d defaultPreparedCache) Load(id string) (entry *proxycore.PreparedEntry, o
 	return nil, false
 }
 
+func (d defaultPreparedCache) Range(f func(id string, entry *proxycore.PreparedEntry) bool) {
+	for _, key := range d.cache.Keys() {
+		if val, ok := d.cache.Peek(key); ok {
+			if !f(key.(string), val.(*proxycore.PreparedEntry)) {
+				return
+			}
+		}
+	}
+}
+
 func preparedIdKey(bytes []byte) [preparedIdSize]byte {
 	var buf [preparedIdSize]byte
 	copy(buf[:], bytes)
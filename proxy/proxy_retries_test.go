@@ -19,6 +19,7 @@ import (
 	"crypto/md5"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/datastax/cql-proxy/proxycore"
 	"github.com/datastax/go-cassandra-native-protocol/frame"
@@ -370,6 +371,52 @@ func TestProxy_RetryGraphQueries(t *testing.T) {
 	}
 }
 
+func TestProxy_ConfigRetryPolicy(t *testing.T) {
+	policy, err := NewConfigRetryPolicy(RetryPolicyConfig{
+		Overloaded:    &RetryRule{MaxRetries: 2, Host: "same"},
+		Bootstrapping: &RetryRule{MaxRetries: 1},
+		Backoff:       RetryBackoff{BaseDelay: 20 * time.Millisecond, MaxDelay: 40 * time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	var tests = []struct {
+		msg           string
+		response      message.Error
+		numNodesTried int
+		retryCount    int
+		minDuration   time.Duration
+	}{
+		{
+			"overloaded error, retried on the same node",
+			&message.Overloaded{ErrorMessage: "Overloaded"},
+			1,                     // Only tried on the first node
+			2,                     // Retried the configured max retries
+			30 * time.Millisecond, // 20ms then 40ms, less up to half of each delay for jitter
+		},
+		{
+			"bootstrapping error, retried once on the next node",
+			&message.IsBootstrapping{ErrorMessage: "Bootstrapping"},
+			2, // Tried on the first and second nodes
+			1, // Retried once instead of on all remaining nodes
+			10 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		start := time.Now()
+		numNodesTried, retryCount, err := testProxyRetryWithConfig(t,
+			frame.NewFrame(primitive.ProtocolVersion4, -1, &message.Query{Query: idempotentQuery}),
+			tt.response, &proxyTestConfig{retryPolicy: policy}, tt.msg)
+		elapsed := time.Since(start)
+
+		assert.Error(t, err, tt.msg)
+		assert.IsType(t, err, &proxycore.CqlError{}, tt.msg)
+		assert.Equal(t, tt.numNodesTried, numNodesTried, tt.msg)
+		assert.Equal(t, tt.retryCount, retryCount, tt.msg)
+		assert.GreaterOrEqual(t, elapsed, tt.minDuration, tt.msg)
+	}
+}
+
 func testProxyRetryWithConfig(t *testing.T, query *frame.Frame, response message.Error, cfg *proxyTestConfig, testMessage string) (numNodesTried, retryCount int, responseError error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
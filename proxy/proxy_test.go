@@ -31,6 +31,7 @@ import (
 	"github.com/datastax/cql-proxy/proxycore"
 	"github.com/gocql/gocql"
 	"github.com/pierrec/lz4/v4"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/datastax/go-cassandra-native-protocol/datatype"
@@ -419,11 +420,25 @@ func setupProxyTest(ctx context.Context, numNodes int, handlers proxycore.MockRe
 }
 
 type proxyTestConfig struct {
-	handlers        proxycore.MockRequestHandlers
-	dseVersion      string
-	rpcAddr         string
-	peers           []PeerConfig
-	idempotentGraph bool
+	handlers             proxycore.MockRequestHandlers
+	dseVersion           string
+	rpcAddr              string
+	peers                []PeerConfig
+	idempotentGraph      bool
+	resultCacheTables    []ResultCacheTable
+	tracerProvider       trace.TracerProvider
+	mirror               *MirrorConfig
+	backends             []BackendConfig
+	routes               map[string]string
+	keyspaceRewrites     []KeyspaceRewrite
+	preparedStorePath    string
+	idempotenceOverrides []IdempotenceOverride
+	retryPolicy          RetryPolicy
+	consistencyRules     []ConsistencyRule
+	capture              *CaptureConfig
+	auth                 proxycore.Authenticator
+	proxyExecute         bool
+	preparedSharingToken string
 }
 
 func setupProxyTestWithConfig(ctx context.Context, numNodes int, cfg *proxyTestConfig) (tester *proxyTester, proxyContactPoint string, err error) {
@@ -451,17 +466,32 @@ func setupProxyTestWithConfig(ctx context.Context, numNodes int, cfg *proxyTestC
 		}
 	}
 	tester.proxy = NewProxy(ctx, Config{
-		Version:           primitive.ProtocolVersion4,
-		Resolver:          proxycore.NewResolverWithDefaultPort([]string{clusterAddr}, clusterPort),
-		ReconnectPolicy:   proxycore.NewReconnectPolicyWithDelays(200*time.Millisecond, time.Second),
-		NumConns:          2,
-		HeartBeatInterval: 30 * time.Second,
-		ConnectTimeout:    10 * time.Second,
-		IdleTimeout:       60 * time.Second,
-		RPCAddr:           cfg.rpcAddr,
-		Peers:             cfg.peers,
-		IdempotentGraph:   cfg.idempotentGraph,
-		Logger:            zap.L(),
+		Version:              primitive.ProtocolVersion4,
+		Resolver:             proxycore.NewResolverWithDefaultPort([]string{clusterAddr}, clusterPort),
+		ReconnectPolicy:      proxycore.NewReconnectPolicyWithDelays(200*time.Millisecond, time.Second),
+		NumConns:             2,
+		HeartBeatInterval:    30 * time.Second,
+		ConnectTimeout:       10 * time.Second,
+		IdleTimeout:          60 * time.Second,
+		RPCAddr:              cfg.rpcAddr,
+		Peers:                cfg.peers,
+		IdempotentGraph:      cfg.idempotentGraph,
+		ResultCacheTables:    cfg.resultCacheTables,
+		ResultCacheSize:      100,
+		TracerProvider:       cfg.tracerProvider,
+		Mirror:               cfg.mirror,
+		Backends:             cfg.backends,
+		Routes:               cfg.routes,
+		KeyspaceRewrites:     cfg.keyspaceRewrites,
+		PreparedStorePath:    cfg.preparedStorePath,
+		IdempotenceOverrides: cfg.idempotenceOverrides,
+		RetryPolicy:          cfg.retryPolicy,
+		ConsistencyRules:     cfg.consistencyRules,
+		Capture:              cfg.capture,
+		Auth:                 cfg.auth,
+		ProxyExecute:         cfg.proxyExecute,
+		PreparedSharingToken: cfg.preparedSharingToken,
+		Logger:               zap.L(),
 	})
 
 	err = tester.proxy.Connect()
@@ -0,0 +1,138 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"go.uber.org/zap"
+)
+
+const (
+	// proxyExecutePayloadKey is the custom payload key DSE uses to execute a request as another role
+	proxyExecutePayloadKey = "ProxyExecute"
+
+	clientAuthenticator = "org.apache.cassandra.auth.PasswordAuthenticator"
+)
+
+// handleAuthResponse authenticates a client using its SASL PLAIN token. The credentials are verified by the default
+// backend and aren't kept by the proxy. Requests are executed as the token's authorization ID, if it has one;
+// otherwise, they're executed as the client's user.
+func (c *client) handleAuthResponse(raw *frame.RawFrame, msg *message.AuthResponse) {
+	if len(c.role) > 0 {
+		c.send(raw.Header, &message.ProtocolError{ErrorMessage: "Client is already authenticated"})
+		return
+	}
+
+	authorizationID, username, password, err := parsePlainToken(msg.Token)
+	if err != nil {
+		c.send(raw.Header, &message.AuthenticationError{ErrorMessage: err.Error()})
+		return
+	}
+
+	err = c.proxy.authenticateClient(c.ctx, authorizationID, username, password)
+	if err != nil {
+		var cqlErr *proxycore.CqlError
+		if errors.As(err, &cqlErr) {
+			if authErr, ok := cqlErr.Message.(*message.AuthenticationError); ok {
+				c.send(raw.Header, authErr)
+				return
+			}
+		}
+		c.proxy.logger.Error("unable to authenticate client", zap.String("username", username), zap.Error(err))
+		c.send(raw.Header, &message.ServerError{ErrorMessage: "Unable to authenticate client"})
+		return
+	}
+
+	c.role = username
+	if len(authorizationID) > 0 {
+		c.role = authorizationID
+	}
+	c.send(raw.Header, &message.AuthSuccess{})
+}
+
+// requiresAuthentication returns true if the client needs to authenticate before the proxy handles the message.
+func (c *client) requiresAuthentication(msg message.Message) bool {
+	if !c.proxy.config.ProxyExecute || len(c.role) > 0 {
+		return false
+	}
+	switch msg.(type) {
+	case *message.Options, *message.Startup, *message.AuthResponse:
+		return false
+	}
+	return true
+}
+
+// maybeAddProxyExecute adds the client's role to requests sent to the backend so that they're executed as that role.
+// The returned frame is re-encoded if the payload was added; otherwise, the original frame is returned. PREPARE requests
+// aren't changed because their frames are cached and used to re-prepare the statement for every client; permissions
+// are checked when the statement is executed.
+func (c *client) maybeAddProxyExecute(raw *frame.RawFrame, body *frame.Body) (*frame.RawFrame, error) {
+	if len(c.role) == 0 {
+		return raw, nil
+	}
+	switch body.Message.(type) {
+	case *codecs.PartialQuery, *codecs.PartialExecute, *codecs.PartialBatch:
+	default:
+		return raw, nil
+	}
+	payload := make(map[string][]byte, len(body.CustomPayload)+1)
+	for k, v := range body.CustomPayload {
+		payload[k] = v
+	}
+	payload[proxyExecutePayloadKey] = []byte(c.role)
+	frm := &frame.Frame{Header: raw.Header, Body: body}
+	frm.SetCustomPayload(payload)
+	return c.codec.ConvertToRawFrame(frm)
+}
+
+// authenticateClient verifies a client's credentials using a new connection to the default backend. The connection is
+// closed once it's authenticated.
+func (p *Proxy) authenticateClient(ctx context.Context, authorizationID, username, password string) error {
+	host := p.defaultBackend.newQueryPlan().Next()
+	if host == nil {
+		return errors.New("no hosts available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.ConnectTimeout)
+	defer cancel()
+
+	conn, err := proxycore.ConnectClient(ctx, host.Endpoint, proxycore.ClientConnConfig{Logger: p.logger})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = conn.Handshake(ctx, p.cluster.NegotiatedVersion,
+		proxycore.NewPasswordAuthWithAuthorizationID(authorizationID, username, password))
+	return err
+}
+
+// parsePlainToken parses a SASL PLAIN token (RFC 4616): "[authzid] NUL authcid NUL passwd".
+func parsePlainToken(token []byte) (authorizationID, username, password string, err error) {
+	parts := bytes.Split(token, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return "", "", "", errors.New("invalid SASL PLAIN token, a username and password are required")
+	}
+	return string(parts[0]), string(parts[1]), string(parts[2]), nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ProxyExecute(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	var executedAs, preparedAs []string
+
+	handlers := proxyExecuteTestHandlers(func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+		mu.Lock()
+		executedAs = append(executedAs, string(frm.Body.CustomPayload[proxyExecutePayloadKey]))
+		mu.Unlock()
+		return &message.VoidResult{}
+	})
+	handlers[primitive.OpCodePrepare] = func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+		mu.Lock()
+		preparedAs = append(preparedAs, string(frm.Body.CustomPayload[proxyExecutePayloadKey]))
+		mu.Unlock()
+		return proxycore.MockDefaultPrepareHandler(cl, frm)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers:     handlers,
+		auth:         proxycore.NewPasswordAuth("proxy", "proxy-pass"),
+		proxyExecute: true,
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	connect := func(auth proxycore.Authenticator) (*proxycore.ClientConn, error) {
+		return connectProxyExecuteTestClient(t, ctx, proxyContactPoint, auth)
+	}
+
+	lastExecutedAs := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(executedAs) == 0 {
+			return ""
+		}
+		return executedAs[len(executedAs)-1]
+	}
+
+	cl, err := connect(proxycore.NewPasswordAuth("alice", "alice-pass"))
+	require.NoError(t, err)
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "INSERT INTO ks.t (k) VALUES (1)"}))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", lastExecutedAs())
+
+	// The role isn't added to PREPARE requests because their frames are cached and used to re-prepare the statement for
+	// every client
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Prepare{Query: "INSERT INTO ks.t (k) VALUES (?)"}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.PreparedResult{}, resp.Body.Message)
+	mu.Lock()
+	assert.Equal(t, []string{""}, preparedAs)
+	mu.Unlock()
+
+	// The authorization ID is used instead of the client's user
+	cl, err = connect(proxycore.NewPasswordAuthWithAuthorizationID("bob", "alice", "alice-pass"))
+	require.NoError(t, err)
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "INSERT INTO ks.t (k) VALUES (1)"}))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", lastExecutedAs())
+
+	_, err = connect(proxycore.NewPasswordAuth("alice", "invalid"))
+	var cqlErr *proxycore.CqlError
+	require.ErrorAs(t, err, &cqlErr)
+	assert.IsType(t, &message.AuthenticationError{}, cqlErr.Message)
+
+	_, err = connect(nil)
+	assert.ErrorIs(t, err, proxycore.AuthExpected)
+
+	// Requests from clients that haven't authenticated are rejected
+	cl, err = proxycore.ConnectClient(ctx, proxycore.NewEndpoint(proxyContactPoint), proxycore.ClientConnConfig{})
+	require.NoError(t, err)
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "INSERT INTO ks.t (k) VALUES (1)"}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.Unauthorized{}, resp.Body.Message)
+}
+
+func TestProxy_ProxyExecuteResultCache(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+	const query = "SELECT v FROM ks.cached WHERE k = 1"
+
+	var mu sync.Mutex
+	reads := make(map[string]int)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxyExecuteTestHandlers(func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			role := string(frm.Body.CustomPayload[proxyExecutePayloadKey])
+			mu.Lock()
+			reads[role]++
+			mu.Unlock()
+			if role != "alice" {
+				return &message.Unauthorized{ErrorMessage: "User bob has no SELECT permission on <table ks.cached>"}
+			}
+			return &message.RowsResult{
+				Metadata: &message.RowsMetadata{
+					ColumnCount: 1,
+					Columns: []*message.ColumnMetadata{
+						{Keyspace: "ks", Table: "cached", Name: "v", Type: datatype.Int},
+					},
+				},
+				Data: message.RowSet{message.Row{message.Column{0, 0, 0, 1}}},
+			}
+		}),
+		auth:              proxycore.NewPasswordAuth("proxy", "proxy-pass"),
+		proxyExecute:      true,
+		resultCacheTables: []ResultCacheTable{{Keyspace: "ks", Table: "cached", TTL: time.Minute}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	alice, err := connectProxyExecuteTestClient(t, ctx, proxyContactPoint, proxycore.NewPasswordAuth("alice", "alice-pass"))
+	require.NoError(t, err)
+	bob, err := connectProxyExecuteTestClient(t, ctx, proxyContactPoint, proxycore.NewPasswordAuth("bob", "bob-pass"))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		resp, err := alice.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: query}))
+		require.NoError(t, err)
+		assert.IsType(t, &message.RowsResult{}, resp.Body.Message)
+	}
+
+	// Alice's cached result isn't returned to Bob, the backend checks Bob's permissions
+	resp, err := bob.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: query}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.Unauthorized{}, resp.Body.Message)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"alice": 1, "bob": 1}, reads)
+}
+
+// proxyExecuteTestHandlers creates mock handlers that require authentication and handle user queries using the query
+// handler.
+func proxyExecuteTestHandlers(query proxycore.MockRequestHandler) proxycore.MockRequestHandlers {
+	passwords := map[string]string{"proxy": "proxy-pass", "alice": "alice-pass", "bob": "bob-pass"}
+	return proxycore.MockRequestHandlers{
+		primitive.OpCodeStartup: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			return &message.Authenticate{Authenticator: "org.apache.cassandra.auth.PasswordAuthenticator"}
+		},
+		primitive.OpCodeAuthResponse: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			parts := bytes.Split(frm.Body.Message.(*message.AuthResponse).Token, []byte{0})
+			if len(parts) == 3 && passwords[string(parts[1])] == string(parts[2]) {
+				return &message.AuthSuccess{}
+			}
+			return &message.AuthenticationError{ErrorMessage: "Provided username and/or password are incorrect"}
+		},
+		primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+				return msg
+			}
+			return query(cl, frm)
+		},
+	}
+}
+
+func connectProxyExecuteTestClient(t *testing.T, ctx context.Context, proxyContactPoint string,
+	auth proxycore.Authenticator) (*proxycore.ClientConn, error) {
+	cl, err := proxycore.ConnectClient(ctx, proxycore.NewEndpoint(proxyContactPoint), proxycore.ClientConnConfig{})
+	require.NoError(t, err)
+	_, err = cl.Handshake(ctx, primitive.ProtocolVersion4, auth)
+	return cl, err
+}
+
+func TestParsePlainToken(t *testing.T) {
+	authorizationID, username, password, err := parsePlainToken([]byte("bob\x00alice\x00secret"))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", authorizationID)
+	assert.Equal(t, "alice", username)
+	assert.Equal(t, "secret", password)
+
+	_, _, _, err = parsePlainToken([]byte("\x00\x00secret"))
+	assert.Error(t, err)
+
+	_, _, _, err = parsePlainToken([]byte("alice"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,277 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultProxyProtocolHeaderTimeout is how long a connection has to send its PROXY protocol header by default.
+	DefaultProxyProtocolHeaderTimeout = 5 * time.Second
+
+	proxyProtocolV1Prefix    = "PROXY "
+	proxyProtocolV1MaxLength = 107 // Including the trailing "\r\n"
+	proxyProtocolV2HeaderLen = 16
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConfig configures the parsing of PROXY protocol (v1 and v2) headers sent by load balancers, e.g. HAProxy
+// or AWS NLB, at the start of client connections.
+type ProxyProtocolConfig struct {
+	// TrustedSources are the CIDRs of the load balancers allowed to send a PROXY protocol header. Connections from
+	// trusted sources are required to send a header, and other connections are served as-is. At least one is required
+	// so that clients can't spoof their address.
+	TrustedSources []string
+	// HeaderTimeout is how long a connection has to send its header. DefaultProxyProtocolHeaderTimeout is used if zero.
+	HeaderTimeout time.Duration
+}
+
+// proxyProtocolListener reads the PROXY protocol header of accepted connections in the background so that a slow
+// connection doesn't block accepting others. Accepted connections report the original client's address as their
+// remote address.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+	logger  *zap.Logger
+	conns   chan net.Conn
+	err     error
+	done    chan struct{} // Closed when the underlying listener fails, err is set before it's closed
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewProxyProtocolListener wraps a listener so that accepted connections report the client address from their PROXY
+// protocol header. A TLS listener, if used, must wrap the returned listener because the header is sent before the TLS
+// handshake.
+func NewProxyProtocolListener(l net.Listener, config ProxyProtocolConfig, logger *zap.Logger) (net.Listener, error) {
+	if len(config.TrustedSources) == 0 {
+		return nil, errors.New("PROXY protocol requires at least one trusted source CIDR")
+	}
+	trusted, err := parseClientCIDRs(config.TrustedSources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol trusted source CIDR: %w", err)
+	}
+	timeout := config.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultProxyProtocolHeaderTimeout
+	}
+	pl := &proxyProtocolListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  timeout,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyProtocolListener) readHeader(conn net.Conn) {
+	if !clientsContain(l.trusted, addrIP(conn.RemoteAddr())) {
+		l.deliver(conn)
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(l.timeout))
+	reader := bufio.NewReader(conn)
+	remoteAddr, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		l.logger.Warn("unable to read PROXY protocol header, closing connection",
+			zap.Stringer("source", conn.RemoteAddr()), zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if remoteAddr == nil { // The load balancer's own connection, e.g. a health check
+		remoteAddr = conn.RemoteAddr()
+	}
+	l.deliver(&proxyProtocolConn{Conn: conn, reader: reader, remoteAddr: remoteAddr})
+}
+
+func (l *proxyProtocolListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// proxyProtocolConn is a connection whose remote address is the original client's address. Reads use the buffered
+// reader that was used to parse the header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// NetConn returns the underlying connection.
+func (c *proxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyProtocolHeader reads a v1 or v2 PROXY protocol header and returns the client's address. The address is nil
+// if the header doesn't contain an address, e.g. for "LOCAL" and "UNKNOWN" connections.
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) == proxyProtocolV1Prefix {
+		return readProxyProtocolV1(reader)
+	}
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(reader)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header doesn't end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("unsupported PROXY protocol v1 protocol: %s", fields[1])
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source address: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source port: %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyProtocolV2HeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", versionCommand>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0x0F {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command: %d", versionCommand&0x0F)
+	}
+
+	// Only the source address and port are used, the destination and any TLVs are skipped
+	var ipLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("PROXY protocol v2 address block is too short")
+	}
+	ip := net.IP(append([]byte(nil), payload[:ipLen]...))
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
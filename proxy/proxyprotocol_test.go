@@ -0,0 +1,155 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2 := func(command, family byte, addrs []byte) []byte {
+		header := append([]byte(nil), proxyProtocolV2Signature...)
+		header = append(header, 0x20|command, family, byte(len(addrs)>>8), byte(len(addrs)))
+		return append(header, addrs...)
+	}
+
+	var tests = []struct {
+		name   string
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 9042\r\n"), "192.168.0.1:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 9042\r\n"), "[2001:db8::1]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 mismatched family", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 9042\r\n"), "", true},
+		{"v1 missing crlf", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 9042\n"), "", true},
+		{"v2 tcp4", v2(0x1, 0x11, []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x23, 0x52}), "192.168.0.1:56324", false},
+		{"v2 tcp4 with tlv", v2(0x1, 0x11, []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x23, 0x52, 0x04, 0x00, 0x01, 0x00}), "192.168.0.1:56324", false},
+		{"v2 local", v2(0x0, 0x00, nil), "", false},
+		{"v2 short address block", v2(0x1, 0x11, []byte{192, 168, 0, 1}), "", true},
+		{"missing header", []byte("\x04\x00\x00\x00\x05\x00\x00\x00\x00"), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(append(tt.header, "data"...)))
+			addr, err := readProxyProtocolHeader(reader)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.addr == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, tt.addr, addr.String())
+			}
+			rest, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pl, err := NewProxyProtocolListener(l, ProxyProtocolConfig{TrustedSources: []string{"127.0.0.0/8"}}, zap.NewNop())
+	require.NoError(t, err)
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 9042\r\nhello"))
+	require.NoError(t, err)
+
+	conn, err := pl.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestProxyProtocolListener_UntrustedSource(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pl, err := NewProxyProtocolListener(l, ProxyProtocolConfig{TrustedSources: []string{"10.0.0.0/8"}}, zap.NewNop())
+	require.NoError(t, err)
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Connections from untrusted sources are served without reading a header
+	conn, err := pl.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+}
+
+func TestProxyProtocolListener_MissingHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pl, err := NewProxyProtocolListener(l, ProxyProtocolConfig{
+		TrustedSources: []string{"127.0.0.0/8"},
+		HeaderTimeout:  100 * time.Millisecond,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The connection is closed because it never sends a header
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNewProxyProtocolListener_InvalidCIDR(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = NewProxyProtocolListener(l, ProxyProtocolConfig{TrustedSources: []string{"not-a-cidr"}}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestNewProxyProtocolListener_NoTrustedSources(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Otherwise, any client could spoof its address
+	_, err = NewProxyProtocolListener(l, ProxyProtocolConfig{}, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,261 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+// maxDiffRows is the maximum number of differing rows included in a mismatch's diff summary.
+const maxDiffRows = 5
+
+// readComparison compares the result of a SELECT from the primary cluster with the result of the same SELECT from the
+// mirror cluster. The comparison is done once both results are received; if either request fails no comparison is
+// done.
+type readComparison struct {
+	mirror    *mirror
+	query     string
+	values    []string
+	codec     frame.RawCodec // Used to decode the primary result which might be compressed
+	primary   *frame.RawFrame
+	secondary *frame.RawFrame
+	mu        sync.Mutex
+}
+
+func (r *readComparison) setPrimary(raw *frame.RawFrame) {
+	r.set(&r.primary, copyRawFrame(raw))
+}
+
+func (r *readComparison) setSecondary(raw *frame.RawFrame) {
+	r.set(&r.secondary, raw)
+}
+
+func (r *readComparison) set(result **frame.RawFrame, raw *frame.RawFrame) {
+	r.mu.Lock()
+	*result = raw
+	done := r.primary != nil && r.secondary != nil
+	r.mu.Unlock()
+	if done {
+		// Decoding and comparing rows can be expensive so it's done outside the connection's read loop.
+		go r.compare()
+	}
+}
+
+func (r *readComparison) compare() {
+	m := r.mirror
+	primary, err := decodeRowsResult(r.codec, r.primary)
+	if err != nil {
+		m.logger.Debug("unable to compare read, primary result is not rows", zap.Error(err))
+		return
+	}
+	secondary, err := decodeRowsResult(codecs.CustomRawCodec, r.secondary)
+	if err != nil {
+		m.logger.Debug("unable to compare read, mirror result is not rows", zap.Error(err))
+		return
+	}
+	atomic.AddUint64(&m.compared, 1)
+	if diff, ok := diffRows(primary.Data, secondary.Data, m.config.CompareIgnoreOrder); !ok {
+		atomic.AddUint64(&m.mismatches, 1)
+		m.logger.Warn("read results differ between primary and mirror clusters",
+			zap.String("query", r.query),
+			zap.Strings("values", r.values),
+			zap.String("diff", diff))
+	}
+}
+
+func decodeRowsResult(codec frame.RawCodec, raw *frame.RawFrame) (*message.RowsResult, error) {
+	if raw.Header.OpCode != primitive.OpCodeResult {
+		return nil, fmt.Errorf("unexpected response %v", raw.Header.OpCode)
+	}
+	frm, err := codec.ConvertFromRawFrame(raw)
+	if err != nil {
+		return nil, err
+	}
+	rows, ok := frm.Body.Message.(*message.RowsResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result %v", frm.Body.Message)
+	}
+	return rows, nil
+}
+
+// diffRows compares two row sets. If they differ it returns false and a summary of the differences. If `ignoreOrder`
+// is set, rows are compared as multisets.
+func diffRows(primary, secondary message.RowSet, ignoreOrder bool) (diff string, ok bool) {
+	var sb strings.Builder
+	if len(primary) != len(secondary) {
+		_, _ = fmt.Fprintf(&sb, "row count: primary=%d mirror=%d; ", len(primary), len(secondary))
+	}
+
+	if !ignoreOrder {
+		n := len(primary)
+		if len(secondary) < n {
+			n = len(secondary)
+		}
+		differing := 0
+		for i := 0; i < n; i++ {
+			if !rowsEqual(primary[i], secondary[i]) {
+				if differing < maxDiffRows {
+					_, _ = fmt.Fprintf(&sb, "row %d: primary=%s mirror=%s; ", i, formatRow(primary[i]), formatRow(secondary[i]))
+				}
+				differing++
+			}
+		}
+		if differing > 0 {
+			_, _ = fmt.Fprintf(&sb, "%d of %d rows differ", differing, n)
+		}
+	} else {
+		counts := make(map[string]int)
+		rows := make(map[string]message.Row)
+		for _, row := range primary {
+			key := rowKey(row)
+			counts[key]++
+			rows[key] = row
+		}
+		for _, row := range secondary {
+			key := rowKey(row)
+			counts[key]--
+			rows[key] = row
+		}
+		var onlyPrimary, onlySecondary []string
+		for key, count := range counts {
+			for ; count > 0; count-- {
+				onlyPrimary = append(onlyPrimary, formatRow(rows[key]))
+			}
+			for ; count < 0; count++ {
+				onlySecondary = append(onlySecondary, formatRow(rows[key]))
+			}
+		}
+		if len(onlyPrimary) > 0 {
+			sort.Strings(onlyPrimary)
+			_, _ = fmt.Fprintf(&sb, "only in primary (%d): %s; ", len(onlyPrimary), strings.Join(truncateRows(onlyPrimary), ", "))
+		}
+		if len(onlySecondary) > 0 {
+			sort.Strings(onlySecondary)
+			_, _ = fmt.Fprintf(&sb, "only in mirror (%d): %s; ", len(onlySecondary), strings.Join(truncateRows(onlySecondary), ", "))
+		}
+	}
+
+	diff = strings.TrimSuffix(sb.String(), "; ")
+	return diff, len(diff) == 0
+}
+
+func rowsEqual(a, b message.Row) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) || (a[i] == nil) != (b[i] == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+func rowKey(row message.Row) string {
+	var sb strings.Builder
+	for _, column := range row {
+		if column == nil {
+			sb.WriteString("-;")
+		} else {
+			_, _ = fmt.Fprintf(&sb, "%d:%x;", len(column), column)
+		}
+	}
+	return sb.String()
+}
+
+func formatRow(row message.Row) string {
+	columns := make([]string, len(row))
+	for i, column := range row {
+		if column == nil {
+			columns[i] = "null"
+		} else {
+			columns[i] = "0x" + hex.EncodeToString(column)
+		}
+	}
+	return "[" + strings.Join(columns, " ") + "]"
+}
+
+func truncateRows(rows []string) []string {
+	if len(rows) > maxDiffRows {
+		return append(rows[:maxDiffRows:maxDiffRows], "...")
+	}
+	return rows
+}
+
+// formatValues formats a request's bound values for logging.
+func formatValues(version primitive.ProtocolVersion, consistency primitive.ConsistencyLevel, parameters []byte) []string {
+	var buf bytes.Buffer
+	_ = primitive.WriteShort(uint16(consistency), &buf)
+	buf.Write(parameters)
+	options, err := message.DecodeQueryOptions(&buf, version)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, value := range options.PositionalValues {
+		values = append(values, formatValue(value))
+	}
+	names := make([]string, 0, len(options.NamedValues))
+	for name := range options.NamedValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values = append(values, name+"="+formatValue(options.NamedValues[name]))
+	}
+	return values
+}
+
+func formatValue(value *primitive.Value) string {
+	switch value.Type {
+	case primitive.ValueTypeNull:
+		return "null"
+	case primitive.ValueTypeUnset:
+		return "unset"
+	default:
+		return "0x" + hex.EncodeToString(value.Contents)
+	}
+}
+
+// newReadComparison creates a comparison for a sampled SELECT. It returns nil if the request is not a QUERY or EXECUTE.
+func (c *client) newReadComparison(version primitive.ProtocolVersion, body *frame.Body) *readComparison {
+	cmp := &readComparison{
+		mirror: c.proxy.mirror,
+		codec:  c.codec,
+	}
+	switch msg := body.Message.(type) {
+	case *codecs.PartialQuery:
+		cmp.query = msg.Query
+		cmp.values = formatValues(version, msg.Consistency, msg.Parameters)
+	case *codecs.PartialExecute:
+		cmp.query = c.proxy.preparedQuery(msg.QueryId)
+		cmp.values = formatValues(version, msg.Consistency, msg.Parameters)
+	default:
+		return nil
+	}
+	return cmp
+}
@@ -0,0 +1,216 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffRows(t *testing.T) {
+	row := func(values ...byte) message.Row {
+		var r message.Row
+		for _, v := range values {
+			r = append(r, message.Column{v})
+		}
+		return r
+	}
+
+	var tests = []struct {
+		name        string
+		primary     message.RowSet
+		secondary   message.RowSet
+		ignoreOrder bool
+		ok          bool
+		diff        string
+	}{
+		{"equal", message.RowSet{row(1, 2), row(3, 4)}, message.RowSet{row(1, 2), row(3, 4)}, false, true, ""},
+		{"different order", message.RowSet{row(1, 2), row(3, 4)}, message.RowSet{row(3, 4), row(1, 2)}, false, false,
+			"row 0: primary=[0x01 0x02] mirror=[0x03 0x04]; row 1: primary=[0x03 0x04] mirror=[0x01 0x02]; 2 of 2 rows differ"},
+		{"different order ignored", message.RowSet{row(1, 2), row(3, 4)}, message.RowSet{row(3, 4), row(1, 2)}, true, true, ""},
+		{"missing row", message.RowSet{row(1, 2), row(3, 4)}, message.RowSet{row(1, 2)}, false, false,
+			"row count: primary=2 mirror=1"},
+		{"missing row ignore order", message.RowSet{row(1, 2), row(3, 4)}, message.RowSet{row(3, 4)}, true, false,
+			"row count: primary=2 mirror=1; only in primary (1): [0x01 0x02]"},
+		{"different row ignore order", message.RowSet{row(1, 2)}, message.RowSet{row(1, 3)}, true, false,
+			"only in primary (1): [0x01 0x02]; only in mirror (1): [0x01 0x03]"},
+		{"null column", message.RowSet{message.Row{nil}}, message.RowSet{message.Row{message.Column{}}}, false, false,
+			"row 0: primary=[null] mirror=[0x]; 1 of 1 rows differ"},
+	}
+
+	for _, tt := range tests {
+		diff, ok := diffRows(tt.primary, tt.secondary, tt.ignoreOrder)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, tt.diff, diff, tt.name)
+	}
+}
+
+func TestProxy_MirrorCompareReads(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	rows := func(values ...byte) message.Message {
+		var data message.RowSet
+		for _, v := range values {
+			data = append(data, message.Row{message.Column{0, 0, 0, v}})
+		}
+		return &message.RowsResult{
+			Metadata: &message.RowsMetadata{
+				ColumnCount: 1,
+				Columns: []*message.ColumnMetadata{
+					{Keyspace: "ks", Table: "t", Name: "v", Type: datatype.Int},
+				},
+			},
+			Data: data,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mirrorPort := generateTestPort()
+	mirrorCluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), mirrorPort)
+	mirrorCluster.Handlers = proxycore.NewMockRequestHandlers(proxycore.MockRequestHandlers{
+		primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+				return msg
+			}
+			if strings.Contains(frm.Body.Message.(*message.Query).Query, "k = 2") {
+				return rows(1)
+			}
+			return rows(2, 1)
+		},
+	})
+	require.NoError(t, mirrorCluster.Add(ctx, 1))
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				return rows(1, 2)
+			},
+		},
+		mirror: &MirrorConfig{
+			Resolver:           proxycore.NewResolverWithDefaultPort([]string{testAddr}, mirrorPort),
+			CompareReads:       1.0,
+			CompareIgnoreOrder: true,
+		},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+		mirrorCluster.Shutdown()
+	}()
+	require.NoError(t, err)
+
+	require.True(t, waitUntil(10*time.Second, func() bool {
+		return tester.proxy.mirror.lb.NewQueryPlan().Next() != nil
+	}))
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	for _, query := range []string{"SELECT v FROM ks.t WHERE k = 1", "SELECT v FROM ks.t WHERE k = 2"} {
+		resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: query}))
+		require.NoError(t, err)
+		result, ok := resp.Body.Message.(*message.RowsResult)
+		require.True(t, ok, "expected rows result")
+		assert.Len(t, result.Data, 2, "only the primary result should be returned")
+	}
+
+	assert.True(t, waitUntil(10*time.Second, func() bool {
+		stats, _ := tester.proxy.MirrorStats()
+		return stats.Compared == 2
+	}))
+
+	stats, _ := tester.proxy.MirrorStats()
+	assert.Equal(t, uint64(1), stats.Mismatches, "only the query with a missing row should be a mismatch")
+}
+
+func TestProxy_MirrorCompareReadsWithResultCache(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+	const query = "SELECT v FROM ks.cached WHERE k = 1"
+
+	rows := &message.RowsResult{
+		Metadata: &message.RowsMetadata{
+			ColumnCount: 1,
+			Columns: []*message.ColumnMetadata{
+				{Keyspace: "ks", Table: "cached", Name: "v", Type: datatype.Int},
+			},
+		},
+		Data: message.RowSet{message.Row{message.Column{0, 0, 0, 1}}},
+	}
+	handlers := proxycore.MockRequestHandlers{
+		primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+			if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+				return msg
+			}
+			return rows
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mirrorPort := generateTestPort()
+	mirrorCluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), mirrorPort)
+	mirrorCluster.Handlers = proxycore.NewMockRequestHandlers(handlers)
+	require.NoError(t, mirrorCluster.Add(ctx, 1))
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: handlers,
+		mirror: &MirrorConfig{
+			Resolver:     proxycore.NewResolverWithDefaultPort([]string{testAddr}, mirrorPort),
+			CompareReads: 1.0,
+		},
+		resultCacheTables: []ResultCacheTable{{Keyspace: "ks", Table: "cached", TTL: time.Minute}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+		mirrorCluster.Shutdown()
+	}()
+	require.NoError(t, err)
+
+	require.True(t, waitUntil(10*time.Second, func() bool {
+		return tester.proxy.mirror.lb.NewQueryPlan().Next() != nil
+	}))
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	for i := 0; i < 3; i++ {
+		resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: query}))
+		require.NoError(t, err)
+		assert.IsType(t, &message.RowsResult{}, resp.Body.Message)
+	}
+
+	// Only the read sent to the primary cluster is mirrored and compared, cache hits aren't
+	assert.True(t, waitUntil(10*time.Second, func() bool {
+		stats, _ := tester.proxy.MirrorStats()
+		return stats.Compared == 1
+	}))
+	stats, _ := tester.proxy.MirrorStats()
+	assert.Equal(t, uint64(1), stats.Sent)
+	assert.Equal(t, uint64(0), stats.Mismatches)
+}
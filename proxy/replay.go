@@ -0,0 +1,544 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/parser"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	replayResultOK      = "OK"
+	replayResultTimeout = "TIMEOUT"
+	replayResultClosed  = "CONNECTION_CLOSED"
+	replayResultNoHosts = "NO_HOSTS_AVAILABLE"
+)
+
+var errReplayPreparedIdMismatch = errors.New("prepared ID changed after re-preparing the query on the target cluster")
+
+type replayConfig struct {
+	Capture         string        `arg:"" help:"Capture file created using '--capture-path'"`
+	ContactPoints   []string      `help:"Contact points for the target cluster" short:"c" required:"" env:"CONTACT_POINTS"`
+	Username        string        `help:"Username to use for authentication" short:"u" env:"USERNAME"`
+	Password        string        `help:"Password to use for authentication" short:"p" env:"PASSWORD"`
+	Port            int           `help:"Default port to use when connecting to the target cluster" default:"9042" short:"r" env:"PORT"`
+	ProtocolVersion string        `help:"Initial protocol version to use when connecting to the target cluster (default: v4, options: v3, v4, v5, DSEv1, DSEv2)" default:"v4" short:"n" env:"PROTOCOL_VERSION"`
+	NumConns        int           `help:"Number of connection to create to each node of the target cluster" default:"1" env:"NUM_CONNS"`
+	Speed           float64       `help:"Replay speed relative to the capture, e.g. '2' replays twice as fast. Requests are sent as fast as possible if zero" default:"1.0" env:"REPLAY_SPEED"`
+	MaxInflight     int           `help:"Maximum number of requests in-flight to the target cluster" default:"1024" env:"REPLAY_MAX_INFLIGHT"`
+	Timeout         time.Duration `help:"Duration before a replayed request is considered timed out" default:"10s" env:"REPLAY_TIMEOUT"`
+	ConnectTimeout  time.Duration `help:"Duration before an attempt to connect to the target cluster is considered timed out" default:"10s" env:"CONNECT_TIMEOUT"`
+	Debug           bool          `help:"Show debug logging" default:"false" env:"DEBUG"`
+}
+
+// Replay starts the replay command. It plays back a capture created by the proxy against a target cluster and reports
+// the differences in latency and results. 'args' shouldn't include the executable or the command name. It returns the
+// exit code for the command.
+func Replay(ctx context.Context, args []string) int {
+	var cfg replayConfig
+
+	parser, err := kong.New(&cfg, kong.Name("cql-proxy replay"),
+		kong.Description("Replay requests captured by the proxy against a target cluster"))
+	if err != nil {
+		panic(err)
+	}
+
+	var cliCtx *kong.Context
+	if cliCtx, err = parser.Parse(args); err != nil {
+		parser.Errorf("error parsing flags: %v", err)
+		return 1
+	}
+
+	if cfg.Speed < 0 {
+		cliCtx.Errorf("invalid replay speed, must not be negative (provided: %v)", cfg.Speed)
+		return 1
+	}
+
+	if cfg.NumConns < 1 || cfg.MaxInflight < 1 {
+		cliCtx.Errorf("invalid number of connections or max in-flight, must be greater than 0 (provided: %d, %d)",
+			cfg.NumConns, cfg.MaxInflight)
+		return 1
+	}
+
+	version, ok := parseProtocolVersion(cfg.ProtocolVersion)
+	if !ok {
+		cliCtx.Errorf("unsupported protocol version: %s", cfg.ProtocolVersion)
+		return 1
+	}
+
+	var logger *zap.Logger
+	if cfg.Debug {
+		logger, err = zap.NewDevelopment()
+	} else {
+		logger, err = zap.NewProduction()
+	}
+	if err != nil {
+		cliCtx.Errorf("unable to create logger")
+		return 1
+	}
+
+	records, err := loadCapture(cfg.Capture)
+	if err != nil {
+		cliCtx.Errorf("%v", err)
+		return 1
+	}
+
+	var auth proxycore.Authenticator
+	if len(cfg.Username) > 0 || len(cfg.Password) > 0 {
+		auth = proxycore.NewPasswordAuth(cfg.Username, cfg.Password)
+	}
+
+	r, err := newReplayer(ctx, replayerConfig{
+		ClusterConfig: proxycore.ClusterConfig{
+			Version:           version,
+			Auth:              auth,
+			Resolver:          proxycore.NewResolverWithDefaultPort(cfg.ContactPoints, cfg.Port),
+			ReconnectPolicy:   proxycore.NewReconnectPolicy(),
+			HeartBeatInterval: 30 * time.Second,
+			ConnectTimeout:    cfg.ConnectTimeout,
+			IdleTimeout:       60 * time.Second,
+			Logger:            logger,
+		},
+		numConns:    cfg.NumConns,
+		speed:       cfg.Speed,
+		maxInflight: cfg.MaxInflight,
+		timeout:     cfg.Timeout,
+	})
+	if err != nil {
+		cliCtx.Errorf("unable to connect to target cluster: %v", err)
+		return 1
+	}
+
+	report, err := r.replay(records)
+	if err != nil {
+		cliCtx.Errorf("%v", err)
+		return 1
+	}
+	report.write(cliCtx.Stdout)
+
+	return 0
+}
+
+// loadCapture reads the records of a capture file.
+func loadCapture(path string) ([]captureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open capture file: %w", err)
+	}
+	defer file.Close()
+
+	var records []captureRecord
+	decoder := json.NewDecoder(file)
+	for {
+		var record captureRecord
+		if err = decoder.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid record %d in capture file '%s': %w", len(records)+1, path, err)
+		}
+		records = append(records, record)
+	}
+}
+
+type replayerConfig struct {
+	proxycore.ClusterConfig
+	numConns    int
+	speed       float64
+	maxInflight int
+	timeout     time.Duration
+}
+
+type replaySessionKey struct {
+	version  primitive.ProtocolVersion
+	keyspace string
+}
+
+type replayer struct {
+	ctx           context.Context
+	config        replayerConfig
+	cluster       *proxycore.Cluster
+	lb            proxycore.LoadBalancer
+	sessions      map[replaySessionKey]*proxycore.Session
+	preparedCache proxycore.PreparedCache
+	inflight      chan struct{}
+	wg            sync.WaitGroup
+	report        *replayReport
+	mu            sync.Mutex
+}
+
+func newReplayer(ctx context.Context, config replayerConfig) (*replayer, error) {
+	preparedCache, err := NewDefaultPreparedCache(1e8 / 256)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := proxycore.ConnectCluster(ctx, config.ClusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	lb := proxycore.NewRoundRobinLoadBalancer()
+	if err = cluster.Listen(lb); err != nil {
+		return nil, err
+	}
+	return &replayer{
+		ctx:           ctx,
+		config:        config,
+		cluster:       cluster,
+		lb:            lb,
+		sessions:      make(map[replaySessionKey]*proxycore.Session),
+		preparedCache: preparedCache,
+		inflight:      make(chan struct{}, config.maxInflight),
+	}, nil
+}
+
+// replay plays back the capture's requests using their original timing scaled by the replay speed. Prepared statements
+// from the capture are added to the prepared cache first so that requests executing statements prepared before the
+// capture started are re-prepared on the target cluster.
+func (r *replayer) replay(records []captureRecord) (*replayReport, error) {
+	r.report = &replayReport{differences: make(map[replayDifference]int)}
+
+	var requests []captureRecord
+	for _, record := range records {
+		switch record.Type {
+		case captureRecordPrepared:
+			if err := r.storePrepared(record); err != nil {
+				return nil, err
+			}
+		case captureRecordRequest:
+			requests = append(requests, record)
+		}
+	}
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Offset < requests[j].Offset
+	})
+
+	var frames []*frame.RawFrame
+	for i, record := range requests {
+		raw, err := codecs.CustomRawCodec.DecodeRawFrame(bytes.NewReader(record.Frame))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode captured request %d: %w", i+1, err)
+		}
+		if r.isHandledByProxy(raw, record.Keyspace) {
+			raw = nil
+		} else if _, err = r.findSession(record.Version, record.Keyspace); err != nil {
+			return nil, fmt.Errorf("unable to connect session for keyspace '%s': %w", record.Keyspace, err)
+		}
+		frames = append(frames, raw)
+	}
+
+	start := time.Now()
+	for i, record := range requests {
+		if frames[i] == nil {
+			r.report.skipped++
+			continue
+		}
+		if r.config.speed > 0 {
+			delay := time.Duration(float64(record.Offset)/r.config.speed) - time.Since(start)
+			if delay > 0 {
+				select {
+				case <-r.ctx.Done():
+					return nil, r.ctx.Err()
+				case <-time.After(delay):
+				}
+			}
+		}
+		select {
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		case r.inflight <- struct{}{}:
+		}
+		r.send(record, frames[i])
+	}
+	r.wg.Wait()
+	r.report.duration = time.Since(start)
+	return r.report, nil
+}
+
+// isHandledByProxy returns true if a captured request was answered by the proxy itself, e.g. "USE" and system table
+// queries. Those requests are never sent to the cluster so they're skipped.
+func (r *replayer) isHandledByProxy(raw *frame.RawFrame, keyspace string) bool {
+	if raw.Header.OpCode != primitive.OpCodeQuery && raw.Header.OpCode != primitive.OpCodePrepare {
+		return false
+	}
+	body, err := codecs.CustomRawCodec.DecodeBody(raw.Header, codecs.NewFrameBodyReader(raw.Body))
+	if err != nil {
+		return false
+	}
+	var query string
+	switch msg := body.Message.(type) {
+	case *codecs.PartialQuery:
+		query = msg.Query
+	case *message.Prepare:
+		query = msg.Query
+		if len(msg.Keyspace) > 0 {
+			keyspace = msg.Keyspace
+		}
+	}
+	handled, _, _ := parser.IsQueryHandled(parser.IdentifierFromString(keyspace), query)
+	return handled
+}
+
+func (r *replayer) storePrepared(record captureRecord) error {
+	prepare := &message.Prepare{Query: record.Query}
+	if record.Version >= primitive.ProtocolVersion5 {
+		prepare.Keyspace = record.Keyspace
+	}
+	raw, err := codecs.CustomRawCodec.ConvertToRawFrame(frame.NewFrame(record.Version, 0, prepare))
+	if err != nil {
+		return fmt.Errorf("unable to encode captured prepared statement '%s': %w", record.ID, err)
+	}
+	r.preparedCache.Store(record.ID, &proxycore.PreparedEntry{PreparedFrame: raw})
+	return nil
+}
+
+func (r *replayer) findSession(version primitive.ProtocolVersion, keyspace string) (*proxycore.Session, error) {
+	key := replaySessionKey{version: version, keyspace: keyspace}
+	if session, ok := r.sessions[key]; ok {
+		return session, nil
+	}
+	session, err := proxycore.ConnectSession(r.ctx, r.cluster, proxycore.SessionConfig{
+		ReconnectPolicy:   r.config.ReconnectPolicy,
+		NumConns:          r.config.numConns,
+		Version:           version,
+		Auth:              r.config.Auth,
+		PreparedCache:     r.preparedCache,
+		Keyspace:          keyspace,
+		HeartBeatInterval: r.config.HeartBeatInterval,
+		ConnectTimeout:    r.config.ConnectTimeout,
+		IdleTimeout:       r.config.IdleTimeout,
+		Logger:            r.config.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.sessions[key] = session
+	return session, nil
+}
+
+func (r *replayer) send(record captureRecord, raw *frame.RawFrame) {
+	r.wg.Add(1)
+	req := &replayRequest{
+		replayer: r,
+		session:  r.sessions[replaySessionKey{version: record.Version, keyspace: record.Keyspace}],
+		record:   record,
+		frm:      raw,
+		qp:       r.lb.NewQueryPlan(),
+		start:    time.Now(),
+	}
+	req.mu.Lock()
+	req.timer = time.AfterFunc(r.config.timeout, req.onTimeout)
+	req.mu.Unlock()
+	req.Execute(true)
+}
+
+func (r *replayer) record(record captureRecord, latency time.Duration, result string) {
+	r.mu.Lock()
+	r.report.add(record, latency, result)
+	r.mu.Unlock()
+	<-r.inflight
+	r.wg.Done()
+}
+
+// replayRequest is a captured request sent to the target cluster. Like mirrored requests it's never retried on error.
+type replayRequest struct {
+	replayer   *replayer
+	session    *proxycore.Session
+	record     captureRecord
+	frm        *frame.RawFrame
+	qp         proxycore.QueryPlan
+	host       *proxycore.Host
+	start      time.Time
+	timer      *time.Timer
+	reprepared bool
+	done       bool
+	mu         sync.Mutex
+}
+
+func (r *replayRequest) Execute(next bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !next {
+		// Called after the query was prepared because of an unprepared error
+		if r.reprepared {
+			r.replayer.config.Logger.Debug("replayed request failed", zap.Error(errReplayPreparedIdMismatch))
+			r.finish(codeName(primitive.ErrorCodeUnprepared))
+			return
+		}
+		r.reprepared = true
+	}
+	for !r.done {
+		if next {
+			r.host = r.qp.Next()
+		}
+		if r.host == nil {
+			r.finish(replayResultNoHosts)
+		} else if err := r.session.Send(r.host, r); err == nil {
+			break
+		} else {
+			next = true
+		}
+	}
+}
+
+func (r *replayRequest) Frame() interface{} {
+	return r.frm
+}
+
+func (r *replayRequest) IsPrepareRequest() bool {
+	return r.frm.Header.OpCode == primitive.OpCodePrepare
+}
+
+func (r *replayRequest) OnClose(_ error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(replayResultClosed)
+}
+
+func (r *replayRequest) OnResult(raw *frame.RawFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := replayResultOK
+	if raw.Header.OpCode == primitive.OpCodeError {
+		result = codeName(primitive.ErrorCodeServerError)
+		if frm, err := codecs.CustomRawCodec.ConvertFromRawFrame(raw); err == nil {
+			if msg, ok := frm.Body.Message.(message.Error); ok {
+				result = codeName(msg.GetErrorCode())
+			}
+		}
+	}
+	r.finish(result)
+}
+
+func (r *replayRequest) onTimeout() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(replayResultTimeout)
+}
+
+// lock before using
+func (r *replayRequest) finish(result string) {
+	if !r.done {
+		r.done = true
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		r.replayer.record(r.record, time.Since(r.start), result)
+	}
+}
+
+// replayDifference is a request whose result on the target cluster differs from the captured result.
+type replayDifference struct {
+	opCode   string
+	captured string
+	replayed string
+}
+
+type replayReport struct {
+	replayed    int
+	skipped     int
+	duration    time.Duration
+	captured    []time.Duration // Captured latencies of the replayed requests
+	latencies   []time.Duration // Latencies on the target cluster
+	differences map[replayDifference]int
+}
+
+func (r *replayReport) add(record captureRecord, latency time.Duration, result string) {
+	r.replayed++
+	r.captured = append(r.captured, record.Latency)
+	r.latencies = append(r.latencies, latency)
+	captured := replayResultOK
+	if len(record.Error) > 0 {
+		captured = record.Error
+	}
+	if captured != result {
+		r.differences[replayDifference{opCode: record.OpCode, captured: captured, replayed: result}]++
+	}
+}
+
+func (r *replayReport) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Replayed %d requests in %s (%d requests handled by the proxy were skipped)\n\n",
+		r.replayed, r.duration.Round(time.Millisecond), r.skipped)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "Latency\tCaptured\tReplayed\tDifference")
+	captured, latencies := sortedDurations(r.captured), sortedDurations(r.latencies)
+	for _, p := range []struct {
+		name       string
+		percentile float64
+	}{{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}, {"max", 1}} {
+		c, l := percentile(captured, p.percentile), percentile(latencies, p.percentile)
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.name, c, l, l-c)
+	}
+	_ = tw.Flush()
+
+	if len(r.differences) == 0 {
+		_, _ = fmt.Fprintln(w, "\nNo result differences")
+		return
+	}
+
+	differences := make([]replayDifference, 0, len(r.differences))
+	for d := range r.differences {
+		differences = append(differences, d)
+	}
+	sort.Slice(differences, func(i, j int) bool {
+		return r.differences[differences[i]] > r.differences[differences[j]]
+	})
+	_, _ = fmt.Fprintln(w, "\nResult differences")
+	_, _ = fmt.Fprintln(tw, "OpCode\tCaptured\tReplayed\tCount")
+	for _, d := range differences {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", d.opCode, d.captured, d.replayed, r.differences[d])
+	}
+	_ = tw.Flush()
+}
+
+func sortedDurations(durations []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -16,9 +16,11 @@ package proxy
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/datastax/cql-proxy/codecs"
 	"github.com/datastax/cql-proxy/parser"
@@ -27,6 +29,8 @@ import (
 
 	"github.com/datastax/go-cassandra-native-protocol/frame"
 	"github.com/datastax/go-cassandra-native-protocol/message"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -40,10 +44,12 @@ const (
 
 type request struct {
 	client     *client
+	backend    *backend
 	session    *proxycore.Session
 	state      idempotentState
 	keyspace   string
 	msg        message.Message
+	payload    map[string][]byte // The request's custom payload
 	done       bool
 	retryCount int
 	host       *proxycore.Host
@@ -53,6 +59,12 @@ type request struct {
 	frm        interface{}
 	isSelect   bool // Only used for prepared statements currently
 	mu         sync.Mutex
+	cache      *resultCacheRequest
+	span       trace.Span // The client request's span
+	attempt    trace.Span // The span of the current backend attempt
+	comparison *readComparison
+	warnings   []string         // Added to the response, e.g. when the request's consistency level is downgraded
+	rule       *consistencyRule // The client's consistency rule that matched the request, nil if none matched
 }
 
 func (r *request) Execute(next bool) {
@@ -70,11 +82,15 @@ func (r *request) executeInternal(next bool) {
 		if r.host == nil {
 			r.done = true
 			r.send(&message.ServerError{ErrorMessage: "Proxy exhausted query plan and there are no more hosts available to try"})
+			r.span.SetStatus(codes.Error, "query plan exhausted")
+			r.span.End()
 		} else {
+			r.startAttempt()
 			err := r.session.Send(r.host, r)
 			if err == nil {
 				break
 			} else {
+				r.endAttemptWithDecision(RetryNext, err)
 				r.client.proxy.logger.Debug("failed to send request to host", zap.Stringer("host", r.host), zap.Error(err))
 			}
 		}
@@ -82,18 +98,32 @@ func (r *request) executeInternal(next bool) {
 }
 
 func (r *request) send(msg message.Message) {
+	r.client.maybeCaptureResponse(r.stream, msg)
 	_ = r.client.conn.Write(proxycore.SenderFunc(func(writer io.Writer) error {
 		return r.client.codec.EncodeFrame(frame.NewFrame(r.version, r.stream, msg), writer)
 	}))
 }
 
 func (r *request) sendRaw(raw *frame.RawFrame) {
+	raw = r.client.maybeRewriteResult(raw)
 	raw.Header.StreamId = r.stream
+	r.client.maybeCaptureRawResponse(r.stream, raw)
 	_ = r.client.conn.Write(proxycore.SenderFunc(func(writer io.Writer) error {
 		return r.client.codec.EncodeRawFrame(raw, writer)
 	}))
 }
 
+// maybePrepareOnAllHosts sends a successful PREPARE request to the session's other hosts so that they don't return an
+// unprepared error the first time the statement is executed on them.
+func (r *request) maybePrepareOnAllHosts(raw *frame.RawFrame) {
+	if !r.client.proxy.config.PrepareOnAllHosts || !r.IsPrepareRequest() || raw.Header.OpCode != primitive.OpCodeResult {
+		return
+	}
+	if prepare, ok := r.frm.(*frame.RawFrame); ok {
+		r.session.PrepareOnAllHosts(prepare, r.host)
+	}
+}
+
 func (r *request) Frame() interface{} {
 	return r.frm
 }
@@ -133,16 +163,20 @@ func (r *request) checkIdempotent() bool {
 	return isIdempotent == r.state
 }
 
-func (r *request) OnClose(_ error) {
+func (r *request) OnClose(err error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.checkIdempotent() {
+		r.endAttemptWithDecision(RetryNext, err)
 		r.executeInternal(true)
 	} else {
 		if !r.done {
 			r.done = true
+			r.endAttemptWithDecision(ReturnError, err)
 			r.send(&message.ServerError{ErrorMessage: "Proxy is unable to retry non-idempotent query after connection to backend cluster closed"})
+			r.span.SetStatus(codes.Error, "connection closed")
+			r.span.End()
 		}
 	}
 }
@@ -153,9 +187,25 @@ func (r *request) OnResult(raw *frame.RawFrame) {
 	if !r.done {
 		if raw.Header.OpCode != primitive.OpCodeError ||
 			!r.handleErrorResult(raw) { // If the error result is retried then we don't send back this response
-			r.client.maybeStorePreparedMetadata(raw, r.isSelect, r.msg)
+			prepare, _ := r.frm.(*frame.RawFrame)
+			r.client.maybeStorePreparedMetadata(raw, prepare, r.isSelect, r.keyspace, r.backend, r.msg, r.payload)
+			r.maybePrepareOnAllHosts(raw)
+			if r.cache != nil {
+				r.client.maybeStoreResult(r.cache, raw)
+			}
 			r.done = true
-			r.sendRaw(raw)
+			r.span.SetAttributes(attrResponse.String(raw.Header.OpCode.String()))
+			if raw.Header.OpCode == primitive.OpCodeError {
+				r.endAttemptWithDecision(ReturnError, errors.New("error response"))
+				r.span.SetStatus(codes.Error, "error response")
+			} else {
+				r.endAttempt(nil)
+			}
+			if r.comparison != nil {
+				r.comparison.setPrimary(raw)
+			}
+			r.sendRaw(r.maybeAddWarnings(raw))
+			r.span.End()
 		}
 	}
 }
@@ -208,6 +258,9 @@ func (r *request) handleErrorResult(raw *frame.RawFrame) (retried bool) {
 			}
 		case *message.IsBootstrapping:
 			decision = RetryNext
+			if policy, ok := r.client.proxy.config.RetryPolicy.(BootstrappingRetryPolicy); ok {
+				decision = policy.OnBootstrapping(msg, r.retryCount)
+			}
 			logger.Debug("retrying on bootstrapping error",
 				zap.Stringer("decision", decision),
 				zap.Int("retryCount", r.retryCount),
@@ -227,14 +280,14 @@ func (r *request) handleErrorResult(raw *frame.RawFrame) (retried bool) {
 			// Do nothing, return the error
 		}
 
+		if (decision == RetryNext || decision == RetrySame) && !r.maybeDowngradeConsistency(errMsg) {
+			decision = ReturnError
+		}
+
 		switch decision {
-		case RetryNext:
-			r.retryCount++
-			r.executeInternal(true)
-			retried = true
-		case RetrySame:
-			r.retryCount++
-			r.executeInternal(false)
+		case RetryNext, RetrySame:
+			r.endAttemptWithDecision(decision, errors.New(errMsg.GetErrorMessage()))
+			r.retry(decision == RetryNext)
 			retried = true
 		default:
 			// Do nothing, return the error
@@ -244,6 +297,124 @@ func (r *request) handleErrorResult(raw *frame.RawFrame) (retried bool) {
 	return retried
 }
 
+// maybeDowngradeConsistency changes the consistency level of the request if the retry policy retries it at a different
+// consistency level. It returns false if the request shouldn't be retried because the downgraded consistency level is
+// weaker than the minimum of the request's consistency rule.
+//
+// lock before using
+func (r *request) maybeDowngradeConsistency(errMsg message.Error) bool {
+	policy, ok := r.client.proxy.config.RetryPolicy.(ConsistencyRetryPolicy)
+	if !ok {
+		return true
+	}
+	consistency, ok := policy.RetryConsistency(errMsg)
+	if !ok {
+		return true
+	}
+	if r.rule != nil && !r.rule.allows(consistency) {
+		r.client.proxy.logger.Debug("not retrying request at a consistency level below the minimum",
+			zap.Stringer("consistency", consistency),
+			zap.Stringer("minimum", *r.rule.minimum),
+			zap.Stringer("error", errMsg.GetErrorCode()))
+		return false
+	}
+
+	// The client's message is shared, e.g. with the mirror, so the consistency level is changed on a copy
+	var previous primitive.ConsistencyLevel
+	switch msg := copyRequestMessage(r.msg).(type) {
+	case *codecs.PartialQuery:
+		previous, msg.Consistency = msg.Consistency, consistency
+		r.msg = msg
+	case *codecs.PartialExecute:
+		previous, msg.Consistency = msg.Consistency, consistency
+		r.msg = msg
+	case *codecs.PartialBatch:
+		previous, msg.Consistency = msg.Consistency, consistency
+		r.msg = msg
+	default:
+		return true
+	}
+
+	var header frame.Header
+	switch frm := r.frm.(type) {
+	case *frame.RawFrame:
+		header = *frm.Header
+	case *frame.Frame:
+		header = *frm.Header
+	default:
+		return true
+	}
+	frm := &frame.Frame{Header: &header, Body: &frame.Body{Message: r.msg}}
+	frm.SetCustomPayload(r.payload)
+	r.frm = frm
+
+	r.client.proxy.logger.Warn("downgrading consistency level of request to retry it",
+		zap.Stringer("from", previous),
+		zap.Stringer("to", consistency),
+		zap.Stringer("error", errMsg.GetErrorCode()),
+		zap.Stringer("host", r.host))
+	r.warnings = append(r.warnings,
+		fmt.Sprintf("Proxy retried the request at consistency level %v instead of %v after a %v error",
+			consistency, previous, errMsg.GetErrorCode()))
+	return true
+}
+
+// copyRequestMessage returns a shallow copy of a QUERY, EXECUTE or BATCH message so that its options can be changed
+// without affecting the original message. Other messages are returned as-is.
+func copyRequestMessage(msg message.Message) message.Message {
+	switch m := msg.(type) {
+	case *codecs.PartialQuery:
+		c := *m
+		return &c
+	case *codecs.PartialExecute:
+		c := *m
+		return &c
+	case *codecs.PartialBatch:
+		c := *m
+		return &c
+	}
+	return msg
+}
+
+// maybeAddWarnings adds the request's warnings, if any, to its response. Warnings are only supported by protocol v4+.
+func (r *request) maybeAddWarnings(raw *frame.RawFrame) *frame.RawFrame {
+	if len(r.warnings) == 0 || raw.Header.Version < primitive.ProtocolVersion4 {
+		return raw
+	}
+	frm, err := r.client.codec.ConvertFromRawFrame(raw)
+	if err != nil {
+		r.client.proxy.logger.Error("unable to decode response to add warnings", zap.Error(err))
+		return raw
+	}
+	frm.SetWarnings(append(frm.Body.Warnings, r.warnings...))
+	withWarnings, err := r.client.codec.ConvertToRawFrame(frm)
+	if err != nil {
+		r.client.proxy.logger.Error("unable to encode response with warnings", zap.Error(err))
+		return raw
+	}
+	return withWarnings
+}
+
+// retry executes the request again, after the retry policy's backoff delay if it has one. The delay is scheduled so
+// that it doesn't block the backend connection's other requests.
+//
+// lock before using
+func (r *request) retry(next bool) {
+	var delay time.Duration
+	if policy, ok := r.client.proxy.config.RetryPolicy.(RetryBackoffPolicy); ok {
+		delay = policy.RetryDelay(r.retryCount)
+	}
+	r.retryCount++
+	if delay <= 0 {
+		r.executeInternal(next)
+		return
+	}
+	r.client.proxy.logger.Debug("delaying retry", zap.Duration("delay", delay), zap.Int("retryCount", r.retryCount))
+	time.AfterFunc(delay, func() {
+		r.Execute(next)
+	})
+}
+
 func (r *request) isBatchIdempotent(batch *codecs.PartialBatch) (idempotent bool, err error) {
 	for _, query := range batch.Queries {
 		switch q := query.QueryOrId.(type) {
@@ -262,3 +433,33 @@ func (r *request) isBatchIdempotent(batch *codecs.PartialBatch) (idempotent bool
 	}
 	return true, nil
 }
+
+// startAttempt starts a span for sending the request to the current host.
+func (r *request) startAttempt() {
+	_, r.attempt = r.client.proxy.tracer.Start(trace.ContextWithSpan(r.client.ctx, r.span), "cql.attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attrHost.String(r.host.String()),
+			attrRetryCount.Int(r.retryCount),
+		))
+}
+
+// endAttemptWithDecision ends the current attempt's span recording the retry decision made after it failed.
+func (r *request) endAttemptWithDecision(decision RetryDecision, err error) {
+	if r.attempt != nil {
+		r.attempt.SetAttributes(attrRetryDecision.String(decision.String()))
+	}
+	r.endAttempt(err)
+}
+
+// endAttempt ends the current attempt's span recording the error, if any.
+func (r *request) endAttempt(err error) {
+	if r.attempt != nil {
+		if err != nil {
+			r.attempt.RecordError(err)
+			r.attempt.SetStatus(codes.Error, err.Error())
+		}
+		r.attempt.End()
+		r.attempt = nil
+	}
+}
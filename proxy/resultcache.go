@@ -0,0 +1,321 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/parser"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ResultCacheTable enables result caching for SELECT queries on a table.
+type ResultCacheTable struct {
+	Keyspace string        `yaml:"keyspace"`
+	Table    string        `yaml:"table"`
+	TTL      time.Duration `yaml:"ttl"`
+}
+
+// ResultCacheStats are the result cache's counters.
+type ResultCacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Stores        uint64 `json:"stores"`
+	Invalidations uint64 `json:"invalidations"`
+	Size          int    `json:"size"`
+}
+
+type tableKey struct {
+	keyspace string
+	table    string
+}
+
+func newTableKey(keyspace, table string) tableKey {
+	return tableKey{parser.IdentifierFromString(keyspace).ID(), parser.IdentifierFromString(table).ID()}
+}
+
+type cachedResult struct {
+	raw        *frame.RawFrame
+	generation uint64
+	expires    time.Time
+}
+
+// resultCache caches the "ROWS" results of SELECT queries for configured tables. Entries are invalidated by bumping
+// the generation of a table; entries stored with an older generation are never returned.
+type resultCache struct {
+	cache         *lru.Cache
+	ttls          map[tableKey]time.Duration
+	generations   map[tableKey]uint64
+	mu            *sync.RWMutex
+	hits          uint64
+	misses        uint64
+	stores        uint64
+	invalidations uint64
+}
+
+func newResultCache(size int, tables []ResultCacheTable) (*resultCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	ttls := make(map[tableKey]time.Duration)
+	generations := make(map[tableKey]uint64)
+	for _, t := range tables {
+		if t.TTL <= 0 {
+			return nil, fmt.Errorf("invalid TTL for result cache table '%s.%s', must be greater than 0 (provided: %s)",
+				t.Keyspace, t.Table, t.TTL)
+		}
+		key := newTableKey(t.Keyspace, t.Table)
+		ttls[key] = t.TTL
+		generations[key] = 0
+	}
+	return &resultCache{
+		cache:       cache,
+		ttls:        ttls,
+		generations: generations,
+		mu:          &sync.RWMutex{},
+	}, nil
+}
+
+// isCached returns true if the table's results are cached.
+func (r *resultCache) isCached(table tableKey) bool {
+	_, ok := r.ttls[table]
+	return ok
+}
+
+// generation returns the current generation of a table. It's captured before a request is sent so that results
+// racing with an invalidation are not stored.
+func (r *resultCache) generation(table tableKey) uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.generations[table]
+}
+
+func (r *resultCache) load(key string, table tableKey, now time.Time) (raw *frame.RawFrame, ok bool) {
+	if val, found := r.cache.Get(key); found {
+		entry := val.(*cachedResult)
+		if now.Before(entry.expires) && entry.generation == r.generation(table) {
+			atomic.AddUint64(&r.hits, 1)
+			return entry.raw, true
+		}
+		r.cache.Remove(key)
+	}
+	atomic.AddUint64(&r.misses, 1)
+	return nil, false
+}
+
+func (r *resultCache) store(key string, table tableKey, generation uint64, raw *frame.RawFrame, now time.Time) {
+	if generation != r.generation(table) {
+		return // Invalidated while the request was in-flight
+	}
+	r.cache.Add(key, &cachedResult{
+		raw:        copyRawFrame(raw),
+		generation: generation,
+		expires:    now.Add(r.ttls[table]),
+	})
+	atomic.AddUint64(&r.stores, 1)
+}
+
+// invalidate removes the results for a table. An empty table invalidates all tables in the keyspace.
+func (r *resultCache) invalidate(keyspace, table string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.generations {
+		if key.keyspace == keyspace && (len(table) == 0 || key.table == table) {
+			r.generations[key]++
+			atomic.AddUint64(&r.invalidations, 1)
+		}
+	}
+}
+
+// invalidateTables invalidates the tables modified by a write. All tables are invalidated if the modified tables are
+// unknown.
+func (r *resultCache) invalidateTables(tables []tableKey) {
+	if len(tables) == 0 {
+		r.invalidateAll()
+	}
+	for _, table := range tables {
+		r.invalidate(table.keyspace, table.table)
+	}
+}
+
+func (r *resultCache) invalidateAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.generations {
+		r.generations[key]++
+	}
+	atomic.AddUint64(&r.invalidations, 1)
+}
+
+func (r *resultCache) stats() ResultCacheStats {
+	return ResultCacheStats{
+		Hits:          atomic.LoadUint64(&r.hits),
+		Misses:        atomic.LoadUint64(&r.misses),
+		Stores:        atomic.LoadUint64(&r.stores),
+		Invalidations: atomic.LoadUint64(&r.invalidations),
+		Size:          r.cache.Len(),
+	}
+}
+
+// resultCacheKey builds a cache key from the parts of a request that determine its result. The default timestamp is
+// removed from the query parameters because drivers commonly generate a new one for every request. Requests using
+// continuous paging are not cached. The role is part of the key so that results read using proxy execution are only
+// returned to clients with the same role.
+func resultCacheKey(version primitive.ProtocolVersion, compression, keyspace, role string, opCode primitive.OpCode,
+	queryOrId []byte, consistency primitive.ConsistencyLevel, parameters []byte) (key string, ok bool) {
+	var buf bytes.Buffer
+	_ = primitive.WriteShort(uint16(consistency), &buf)
+	buf.Write(parameters)
+
+	options, err := message.DecodeQueryOptions(&buf, version)
+	if err != nil || options.ContinuousPagingOptions != nil {
+		return "", false
+	}
+	options.DefaultTimestamp = nil
+
+	buf.Reset()
+	buf.WriteByte(byte(version))
+	buf.WriteByte(byte(opCode))
+	_ = primitive.WriteString(compression, &buf)
+	_ = primitive.WriteString(keyspace, &buf)
+	_ = primitive.WriteString(role, &buf)
+	_ = primitive.WriteBytes(queryOrId, &buf)
+	if err = message.EncodeQueryOptions(options, &buf, version); err != nil {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+func copyRawFrame(raw *frame.RawFrame) *frame.RawFrame {
+	header := *raw.Header
+	return &frame.RawFrame{Header: &header, Body: raw.Body}
+}
+
+// isRowsResult returns true if the frame is a "ROWS" result. The body is compressed if compression is used so it
+// needs to be decoded to find the result type.
+func isRowsResult(codec frame.RawCodec, raw *frame.RawFrame) bool {
+	if raw.Header.OpCode != primitive.OpCodeResult {
+		return false
+	}
+	frm, err := codec.ConvertFromRawFrame(raw)
+	if err != nil {
+		return false
+	}
+	_, ok := frm.Body.Message.(*message.RowsResult)
+	return ok
+}
+
+// resultCacheRequest is the result cache state of an in-flight request.
+type resultCacheRequest struct {
+	key        string // Only set for a SELECT whose result can be cached
+	table      tableKey
+	generation uint64
+	writes     []tableKey // The tables modified by a write; nil if unknown
+}
+
+// findTables returns the tables referenced by a query. It returns nil if the query can't be parsed.
+func findTables(keyspace, query string) (tables []tableKey) {
+	refs, err := parser.FindTableRefs(query)
+	if err != nil {
+		return nil
+	}
+	for _, ref := range refs {
+		ks, table := ref.QualifiedID(keyspace)
+		tables = append(tables, tableKey{ks, table})
+	}
+	return tables
+}
+
+// maybeUseResultCache returns true if the request was answered from the result cache. Otherwise, it records the state
+// needed to store the request's result or to invalidate the tables modified by the request.
+func (c *client) maybeUseResultCache(req *request, raw *frame.RawFrame, body *frame.Body) (hit bool) {
+	cache := c.proxy.resultCache
+
+	var (
+		tables []tableKey
+		key    string
+		ok     bool
+	)
+
+	switch msg := body.Message.(type) {
+	case *codecs.PartialQuery:
+		tables = findTables(c.keyspace, msg.Query)
+		if req.isSelect {
+			key, ok = resultCacheKey(raw.Header.Version, c.compression, c.keyspace, c.role, raw.Header.OpCode,
+				[]byte(msg.Query), msg.Consistency, msg.Parameters)
+		}
+	case *codecs.PartialExecute:
+		tables = c.proxy.preparedTables(msg.QueryId)
+		if req.isSelect {
+			key, ok = resultCacheKey(raw.Header.Version, c.compression, c.keyspace, c.role, raw.Header.OpCode,
+				msg.QueryId, msg.Consistency, msg.Parameters)
+		}
+	case *codecs.PartialBatch:
+		for _, query := range msg.Queries {
+			var queryTables []tableKey
+			switch q := query.QueryOrId.(type) {
+			case string:
+				queryTables = findTables(c.keyspace, q)
+			case []byte:
+				queryTables = c.proxy.preparedTables(q)
+			}
+			if len(queryTables) == 0 {
+				tables = nil
+				break
+			}
+			tables = append(tables, queryTables...)
+		}
+	default:
+		return false
+	}
+
+	if req.isSelect {
+		if ok && len(tables) == 1 && cache.isCached(tables[0]) {
+			table := tables[0]
+			if cached, found := cache.load(key, table, time.Now()); found {
+				req.sendRaw(copyRawFrame(cached))
+				return true
+			}
+			req.cache = &resultCacheRequest{key: key, table: table, generation: cache.generation(table)}
+		}
+	} else {
+		// Invalidate before the write is sent and again after it completes so that a read that starts during the
+		// write doesn't cache the previous value.
+		cache.invalidateTables(tables)
+		req.cache = &resultCacheRequest{writes: tables}
+	}
+	return false
+}
+
+// maybeStoreResult stores the result of a cacheable SELECT or invalidates the tables modified by a completed write.
+func (c *client) maybeStoreResult(cr *resultCacheRequest, raw *frame.RawFrame) {
+	cache := c.proxy.resultCache
+	if len(cr.key) > 0 {
+		if isRowsResult(c.codec, raw) {
+			cache.store(cr.key, cr.table, cr.generation, raw, time.Now())
+		}
+	} else {
+		cache.invalidateTables(cr.writes)
+	}
+}
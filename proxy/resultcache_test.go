@@ -0,0 +1,157 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ResultCache(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	queries := make(map[string]int)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				query := frm.Body.Message.(*message.Query).Query
+				if !strings.Contains(query, "ks.") {
+					return proxycore.MockDefaultQueryHandler(cl, frm)
+				}
+				mu.Lock()
+				queries[query]++
+				mu.Unlock()
+				if strings.HasPrefix(query, "SELECT") {
+					return &message.RowsResult{
+						Metadata: &message.RowsMetadata{
+							ColumnCount: 1,
+							Columns: []*message.ColumnMetadata{
+								{Keyspace: "ks", Table: "cached", Name: "v", Type: datatype.Int},
+							},
+						},
+						Data: message.RowSet{message.Row{message.Column{0, 0, 0, 1}}},
+					}
+				}
+				return &message.VoidResult{}
+			},
+		},
+		resultCacheTables: []ResultCacheTable{{Keyspace: "ks", Table: "cached", TTL: time.Minute}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	count := func(query string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[query]
+	}
+
+	query := func(query string, key int32, timestamp int64) {
+		resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{
+			Query: query,
+			Options: &message.QueryOptions{
+				Consistency:      primitive.ConsistencyLevelLocalQuorum,
+				PositionalValues: []*primitive.Value{primitive.NewValue([]byte{0, 0, 0, byte(key)})},
+				DefaultTimestamp: &timestamp,
+			},
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, primitive.OpCodeResult, resp.Header.OpCode)
+	}
+
+	const cachedQuery = "SELECT v FROM ks.cached WHERE k = ?"
+	const otherQuery = "SELECT v FROM ks.other WHERE k = ?"
+	const writeQuery = "UPDATE ks.cached SET v = 2 WHERE k = ?"
+
+	query(cachedQuery, 1, 1)
+	query(cachedQuery, 1, 2) // A different default timestamp is still a hit
+	query(cachedQuery, 1, 3)
+	assert.Equal(t, 1, count(cachedQuery))
+
+	query(cachedQuery, 2, 4) // Different bound values
+	assert.Equal(t, 2, count(cachedQuery))
+
+	query(otherQuery, 1, 5) // Not a cached table
+	query(otherQuery, 1, 6)
+	assert.Equal(t, 2, count(otherQuery))
+
+	query(writeQuery, 1, 7) // Invalidates the table
+	query(cachedQuery, 1, 8)
+	assert.Equal(t, 3, count(cachedQuery))
+	query(cachedQuery, 1, 9)
+	assert.Equal(t, 3, count(cachedQuery))
+
+	tester.proxy.OnEvent(&proxycore.SchemaChangeEvent{Message: &message.SchemaChangeEvent{
+		ChangeType: primitive.SchemaChangeTypeUpdated,
+		Target:     primitive.SchemaChangeTargetTable,
+		Keyspace:   "ks",
+		Object:     "cached",
+	}})
+	query(cachedQuery, 1, 10)
+	assert.Equal(t, 4, count(cachedQuery))
+
+	stats, ok := tester.proxy.ResultCacheStats()
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(4), stats.Misses)
+	assert.Equal(t, uint64(4), stats.Stores)
+}
+
+func TestResultCache_Expires(t *testing.T) {
+	cache, err := newResultCache(10, []ResultCacheTable{{Keyspace: "ks", Table: "tbl", TTL: time.Second}})
+	require.NoError(t, err)
+
+	table := newTableKey("ks", "tbl")
+	raw := &frame.RawFrame{Header: &frame.Header{OpCode: primitive.OpCodeResult}}
+	now := time.Now()
+
+	cache.store("key", table, cache.generation(table), raw, now)
+	_, ok := cache.load("key", table, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	_, ok = cache.load("key", table, now.Add(2*time.Second))
+	assert.False(t, ok)
+
+	generation := cache.generation(table)
+	cache.invalidate("ks", "")
+	cache.store("key", table, generation, raw, now) // Invalidated while in-flight
+	_, ok = cache.load("key", table, now)
+	assert.False(t, ok)
+}
+
+func TestResultCache_InvalidTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		_, err := newResultCache(10, []ResultCacheTable{{Keyspace: "ks", Table: "tbl", TTL: ttl}})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+const (
+	defaultRetryBackoffJitter = 0.5
+	// defaultRetryBackoffMaxDelayFactor is the max delay, as a multiple of the base delay, when it isn't configured
+	defaultRetryBackoffMaxDelayFactor = 16
+)
+
+// BootstrappingRetryPolicy is an optional interface implemented by retry policies that handle bootstrapping errors.
+// Without it, requests that fail because the host is bootstrapping are always retried on the next host.
+type BootstrappingRetryPolicy interface {
+	// OnBootstrapping handles the retry decision for a host that's bootstrapping (Is_bootstrapping = 0x1002).
+	OnBootstrapping(msg *message.IsBootstrapping, retryCount int) RetryDecision
+}
+
+// RetryBackoffPolicy is an optional interface implemented by retry policies that delay retries.
+type RetryBackoffPolicy interface {
+	// RetryDelay returns how long to wait before retrying a request that has been retried `retryCount` times.
+	RetryDelay(retryCount int) time.Duration
+}
+
+// RetryRule configures the retries of a class of errors. A rule with zero max retries never retries.
+type RetryRule struct {
+	MaxRetries int    `yaml:"max-retries"`
+	Host       string `yaml:"host"` // Either "same" or "next", uses the error class's default if empty
+}
+
+// RetryBackoff configures the delay before retrying a request. The delay starts at the base delay and doubles for
+// each retry up to the max delay, which is 16 times the base delay if it's not set. Jitter is the fraction of the delay
+// that's randomized, between 0 and 1.
+type RetryBackoff struct {
+	BaseDelay time.Duration `yaml:"base-delay"`
+	MaxDelay  time.Duration `yaml:"max-delay"`
+	Jitter    *float64      `yaml:"jitter"`
+}
+
+// RetryPolicyConfig is a declarative retry policy. Error classes without a rule use the default retry policy's
+// behavior. Write timeout rules are keyed by the error's write type, e.g. "simple", "batch_log" or "cas".
+type RetryPolicyConfig struct {
+	ReadTimeout   *RetryRule            `yaml:"read-timeout"`
+	WriteTimeout  map[string]*RetryRule `yaml:"write-timeout"`
+	Unavailable   *RetryRule            `yaml:"unavailable"`
+	Overloaded    *RetryRule            `yaml:"overloaded"`
+	ServerError   *RetryRule            `yaml:"server-error"`
+	Bootstrapping *RetryRule            `yaml:"bootstrapping"`
+	Backoff       RetryBackoff          `yaml:"backoff"`
+}
+
+type retryRule struct {
+	maxRetries int
+	decision   RetryDecision
+}
+
+func (r retryRule) decide(retryCount int) RetryDecision {
+	if retryCount < r.maxRetries {
+		return r.decision
+	}
+	return ReturnError
+}
+
+type configRetryPolicy struct {
+	readTimeout   *retryRule
+	writeTimeout  map[primitive.WriteType]retryRule
+	unavailable   *retryRule
+	overloaded    *retryRule
+	serverError   *retryRule
+	bootstrapping *retryRule
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	jitter        float64
+}
+
+// NewConfigRetryPolicy creates a retry policy from its configuration.
+func NewConfigRetryPolicy(config RetryPolicyConfig) (RetryPolicy, error) {
+	var err error
+	policy := &configRetryPolicy{
+		writeTimeout: make(map[primitive.WriteType]retryRule),
+		baseDelay:    config.Backoff.BaseDelay,
+		maxDelay:     config.Backoff.MaxDelay,
+		jitter:       defaultRetryBackoffJitter,
+	}
+	if policy.readTimeout, err = newRetryRule("read-timeout", config.ReadTimeout, RetrySame); err != nil {
+		return nil, err
+	}
+	for name, rule := range config.WriteTimeout {
+		writeType := primitive.WriteType(strings.ToUpper(name))
+		if !writeType.IsValid() && writeType != primitive.WriteTypeCas { // "CAS" isn't considered valid by the protocol library
+			return nil, fmt.Errorf("invalid write type '%s' in retry policy 'write-timeout'", name)
+		}
+		r, err := newRetryRule("write-timeout", rule, RetrySame)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			policy.writeTimeout[writeType] = *r
+		}
+	}
+	if policy.unavailable, err = newRetryRule("unavailable", config.Unavailable, RetryNext); err != nil {
+		return nil, err
+	}
+	if policy.overloaded, err = newRetryRule("overloaded", config.Overloaded, RetryNext); err != nil {
+		return nil, err
+	}
+	if policy.serverError, err = newRetryRule("server-error", config.ServerError, RetryNext); err != nil {
+		return nil, err
+	}
+	if policy.bootstrapping, err = newRetryRule("bootstrapping", config.Bootstrapping, RetryNext); err != nil {
+		return nil, err
+	}
+	if config.Backoff.Jitter != nil {
+		policy.jitter = *config.Backoff.Jitter
+	}
+	if policy.baseDelay < 0 || policy.maxDelay < 0 {
+		return nil, fmt.Errorf("retry policy backoff delays must not be negative")
+	}
+	if policy.maxDelay == 0 {
+		policy.maxDelay = policy.baseDelay * defaultRetryBackoffMaxDelayFactor
+	} else if policy.maxDelay < policy.baseDelay {
+		return nil, fmt.Errorf("retry policy backoff max delay must be greater than or equal to its base delay")
+	}
+	if policy.jitter < 0 || policy.jitter > 1 {
+		return nil, fmt.Errorf("retry policy backoff jitter must be between 0 and 1")
+	}
+	return policy, nil
+}
+
+func newRetryRule(class string, rule *RetryRule, defaultDecision RetryDecision) (*retryRule, error) {
+	if rule == nil {
+		return nil, nil
+	}
+	if rule.MaxRetries < 0 {
+		return nil, fmt.Errorf("retry policy '%s' max retries must not be negative", class)
+	}
+	r := &retryRule{maxRetries: rule.MaxRetries, decision: defaultDecision}
+	switch strings.ToLower(rule.Host) {
+	case "":
+	case "same":
+		r.decision = RetrySame
+	case "next":
+		r.decision = RetryNext
+	default:
+		return nil, fmt.Errorf("invalid host '%s' in retry policy '%s', expected 'same' or 'next'", rule.Host, class)
+	}
+	return r, nil
+}
+
+func (p *configRetryPolicy) OnReadTimeout(msg *message.ReadTimeout, retryCount int) RetryDecision {
+	if p.readTimeout != nil {
+		return p.readTimeout.decide(retryCount)
+	}
+	return defaultRetryPolicyInstance.OnReadTimeout(msg, retryCount)
+}
+
+func (p *configRetryPolicy) OnWriteTimeout(msg *message.WriteTimeout, retryCount int) RetryDecision {
+	if rule, ok := p.writeTimeout[msg.WriteType]; ok {
+		return rule.decide(retryCount)
+	}
+	return defaultRetryPolicyInstance.OnWriteTimeout(msg, retryCount)
+}
+
+func (p *configRetryPolicy) OnUnavailable(msg *message.Unavailable, retryCount int) RetryDecision {
+	if p.unavailable != nil {
+		return p.unavailable.decide(retryCount)
+	}
+	return defaultRetryPolicyInstance.OnUnavailable(msg, retryCount)
+}
+
+func (p *configRetryPolicy) OnErrorResponse(msg message.Error, retryCount int) RetryDecision {
+	switch msg.GetErrorCode() {
+	case primitive.ErrorCodeOverloaded:
+		if p.overloaded != nil {
+			return p.overloaded.decide(retryCount)
+		}
+	case primitive.ErrorCodeServerError:
+		if p.serverError != nil {
+			return p.serverError.decide(retryCount)
+		}
+	}
+	return defaultRetryPolicyInstance.OnErrorResponse(msg, retryCount)
+}
+
+func (p *configRetryPolicy) OnBootstrapping(_ *message.IsBootstrapping, retryCount int) RetryDecision {
+	if p.bootstrapping != nil {
+		return p.bootstrapping.decide(retryCount)
+	}
+	return RetryNext
+}
+
+// RetryDelay uses an exponential backoff where a random part of the delay, up to the jitter fraction, is removed so
+// that retries from many clients are spread out.
+func (p *configRetryPolicy) RetryDelay(retryCount int) time.Duration {
+	if p.baseDelay == 0 {
+		return 0
+	}
+	delay := p.maxDelay
+	if retryCount < 32 && p.baseDelay<<retryCount < p.maxDelay && p.baseDelay<<retryCount > 0 {
+		delay = p.baseDelay << retryCount
+	}
+	if p.jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.jitter * float64(delay))
+	}
+	return delay
+}
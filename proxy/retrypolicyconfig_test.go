@@ -0,0 +1,113 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRetryPolicy(t *testing.T) {
+	policy, err := NewConfigRetryPolicy(RetryPolicyConfig{
+		ReadTimeout: &RetryRule{MaxRetries: 2},
+		WriteTimeout: map[string]*RetryRule{
+			"simple": {MaxRetries: 1, Host: "next"},
+			"cas":    {MaxRetries: 0},
+		},
+		Overloaded: &RetryRule{MaxRetries: 3, Host: "same"},
+	})
+	require.NoError(t, err)
+
+	readTimeout := &message.ReadTimeout{Received: 1, BlockFor: 2, DataPresent: true}
+	assert.Equal(t, RetrySame, policy.OnReadTimeout(readTimeout, 0))
+	assert.Equal(t, RetrySame, policy.OnReadTimeout(readTimeout, 1))
+	assert.Equal(t, ReturnError, policy.OnReadTimeout(readTimeout, 2))
+
+	assert.Equal(t, RetryNext, policy.OnWriteTimeout(&message.WriteTimeout{WriteType: primitive.WriteTypeSimple}, 0))
+	assert.Equal(t, ReturnError, policy.OnWriteTimeout(&message.WriteTimeout{WriteType: primitive.WriteTypeSimple}, 1))
+	assert.Equal(t, ReturnError, policy.OnWriteTimeout(&message.WriteTimeout{WriteType: primitive.WriteTypeCas}, 0))
+	// Write types without a rule use the default policy
+	assert.Equal(t, RetrySame, policy.OnWriteTimeout(&message.WriteTimeout{WriteType: primitive.WriteTypeBatchLog}, 0))
+
+	assert.Equal(t, RetrySame, policy.OnErrorResponse(&message.Overloaded{}, 2))
+	assert.Equal(t, ReturnError, policy.OnErrorResponse(&message.Overloaded{}, 3))
+	assert.Equal(t, RetryNext, policy.OnErrorResponse(&message.ServerError{}, 5))
+	assert.Equal(t, ReturnError, policy.OnErrorResponse(&message.WriteFailure{}, 0))
+
+	assert.Equal(t, RetryNext, policy.OnUnavailable(&message.Unavailable{}, 0))
+	assert.Equal(t, ReturnError, policy.OnUnavailable(&message.Unavailable{}, 1))
+
+	assert.Equal(t, time.Duration(0), policy.(RetryBackoffPolicy).RetryDelay(0))
+}
+
+func TestConfigRetryPolicy_Backoff(t *testing.T) {
+	jitter := 0.0
+	policy, err := NewConfigRetryPolicy(RetryPolicyConfig{
+		Backoff: RetryBackoff{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Jitter: &jitter},
+	})
+	require.NoError(t, err)
+
+	backoff := policy.(RetryBackoffPolicy)
+	assert.Equal(t, 10*time.Millisecond, backoff.RetryDelay(0))
+	assert.Equal(t, 20*time.Millisecond, backoff.RetryDelay(1))
+	assert.Equal(t, 40*time.Millisecond, backoff.RetryDelay(2))
+	assert.Equal(t, 50*time.Millisecond, backoff.RetryDelay(3))
+	assert.Equal(t, 50*time.Millisecond, backoff.RetryDelay(100))
+
+	// Without a max delay, the delay grows up to 16 times the base delay
+	policy, err = NewConfigRetryPolicy(RetryPolicyConfig{
+		Backoff: RetryBackoff{BaseDelay: 10 * time.Millisecond, Jitter: &jitter},
+	})
+	require.NoError(t, err)
+	backoff = policy.(RetryBackoffPolicy)
+	assert.Equal(t, 10*time.Millisecond, backoff.RetryDelay(0))
+	assert.Equal(t, 20*time.Millisecond, backoff.RetryDelay(1))
+	assert.Equal(t, 80*time.Millisecond, backoff.RetryDelay(3))
+	assert.Equal(t, 160*time.Millisecond, backoff.RetryDelay(4))
+	assert.Equal(t, 160*time.Millisecond, backoff.RetryDelay(100))
+
+	policy, err = NewConfigRetryPolicy(RetryPolicyConfig{
+		Backoff: RetryBackoff{BaseDelay: 100 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		delay := policy.(RetryBackoffPolicy).RetryDelay(i)
+		maxDelay := 100 * time.Millisecond << min(i, 4)
+		assert.GreaterOrEqual(t, delay, maxDelay/2)
+		assert.LessOrEqual(t, delay, maxDelay)
+	}
+}
+
+func TestConfigRetryPolicy_Invalid(t *testing.T) {
+	var tests = []struct {
+		msg    string
+		config RetryPolicyConfig
+	}{
+		{"invalid host", RetryPolicyConfig{Unavailable: &RetryRule{MaxRetries: 1, Host: "other"}}},
+		{"negative max retries", RetryPolicyConfig{ReadTimeout: &RetryRule{MaxRetries: -1}}},
+		{"invalid write type", RetryPolicyConfig{WriteTimeout: map[string]*RetryRule{"invalid": {MaxRetries: 1}}}},
+		{"max delay less than base delay", RetryPolicyConfig{Backoff: RetryBackoff{BaseDelay: time.Second, MaxDelay: time.Millisecond}}},
+	}
+
+	for _, tt := range tests {
+		_, err := NewConfigRetryPolicy(tt.config)
+		assert.Error(t, err, tt.msg)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/parser"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+// KeyspaceRewrite renames a keyspace for a set of clients. Clients use the keyspace name `From` and the proxy uses the
+// keyspace name `To` when talking to the backend.
+type KeyspaceRewrite struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Clients are the CIDRs of the clients the rewrite applies to. If empty, it applies to all clients.
+	Clients []string `yaml:"clients"`
+}
+
+type keyspaceRewriteRule struct {
+	from    string
+	to      string
+	clients []*net.IPNet
+}
+
+func newKeyspaceRewriteRules(rewrites []KeyspaceRewrite) ([]keyspaceRewriteRule, error) {
+	rules := make([]keyspaceRewriteRule, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		if len(rewrite.From) == 0 || len(rewrite.To) == 0 {
+			return nil, fmt.Errorf("keyspace rewrite requires both 'from' and 'to' keyspaces")
+		}
+		rule := keyspaceRewriteRule{
+			from: parser.IdentifierFromString(rewrite.From).ID(),
+			to:   parser.IdentifierFromString(rewrite.To).ID(),
+		}
+		var err error
+		if rule.clients, err = parseClientCIDRs(rewrite.Clients); err != nil {
+			return nil, fmt.Errorf("invalid client CIDR for keyspace rewrite '%s': %w", rewrite.From, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r keyspaceRewriteRule) matches(ip net.IP) bool {
+	return clientsContain(r.clients, ip)
+}
+
+// keyspaceRewriter maps keyspace IDs between the names used by a client and the names used by the backend.
+type keyspaceRewriter struct {
+	toBackend map[string]string
+	toClient  map[string]string
+}
+
+// newKeyspaceRewriter returns the rewriter for a client's address or nil if no rewrite rules apply to the client. The
+// first matching rule for a keyspace wins.
+func (p *Proxy) newKeyspaceRewriter(addr net.Addr) *keyspaceRewriter {
+	if len(p.rewriteRules) == 0 {
+		return nil
+	}
+	ip := addrIP(addr)
+	var rewriter *keyspaceRewriter
+	for _, rule := range p.rewriteRules {
+		if !rule.matches(ip) {
+			continue
+		}
+		if rewriter == nil {
+			rewriter = &keyspaceRewriter{
+				toBackend: make(map[string]string),
+				toClient:  make(map[string]string),
+			}
+		}
+		if _, ok := rewriter.toBackend[rule.from]; ok {
+			continue
+		}
+		if _, ok := rewriter.toClient[rule.to]; ok {
+			p.logger.Warn("ignoring keyspace rewrite that maps multiple keyspaces to the same backend keyspace",
+				zap.String("from", rule.from),
+				zap.String("to", rule.to),
+				zap.Stringer("client", addr))
+			continue
+		}
+		rewriter.toBackend[rule.from] = rule.to
+		rewriter.toClient[rule.to] = rule.from
+	}
+	return rewriter
+}
+
+// backendKeyspace returns the backend's name for a client keyspace. The keyspace is a CQL identifier that might be
+// quoted and the result is also a CQL identifier.
+func (r *keyspaceRewriter) backendKeyspace(keyspace string) string {
+	if to, ok := r.toBackend[parser.IdentifierFromString(keyspace).ID()]; ok {
+		return parser.QuoteID(to)
+	}
+	return keyspace
+}
+
+// rewriteQuery rewrites the keyspaces referenced by a query. An error is returned if the query can't be parsed because
+// it might reference a keyspace that should be rewritten.
+func (r *keyspaceRewriter) rewriteQuery(query string) (string, bool, error) {
+	return parser.RewriteKeyspaces(query, func(keyspace string) (string, bool) {
+		to, ok := r.toBackend[keyspace]
+		return to, ok
+	})
+}
+
+// clientID returns the client's name for a backend keyspace ID.
+func (r *keyspaceRewriter) clientID(keyspace string) (string, bool) {
+	from, ok := r.toClient[keyspace]
+	return from, ok
+}
+
+// maybeRewriteRequest rewrites the keyspaces referenced by a client's request to their backend names. The returned
+// frame is re-encoded if anything changed; otherwise, the original frame is returned. A nil frame is returned if the
+// request was rejected because one of its queries can't be rewritten.
+func (c *client) maybeRewriteRequest(raw *frame.RawFrame, body *frame.Body) (*frame.RawFrame, error) {
+	r := c.rewriter
+	if r == nil {
+		return raw, nil
+	}
+	changed := false
+	rewrite := func(query string) (string, error) {
+		rewritten, ok, err := r.rewriteQuery(query)
+		changed = changed || ok
+		return rewritten, err
+	}
+	reject := func(query string) (*frame.RawFrame, error) {
+		c.proxy.logger.Debug("rejecting query whose keyspaces can't be rewritten", zap.String("query", query))
+		c.send(raw.Header, &message.Invalid{
+			ErrorMessage: fmt.Sprintf("Proxy is unable to rewrite the keyspaces of query: %s", query),
+		})
+		return nil, nil
+	}
+	switch msg := body.Message.(type) {
+	case *message.Prepare:
+		var err error
+		if msg.Query, err = rewrite(msg.Query); err != nil {
+			return reject(msg.Query)
+		}
+		if len(msg.Keyspace) > 0 {
+			if keyspace := r.backendKeyspace(msg.Keyspace); keyspace != msg.Keyspace {
+				msg.Keyspace = keyspace
+				changed = true
+			}
+		}
+	case *codecs.PartialQuery:
+		var err error
+		if msg.Query, err = rewrite(msg.Query); err != nil {
+			return reject(msg.Query)
+		}
+	case *codecs.PartialBatch:
+		for i := range msg.Queries {
+			if query, ok := msg.Queries[i].QueryOrId.(string); ok {
+				var err error
+				if msg.Queries[i].QueryOrId, err = rewrite(query); err != nil {
+					return reject(query)
+				}
+			}
+		}
+	}
+	if !changed {
+		return raw, nil
+	}
+	return c.codec.ConvertToRawFrame(&frame.Frame{Header: raw.Header, Body: body})
+}
+
+// maybeRewriteResult rewrites the keyspaces in a result from a backend to the client's names. The original frame is
+// returned if nothing changed or the result can't be rewritten.
+func (c *client) maybeRewriteResult(raw *frame.RawFrame) *frame.RawFrame {
+	if c.rewriter == nil || raw.Header.OpCode != primitive.OpCodeResult {
+		return raw
+	}
+	frm, err := c.codec.ConvertFromRawFrame(raw)
+	if err != nil {
+		c.proxy.logger.Error("unable to decode result to rewrite keyspaces", zap.Error(err))
+		return raw
+	}
+	if !c.rewriter.rewriteResult(frm.Body.Message) {
+		return raw
+	}
+	rewritten, err := c.codec.ConvertToRawFrame(frm)
+	if err != nil {
+		c.proxy.logger.Error("unable to encode result with rewritten keyspaces", zap.Error(err))
+		return raw
+	}
+	return rewritten
+}
+
+// rewriteResult rewrites the keyspaces in a result message to the client's names. It returns true if the message was
+// changed.
+func (r *keyspaceRewriter) rewriteResult(msg message.Message) bool {
+	switch m := msg.(type) {
+	case *message.RowsResult:
+		if m.Metadata != nil {
+			return r.rewriteColumns(m.Metadata.Columns)
+		}
+	case *message.PreparedResult:
+		changed := false
+		if m.VariablesMetadata != nil && r.rewriteColumns(m.VariablesMetadata.Columns) {
+			changed = true
+		}
+		if m.ResultMetadata != nil && r.rewriteColumns(m.ResultMetadata.Columns) {
+			changed = true
+		}
+		return changed
+	case *message.SetKeyspaceResult:
+		return r.rewriteKeyspace(&m.Keyspace)
+	case *message.SchemaChangeResult:
+		return r.rewriteKeyspace(&m.Keyspace)
+	}
+	return false
+}
+
+func (r *keyspaceRewriter) rewriteColumns(columns []*message.ColumnMetadata) bool {
+	changed := false
+	for _, column := range columns {
+		if r.rewriteKeyspace(&column.Keyspace) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (r *keyspaceRewriter) rewriteKeyspace(keyspace *string) bool {
+	if from, ok := r.clientID(*keyspace); ok {
+		*keyspace = from
+		return true
+	}
+	return false
+}
+
+// rewriteEvent returns a copy of a schema change event that uses the client's keyspace name, or nil if the event's
+// keyspace isn't rewritten.
+func (r *keyspaceRewriter) rewriteEvent(evt *message.SchemaChangeEvent) *message.SchemaChangeEvent {
+	from, ok := r.clientID(evt.Keyspace)
+	if !ok {
+		return nil
+	}
+	rewritten := *evt
+	rewritten.Keyspace = from
+	return &rewritten
+}
@@ -0,0 +1,150 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_KeyspaceRewrites(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	var received []string
+
+	columns := []*message.ColumnMetadata{
+		{Keyspace: "staging_orders", Table: "t", Name: "k", Type: datatype.Int},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				query := frm.Body.Message.(*message.Query).Query
+				mu.Lock()
+				received = append(received, query)
+				mu.Unlock()
+				if strings.HasPrefix(query, "CREATE TABLE") {
+					return &message.SchemaChangeResult{
+						ChangeType: primitive.SchemaChangeTypeCreated,
+						Target:     primitive.SchemaChangeTargetTable,
+						Keyspace:   "staging_orders",
+						Object:     "t2",
+					}
+				}
+				return &message.RowsResult{
+					Metadata: &message.RowsMetadata{ColumnCount: 1, Columns: columns},
+					Data:     message.RowSet{{{0, 0, 0, 1}}},
+				}
+			},
+			primitive.OpCodePrepare: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				query := frm.Body.Message.(*message.Prepare).Query
+				mu.Lock()
+				received = append(received, query)
+				mu.Unlock()
+				id := md5.Sum([]byte(query))
+				return &message.PreparedResult{
+					PreparedQueryId:   id[:],
+					VariablesMetadata: &message.VariablesMetadata{Columns: columns},
+				}
+			},
+		},
+		keyspaceRewrites: []KeyspaceRewrite{{From: "orders", To: "staging_orders"}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	lastReceived := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(received) == 0 {
+			return ""
+		}
+		return received[len(received)-1]
+	}
+
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "SELECT k FROM orders.t"}))
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT k FROM staging_orders.t", lastReceived())
+	rows, ok := resp.Body.Message.(*message.RowsResult)
+	require.True(t, ok, "expected rows result")
+	assert.Equal(t, "orders", rows.Metadata.Columns[0].Keyspace)
+
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Prepare{Query: "INSERT INTO orders.t (k) VALUES (?)"}))
+	require.NoError(t, err)
+	assert.Equal(t, "INSERT INTO staging_orders.t (k) VALUES (?)", lastReceived())
+	prepared, ok := resp.Body.Message.(*message.PreparedResult)
+	require.True(t, ok, "expected prepared result")
+	assert.Equal(t, "orders", prepared.VariablesMetadata.Columns[0].Keyspace)
+
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "USE orders"}))
+	require.NoError(t, err)
+	setKeyspace, ok := resp.Body.Message.(*message.SetKeyspaceResult)
+	require.True(t, ok, "expected set keyspace result")
+	assert.Equal(t, "orders", setKeyspace.Keyspace)
+
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "CREATE TABLE t2 (k int PRIMARY KEY)"}))
+	require.NoError(t, err)
+	schemaChange, ok := resp.Body.Message.(*message.SchemaChangeResult)
+	require.True(t, ok, "expected schema change result")
+	assert.Equal(t, "orders", schemaChange.Keyspace)
+
+	// Keyspaces without a rewrite are unchanged
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "SELECT k FROM other.t"}))
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT k FROM other.t", lastReceived())
+
+	_, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "DROP TABLE orders.t"}))
+	require.NoError(t, err)
+	assert.Equal(t, "DROP TABLE staging_orders.t", lastReceived())
+
+	// Statements whose keyspaces can't be found are rejected instead of being sent as-is
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: "DESCRIBE TABLE orders.t"}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.Invalid{}, resp.Body.Message)
+	assert.Equal(t, "DROP TABLE staging_orders.t", lastReceived())
+}
+
+func TestProxy_KeyspaceRewritesInvalidCIDR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tester, _, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		keyspaceRewrites: []KeyspaceRewrite{{From: "orders", To: "staging_orders", Clients: []string{"not-a-cidr"}}},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+	}()
+	require.Error(t, err)
+}
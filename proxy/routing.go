@@ -0,0 +1,383 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/datastax/cql-proxy/codecs"
+	"github.com/datastax/cql-proxy/parser"
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const systemSchemaKeyspace = "system_schema"
+
+// buildRoutes maps the configured keyspaces to their backends.
+func (p *Proxy) buildRoutes() error {
+	backends := make(map[string]*backend)
+	for _, b := range p.backends {
+		backends[b.name] = b
+	}
+	p.routes = make(map[string]*backend)
+	for keyspace, name := range p.config.Routes {
+		b, ok := backends[name]
+		if !ok {
+			return fmt.Errorf("keyspace '%s' is routed to an unknown backend '%s'", keyspace, name)
+		}
+		p.routes[parser.IdentifierFromString(keyspace).ID()] = b
+	}
+	return nil
+}
+
+// backendByName returns the backend with a given name or nil if it doesn't exist.
+func (p *Proxy) backendByName(name string) *backend {
+	for _, b := range p.backends {
+		if b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// route returns the backend a keyspace is routed to. The keyspace is a CQL identifier that might be quoted.
+func (p *Proxy) route(keyspace string) *backend {
+	return p.routeID(parser.IdentifierFromString(keyspace).ID())
+}
+
+// routeID returns the backend a keyspace ID (i.e. its exact name) is routed to. Keyspaces without a route use the
+// default backend.
+func (p *Proxy) routeID(id string) *backend {
+	if b, ok := p.routes[id]; ok {
+		return b
+	}
+	return p.defaultBackend
+}
+
+// routeTables returns the backend for the tables referenced by a query. The first qualified table determines the
+// backend; otherwise, the keyspace is used.
+func (p *Proxy) routeTables(tables []tableKey, keyspace string) *backend {
+	if len(tables) > 0 {
+		return p.routeID(tables[0].keyspace)
+	}
+	return p.route(keyspace)
+}
+
+func (p *Proxy) preparedBackend(id []byte) *backend {
+	if val, ok := p.preparedMetadata.Load(preparedIdKey(id)); ok {
+		return val.(preparedMetadata).backend
+	}
+	return nil
+}
+
+// findBackend returns the backend for a request. Queries are routed using their table names and prepared statements
+// using the backend they were prepared on; otherwise, the request is routed using the client's keyspace. An error is
+// returned if the statements of a batch are routed to different backends because a batch can't be split.
+func (c *client) findBackend(body *frame.Body) (*backend, error) {
+	p := c.proxy
+	if len(p.routes) == 0 {
+		return p.defaultBackend, nil
+	}
+	switch msg := body.Message.(type) {
+	case *codecs.PartialQuery:
+		return p.routeTables(findTables(c.keyspace, msg.Query), c.keyspace), nil
+	case *message.Prepare:
+		keyspace := c.keyspace
+		if len(msg.Keyspace) != 0 {
+			keyspace = msg.Keyspace
+		}
+		return p.routeTables(findTables(keyspace, msg.Query), keyspace), nil
+	case *codecs.PartialExecute:
+		if b := p.preparedBackend(msg.QueryId); b != nil {
+			return b, nil
+		}
+	case *codecs.PartialBatch:
+		var batchBackend *backend
+		for _, query := range msg.Queries {
+			b := p.route(c.keyspace)
+			switch q := query.QueryOrId.(type) {
+			case string:
+				b = p.routeTables(findTables(c.keyspace, q), c.keyspace)
+			case []byte:
+				if prepared := p.preparedBackend(q); prepared != nil {
+					b = prepared
+				}
+			}
+			if batchBackend == nil {
+				batchBackend = b
+			} else if b != batchBackend {
+				return nil, fmt.Errorf("Batch statements are routed to different backends ('%s' and '%s')",
+					batchBackend.name, b.name)
+			}
+		}
+		if batchBackend != nil {
+			return batchBackend, nil
+		}
+	}
+	return p.route(c.keyspace), nil
+}
+
+// sessionKeyspace returns the keyspace of the session used to send a client's request to a backend. The client's
+// keyspace might not exist on the backend if it's routed elsewhere so no keyspace is used in that case.
+func (c *client) sessionKeyspace(b *backend) string {
+	if c.proxy.route(c.keyspace) == b {
+		return c.keyspace
+	}
+	return ""
+}
+
+// isSchemaQuery returns true if a query only references "system_schema" tables.
+func isSchemaQuery(tables []tableKey) bool {
+	for _, table := range tables {
+		if table.keyspace != systemSchemaKeyspace {
+			return false
+		}
+	}
+	return len(tables) > 0
+}
+
+// maybeFanOutSchemaQuery sends a "system_schema" query to all backends and merges their results so that drivers see
+// the schema of every routed keyspace. It returns false if the request is not a schema query or routing is disabled.
+func (c *client) maybeFanOutSchemaQuery(raw *frame.RawFrame, body *frame.Body, span trace.Span) bool {
+	p := c.proxy
+	if len(p.routes) == 0 {
+		return false
+	}
+	msg, ok := body.Message.(*codecs.PartialQuery)
+	if !ok || !isSchemaQuery(findTables(c.keyspace, msg.Query)) {
+		return false
+	}
+
+	results := &schemaResults{
+		client:    c,
+		header:    raw.Header,
+		span:      span,
+		results:   make([]schemaResult, len(p.backends)),
+		remaining: len(p.backends),
+	}
+	for i, b := range p.backends {
+		sess, err := b.findSession(raw.Header.Version, "", c.compression)
+		if err != nil {
+			results.onDone(i, schemaResult{}, fmt.Errorf("unable to create session for backend '%s': %w", b.name, err))
+			continue
+		}
+		req := &schemaRequest{
+			results: results,
+			index:   i,
+			session: sess,
+			version: raw.Header.Version,
+			msg:     msg,
+			frm:     copyRawFrame(raw), // The stream ID is changed by each backend connection
+			qp:      b.newQueryPlan(),
+		}
+		req.Execute(true)
+	}
+	return true
+}
+
+// schemaResults merges the results of a schema query from all backends. Only the rows of keyspaces that are routed to
+// a backend are kept from that backend's result.
+type schemaResults struct {
+	client    *client
+	header    *frame.Header
+	span      trace.Span
+	results   []schemaResult
+	err       error
+	remaining int
+	mu        sync.Mutex
+}
+
+// schemaResult is a backend's response to a schema query. The rows of all the result's pages are set if the backend
+// returned rows; otherwise, the raw response, e.g. an error, is returned to the client as-is.
+type schemaResult struct {
+	raw  *frame.RawFrame
+	rows *message.RowsResult
+}
+
+func (s *schemaResults) onDone(index int, result schemaResult, err error) {
+	s.mu.Lock()
+	s.results[index] = result
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	s.remaining--
+	done := s.remaining == 0
+	s.mu.Unlock()
+	if done {
+		s.merge()
+	}
+}
+
+func (s *schemaResults) merge() {
+	c := s.client
+	p := c.proxy
+	defer s.span.End()
+
+	if s.err != nil {
+		p.logger.Error("unable to query schema from all backends", zap.Error(s.err))
+		s.span.SetStatus(codes.Error, s.err.Error())
+		c.send(s.header, &message.ServerError{ErrorMessage: "Proxy unable to query schema from all backends"})
+		return
+	}
+
+	var merged *message.RowsResult
+	for i, result := range s.results {
+		rows := result.rows
+		if rows == nil { // Return errors, and any other unexpected results, as-is
+			s.sendRaw(result.raw)
+			return
+		}
+		b := p.backends[i]
+		column := keyspaceNameColumn(rows.Metadata)
+		if merged == nil {
+			merged = &message.RowsResult{Metadata: rows.Metadata}
+		}
+		for _, row := range rows.Data {
+			if column < 0 || p.routeID(string(row[column])) == b {
+				merged.Data = append(merged.Data, row)
+			}
+		}
+	}
+	if c.rewriter != nil {
+		c.rewriter.rewriteResult(merged)
+	}
+	c.send(s.header, merged)
+}
+
+func (s *schemaResults) sendRaw(raw *frame.RawFrame) {
+	raw = s.client.maybeRewriteResult(raw)
+	raw.Header.StreamId = s.header.StreamId
+	c := s.client
+	c.maybeCaptureRawResponse(raw.Header.StreamId, raw)
+	_ = c.conn.Write(proxycore.SenderFunc(func(writer io.Writer) error {
+		return c.codec.EncodeRawFrame(raw, writer)
+	}))
+}
+
+func keyspaceNameColumn(metadata *message.RowsMetadata) int {
+	for i, column := range metadata.Columns {
+		if column.Name == "keyspace_name" {
+			return i
+		}
+	}
+	return -1
+}
+
+// schemaRequest is a schema query sent to a single backend. All the pages of the backend's result are fetched so that
+// the merged result is complete.
+type schemaRequest struct {
+	results *schemaResults
+	index   int
+	session *proxycore.Session
+	version primitive.ProtocolVersion
+	msg     *codecs.PartialQuery
+	frm     interface{}
+	qp      proxycore.QueryPlan
+	host    *proxycore.Host
+	rows    *message.RowsResult // The rows of the pages received so far
+	done    bool
+	mu      sync.Mutex
+}
+
+func (r *schemaRequest) Execute(next bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for !r.done {
+		if next {
+			r.host = r.qp.Next()
+		}
+		if r.host == nil {
+			r.finish(schemaResult{}, errors.New("no more hosts available to try"))
+		} else if err := r.session.Send(r.host, r); err == nil {
+			break
+		} else {
+			next = true
+		}
+	}
+}
+
+func (r *schemaRequest) Frame() interface{} {
+	return r.frm
+}
+
+func (r *schemaRequest) IsPrepareRequest() bool {
+	return false
+}
+
+func (r *schemaRequest) OnClose(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finish(schemaResult{}, err)
+}
+
+func (r *schemaRequest) OnResult(raw *frame.RawFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	rows, err := decodeRowsResult(r.results.client.codec, raw)
+	if err != nil {
+		r.finish(schemaResult{raw: raw}, nil)
+		return
+	}
+	if r.rows == nil {
+		r.rows = rows
+	} else {
+		r.rows.Data = append(r.rows.Data, rows.Data...)
+	}
+	pagingState := rows.Metadata.PagingState
+	if pagingState == nil {
+		r.rows.Metadata.PagingState = nil
+		r.finish(schemaResult{raw: raw, rows: r.rows}, nil)
+		return
+	}
+	if err = r.nextPage(pagingState); err != nil {
+		r.finish(schemaResult{}, err)
+	}
+}
+
+// nextPage requests the next page of the result from the same host.
+//
+// lock before using
+func (r *schemaRequest) nextPage(pagingState []byte) error {
+	var buf bytes.Buffer
+	_ = primitive.WriteShort(uint16(r.msg.Consistency), &buf)
+	buf.Write(r.msg.Parameters)
+	options, err := message.DecodeQueryOptions(&buf, r.version)
+	if err != nil {
+		return fmt.Errorf("unable to decode schema query options: %w", err)
+	}
+	options.PagingState = pagingState
+	r.frm = frame.NewFrame(r.version, 0, &message.Query{Query: r.msg.Query, Options: options})
+	return r.session.Send(r.host, r)
+}
+
+// lock before using
+func (r *schemaRequest) finish(result schemaResult, err error) {
+	if !r.done {
+		r.done = true
+		r.results.onDone(r.index, result, err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_RouteKeyspaces(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	received := make(map[string][]string) // Query -> backends
+
+	backendFor := func(query string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[query]
+	}
+
+	handlers := func(name string, keyspaces ...string) proxycore.MockRequestHandlers {
+		record := func(query string) {
+			mu.Lock()
+			received[query] = append(received[query], name)
+			mu.Unlock()
+		}
+		return proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if msg := cl.InterceptQuery(frm.Header, frm.Body.Message.(*message.Query)); msg != nil {
+					return msg
+				}
+				query := frm.Body.Message.(*message.Query).Query
+				record(query)
+				if strings.Contains(query, "system_schema") {
+					// Each keyspace is returned in its own page
+					page := 0
+					if pagingState := frm.Body.Message.(*message.Query).Options.PagingState; len(pagingState) > 0 {
+						page = int(pagingState[0])
+					}
+					var pagingState []byte
+					if page+1 < len(keyspaces) {
+						pagingState = []byte{byte(page + 1)}
+					}
+					return &message.RowsResult{
+						Metadata: &message.RowsMetadata{
+							ColumnCount: 1,
+							Columns: []*message.ColumnMetadata{
+								{Keyspace: "system_schema", Table: "keyspaces", Name: "keyspace_name", Type: datatype.Varchar},
+							},
+							PagingState: pagingState,
+						},
+						Data: message.RowSet{{[]byte(keyspaces[page])}},
+					}
+				}
+				return &message.VoidResult{}
+			},
+			primitive.OpCodeExecute: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				record("execute")
+				return &message.VoidResult{}
+			},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	otherPort := generateTestPort()
+	other := proxycore.NewMockCluster(net.ParseIP(testStartAddr), otherPort)
+	other.Handlers = proxycore.NewMockRequestHandlers(handlers("other", "system", "ks_other"))
+	require.NoError(t, other.Add(ctx, 1))
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 1, &proxyTestConfig{
+		handlers: handlers("default", "system", "ks_default", "ks_other"),
+		backends: []BackendConfig{{
+			Name:     "other",
+			Resolver: proxycore.NewResolverWithDefaultPort([]string{testAddr}, otherPort),
+		}},
+		routes: map[string]string{"ks_other": "other"},
+	})
+	defer func() {
+		cancel()
+		tester.shutdown()
+		other.Shutdown()
+	}()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	query := func(query string) message.Message {
+		resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Query{Query: query}))
+		require.NoError(t, err)
+		require.Equal(t, primitive.OpCodeResult, resp.Header.OpCode, query)
+		return resp.Body.Message
+	}
+
+	query("INSERT INTO ks_default.t (k) VALUES (1)")
+	assert.Equal(t, []string{"default"}, backendFor("INSERT INTO ks_default.t (k) VALUES (1)"))
+
+	query("INSERT INTO ks_other.t (k) VALUES (1)")
+	assert.Equal(t, []string{"other"}, backendFor("INSERT INTO ks_other.t (k) VALUES (1)"))
+
+	// Schema queries are sent to all backends and only the keyspaces routed to each backend are kept. Every page of each
+	// backend's result is fetched.
+	rows, ok := query("SELECT keyspace_name FROM system_schema.keyspaces").(*message.RowsResult)
+	require.True(t, ok, "expected rows result")
+	var keyspaces []string
+	for _, row := range rows.Data {
+		keyspaces = append(keyspaces, string(row[0]))
+	}
+	assert.ElementsMatch(t, []string{"system", "ks_default", "ks_other"}, keyspaces)
+	assert.Nil(t, rows.Metadata.PagingState)
+	assert.ElementsMatch(t, []string{"default", "default", "default", "other", "other"},
+		backendFor("SELECT keyspace_name FROM system_schema.keyspaces"))
+
+	// Unqualified tables use the client's keyspace
+	_ = query("USE ks_other")
+	query("INSERT INTO t (k) VALUES (2)")
+	assert.Equal(t, []string{"other"}, backendFor("INSERT INTO t (k) VALUES (2)"))
+
+	// Prepared statements are executed on the backend they were prepared on
+	resp, err := cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Prepare{Query: "INSERT INTO t (k) VALUES (?)"}))
+	require.NoError(t, err)
+	prepared, ok := resp.Body.Message.(*message.PreparedResult)
+	require.True(t, ok, "expected prepared result")
+
+	_ = query("USE ks_default")
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Execute{QueryId: prepared.PreparedQueryId}))
+	require.NoError(t, err)
+	assert.Equal(t, primitive.OpCodeResult, resp.Header.OpCode)
+	assert.Equal(t, []string{"other"}, backendFor("execute"))
+
+	// A batch can't be split across backends
+	resp, err = cl.SendAndReceive(ctx, frame.NewFrame(version, 0, &message.Batch{
+		Type: primitive.BatchTypeLogged,
+		Children: []*message.BatchChild{
+			{Query: "INSERT INTO ks_default.t (k) VALUES (3)"},
+			{Query: "INSERT INTO ks_other.t (k) VALUES (3)"},
+		},
+	}))
+	require.NoError(t, err)
+	assert.IsType(t, &message.Invalid{}, resp.Body.Message)
+	assert.Empty(t, backendFor("INSERT INTO ks_default.t (k) VALUES (3)"))
+	assert.Empty(t, backendFor("INSERT INTO ks_other.t (k) VALUES (3)"))
+}
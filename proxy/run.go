@@ -32,50 +32,132 @@ import (
 	"github.com/datastax/cql-proxy/astra"
 	"github.com/datastax/cql-proxy/proxycore"
 	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
 
 const livenessPath = "/liveness"
 const readinessPath = "/readiness"
+const resultCacheStatsPath = "/stats/result-cache"
+const mirrorStatsPath = "/stats/mirror"
 
 type runConfig struct {
-	AstraBundle                         string        `yaml:"astra-bundle" help:"Path to secure connect bundle for an Astra database. Requires '--username' and '--password'. Ignored if using the token or contact points option." short:"b" env:"ASTRA_BUNDLE"`
-	AstraToken                          string        `yaml:"astra-token" help:"Token used to authenticate to an Astra database. Requires '--astra-database-id'. Ignored if using the bundle path or contact points option." short:"t" env:"ASTRA_TOKEN"`
-	AstraDatabaseID                     string        `yaml:"astra-database-id" help:"Database ID of the Astra database. Requires '--astra-token'" short:"i" env:"ASTRA_DATABASE_ID"`
-	AstraApiURL                         string        `yaml:"astra-api-url" help:"URL for the Astra API" default:"https://api.astra.datastax.com" env:"ASTRA_API_URL"`
-	AstraTimeout                        time.Duration `yaml:"astra-timeout" help:"Timeout for contacting Astra when retrieving the bundle and metadata" default:"10s" env:"ASTRA_TIMEOUT"`
-	ContactPoints                       []string      `yaml:"contact-points" help:"Contact points for cluster. Ignored if using the bundle path or token option." short:"c" env:"CONTACT_POINTS"`
-	Username                            string        `yaml:"username" help:"Username to use for authentication" short:"u" env:"USERNAME"`
-	Password                            string        `yaml:"password" help:"Password to use for authentication" short:"p" env:"PASSWORD"`
-	Port                                int           `yaml:"port" help:"Default port to use when connecting to cluster" default:"9042" short:"r" env:"PORT"`
-	ProtocolVersion                     string        `yaml:"protocol-version" help:"Initial protocol version to use when connecting to the backend cluster (default: v4, options: v3, v4, v5, DSEv1, DSEv2)" default:"v4" short:"n" env:"PROTOCOL_VERSION"`
-	MaxProtocolVersion                  string        `yaml:"max-protocol-version" help:"Max protocol version supported by the backend cluster (default: v4, options: v3, v4, v5, DSEv1, DSEv2)" default:"v4" short:"m" env:"MAX_PROTOCOL_VERSION"`
-	Bind                                string        `yaml:"bind" help:"Address to use to bind server" short:"a" default:":9042" env:"BIND"`
-	Config                              *os.File      `yaml:"-" help:"YAML configuration file" short:"f" env:"CONFIG_FILE"` // Not available in the configuration file
-	Debug                               bool          `yaml:"debug" help:"Show debug logging" default:"false" env:"DEBUG"`
-	HealthCheck                         bool          `yaml:"health-check" help:"Enable liveness and readiness checks" default:"false" env:"HEALTH_CHECK"`
-	HttpBind                            string        `yaml:"http-bind" help:"Address to use to bind HTTP server used for health checks" default:":8000" env:"HTTP_BIND"`
-	HeartbeatInterval                   time.Duration `yaml:"heartbeat-interval" help:"Interval between performing heartbeats to the cluster" default:"30s" env:"HEARTBEAT_INTERVAL"`
-	ConnectTimeout                      time.Duration `yaml:"connect-timeout" help:"Duration before an attempt to connect to a cluster is considered timed out" default:"10s" env:"CONNECT_TIMEOUT"`
-	IdleTimeout                         time.Duration `yaml:"idle-timeout" help:"Duration between successful heartbeats before a connection to the cluster is considered unresponsive and closed" default:"60s" env:"IDLE_TIMEOUT"`
-	ReadinessTimeout                    time.Duration `yaml:"readiness-timeout" help:"Duration the proxy is unable to connect to the backend cluster before it is considered not ready" default:"30s" env:"READINESS_TIMEOUT"`
-	IdempotentGraph                     bool          `yaml:"idempotent-graph" help:"If true it will treat all graph queries as idempotent by default and retry them automatically. It may be dangerous to retry some graph queries -- use with caution." default:"false" env:"IDEMPOTENT_GRAPH"`
-	NumConns                            int           `yaml:"num-conns" help:"Number of connection to create to each node of the backend cluster" default:"1" env:"NUM_CONNS"`
-	ProxyCertFile                       string        `yaml:"proxy-cert-file" help:"Path to a PEM encoded certificate file with its intermediate certificate chain. This is used to encrypt traffic for proxy clients" env:"PROXY_CERT_FILE"`
-	ProxyKeyFile                        string        `yaml:"proxy-key-file" help:"Path to a PEM encoded private key file. This is used to encrypt traffic for proxy clients" env:"PROXY_KEY_FILE"`
-	RpcAddress                          string        `yaml:"rpc-address" help:"Address to advertise in the 'system.local' table for 'rpc_address'. It must be set if configuring peer proxies" env:"RPC_ADDRESS"`
-	DataCenter                          string        `yaml:"data-center" help:"Data center to use in system tables" env:"DATA_CENTER"`
-	Tokens                              []string      `yaml:"tokens" help:"Tokens to use in the system tables. It's not recommended" env:"TOKENS"`
-	Peers                               []PeerConfig  `yaml:"peers" kong:"-"` // Not available as a CLI flag
-	UnsupportedWriteConsistencies       []clWrapper   `yaml:"unsupported-write-consistencies" help:"A list of unsupported write consistency levels. The unsupported write consistency override setting will be used inplace of the unsupported level" env:"UNSUPPORTED_WRITE_CONSISTENCIES"`
-	UnsupportedWriteConsistencyOverride clWrapper     `yaml:"unsupported-write-consistency-override" help:"A consistency level use to override unsupported write consistency levels" env:"" default:"LOCAL_QUORUM"`
+	AstraBundle                         string                `yaml:"astra-bundle" help:"Path to secure connect bundle for an Astra database. Requires '--username' and '--password'. Ignored if using the token or contact points option." short:"b" env:"ASTRA_BUNDLE"`
+	AstraToken                          string                `yaml:"astra-token" help:"Token used to authenticate to an Astra database. Requires '--astra-database-id'. Ignored if using the bundle path or contact points option." short:"t" env:"ASTRA_TOKEN"`
+	AstraTokenFile                      string                `yaml:"astra-token-file" help:"File containing the token used to authenticate to an Astra database, e.g. a mounted secret. It's re-read when it changes. Requires '--astra-database-id'" env:"ASTRA_TOKEN_FILE"`
+	AstraDatabaseID                     string                `yaml:"astra-database-id" help:"Database ID of the Astra database. Requires '--astra-token'" short:"i" env:"ASTRA_DATABASE_ID"`
+	AstraApiURL                         string                `yaml:"astra-api-url" help:"URL for the Astra API" default:"https://api.astra.datastax.com" env:"ASTRA_API_URL"`
+	AstraTimeout                        time.Duration         `yaml:"astra-timeout" help:"Timeout for contacting Astra when retrieving the bundle and metadata" default:"10s" env:"ASTRA_TIMEOUT"`
+	AstraRefreshInterval                time.Duration         `yaml:"astra-refresh-interval" help:"Interval between refreshing the Astra metadata, e.g. the SNI proxy address, and updating the endpoints of the database's nodes. The metadata is also refreshed after failing to reconnect to every node. Periodic refresh is disabled if zero" default:"5m" env:"ASTRA_REFRESH_INTERVAL"`
+	AstraFailoverBundles                []string              `yaml:"astra-failover-bundles" help:"Paths to secure connect bundles for the other regions of a multi-region Astra database, in order of preference. The proxy fails over to the next region if the region of '--astra-bundle' is unavailable, and fails back when it recovers" env:"ASTRA_FAILOVER_BUNDLES"`
+	AstraFailover                       bool                  `yaml:"astra-failover" help:"Fail over to the other regions of a multi-region Astra database when using '--astra-token'. Regions are preferred in the order returned by the Astra API, starting with the primary region" default:"false" env:"ASTRA_FAILOVER"`
+	AstraFailoverDelay                  time.Duration         `yaml:"astra-failover-delay" help:"Duration the Astra database's region needs to be unavailable before failing over to the next region" default:"30s" env:"ASTRA_FAILOVER_DELAY"`
+	AstraBundleRefreshInterval          time.Duration         `yaml:"astra-bundle-refresh-interval" help:"Interval between re-reading the Astra bundle files, or downloading the bundle again when using '--astra-token', so that rotated certificates are used for new connections. Bundles are also reloaded after a certificate verification error. The interval is checked when the Astra metadata is refreshed and before connecting to a node. Periodic reloading is disabled if zero" default:"24h" env:"ASTRA_BUNDLE_REFRESH_INTERVAL"`
+	ContactPoints                       []string              `yaml:"contact-points" help:"Contact points for cluster. Ignored if using the bundle path or token option." short:"c" env:"CONTACT_POINTS"`
+	Username                            string                `yaml:"username" help:"Username to use for authentication" short:"u" env:"USERNAME"`
+	Password                            string                `yaml:"password" help:"Password to use for authentication" short:"p" env:"PASSWORD"`
+	UsernameFile                        string                `yaml:"username-file" help:"File containing the username to use for authentication, e.g. a mounted secret. It's re-read when it changes" env:"USERNAME_FILE"`
+	PasswordFile                        string                `yaml:"password-file" help:"File containing the password to use for authentication, e.g. a mounted secret. It's re-read when it changes" env:"PASSWORD_FILE"`
+	KerberosPrincipal                   string                `yaml:"kerberos-principal" help:"Kerberos principal to use for GSSAPI authentication, e.g. 'cassandra@EXAMPLE.COM'. It's used instead of '--username' and '--password'" env:"KERBEROS_PRINCIPAL"`
+	KerberosKeytab                      string                `yaml:"kerberos-keytab" help:"Path to the keytab of the Kerberos principal" env:"KERBEROS_KEYTAB"`
+	KerberosConfig                      string                `yaml:"kerberos-config" help:"Path to the Kerberos configuration file" default:"/etc/krb5.conf" env:"KERBEROS_CONFIG"`
+	KerberosService                     string                `yaml:"kerberos-service" help:"Service name of the backend cluster's Kerberos principals, e.g. 'dse' for 'dse/node1.example.com@EXAMPLE.COM'" default:"dse" env:"KERBEROS_SERVICE"`
+	KerberosServiceHost                 string                `yaml:"kerberos-service-host" help:"Host of the backend cluster's Kerberos principals. By default, it's found using a reverse lookup of each node's address" env:"KERBEROS_SERVICE_HOST"`
+	ProxyExecute                        bool                  `yaml:"proxy-execute" help:"Require clients to authenticate, using the backend cluster's credentials, and execute their requests as their role using DSE proxy authorization. The proxy's user requires the 'PROXY.EXECUTE' permission on the clients' roles" default:"false" env:"PROXY_EXECUTE"`
+	Port                                int                   `yaml:"port" help:"Default port to use when connecting to cluster" default:"9042" short:"r" env:"PORT"`
+	ProtocolVersion                     string                `yaml:"protocol-version" help:"Initial protocol version to use when connecting to the backend cluster (default: v4, options: v3, v4, v5, DSEv1, DSEv2)" default:"v4" short:"n" env:"PROTOCOL_VERSION"`
+	MaxProtocolVersion                  string                `yaml:"max-protocol-version" help:"Max protocol version supported by the backend cluster (default: v4, options: v3, v4, v5, DSEv1, DSEv2)" default:"v4" short:"m" env:"MAX_PROTOCOL_VERSION"`
+	Bind                                string                `yaml:"bind" help:"Address to use to bind server" short:"a" default:":9042" env:"BIND"`
+	Config                              *os.File              `yaml:"-" help:"YAML configuration file" short:"f" env:"CONFIG_FILE"` // Not available in the configuration file
+	Debug                               bool                  `yaml:"debug" help:"Show debug logging" default:"false" env:"DEBUG"`
+	HealthCheck                         bool                  `yaml:"health-check" help:"Enable liveness and readiness checks" default:"false" env:"HEALTH_CHECK"`
+	HttpBind                            string                `yaml:"http-bind" help:"Address to use to bind HTTP server used for health checks" default:":8000" env:"HTTP_BIND"`
+	HeartbeatInterval                   time.Duration         `yaml:"heartbeat-interval" help:"Interval between performing heartbeats to the cluster" default:"30s" env:"HEARTBEAT_INTERVAL"`
+	ConnectTimeout                      time.Duration         `yaml:"connect-timeout" help:"Duration before an attempt to connect to a cluster is considered timed out" default:"10s" env:"CONNECT_TIMEOUT"`
+	IdleTimeout                         time.Duration         `yaml:"idle-timeout" help:"Duration between successful heartbeats before a connection to the cluster is considered unresponsive and closed" default:"60s" env:"IDLE_TIMEOUT"`
+	ReadinessTimeout                    time.Duration         `yaml:"readiness-timeout" help:"Duration the proxy is unable to connect to the backend cluster before it is considered not ready" default:"30s" env:"READINESS_TIMEOUT"`
+	IdempotentGraph                     bool                  `yaml:"idempotent-graph" help:"If true it will treat all graph queries as idempotent by default and retry them automatically. It may be dangerous to retry some graph queries -- use with caution." default:"false" env:"IDEMPOTENT_GRAPH"`
+	NumConns                            int                   `yaml:"num-conns" help:"Number of connection to create to each node of the backend cluster" default:"1" env:"NUM_CONNS"`
+	MaxConns                            int                   `yaml:"max-conns" help:"Maximum number of connections to each node of the backend cluster when under sustained load. Pools have a fixed size of '--num-conns' if not greater than '--num-conns'" default:"0" env:"MAX_CONNS"`
+	RemoteNumConns                      int                   `yaml:"remote-num-conns" help:"Number of connections to create to each node outside of the local data center. Uses '--num-conns' if not set" default:"0" env:"REMOTE_NUM_CONNS"`
+	RemoteMaxConns                      int                   `yaml:"remote-max-conns" help:"Maximum number of connections to each node outside of the local data center. Uses '--max-conns' if not set" default:"0" env:"REMOTE_MAX_CONNS"`
+	ConnScaleUpInflight                 int32                 `yaml:"conn-scale-up-inflight" help:"Average number of inflight requests per connection that causes a connection to be added to a node's pool" default:"512" env:"CONN_SCALE_UP_INFLIGHT"`
+	ConnScaleDownIdle                   time.Duration         `yaml:"conn-scale-down-idle" help:"Duration a node's pool needs to be idle before a connection above '--num-conns' is closed" default:"2m" env:"CONN_SCALE_DOWN_IDLE"`
+	ProxyCertFile                       string                `yaml:"proxy-cert-file" help:"Path to a PEM encoded certificate file with its intermediate certificate chain. This is used to encrypt traffic for proxy clients" env:"PROXY_CERT_FILE"`
+	ProxyKeyFile                        string                `yaml:"proxy-key-file" help:"Path to a PEM encoded private key file. This is used to encrypt traffic for proxy clients" env:"PROXY_KEY_FILE"`
+	RpcAddress                          string                `yaml:"rpc-address" help:"Address to advertise in the 'system.local' table for 'rpc_address'. It must be set if configuring peer proxies" env:"RPC_ADDRESS"`
+	DataCenter                          string                `yaml:"data-center" help:"Data center to use in system tables" env:"DATA_CENTER"`
+	Tokens                              []string              `yaml:"tokens" help:"Tokens to use in the system tables. It's not recommended" env:"TOKENS"`
+	Peers                               []PeerConfig          `yaml:"peers" kong:"-"` // Not available as a CLI flag
+	UnsupportedWriteConsistencies       []clWrapper           `yaml:"unsupported-write-consistencies" help:"A list of unsupported write consistency levels. The unsupported write consistency override setting will be used inplace of the unsupported level" env:"UNSUPPORTED_WRITE_CONSISTENCIES"`
+	UnsupportedWriteConsistencyOverride clWrapper             `yaml:"unsupported-write-consistency-override" help:"A consistency level use to override unsupported write consistency levels" env:"" default:"LOCAL_QUORUM"`
+	ResultCacheSize                     int                   `yaml:"result-cache-size" help:"Maximum number of results stored in the result cache. Only tables configured using 'result-cache-tables' in the configuration file are cached" default:"10000" env:"RESULT_CACHE_SIZE"`
+	ResultCacheTables                   []ResultCacheTable    `yaml:"result-cache-tables" kong:"-"` // Not available as a CLI flag
+	OtlpEndpoint                        string                `yaml:"otlp-endpoint" help:"URL of an OpenTelemetry collector used to export request traces using OTLP over HTTP, e.g. 'http://localhost:4318'. Tracing is disabled if not set" env:"OTLP_ENDPOINT"`
+	TraceSampleRatio                    float64               `yaml:"trace-sample-ratio" help:"Ratio of requests to trace when the client hasn't made a sampling decision using a 'traceparent' in the request's custom payload" default:"1.0" env:"TRACE_SAMPLE_RATIO"`
+	MirrorContactPoints                 []string              `yaml:"mirror-contact-points" help:"Contact points for a secondary cluster that receives a copy of client writes. Mirroring is disabled if not set" env:"MIRROR_CONTACT_POINTS"`
+	MirrorUsername                      string                `yaml:"mirror-username" help:"Username to use for authentication to the mirror cluster" env:"MIRROR_USERNAME"`
+	MirrorPassword                      string                `yaml:"mirror-password" help:"Password to use for authentication to the mirror cluster" env:"MIRROR_PASSWORD"`
+	MirrorReads                         bool                  `yaml:"mirror-reads" help:"Also mirror SELECT queries to the mirror cluster" default:"false" env:"MIRROR_READS"`
+	MirrorQueueSize                     int                   `yaml:"mirror-queue-size" help:"Maximum number of requests waiting to be sent to the mirror cluster. Requests are dropped when the queue is full" default:"10000" env:"MIRROR_QUEUE_SIZE"`
+	MirrorMaxInflight                   int                   `yaml:"mirror-max-inflight" help:"Maximum number of requests in-flight to the mirror cluster" default:"1024" env:"MIRROR_MAX_INFLIGHT"`
+	MirrorCompareReads                  float64               `yaml:"mirror-compare-reads" help:"Ratio of SELECT queries that are also run against the mirror cluster to compare their results. Mismatches are logged" default:"0" env:"MIRROR_COMPARE_READS"`
+	MirrorCompareIgnoreOrder            bool                  `yaml:"mirror-compare-ignore-order" help:"Ignore the order of rows when comparing results from the mirror cluster" default:"false" env:"MIRROR_COMPARE_IGNORE_ORDER"`
+	PreparedStorePath                   string                `yaml:"prepared-store-path" help:"File used to persist prepared statements across restarts. Persisted statements are re-prepared on startup" env:"PREPARED_STORE_PATH"`
+	PreparedStoreFlushInterval          time.Duration         `yaml:"prepared-store-flush-interval" help:"How often new prepared statements are written to the prepared store" default:"10s" env:"PREPARED_STORE_FLUSH_INTERVAL"`
+	PreparedStoreMaxEntries             int                   `yaml:"prepared-store-max-entries" help:"Maximum number of prepared statements kept in the prepared store" default:"100000" env:"PREPARED_STORE_MAX_ENTRIES"`
+	PrepareOnAllHosts                   bool                  `yaml:"prepare-on-all-hosts" help:"Send new PREPARE requests to all hosts in the background and re-prepare statements on hosts that are added or come back up" default:"true" env:"PREPARE_ON_ALL_HOSTS"`
+	ReprepareConcurrency                int                   `yaml:"reprepare-concurrency" help:"Maximum number of inflight requests used to re-prepare statements on a host" default:"8" env:"REPREPARE_CONCURRENCY"`
+	PreparedPeerTimeout                 time.Duration         `yaml:"prepared-peer-timeout" help:"Timeout for fetching an unknown prepared statement from a peer proxy. Only used if peers have an 'http-address'" default:"500ms" env:"PREPARED_PEER_TIMEOUT"`
+	PreparedSharingToken                string                `yaml:"prepared-sharing-token" help:"Shared secret that peers use to fetch prepared statements from each other. Required if peers have an 'http-address'" env:"PREPARED_SHARING_TOKEN"`
+	DowngradeConsistency                bool                  `yaml:"downgrade-consistency" help:"Retry read timeouts, write timeouts and unavailable errors at a lower consistency level that the available replicas can satisfy. This weakens consistency guarantees -- use with caution" default:"false" env:"DOWNGRADE_CONSISTENCY"`
+	CapturePath                         string                `yaml:"capture-path" help:"File used to capture client requests and the results of their responses. Captures are played back using the 'replay' command. Capturing is disabled if not set" env:"CAPTURE_PATH"`
+	CaptureDuration                     time.Duration         `yaml:"capture-duration" help:"How long client requests are captured after the proxy starts. Requests are captured until the proxy stops if zero" default:"0s" env:"CAPTURE_DURATION"`
+	CaptureClients                      []string              `yaml:"capture-clients" help:"Only capture the requests of clients connecting from a list of CIDRs, e.g. '10.0.0.0/8'. All clients are captured if not set" env:"CAPTURE_CLIENTS"`
+	CaptureQueueSize                    int                   `yaml:"capture-queue-size" help:"Maximum number of records waiting to be written to the capture file. Records are dropped when the queue is full" default:"10000" env:"CAPTURE_QUEUE_SIZE"`
+	ProxyProtocol                       bool                  `yaml:"proxy-protocol" help:"Read a PROXY protocol (v1 or v2) header at the start of client connections so that the original client address is used instead of the load balancer's" default:"false" env:"PROXY_PROTOCOL"`
+	ProxyProtocolTrustedSources         []string              `yaml:"proxy-protocol-trusted-sources" help:"Only read PROXY protocol headers from connections from a list of CIDRs, e.g. '10.0.0.0/8'. Other connections are served as-is. Required if PROXY protocol is enabled" env:"PROXY_PROTOCOL_TRUSTED_SOURCES"`
+	ProxyProtocolHeaderTimeout          time.Duration         `yaml:"proxy-protocol-header-timeout" help:"Duration a connection has to send its PROXY protocol header before it's closed" default:"5s" env:"PROXY_PROTOCOL_HEADER_TIMEOUT"`
+	Backends                            []backendRunConfig    `yaml:"backends" kong:"-"`              // Not available as a CLI flag
+	Routes                              map[string]string     `yaml:"routes" kong:"-"`                // Not available as a CLI flag
+	KeyspaceRewrites                    []KeyspaceRewrite     `yaml:"keyspace-rewrites" kong:"-"`     // Not available as a CLI flag
+	IdempotenceOverrides                []IdempotenceOverride `yaml:"idempotence-overrides" kong:"-"` // Not available as a CLI flag
+	RetryPolicy                         *RetryPolicyConfig    `yaml:"retry-policy" kong:"-"`          // Not available as a CLI flag
+	ConsistencyRules                    []ConsistencyRule     `yaml:"consistency-rules" kong:"-"`     // Not available as a CLI flag
+	Listeners                           []ListenerConfig      `yaml:"listeners" kong:"-"`             // Not available as a CLI flag
+}
+
+// ListenerConfig is an additional address or unix socket the proxy serves clients on. If any listeners are configured
+// they replace the listener created using "bind".
+type ListenerConfig struct {
+	Bind          string `yaml:"bind,omitempty"`
+	Socket        string `yaml:"socket,omitempty"`
+	ProxyCertFile string `yaml:"proxy-cert-file,omitempty"`
+	ProxyKeyFile  string `yaml:"proxy-key-file,omitempty"`
+	// RPCAddress is advertised in the "system.local" table to the listener's clients instead of "rpc-address".
+	RPCAddress string `yaml:"rpc-address,omitempty"`
+}
+
+// backendRunConfig is an additional backend cluster that keyspaces can be routed to using "routes".
+type backendRunConfig struct {
+	Name          string   `yaml:"name"`
+	AstraBundle   string   `yaml:"astra-bundle"`
+	ContactPoints []string `yaml:"contact-points"`
+	Port          int      `yaml:"port"`
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password"`
 }
 
 type clWrapper struct {
 	primitive.ConsistencyLevel
 }
 
+// MarshalText writes the consistency level's name, e.g. "LOCAL_QUORUM", so that it can be read back using UnmarshalText.
+func (c clWrapper) MarshalText() ([]byte, error) {
+	return []byte(codeName(c.ConsistencyLevel)), nil
+}
+
 func (c *clWrapper) UnmarshalText(text []byte) error {
 	switch strings.ToLower(string(text)) {
 	case "any":
@@ -110,84 +192,48 @@ func (c *clWrapper) UnmarshalText(text []byte) error {
 // Run starts the proxy command. 'args' shouldn't include the executable (i.e. os.Args[1:]). It returns the exit code
 // for the proxy.
 func Run(ctx context.Context, args []string) int {
-	var cfg runConfig
-	var err error
-
-	parser, err := kong.New(&cfg)
-	if err != nil {
-		panic(err)
-	}
-
-	var cliCtx *kong.Context
-	if cliCtx, err = parser.Parse(args); err != nil {
-		parser.Errorf("error parsing flags: %v", err)
+	cfg, cliCtx, ok := parseRunConfig(args)
+	if !ok {
 		return 1
 	}
 
-	if cfg.Config != nil {
-		bytes, err := ioutil.ReadAll(cfg.Config)
-		if err != nil {
-			cliCtx.Errorf("unable to read contents of configuration file '%s': %v", cfg.Config.Name(), err)
-			return 1
+	if errs := cfg.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			cliCtx.Errorf("%v", err)
 		}
-		err = yaml.Unmarshal(bytes, &cfg)
-		if err != nil {
-			cliCtx.Errorf("invalid YAML in configuration file '%s': %v", cfg.Config.Name(), err)
-		}
-	}
-
-	var resolver proxycore.EndpointResolver
-	if len(cfg.AstraBundle) > 0 {
-		if bundle, err := astra.LoadBundleZipFromPath(cfg.AstraBundle); err != nil {
-			cliCtx.Errorf("unable to open bundle %s from file: %v", cfg.AstraBundle, err)
-		} else {
-			resolver = astra.NewResolver(bundle, cfg.AstraTimeout)
-		}
-	} else if len(cfg.AstraToken) > 0 {
-		if len(cfg.AstraDatabaseID) == 0 {
-			cliCtx.Fatalf("database ID is required when using a token")
-		}
-		if bundle, err := astra.LoadBundleZipFromURL(cfg.AstraApiURL, cfg.AstraDatabaseID, cfg.AstraToken, cfg.AstraTimeout); err != nil {
-			cliCtx.Fatalf("unable to load bundle %s from astra: %v", cfg.AstraBundle, err)
-		} else {
-			resolver = astra.NewResolver(bundle, cfg.AstraTimeout)
-		}
-		cfg.Username = "token"
-		cfg.Password = cfg.AstraToken
-	} else if len(cfg.ContactPoints) > 0 {
-		resolver = proxycore.NewResolverWithDefaultPort(cfg.ContactPoints, cfg.Port)
-	} else {
-		cliCtx.Errorf("must provide either bundle path, token, or contact points")
 		return 1
 	}
 
-	if cfg.HeartbeatInterval >= cfg.IdleTimeout {
-		cliCtx.Errorf("idle-timeout must be greater than heartbeat-interval (heartbeat interval: %s, idle timeout: %s)",
-			cfg.HeartbeatInterval, cfg.IdleTimeout)
+	resolver, err := cfg.buildResolver()
+	if err != nil {
+		cliCtx.Errorf("%v", err)
 		return 1
 	}
 
-	if cfg.NumConns < 1 {
-		cliCtx.Errorf("invalid number of connections, must be greater than 0 (provided: %d)", cfg.NumConns)
+	backends, err := cfg.buildBackends()
+	if err != nil {
+		cliCtx.Errorf("%v", err)
 		return 1
 	}
 
-	var ok bool
-	var version primitive.ProtocolVersion
-	if version, ok = parseProtocolVersion(cfg.ProtocolVersion); !ok {
-		cliCtx.Errorf("unsupported protocol version: %s", cfg.ProtocolVersion)
+	retryPolicy, err := cfg.buildRetryPolicy()
+	if err != nil {
+		cliCtx.Errorf("%v", err)
 		return 1
 	}
 
-	var maxVersion primitive.ProtocolVersion
-	if maxVersion, ok = parseProtocolVersion(cfg.MaxProtocolVersion); !ok {
-		cliCtx.Errorf("unsupported max protocol version: %s", cfg.ProtocolVersion)
-		return 1
-	}
+	// The protocol versions have already been validated
+	version, _ := parseProtocolVersion(cfg.ProtocolVersion)
+	maxVersion, _ := parseProtocolVersion(cfg.MaxProtocolVersion)
 
-	if version > maxVersion {
-		cliCtx.Errorf("default protocol version is greater than max protocol version")
-		return 1
+	var capture *CaptureConfig
+	if len(cfg.CapturePath) > 0 {
+		capture = &CaptureConfig{
+			Path:      cfg.CapturePath,
+			Duration:  cfg.CaptureDuration,
+			Clients:   cfg.CaptureClients,
+			QueueSize: cfg.CaptureQueueSize,
+		}
 	}
 
 	var logger *zap.Logger
@@ -201,10 +247,40 @@ func Run(ctx context.Context, args []string) int {
 		return 1
 	}
 
-	var auth proxycore.Authenticator
+	var tracerProvider trace.TracerProvider
+	if len(cfg.OtlpEndpoint) > 0 {
+		provider, err := NewOTLPTracerProvider(ctx, cfg.OtlpEndpoint, cfg.TraceSampleRatio)
+		if err != nil {
+			cliCtx.Errorf("unable to create OpenTelemetry tracer provider: %v", err)
+			return 1
+		}
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = provider.Shutdown(shutdownCtx)
+		}()
+		tracerProvider = provider
+	}
+
+	auth, err := cfg.buildAuth(logger)
+	if err != nil {
+		cliCtx.Errorf("%v", err)
+		return 1
+	}
 
-	if len(cfg.Username) > 0 || len(cfg.Password) > 0 {
-		auth = proxycore.NewPasswordAuth(cfg.Username, cfg.Password)
+	var mirror *MirrorConfig
+	if len(cfg.MirrorContactPoints) > 0 {
+		mirror = &MirrorConfig{
+			Resolver:           proxycore.NewResolverWithDefaultPort(cfg.MirrorContactPoints, cfg.Port),
+			Reads:              cfg.MirrorReads,
+			QueueSize:          cfg.MirrorQueueSize,
+			MaxInflight:        cfg.MirrorMaxInflight,
+			CompareReads:       cfg.MirrorCompareReads,
+			CompareIgnoreOrder: cfg.MirrorCompareIgnoreOrder,
+		}
+		if len(cfg.MirrorUsername) > 0 || len(cfg.MirrorPassword) > 0 {
+			mirror.Auth = proxycore.NewPasswordAuth(cfg.MirrorUsername, cfg.MirrorPassword)
+		}
 	}
 
 	p := NewProxy(ctx, Config{
@@ -212,7 +288,13 @@ func Run(ctx context.Context, args []string) int {
 		MaxVersion:                          maxVersion,
 		Resolver:                            resolver,
 		ReconnectPolicy:                     proxycore.NewReconnectPolicy(),
+		RetryPolicy:                         retryPolicy,
 		NumConns:                            cfg.NumConns,
+		MaxConns:                            cfg.MaxConns,
+		RemoteNumConns:                      cfg.RemoteNumConns,
+		RemoteMaxConns:                      cfg.RemoteMaxConns,
+		ConnScaleUpInflight:                 cfg.ConnScaleUpInflight,
+		ConnScaleDownIdle:                   cfg.ConnScaleDownIdle,
 		Auth:                                auth,
 		Logger:                              logger,
 		HeartBeatInterval:                   cfg.HeartbeatInterval,
@@ -225,6 +307,26 @@ func Run(ctx context.Context, args []string) int {
 		IdempotentGraph:                     cfg.IdempotentGraph,
 		UnsupportedWriteConsistencies:       cfg.UnsupportedWriteConsistencies,
 		UnsupportedWriteConsistencyOverride: cfg.UnsupportedWriteConsistencyOverride,
+		ResultCacheTables:                   cfg.ResultCacheTables,
+		ResultCacheSize:                     cfg.ResultCacheSize,
+		TracerProvider:                      tracerProvider,
+		Mirror:                              mirror,
+		Backends:                            backends,
+		Routes:                              cfg.Routes,
+		KeyspaceRewrites:                    cfg.KeyspaceRewrites,
+		PreparedStorePath:                   cfg.PreparedStorePath,
+		PreparedStoreFlushInterval:          cfg.PreparedStoreFlushInterval,
+		PreparedStoreMaxEntries:             cfg.PreparedStoreMaxEntries,
+		PrepareOnAllHosts:                   cfg.PrepareOnAllHosts,
+		ReprepareConcurrency:                cfg.ReprepareConcurrency,
+		PreparedPeerTimeout:                 cfg.PreparedPeerTimeout,
+		PreparedSharingToken:                cfg.PreparedSharingToken,
+		IdempotenceOverrides:                cfg.IdempotenceOverrides,
+		ConsistencyRules:                    cfg.ConsistencyRules,
+		Capture:                             capture,
+		ResolveInterval:                     cfg.AstraRefreshInterval,
+		FailoverDelay:                       cfg.AstraFailoverDelay,
+		ProxyExecute:                        cfg.ProxyExecute,
 	})
 
 	cfg.Bind = maybeAddPort(cfg.Bind, "9042")
@@ -232,6 +334,8 @@ func Run(ctx context.Context, args []string) int {
 
 	var mux http.ServeMux
 	cfg.maybeAddHealthCheck(p, &mux)
+	cfg.maybeAddStats(p, &mux)
+	cfg.maybeAddPreparedSharing(p, &mux)
 
 	err = cfg.listenAndServe(p, &mux, ctx, logger)
 	if err != nil {
@@ -242,6 +346,407 @@ func Run(ctx context.Context, args []string) int {
 	return 0
 }
 
+// parseRunConfig parses the proxy's flags and its configuration file. Errors are reported to the user, and it returns
+// false if the command should exit.
+func parseRunConfig(args []string, options ...kong.Option) (*runConfig, *kong.Context, bool) {
+	var cfg runConfig
+
+	parser, err := kong.New(&cfg, options...)
+	if err != nil {
+		panic(err)
+	}
+
+	var cliCtx *kong.Context
+	if cliCtx, err = parser.Parse(args); err != nil {
+		parser.Errorf("error parsing flags: %v", err)
+		return nil, nil, false
+	}
+
+	if cfg.Config != nil {
+		bytes, err := ioutil.ReadAll(cfg.Config)
+		if err != nil {
+			cliCtx.Errorf("unable to read contents of configuration file '%s': %v", cfg.Config.Name(), err)
+			return nil, nil, false
+		}
+		err = yaml.Unmarshal(bytes, &cfg)
+		if err != nil {
+			cliCtx.Errorf("invalid YAML in configuration file '%s': %v", cfg.Config.Name(), err)
+			return nil, nil, false
+		}
+	}
+
+	return &cfg, cliCtx, true
+}
+
+// validate runs the semantic checks of the configuration without connecting to any cluster. It returns all the
+// problems found instead of stopping at the first one.
+func (c *runConfig) validate() []error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(c.AstraBundle) > 0 {
+		if _, err := astra.LoadBundleZipFromPath(c.AstraBundle); err != nil {
+			check(fmt.Errorf("unable to open bundle %s from file: %v", c.AstraBundle, err))
+		}
+		for _, path := range c.AstraFailoverBundles {
+			if _, err := astra.LoadBundleZipFromPath(path); err != nil {
+				check(fmt.Errorf("unable to open failover bundle %s from file: %v", path, err))
+			}
+		}
+	} else if c.usesAstraToken() {
+		// The bundle is retrieved from Astra when the proxy starts
+		if len(c.AstraDatabaseID) == 0 {
+			check(errors.New("database ID is required when using a token"))
+		}
+	} else if len(c.ContactPoints) == 0 {
+		check(errors.New("must provide either bundle path, token, or contact points"))
+	}
+
+	for _, f := range []struct{ name, value, file string }{
+		{"username", c.Username, c.UsernameFile},
+		{"password", c.Password, c.PasswordFile},
+		{"Astra token", c.AstraToken, c.AstraTokenFile},
+	} {
+		if len(f.file) == 0 {
+			continue
+		}
+		if len(f.value) > 0 {
+			check(fmt.Errorf("the %s and the %s file can't both be set", f.name, f.name))
+		} else if _, err := proxycore.NewCredentialFile(f.file, nil); err != nil {
+			check(err)
+		}
+	}
+
+	if len(c.AstraFailoverBundles) > 0 && len(c.AstraBundle) == 0 {
+		check(errors.New("failover bundles require the bundle of the preferred region ('astra-bundle')"))
+	}
+
+	if len(c.KerberosPrincipal) > 0 {
+		if c.usesPassword() {
+			check(errors.New("Kerberos authentication can't be used with a username and password"))
+		}
+		if len(c.AstraBundle) > 0 || c.usesAstraToken() {
+			check(errors.New("Kerberos authentication isn't supported by Astra"))
+		}
+		if len(c.KerberosKeytab) == 0 {
+			check(errors.New("a keytab is required for Kerberos authentication"))
+		} else if _, err := c.buildAuth(nil); err != nil {
+			check(err)
+		}
+	}
+
+	if c.ProxyExecute {
+		if len(c.AstraBundle) > 0 || c.usesAstraToken() {
+			check(errors.New("proxy execution isn't supported by Astra"))
+		} else if len(c.Username) == 0 && len(c.UsernameFile) == 0 && len(c.KerberosPrincipal) == 0 {
+			check(errors.New("proxy execution requires the proxy's credentials, a username and password or a Kerberos principal"))
+		}
+	}
+
+	if c.AstraBundleRefreshInterval < 0 {
+		check(fmt.Errorf("invalid Astra bundle refresh interval, must not be negative (provided: %s)", c.AstraBundleRefreshInterval))
+	}
+
+	if c.AstraFailoverDelay < 0 {
+		check(fmt.Errorf("invalid Astra failover delay, must not be negative (provided: %s)", c.AstraFailoverDelay))
+	}
+
+	if c.HeartbeatInterval >= c.IdleTimeout {
+		check(fmt.Errorf("idle-timeout must be greater than heartbeat-interval (heartbeat interval: %s, idle timeout: %s)",
+			c.HeartbeatInterval, c.IdleTimeout))
+	}
+
+	if c.AstraRefreshInterval < 0 {
+		check(fmt.Errorf("invalid Astra refresh interval, must not be negative (provided: %s)", c.AstraRefreshInterval))
+	}
+
+	if c.NumConns < 1 {
+		check(fmt.Errorf("invalid number of connections, must be greater than 0 (provided: %d)", c.NumConns))
+	}
+
+	if len(c.ResultCacheTables) > 0 && c.ResultCacheSize < 1 {
+		check(fmt.Errorf("invalid result cache size, must be greater than 0 (provided: %d)", c.ResultCacheSize))
+	}
+
+	for _, t := range c.ResultCacheTables {
+		if t.TTL <= 0 {
+			check(fmt.Errorf("invalid TTL for result cache table '%s.%s', must be greater than 0 (provided: %s)",
+				t.Keyspace, t.Table, t.TTL))
+		}
+	}
+
+	if c.MaxConns < 0 || c.RemoteNumConns < 0 || c.RemoteMaxConns < 0 {
+		check(errors.New("invalid number of connections, max-conns, remote-num-conns and remote-max-conns must not be negative"))
+	}
+
+	if c.ConnScaleUpInflight < 1 {
+		check(fmt.Errorf("invalid connection scale up inflight threshold, must be greater than 0 (provided: %d)", c.ConnScaleUpInflight))
+	}
+
+	if len(c.MirrorContactPoints) > 0 && (c.MirrorQueueSize < 1 || c.MirrorMaxInflight < 1) {
+		check(fmt.Errorf("invalid mirror queue size or max in-flight, must be greater than 0 (provided: %d, %d)",
+			c.MirrorQueueSize, c.MirrorMaxInflight))
+	}
+
+	if c.MirrorCompareReads < 0 || c.MirrorCompareReads > 1 {
+		check(fmt.Errorf("invalid mirror compare reads ratio, must be between 0 and 1 (provided: %v)", c.MirrorCompareReads))
+	}
+
+	_, err := c.buildBackends()
+	check(err)
+
+	if len(c.PreparedStorePath) > 0 && c.PreparedStoreMaxEntries < 1 {
+		check(fmt.Errorf("invalid prepared store max entries, must be greater than 0 (provided: %d)", c.PreparedStoreMaxEntries))
+	}
+
+	_, err = newKeyspaceRewriteRules(c.KeyspaceRewrites)
+	check(err)
+
+	_, err = newConsistencyRules(c.ConsistencyRules)
+	check(err)
+
+	if len(c.CapturePath) > 0 {
+		if c.CaptureDuration < 0 {
+			check(fmt.Errorf("invalid capture duration, must not be negative (provided: %s)", c.CaptureDuration))
+		}
+		if _, err = parseClientCIDRs(c.CaptureClients); err != nil {
+			check(fmt.Errorf("invalid capture client CIDR: %v", err))
+		}
+		if c.CaptureQueueSize < 1 {
+			check(fmt.Errorf("invalid capture queue size, must be greater than 0 (provided: %d)", c.CaptureQueueSize))
+		}
+	}
+
+	if c.ProxyProtocol {
+		if c.ProxyProtocolHeaderTimeout < 0 {
+			check(fmt.Errorf("invalid PROXY protocol header timeout, must not be negative (provided: %s)", c.ProxyProtocolHeaderTimeout))
+		}
+		if len(c.ProxyProtocolTrustedSources) == 0 {
+			check(errors.New("PROXY protocol requires at least one trusted source CIDR"))
+		} else if _, err = parseClientCIDRs(c.ProxyProtocolTrustedSources); err != nil {
+			check(fmt.Errorf("invalid PROXY protocol trusted source CIDR: %v", err))
+		}
+	}
+
+	_, err = c.buildRetryPolicy()
+	check(err)
+
+	version, versionOk := parseProtocolVersion(c.ProtocolVersion)
+	if !versionOk {
+		check(fmt.Errorf("unsupported protocol version: %s", c.ProtocolVersion))
+	}
+	maxVersion, maxVersionOk := parseProtocolVersion(c.MaxProtocolVersion)
+	if !maxVersionOk {
+		check(fmt.Errorf("unsupported max protocol version: %s", c.MaxProtocolVersion))
+	}
+	if versionOk && maxVersionOk && version > maxVersion {
+		check(errors.New("default protocol version is greater than max protocol version"))
+	}
+
+	if (len(c.ProxyCertFile) > 0) != (len(c.ProxyKeyFile) > 0) {
+		check(errors.New("both certificate and private key are required for TLS"))
+	} else if len(c.ProxyCertFile) > 0 {
+		if _, err = tls.LoadX509KeyPair(c.ProxyCertFile, c.ProxyKeyFile); err != nil {
+			check(fmt.Errorf("unable to load TLS certificate pair: %v", err))
+		}
+	}
+
+	for i, l := range c.Listeners {
+		if (len(l.Bind) > 0) == (len(l.Socket) > 0) {
+			check(fmt.Errorf("listener %d requires either a bind address or a socket path", i))
+		}
+		if (len(l.ProxyCertFile) > 0) != (len(l.ProxyKeyFile) > 0) {
+			check(fmt.Errorf("listener %d: both certificate and private key are required for TLS", i))
+		} else if len(l.ProxyCertFile) > 0 {
+			if _, err = tls.LoadX509KeyPair(l.ProxyCertFile, l.ProxyKeyFile); err != nil {
+				check(fmt.Errorf("listener %d: unable to load TLS certificate pair: %v", i, err))
+			}
+		}
+		if len(l.RPCAddress) > 0 {
+			if _, err = net.ResolveIPAddr("ip", l.RPCAddress); err != nil {
+				check(fmt.Errorf("listener %d: invalid RPC address: %v", i, err))
+			}
+		}
+	}
+
+	check(validatePeers(c.RpcAddress, c.Tokens, c.Peers))
+	if c.hasPreparedPeers() && len(c.PreparedSharingToken) == 0 {
+		check(errors.New("a prepared sharing token is required when peers have an 'http-address'"))
+	}
+
+	return errs
+}
+
+// buildRetryPolicy creates the retry policy using either the configured retry policy or the downgrading consistency
+// retry policy. The default retry policy is used if neither is enabled.
+func (c *runConfig) buildRetryPolicy() (RetryPolicy, error) {
+	if c.RetryPolicy != nil && c.DowngradeConsistency {
+		return nil, errors.New("downgrade consistency can't be used with a configured retry policy")
+	} else if c.RetryPolicy != nil {
+		return NewConfigRetryPolicy(*c.RetryPolicy)
+	} else if c.DowngradeConsistency {
+		return NewDowngradingConsistencyRetryPolicy(), nil
+	}
+	return NewDefaultRetryPolicy(), nil
+}
+
+// buildResolver creates the default backend's resolver using either an Astra bundle, an Astra token or contact points.
+// An Astra token is also used as the password.
+func (c *runConfig) buildResolver() (proxycore.EndpointResolver, error) {
+	if len(c.AstraBundle) > 0 {
+		bundle, err := astra.LoadBundleZipFromPath(c.AstraBundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open bundle %s from file: %v", c.AstraBundle, err)
+		}
+		if len(c.AstraFailoverBundles) == 0 {
+			return astra.NewResolverWithRefresh(bundle, c.AstraTimeout,
+				astra.BundleLoaderFromPath(c.AstraBundle), c.AstraBundleRefreshInterval), nil
+		}
+		bundles := []*astra.Bundle{bundle}
+		loads := []astra.BundleLoader{astra.BundleLoaderFromPath(c.AstraBundle)}
+		for _, path := range c.AstraFailoverBundles {
+			bundle, err = astra.LoadBundleZipFromPath(path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open failover bundle %s from file: %v", path, err)
+			}
+			bundles = append(bundles, bundle)
+			loads = append(loads, astra.BundleLoaderFromPath(path))
+		}
+		return astra.NewFailoverResolverWithRefresh(bundles, c.AstraTimeout, loads, c.AstraBundleRefreshInterval), nil
+	} else if c.usesAstraToken() {
+		if len(c.AstraDatabaseID) == 0 {
+			return nil, errors.New("database ID is required when using a token")
+		}
+		// A token file is also used as the password file so that a rotated token is used by new connections
+		var tokenFile *proxycore.CredentialFile
+		if len(c.AstraTokenFile) > 0 {
+			var err error
+			if tokenFile, err = proxycore.NewCredentialFile(c.AstraTokenFile, nil); err != nil {
+				return nil, err
+			}
+			c.AstraToken = tokenFile.Value()
+			c.PasswordFile = c.AstraTokenFile
+		} else {
+			c.Password = c.AstraToken
+		}
+		c.Username = "token"
+		if c.AstraFailover {
+			bundles, err := astra.LoadBundleZipsFromURL(c.AstraApiURL, c.AstraDatabaseID, c.AstraToken, c.AstraTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load bundles for database %s from astra: %v", c.AstraDatabaseID, err)
+			}
+			loads := make([]astra.BundleLoader, len(bundles))
+			for i, bundle := range bundles {
+				loads[i] = c.bundleLoaderFromURL(bundle, tokenFile)
+			}
+			return astra.NewFailoverResolverWithRefresh(bundles, c.AstraTimeout, loads, c.AstraBundleRefreshInterval), nil
+		}
+		bundle, err := astra.LoadBundleZipFromURL(c.AstraApiURL, c.AstraDatabaseID, c.AstraToken, c.AstraTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load bundle for database %s from astra: %v", c.AstraDatabaseID, err)
+		}
+		return astra.NewResolverWithRefresh(bundle, c.AstraTimeout, c.bundleLoaderFromURL(bundle, tokenFile), c.AstraBundleRefreshInterval), nil
+	} else if len(c.ContactPoints) > 0 {
+		return proxycore.NewResolverWithDefaultPort(c.ContactPoints, c.Port), nil
+	}
+	return nil, errors.New("must provide either bundle path, token, or contact points")
+}
+
+// bundleLoaderFromURL creates a loader that downloads the bundle again from Astra so that it can be refreshed. The
+// latest token is used if it's read from a file.
+func (c *runConfig) bundleLoaderFromURL(bundle *astra.Bundle, tokenFile *proxycore.CredentialFile) astra.BundleLoader {
+	if tokenFile == nil {
+		return astra.BundleLoaderFromURL(c.AstraApiURL, c.AstraDatabaseID, c.AstraToken, c.AstraTimeout, bundle.Host)
+	}
+	return func() (*astra.Bundle, error) {
+		return astra.BundleLoaderFromURL(c.AstraApiURL, c.AstraDatabaseID, tokenFile.Value(), c.AstraTimeout, bundle.Host)()
+	}
+}
+
+// usesAstraToken returns true if the default backend is an Astra database whose bundle is downloaded using a token.
+func (c *runConfig) usesAstraToken() bool {
+	return len(c.AstraToken) > 0 || len(c.AstraTokenFile) > 0
+}
+
+// usesPassword returns true if a username or password is configured, either as a value or a file.
+func (c *runConfig) usesPassword() bool {
+	return len(c.Username) > 0 || len(c.Password) > 0 || len(c.UsernameFile) > 0 || len(c.PasswordFile) > 0
+}
+
+// buildAuth creates the default backend's authenticator, or nil if no credentials are configured.
+func (c *runConfig) buildAuth(logger *zap.Logger) (proxycore.Authenticator, error) {
+	if len(c.KerberosPrincipal) > 0 {
+		return proxycore.NewGSSAPIAuth(proxycore.GSSAPIConfig{
+			Principal:    c.KerberosPrincipal,
+			KeytabPath:   c.KerberosKeytab,
+			Krb5ConfPath: c.KerberosConfig,
+			Service:      c.KerberosService,
+			ServiceHost:  c.KerberosServiceHost,
+			Logger:       logger,
+		})
+	}
+	if len(c.UsernameFile) > 0 || len(c.PasswordFile) > 0 {
+		return proxycore.NewFilePasswordAuth(proxycore.FilePasswordConfig{
+			Username:     c.Username,
+			UsernameFile: c.UsernameFile,
+			Password:     c.Password,
+			PasswordFile: c.PasswordFile,
+			Logger:       logger,
+		})
+	}
+	if len(c.Username) > 0 || len(c.Password) > 0 {
+		return proxycore.NewPasswordAuth(c.Username, c.Password), nil
+	}
+	return nil, nil
+}
+
+// buildBackends validates the additional backends and creates their resolvers and authenticators.
+func (c *runConfig) buildBackends() ([]BackendConfig, error) {
+	names := map[string]bool{defaultBackendName: true}
+	backends := make([]BackendConfig, 0, len(c.Backends))
+	for _, b := range c.Backends {
+		if len(b.Name) == 0 {
+			return nil, errors.New("backend name is required")
+		}
+		if names[b.Name] {
+			return nil, fmt.Errorf("duplicate backend name '%s'", b.Name)
+		}
+		names[b.Name] = true
+
+		config := BackendConfig{Name: b.Name}
+		if len(b.AstraBundle) > 0 {
+			bundle, err := astra.LoadBundleZipFromPath(b.AstraBundle)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open bundle %s from file for backend '%s': %v", b.AstraBundle, b.Name, err)
+			}
+			config.Resolver = astra.NewResolverWithRefresh(bundle, c.AstraTimeout,
+				astra.BundleLoaderFromPath(b.AstraBundle), c.AstraBundleRefreshInterval)
+		} else if len(b.ContactPoints) > 0 {
+			port := b.Port
+			if port == 0 {
+				port = c.Port
+			}
+			config.Resolver = proxycore.NewResolverWithDefaultPort(b.ContactPoints, port)
+		} else {
+			return nil, fmt.Errorf("must provide either bundle path or contact points for backend '%s'", b.Name)
+		}
+		if len(b.Username) > 0 || len(b.Password) > 0 {
+			config.Auth = proxycore.NewPasswordAuth(b.Username, b.Password)
+		}
+		backends = append(backends, config)
+	}
+	for keyspace, name := range c.Routes {
+		if !names[name] {
+			return nil, fmt.Errorf("keyspace '%s' is routed to an unknown backend '%s'", keyspace, name)
+		}
+	}
+	return backends, nil
+}
+
 func parseProtocolVersion(s string) (version primitive.ProtocolVersion, ok bool) {
 	ok = true
 	lowered := strings.ToLower(s)
@@ -292,6 +797,55 @@ func (c *runConfig) maybeAddHealthCheck(p *Proxy, mux *http.ServeMux) {
 	}
 }
 
+// maybeAddStats checks the config and adds handlers for proxy statistics if required.
+func (c *runConfig) maybeAddStats(p *Proxy, mux *http.ServeMux) {
+	if len(c.ResultCacheTables) > 0 {
+		mux.HandleFunc(resultCacheStatsPath, func(writer http.ResponseWriter, request *http.Request) {
+			stats, _ := p.ResultCacheStats()
+			writeJSON(writer, stats)
+		})
+	}
+	if len(c.MirrorContactPoints) > 0 {
+		mux.HandleFunc(mirrorStatsPath, func(writer http.ResponseWriter, request *http.Request) {
+			stats, _ := p.MirrorStats()
+			writeJSON(writer, stats)
+		})
+	}
+}
+
+// maybeAddPreparedSharing adds the handler used by peers to fetch prepared statements if any peers share them.
+func (c *runConfig) maybeAddPreparedSharing(p *Proxy, mux *http.ServeMux) {
+	if c.hasPreparedPeers() {
+		mux.Handle(preparedPath, p.PreparedHandler())
+	}
+}
+
+// hasPreparedPeers returns true if any peers have an HTTP address used to share prepared statements.
+func (c *runConfig) hasPreparedPeers() bool {
+	for _, peer := range c.Peers {
+		if len(peer.HttpAddr) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isHttpEnabled returns true if any of the features served by the HTTP server are enabled.
+func (c *runConfig) isHttpEnabled() bool {
+	return c.HealthCheck || len(c.ResultCacheTables) > 0 || len(c.MirrorContactPoints) > 0 || c.hasPreparedPeers()
+}
+
+func writeJSON(writer http.ResponseWriter, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("failed to marshal json response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(response)
+}
+
 // maybeAddPort adds the default port to an IP; otherwise, it returns the original address.
 func maybeAddPort(addr string, defaultPort string) string {
 	if net.ParseIP(addr) != nil {
@@ -317,16 +871,34 @@ func (c *runConfig) listenAndServe(p *Proxy, mux *http.ServeMux, ctx context.Con
 		return err
 	}
 
-	proxyListener, err := resolveAndListen(c.Bind, c.ProxyCertFile, c.ProxyKeyFile)
-	if err != nil {
-		return err
+	listenerConfigs := c.Listeners
+	if len(listenerConfigs) == 0 {
+		listenerConfigs = []ListenerConfig{{Bind: c.Bind, ProxyCertFile: c.ProxyCertFile, ProxyKeyFile: c.ProxyKeyFile}}
+	}
+
+	proxyListeners := make([]net.Listener, 0, len(listenerConfigs))
+	defer func() {
+		if err != nil {
+			for _, l := range proxyListeners {
+				_ = l.Close()
+			}
+		}
+	}()
+
+	for _, lc := range listenerConfigs {
+		proxyListener, err := c.listen(lc, logger)
+		if err != nil {
+			return err
+		}
+		proxyListeners = append(proxyListeners, proxyListener)
+		logger.Info("proxy is listening", zap.Stringer("address", proxyListener.Addr()))
 	}
 
-	logger.Info("proxy is listening", zap.Stringer("address", proxyListener.Addr()))
+	numServers += len(proxyListeners) - 1
 
 	var httpListener net.Listener
 
-	if c.HealthCheck {
+	if c.isHttpEnabled() {
 		numServers++ // Add the HTTP server
 
 		httpListener, err = resolveAndListen(c.HttpBind, "", "")
@@ -334,9 +906,15 @@ func (c *runConfig) listenAndServe(p *Proxy, mux *http.ServeMux, ctx context.Con
 			return err
 		}
 
-		logger.Info("health checks are listening",
-			zap.String("livenessURL", c.HttpBind+livenessPath),
-			zap.String("readinessURL", c.HttpBind+readinessPath))
+		if c.HealthCheck {
+			logger.Info("health checks are listening",
+				zap.String("livenessURL", c.HttpBind+livenessPath),
+				zap.String("readinessURL", c.HttpBind+readinessPath))
+		}
+		if len(c.ResultCacheTables) > 0 {
+			logger.Info("result cache statistics are listening",
+				zap.String("statsURL", c.HttpBind+resultCacheStatsPath))
+		}
 	}
 
 	wg.Add(numServers)
@@ -355,15 +933,17 @@ func (c *runConfig) listenAndServe(p *Proxy, mux *http.ServeMux, ctx context.Con
 		}
 	}()
 
-	go func() {
-		defer wg.Done()
-		err := p.Serve(proxyListener)
-		if err != nil && err != ErrProxyClosed {
-			ch <- err
-		}
-	}()
+	for i, proxyListener := range proxyListeners {
+		go func(l net.Listener, options ListenerOptions) {
+			defer wg.Done()
+			err := p.ServeWithOptions(l, options)
+			if err != nil && err != ErrProxyClosed {
+				ch <- err
+			}
+		}(proxyListener, ListenerOptions{RPCAddr: listenerConfigs[i].RPCAddress})
+	}
 
-	if c.HealthCheck {
+	if c.isHttpEnabled() {
 		go func() {
 			defer wg.Done()
 			err := server.Serve(httpListener)
@@ -383,17 +963,63 @@ func (c *runConfig) listenAndServe(p *Proxy, mux *http.ServeMux, ctx context.Con
 	return err
 }
 
-func resolveAndListen(address, cert, key string) (net.Listener, error) {
-	if len(cert) > 0 || len(key) > 0 {
-		if len(cert) == 0 || len(key) == 0 {
-			return nil, errors.New("both certificate and private key are required for TLS")
-		}
-		cert, err := tls.LoadX509KeyPair(cert, key)
+// listen creates a proxy listener using the listener's address or socket. If enabled, PROXY protocol headers are read
+// before the TLS handshake.
+func (c *runConfig) listen(lc ListenerConfig, logger *zap.Logger) (l net.Listener, err error) {
+	if len(lc.Socket) > 0 {
+		l, err = listenUnix(lc.Socket)
+	} else {
+		l, err = net.Listen("tcp", maybeAddPort(lc.Bind, "9042"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.ProxyProtocol {
+		pl, err := NewProxyProtocolListener(l, ProxyProtocolConfig{
+			TrustedSources: c.ProxyProtocolTrustedSources,
+			HeaderTimeout:  c.ProxyProtocolHeaderTimeout,
+		}, logger)
 		if err != nil {
-			return nil, fmt.Errorf("unable to load TLS certificate pair: %v", err)
+			_ = l.Close()
+			return nil, err
 		}
-		return tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}})
-	} else {
-		return net.Listen("tcp", address)
+		l = pl
+	}
+	return maybeListenTLS(l, lc.ProxyCertFile, lc.ProxyKeyFile)
+}
+
+func resolveAndListen(address, cert, key string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return maybeListenTLS(l, cert, key)
+}
+
+// listenUnix listens on a unix socket. A socket file left behind by a previous run is removed, but any other kind of
+// file at the path is left untouched.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %v", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// maybeListenTLS wraps a listener using TLS if a certificate and private key are provided.
+func maybeListenTLS(l net.Listener, cert, key string) (net.Listener, error) {
+	if len(cert) == 0 && len(key) == 0 {
+		return l, nil
+	}
+	if len(cert) == 0 || len(key) == 0 {
+		_ = l.Close()
+		return nil, errors.New("both certificate and private key are required for TLS")
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("unable to load TLS certificate pair: %v", err)
 	}
+	return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{pair}}), nil
 }
@@ -412,6 +412,43 @@ func TestRun_ConfigFileWithInvalidPeer(t *testing.T) {
 	require.Equal(t, 1, rc)
 }
 
+func TestRun_ConfigFileWithInvalidRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clusterPort, clusterAddr, proxyBindAddr, _ := generateTestAddrs(testAddr)
+
+	cluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), clusterPort)
+
+	err := cluster.Add(ctx, 1)
+	require.NoError(t, err)
+
+	defer cluster.Shutdown()
+
+	configFileName, err := writeTempYaml(struct {
+		Bind          string
+		Port          int
+		ContactPoints []string `yaml:"contact-points"`
+		Backends      []backendRunConfig
+		Routes        map[string]string
+	}{
+		ContactPoints: []string{clusterAddr},
+		Bind:          proxyBindAddr,
+		Port:          clusterPort,
+		Backends: []backendRunConfig{{
+			Name:          "other",
+			ContactPoints: []string{clusterAddr},
+		}},
+		Routes: map[string]string{"ks": "doesnotexist"},
+	})
+	require.NoError(t, err)
+
+	rc := Run(ctx, []string{
+		"--config", configFileName,
+	})
+	require.Equal(t, 1, rc)
+}
+
 func TestRun_ProxyTLS(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -482,6 +519,114 @@ func TestRun_ProxyTLS(t *testing.T) {
 	require.Equal(t, rs.RowCount(), 1)
 }
 
+func TestRun_Listeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	clusterPort, clusterAddr, proxyBindAddr, httpBindAddr := generateTestAddrs(testAddr)
+
+	cluster := proxycore.NewMockCluster(net.ParseIP(testStartAddr), clusterPort)
+	defer cluster.Shutdown()
+	err := cluster.Add(ctx, 1)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "listeners")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "cql-proxy.sock")
+
+	configFileName, err := writeTempYaml(struct {
+		Port          int
+		ContactPoints []string `yaml:"contact-points"`
+		HealthCheck   bool     `yaml:"health-check"`
+		HttpBind      string   `yaml:"http-bind"`
+		Listeners     []ListenerConfig
+	}{
+		Port:          clusterPort,
+		ContactPoints: []string{clusterAddr},
+		HealthCheck:   true,
+		HttpBind:      httpBindAddr,
+		Listeners: []ListenerConfig{
+			{Bind: proxyBindAddr, RPCAddress: "10.0.0.1"},
+			{Socket: socketPath},
+		},
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		rc := Run(ctx, []string{
+			"--config", configFileName,
+		})
+		assert.Equal(t, 0, rc)
+		wg.Done()
+	}()
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	require.True(t, waitUntil(10*time.Second, func() bool {
+		return checkLiveness(httpBindAddr)
+	}))
+
+	// The TCP listener advertises its own RPC address
+	cl := connectTestClient(t, ctx, proxyBindAddr)
+	defer cl.Close()
+
+	rs, err := cl.Query(ctx, primitive.ProtocolVersion4, &message.Query{
+		Query: "SELECT rpc_address FROM system.local",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, rs.RowCount())
+
+	rpcAddr, err := rs.Row(0).InetByName("rpc_address")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", rpcAddr.String())
+
+	// Clients connected using the unix socket are served by the same proxy
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	codec := frame.NewCodec()
+	err = codec.EncodeFrame(frame.NewFrame(primitive.ProtocolVersion4, 0, message.NewStartup()), conn)
+	require.NoError(t, err)
+	response, err := codec.DecodeFrame(conn)
+	require.NoError(t, err)
+	assert.IsType(t, &message.Ready{}, response.Body.Message)
+
+	err = codec.EncodeFrame(frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Query{
+		Query: "SELECT rpc_address FROM system.local",
+	}), conn)
+	require.NoError(t, err)
+	response, err = codec.DecodeFrame(conn)
+	require.NoError(t, err)
+	rows, ok := response.Body.Message.(*message.RowsResult)
+	require.True(t, ok, "expected rows result, got %v", response.Body.Message)
+	require.Len(t, rows.Data, 1)
+	assert.Equal(t, net.IPv4(127, 0, 0, 1).To4(), net.IP(rows.Data[0][0]))
+}
+
+func TestRun_ListenerWithoutAddress(t *testing.T) {
+	configFileName, err := writeTempYaml(struct {
+		ContactPoints []string `yaml:"contact-points"`
+		Listeners     []ListenerConfig
+	}{
+		ContactPoints: []string{"127.0.0.1"},
+		Listeners:     []ListenerConfig{{RPCAddress: "127.0.0.1"}},
+	})
+	require.NoError(t, err)
+
+	rc := Run(context.Background(), []string{
+		"--config", configFileName,
+	})
+	require.Equal(t, 1, rc)
+}
+
 func TestRun_UnsupportedWriteConsistency(t *testing.T) {
 	unsupportedConsistencies := []primitive.ConsistencyLevel{
 		primitive.ConsistencyLevelAny,
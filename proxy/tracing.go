@@ -0,0 +1,125 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/datastax/cql-proxy/proxy"
+
+// Span attribute keys
+const (
+	attrOpCode        = attribute.Key("cql.opcode")
+	attrStream        = attribute.Key("cql.stream")
+	attrKeyspace      = attribute.Key("cql.keyspace")
+	attrHost          = attribute.Key("cql.host")
+	attrRetryCount    = attribute.Key("cql.retry_count")
+	attrRetryDecision = attribute.Key("cql.retry_decision")
+	attrResponse      = attribute.Key("cql.response")
+)
+
+var traceContextPropagator = propagation.TraceContext{}
+
+// customPayloadCarrier adapts a CQL custom payload so that W3C trace context ("traceparent" and "tracestate") can be
+// extracted from it.
+type customPayloadCarrier map[string][]byte
+
+func (c customPayloadCarrier) Get(key string) string {
+	return string(c[key])
+}
+
+func (c customPayloadCarrier) Set(key string, value string) {
+	c[key] = []byte(value)
+}
+
+func (c customPayloadCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func getOrCreateNoopTracerProvider(provider trace.TracerProvider) trace.TracerProvider {
+	if provider == nil {
+		return noop.NewTracerProvider()
+	}
+	return provider
+}
+
+// NewOTLPTracerProvider creates a tracer provider that exports spans using OTLP over HTTP to the endpoint URL (e.g.
+// "http://localhost:4318"). Parent-based sampling is used so that a sampling decision made by a client is respected;
+// otherwise, spans are sampled using `sampleRatio`.
+func NewOTLPTracerProvider(ctx context.Context, endpointURL string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpointURL))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("cql-proxy")))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	), nil
+}
+
+// startSpan starts a span for a client request, using the W3C trace context from the request's custom payload as the
+// parent if present.
+func (c *client) startSpan(raw *frame.RawFrame, body *frame.Body) trace.Span {
+	ctx := c.ctx
+	if len(body.CustomPayload) > 0 {
+		ctx = traceContextPropagator.Extract(ctx, customPayloadCarrier(body.CustomPayload))
+	}
+	name := operationName(raw.Header.OpCode)
+	_, span := c.proxy.tracer.Start(ctx, "cql."+name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attrOpCode.String(name),
+			attrStream.Int(int(raw.Header.StreamId)),
+			attrKeyspace.String(c.keyspace),
+		))
+	return span
+}
+
+func operationName(opCode primitive.OpCode) string {
+	switch opCode {
+	case primitive.OpCodeQuery:
+		return "query"
+	case primitive.OpCodePrepare:
+		return "prepare"
+	case primitive.OpCodeExecute:
+		return "execute"
+	case primitive.OpCodeBatch:
+		return "batch"
+	default:
+		return opCode.String()
+	}
+}
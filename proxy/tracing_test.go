@@ -0,0 +1,154 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/datastax/cql-proxy/proxycore"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProxy_Tracing(t *testing.T) {
+	const version = primitive.ProtocolVersion4
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanId = "00f067aa0ba902b7"
+
+	collector := &testCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider, err := NewOTLPTracerProvider(ctx, server.URL, 1.0)
+	require.NoError(t, err)
+
+	var attempts int32
+
+	tester, proxyContactPoint, err := setupProxyTestWithConfig(ctx, 2, &proxyTestConfig{
+		handlers: proxycore.MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *proxycore.MockClient, frm *frame.Frame) message.Message {
+				if frm.Body.Message.(*message.Query).Query != "SELECT * FROM test.test" {
+					return proxycore.MockDefaultQueryHandler(cl, frm)
+				}
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					return &message.IsBootstrapping{ErrorMessage: "Bootstrapping"}
+				}
+				return &message.RowsResult{
+					Metadata: &message.RowsMetadata{ColumnCount: 0},
+					Data:     message.RowSet{},
+				}
+			},
+		},
+		tracerProvider: provider,
+	})
+	defer tester.shutdown()
+	require.NoError(t, err)
+
+	cl := connectTestClient(t, ctx, proxyContactPoint)
+
+	frm := frame.NewFrame(version, 0, &message.Query{Query: "SELECT * FROM test.test"})
+	frm.SetCustomPayload(map[string][]byte{"traceparent": []byte("00-" + traceId + "-" + parentSpanId + "-01")})
+	resp, err := cl.SendAndReceive(ctx, frm)
+	require.NoError(t, err)
+	assert.Equal(t, primitive.OpCodeResult, resp.Header.OpCode)
+
+	require.NoError(t, provider.ForceFlush(ctx))
+
+	spans := collector.spansByName()
+
+	require.Len(t, spans["cql.query"], 1)
+	span := spans["cql.query"][0]
+	assert.Equal(t, traceId, hex.EncodeToString(span.TraceId))
+	assert.Equal(t, parentSpanId, hex.EncodeToString(span.ParentSpanId))
+
+	attemptSpans := spans["cql.attempt"]
+	require.Len(t, attemptSpans, 2)
+	for i, attempt := range attemptSpans {
+		assert.Equal(t, span.SpanId, attempt.ParentSpanId)
+		attrs := spanAttributes(attempt)
+		assert.Equal(t, int64(i), attrs["cql.retry_count"].GetIntValue())
+		assert.NotEmpty(t, attrs["cql.host"].GetStringValue())
+	}
+	assert.Equal(t, RetryNext.String(), spanAttributes(attemptSpans[0])["cql.retry_decision"].GetStringValue())
+}
+
+// testCollector is a stand-in for an OpenTelemetry collector that accepts OTLP over HTTP.
+type testCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *testCollector) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err = proto.Unmarshal(body, &req); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	c.mu.Unlock()
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	writer.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = writer.Write(resp)
+}
+
+func (c *testCollector) spansByName() map[string][]*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string][]*tracepb.Span)
+	for _, span := range c.spans {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	return spans
+}
+
+func spanAttributes(span *tracepb.Span) map[string]interface {
+	GetStringValue() string
+	GetIntValue() int64
+} {
+	attrs := make(map[string]interface {
+		GetStringValue() string
+		GetIntValue() int64
+	})
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
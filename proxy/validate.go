@@ -0,0 +1,82 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v2"
+)
+
+const maskedSecret = "********"
+
+// Validate starts the validate command. It parses the proxy's flags, environment variables and configuration file the
+// same way as Run, checks the configuration without connecting to any cluster and prints the effective configuration
+// with its secrets masked. 'args' shouldn't include the executable or the command's name. It returns the exit code for
+// the command.
+func Validate(_ context.Context, args []string) int {
+	cfg, cliCtx, ok := parseRunConfig(args, kong.Name("cql-proxy validate"),
+		kong.Description("Validate the proxy's configuration and print the effective configuration"))
+	if !ok {
+		return 1
+	}
+
+	if errs := cfg.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			cliCtx.Errorf("%v", err)
+		}
+		return 1
+	}
+
+	if err := writeEffectiveConfig(cliCtx.Stdout, cfg); err != nil {
+		cliCtx.Errorf("unable to write effective configuration: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// writeEffectiveConfig writes the merged configuration as YAML with its secrets masked.
+func writeEffectiveConfig(w io.Writer, cfg *runConfig) error {
+	bytes, err := yaml.Marshal(cfg.masked())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Configuration is valid\n\n%s", bytes)
+	return err
+}
+
+// masked returns a copy of the configuration with its passwords and tokens replaced.
+func (c *runConfig) masked() *runConfig {
+	masked := *c
+	maskSecret(&masked.Password)
+	maskSecret(&masked.AstraToken)
+	maskSecret(&masked.PreparedSharingToken)
+	maskSecret(&masked.MirrorPassword)
+	masked.Backends = make([]backendRunConfig, len(c.Backends))
+	for i, b := range c.Backends {
+		maskSecret(&b.Password)
+		masked.Backends[i] = b
+	}
+	return &masked
+}
+
+func maskSecret(secret *string) {
+	if len(*secret) > 0 {
+		*secret = maskedSecret
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestValidate(t *testing.T) {
+	configFileName, err := writeTempYaml(struct {
+		ContactPoints []string `yaml:"contact-points"`
+		RPCAddr       string   `yaml:"rpc-address"`
+		Password      string
+		Peers         []PeerConfig
+		Backends      []backendRunConfig
+		Routes        map[string]string
+	}{
+		ContactPoints: []string{"127.0.0.1"},
+		RPCAddr:       "127.0.0.1",
+		Password:      "secret",
+		Peers:         []PeerConfig{{RPCAddr: "127.0.0.2"}},
+		Backends:      []backendRunConfig{{Name: "analytics", ContactPoints: []string{"127.0.0.3"}, Password: "secret"}},
+		Routes:        map[string]string{"ks": "analytics"},
+	})
+	require.NoError(t, err)
+	defer os.Remove(configFileName)
+
+	cfg, _, ok := parseRunConfig([]string{"--config", configFileName, "--unsupported-write-consistency-override", "quorum"})
+	require.True(t, ok)
+	assert.Empty(t, cfg.validate())
+
+	var out bytes.Buffer
+	require.NoError(t, writeEffectiveConfig(&out, cfg))
+	assert.Contains(t, out.String(), "Configuration is valid")
+	assert.NotContains(t, out.String(), "secret")
+
+	// The effective configuration can be used as a configuration file
+	var effective runConfig
+	require.NoError(t, yaml.Unmarshal(bytes.TrimPrefix(out.Bytes(), []byte("Configuration is valid\n")), &effective))
+	assert.Equal(t, []string{"127.0.0.1"}, effective.ContactPoints)
+	assert.Equal(t, maskedSecret, effective.Password)
+	assert.Equal(t, maskedSecret, effective.Backends[0].Password)
+	assert.Equal(t, cfg.UnsupportedWriteConsistencyOverride, effective.UnsupportedWriteConsistencyOverride)
+
+	// Masking doesn't modify the configuration
+	assert.Equal(t, "secret", cfg.Password)
+	assert.Equal(t, "secret", cfg.Backends[0].Password)
+}
+
+func TestValidate_Invalid(t *testing.T) {
+	configFileName, err := writeTempYaml(struct {
+		Peers []PeerConfig
+	}{
+		Peers: []PeerConfig{{RPCAddr: "127.0.0.2"}},
+	})
+	require.NoError(t, err)
+	defer os.Remove(configFileName)
+
+	cfg, _, ok := parseRunConfig([]string{"--config", configFileName, "--heartbeat-interval", "60s", "--idle-timeout", "30s"})
+	require.True(t, ok)
+
+	errs := cfg.validate()
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, []string{
+		"must provide either bundle path, token, or contact points",
+		"idle-timeout must be greater than heartbeat-interval (heartbeat interval: 1m0s, idle timeout: 30s)",
+		"peers provided, but RPC address is not set",
+	}, messages)
+
+	assert.Equal(t, 1, Validate(context.Background(), []string{"--config", configFileName}))
+}
+
+func TestValidate_InvalidYaml(t *testing.T) {
+	f, err := ioutil.TempFile("", "cql-proxy-yaml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("contact-points: [127.0.0.1\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, 1, Validate(context.Background(), []string{"--config", f.Name()}))
+	assert.Equal(t, 1, Run(context.Background(), []string{"--config", f.Name()}))
+}
+
+func TestValidate_Kerberos(t *testing.T) {
+	cfg, _, ok := parseRunConfig([]string{"--contact-points", "127.0.0.1", "--kerberos-principal", "cassandra@EXAMPLE.COM",
+		"--username", "cassandra"})
+	require.True(t, ok)
+
+	errs := cfg.validate()
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, []string{
+		"Kerberos authentication can't be used with a username and password",
+		"a keytab is required for Kerberos authentication",
+	}, messages)
+}
+
+func TestValidate_ProxyExecute(t *testing.T) {
+	cfg, _, ok := parseRunConfig([]string{"--contact-points", "127.0.0.1", "--proxy-execute"})
+	require.True(t, ok)
+
+	errs := cfg.validate()
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "proxy execution requires the proxy's credentials, a username and password or a Kerberos principal")
+
+	cfg, _, ok = parseRunConfig([]string{"--contact-points", "127.0.0.1", "--proxy-execute", "--username", "proxy",
+		"--password", "secret"})
+	require.True(t, ok)
+	assert.Empty(t, cfg.validate())
+}
+
+func TestValidate_ProxyProtocol(t *testing.T) {
+	cfg, _, ok := parseRunConfig([]string{"--contact-points", "127.0.0.1", "--proxy-protocol"})
+	require.True(t, ok)
+
+	errs := cfg.validate()
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "PROXY protocol requires at least one trusted source CIDR")
+
+	cfg, _, ok = parseRunConfig([]string{"--contact-points", "127.0.0.1", "--proxy-protocol",
+		"--proxy-protocol-trusted-sources", "10.0.0.0/8"})
+	require.True(t, ok)
+	assert.Empty(t, cfg.validate())
+}
+
+func TestValidate_ResultCacheTTL(t *testing.T) {
+	configFileName, err := writeTempYaml(struct {
+		ContactPoints     []string           `yaml:"contact-points"`
+		ResultCacheTables []ResultCacheTable `yaml:"result-cache-tables"`
+	}{
+		ContactPoints:     []string{"127.0.0.1"},
+		ResultCacheTables: []ResultCacheTable{{Keyspace: "ks", Table: "cached", TTL: time.Minute}, {Keyspace: "ks", Table: "expired"}},
+	})
+	require.NoError(t, err)
+	defer os.Remove(configFileName)
+
+	cfg, _, ok := parseRunConfig([]string{"--config", configFileName})
+	require.True(t, ok)
+
+	errs := cfg.validate()
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "invalid TTL for result cache table 'ks.expired', must be greater than 0 (provided: 0s)")
+}
+
+func TestValidate_CredentialFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("secret\n"), 0600))
+
+	cfg, _, ok := parseRunConfig([]string{"--contact-points", "127.0.0.1", "--username", "cassandra",
+		"--password-file", path})
+	require.True(t, ok)
+	assert.Empty(t, cfg.validate())
+
+	cfg, _, ok = parseRunConfig([]string{"--contact-points", "127.0.0.1", "--password", "secret",
+		"--password-file", path, "--username-file", filepath.Join(t.TempDir(), "missing")})
+	require.True(t, ok)
+	errs := cfg.validate()
+	require.Len(t, errs, 2)
+	assert.EqualError(t, errs[1], "the password and the password file can't both be set")
+}
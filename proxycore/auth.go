@@ -78,3 +78,13 @@ func NewPasswordAuth(username string, password string) Authenticator {
 		password: password,
 	}
 }
+
+// NewPasswordAuthWithAuthorizationID creates a password authenticator that authorizes as another role using DSE proxy
+// authentication. The authenticated user requires the "PROXY.LOGIN" permission on the authorization ID's role.
+func NewPasswordAuthWithAuthorizationID(authorizationID string, username string, password string) Authenticator {
+	return &passwordAuth{
+		authId:   authorizationID,
+		username: username,
+		password: password,
+	}
+}
@@ -87,6 +87,10 @@ func ConnectClient(ctx context.Context, endpoint Endpoint, config ClientConnConf
 }
 
 func (c *ClientConn) Handshake(ctx context.Context, version primitive.ProtocolVersion, auth Authenticator, startupKeysAndValues ...string) (primitive.ProtocolVersion, error) {
+	if stateful, ok := auth.(StatefulAuthenticator); ok {
+		auth = stateful.NewSession()
+	}
+
 	if len(startupKeysAndValues)%2 != 0 {
 		return version, errors.New("invalid startup key/value pairs")
 	}
@@ -195,25 +199,31 @@ func (c *ClientConn) authInitialResponse(ctx context.Context, version primitive.
 	}
 }
 
+// authChallenge responds to challenges until authentication succeeds or fails. Some mechanisms, e.g. GSSAPI, require
+// several challenges.
 func (c *ClientConn) authChallenge(ctx context.Context, version primitive.ProtocolVersion, auth Authenticator, challenge *message.AuthChallenge) error {
-	token, err := auth.EvaluateChallenge(challenge.Token)
-	if err != nil {
-		return err
-	}
-	response, err := c.SendAndReceive(ctx, frame.NewFrame(version, -1, &message.AuthResponse{Token: token}))
-	if err != nil {
-		return err
-	}
+	for {
+		token, err := auth.EvaluateChallenge(challenge.Token)
+		if err != nil {
+			return err
+		}
+		response, err := c.SendAndReceive(ctx, frame.NewFrame(version, -1, &message.AuthResponse{Token: token}))
+		if err != nil {
+			return err
+		}
 
-	switch msg := response.Body.Message.(type) {
-	case *message.AuthSuccess:
-		return auth.Success(msg.Token)
-	case message.Error:
-		return &CqlError{Message: msg}
-	default:
-		return &UnexpectedResponse{
-			Expected: []string{"AUTH_SUCCESS"},
-			Received: response.Body.String(),
+		switch msg := response.Body.Message.(type) {
+		case *message.AuthChallenge:
+			challenge = msg
+		case *message.AuthSuccess:
+			return auth.Success(msg.Token)
+		case message.Error:
+			return &CqlError{Message: msg}
+		default:
+			return &UnexpectedResponse{
+				Expected: []string{"AUTH_CHALLENGE", "AUTH_SUCCESS"},
+				Received: response.Body.String(),
+			}
 		}
 	}
 }
@@ -490,6 +490,12 @@ func (t *testPrepareCache) Load(id string) (entry *PreparedEntry, ok bool) {
 	return nil, false
 }
 
+func (t *testPrepareCache) Range(f func(id string, entry *PreparedEntry) bool) {
+	t.cache.Range(func(key, value interface{}) bool {
+		return f(key.(string), value.(*PreparedEntry))
+	})
+}
+
 type testPrepareRequest struct {
 	t          *testing.T
 	wg         *sync.WaitGroup
@@ -31,6 +31,7 @@ import (
 const (
 	DefaultRefreshWindow  = 10 * time.Second
 	DefaultRefreshTimeout = 5 * time.Second
+	DefaultFailoverDelay  = 30 * time.Second
 )
 
 type Event interface {
@@ -53,6 +54,16 @@ func (r RemoveEvent) isEvent() {
 	panic("do not call")
 }
 
+// UpdateEvent is sent when a host's endpoint changes, but the host is the same, e.g. if the address of the Astra SNI proxy
+// is rotated. New connections to the host should use the updated endpoint.
+type UpdateEvent struct {
+	Host *Host
+}
+
+func (u UpdateEvent) isEvent() {
+	panic("do not call")
+}
+
 type UpEvent struct {
 	Host *Host
 }
@@ -105,14 +116,22 @@ type ClusterConfig struct {
 	ConnectTimeout    time.Duration
 	RefreshTimeout    time.Duration
 	IdleTimeout       time.Duration
-	Logger            *zap.Logger
+	// ResolveInterval is the interval between re-resolving the cluster's endpoints and refreshing its hosts, e.g. to
+	// pick up changes to the Astra metadata. Endpoints are also re-resolved after failing to reconnect to every host.
+	// Periodic re-resolution is disabled if it's zero.
+	ResolveInterval time.Duration
+	// FailoverDelay is how long the cluster needs to be unreachable before failing over to alternative endpoints. It's
+	// only used if Resolver is a FailoverEndpointResolver. The cluster fails back to the preferred endpoints, when
+	// they're available again, every ResolveInterval.
+	FailoverDelay time.Duration
+	Logger        *zap.Logger
 }
 
 type ClusterInfo struct {
 	Partitioner    string
 	ReleaseVersion string
 	CQLVersion     string
-	LocalDC        string
+	LocalDC        string // The local data center on start up. Use Cluster.LocalDC() for the current local data center.
 	DSEVersion     string
 }
 
@@ -125,11 +144,14 @@ type Cluster struct {
 	currentEndpoint  Endpoint
 	hosts            []*Host
 	currentHostIndex int
+	reconnectErrors  int // Number of consecutive failed attempts to reconnect
 	listeners        []ClusterListener
 	addListener      chan ClusterListener
 	events           chan *frame.Frame
 	outageMu         sync.Mutex
 	outageTime       time.Time
+	localDCMu        sync.Mutex
+	localDC          string // The data center of the control connection, it changes when failing over or back
 	// the following are immutable after start up
 	NegotiatedVersion primitive.ProtocolVersion
 	Info              ClusterInfo
@@ -167,7 +189,10 @@ func ConnectCluster(ctx context.Context, config ClusterConfig) (*Cluster, error)
 	}
 
 	if err != nil {
-		return nil, err
+		// Fail over immediately if the preferred endpoints are unavailable on start up
+		if resolver, ok := config.Resolver.(FailoverEndpointResolver); !ok || !c.failover(resolver, true) {
+			return nil, err
+		}
 	}
 
 	go c.stayConnected()
@@ -213,6 +238,7 @@ func (c *Cluster) connect(ctx context.Context, endpoint Endpoint, initial bool)
 
 	negotiated, err := conn.Handshake(ctx, version, c.config.Auth)
 	if err != nil {
+		maybeReloadAuth(c.config.Auth, err)
 		return err
 	}
 	if !initial && negotiated != version {
@@ -224,6 +250,22 @@ func (c *Cluster) connect(ctx context.Context, endpoint Endpoint, initial bool)
 		return err
 	}
 
+	// The local DC is updated before the hosts are merged so that the pools for the hosts added after failing over (or
+	// back) use the new local DC. It's restored if merging fails; no events are sent in that case.
+	previousDC := c.LocalDC()
+	c.setLocalDC(info.LocalDC)
+
+	// The control connection is only replaced after the hosts are merged so that a failed attempt doesn't replace a
+	// healthy control connection, e.g. when failing back to a preferred set of endpoints.
+	if err = c.mergeHosts(endpoint, hosts); err != nil {
+		c.setLocalDC(previousDC)
+		return err
+	}
+
+	if !initial && previousDC != info.LocalDC {
+		c.logger.Info("local DC changed", zap.String("previous", previousDC), zap.String("dc", info.LocalDC))
+	}
+
 	c.currentEndpoint = endpoint
 	c.controlConn = conn
 	c.setOutageTime(time.Time{})
@@ -234,10 +276,10 @@ func (c *Cluster) connect(ctx context.Context, endpoint Endpoint, initial bool)
 
 	go conn.Heartbeats(c.config.ConnectTimeout, version, c.config.HeartBeatInterval, c.config.IdleTimeout, c.logger)
 
-	return c.mergeHosts(hosts)
+	return nil
 }
 
-func (c *Cluster) mergeHosts(hosts []*Host) error {
+func (c *Cluster) mergeHosts(current Endpoint, hosts []*Host) error {
 	existing := make(map[string]*Host)
 
 	for _, host := range c.hosts {
@@ -246,19 +288,23 @@ func (c *Cluster) mergeHosts(hosts []*Host) error {
 
 	c.currentHostIndex = -1
 	for i, host := range hosts {
-		if host.Key() == c.currentEndpoint.Key() {
+		if host.Key() == current.Key() {
 			c.currentHostIndex = i
 			break
 		}
 	}
 	if c.currentHostIndex < 0 {
-		return fmt.Errorf("host %s not found in system tables", c.currentEndpoint)
+		return fmt.Errorf("host %s not found in system tables", current)
 	}
 
 	for _, host := range hosts {
 		key := host.Key()
-		if _, ok := existing[key]; ok {
+		if previous, ok := existing[key]; ok {
 			delete(existing, key)
+			if previous.Addr() != host.Addr() {
+				c.logger.Info("updating host endpoint", zap.Stringer("host", host), zap.String("previous", previous.Addr()))
+				c.sendEvent(&UpdateEvent{host})
+			}
 		} else {
 			c.logger.Info("adding host to the cluster", zap.Stringer("host", host))
 			c.sendEvent(&AddEvent{host})
@@ -365,12 +411,103 @@ func (c *Cluster) reconnect() bool {
 	err := c.connect(c.ctx, host.Endpoint, false)
 	if err != nil {
 		c.logger.Error("error reconnecting to host", zap.Stringer("host", host), zap.Error(err))
+		c.reconnectErrors++
+		if c.reconnectErrors < len(c.hosts) {
+			return false
+		}
+		// Every host failed, their endpoints might be stale so try using newly resolved endpoints
+		c.reconnectErrors = 0
+		if err = c.connectResolved(false); err != nil {
+			c.logger.Error("error reconnecting to resolved endpoints", zap.Error(err))
+			if !c.maybeFailover() {
+				return false
+			}
+		}
+	}
+	c.reconnectErrors = 0
+	c.logger.Debug("control connection connected", zap.Stringer("endpoint", c.currentEndpoint))
+	c.sendEvent(&ReconnectEvent{c.currentEndpoint})
+	return true
+}
+
+// connectResolved re-resolves the cluster's endpoints and connects to the first available endpoint.
+func (c *Cluster) connectResolved(initial bool) error {
+	endpoints, err := c.config.Resolver.Resolve(c.ctx)
+	if err != nil {
+		return fmt.Errorf("unable to resolve endpoints: %w", err)
+	}
+	if len(endpoints) == 0 {
+		return errors.New("no endpoints resolved")
+	}
+	for _, endpoint := range endpoints {
+		if err = c.connect(c.ctx, endpoint, initial); err == nil {
+			return nil
+		}
+		c.logger.Debug("error connecting to resolved endpoint", zap.Stringer("endpoint", endpoint), zap.Error(err))
+	}
+	return err
+}
+
+// maybeFailover fails over if the cluster has been unreachable for longer than the failover delay.
+func (c *Cluster) maybeFailover() bool {
+	resolver, ok := c.config.Resolver.(FailoverEndpointResolver)
+	if !ok || c.OutageDuration() < getOrUseDefault(c.config.FailoverDelay, DefaultFailoverDelay) {
 		return false
-	} else {
-		c.logger.Debug("control connection connected", zap.Stringer("endpoint", c.currentEndpoint))
+	}
+	return c.failover(resolver, false)
+}
+
+// failover connects using the resolver's alternative endpoints, in order of preference.
+func (c *Cluster) failover(resolver FailoverEndpointResolver, initial bool) bool {
+	active := resolver.Active()
+	for i := 0; i < resolver.Alternatives(); i++ {
+		if i == active {
+			continue
+		}
+		if err := c.connectAlternative(resolver, i, initial); err != nil {
+			c.logger.Error("unable to fail over", zap.String("alternative", resolver.Alternative(i)), zap.Error(err))
+			continue
+		}
+		c.logger.Warn("failed over to alternative endpoints",
+			zap.String("previous", resolver.Alternative(active)), zap.String("alternative", resolver.Alternative(i)))
+		return true
+	}
+	return false
+}
+
+// maybeFailBack connects using the resolver's preferred endpoints if the cluster previously failed over, and they're
+// available again. The previous control connection is closed once the cluster has failed back.
+func (c *Cluster) maybeFailBack() bool {
+	resolver, ok := c.config.Resolver.(FailoverEndpointResolver)
+	if !ok {
+		return false
+	}
+	active := resolver.Active()
+	previous := c.controlConn
+	for i := 0; i < active; i++ {
+		if err := c.connectAlternative(resolver, i, false); err != nil {
+			c.logger.Debug("unable to fail back", zap.String("alternative", resolver.Alternative(i)), zap.Error(err))
+			continue
+		}
+		c.logger.Info("failed back to preferred endpoints",
+			zap.String("previous", resolver.Alternative(active)), zap.String("alternative", resolver.Alternative(i)))
+		_ = previous.Close()
 		c.sendEvent(&ReconnectEvent{c.currentEndpoint})
 		return true
 	}
+	return false
+}
+
+// connectAlternative switches the resolver to one of its alternative endpoints and connects using them. The resolver
+// is switched back if it's unable to connect.
+func (c *Cluster) connectAlternative(resolver FailoverEndpointResolver, index int, initial bool) error {
+	previous := resolver.Active()
+	resolver.SetActive(index)
+	if err := c.connectResolved(initial); err != nil {
+		resolver.SetActive(previous)
+		return err
+	}
+	return nil
 }
 
 func (c *Cluster) OutageDuration() time.Duration {
@@ -383,13 +520,27 @@ func (c *Cluster) OutageDuration() time.Duration {
 	}
 }
 
+// LocalDC returns the data center of the cluster's current control connection. It's the same as Info.LocalDC unless
+// the cluster has failed over to alternative endpoints in another data center.
+func (c *Cluster) LocalDC() string {
+	c.localDCMu.Lock()
+	defer c.localDCMu.Unlock()
+	return c.localDC
+}
+
+func (c *Cluster) setLocalDC(dc string) {
+	c.localDCMu.Lock()
+	c.localDC = dc
+	c.localDCMu.Unlock()
+}
+
 func (c *Cluster) refreshHosts() {
 	timeout := getOrUseDefault(c.config.RefreshTimeout, DefaultRefreshTimeout)
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	hosts, _, err := c.queryHosts(ctx, c.controlConn, c.NegotiatedVersion)
 	if err == nil {
-		err = c.mergeHosts(hosts)
+		err = c.mergeHosts(c.currentEndpoint, hosts)
 	}
 	if err != nil {
 		c.logger.Error("unable to refresh hosts", zap.Error(err))
@@ -397,6 +548,19 @@ func (c *Cluster) refreshHosts() {
 	}
 }
 
+// resolveHosts re-resolves the cluster's endpoints and refreshes its hosts so that changes to their endpoints are
+// picked up. It also fails back to the resolver's preferred endpoints if the cluster previously failed over.
+func (c *Cluster) resolveHosts() {
+	if c.maybeFailBack() {
+		return
+	}
+	if _, err := c.config.Resolver.Resolve(c.ctx); err != nil {
+		c.logger.Error("unable to resolve endpoints", zap.Error(err))
+		return
+	}
+	c.refreshHosts()
+}
+
 func (c *Cluster) setOutageTime(t time.Time) {
 	c.outageMu.Lock()
 	c.outageTime = t
@@ -413,6 +577,13 @@ func (c *Cluster) stayConnected() {
 	reconnectPolicy := c.config.ReconnectPolicy.Clone()
 	pendingConnect := false
 
+	var resolveTicker <-chan time.Time
+	if c.config.ResolveInterval > 0 {
+		ticker := time.NewTicker(c.config.ResolveInterval)
+		defer ticker.Stop()
+		resolveTicker = ticker.C
+	}
+
 	done := false
 
 	for !done {
@@ -453,6 +624,8 @@ func (c *Cluster) stayConnected() {
 			case <-refreshTimer.C:
 				c.refreshHosts()
 				pendingRefresh = false
+			case <-resolveTicker:
+				c.resolveHosts()
 			case event := <-c.events:
 				window := getOrUseDefault(c.config.RefreshWindow, DefaultRefreshWindow)
 				switch msg := event.Body.Message.(type) {
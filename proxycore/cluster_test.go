@@ -16,7 +16,11 @@ package proxycore
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -91,3 +95,213 @@ func TestConnectCluster(t *testing.T) {
 	event = wait()
 	assert.Equal(t, event, &ReconnectEvent{&defaultEndpoint{addr: "127.0.0.1:9042"}})
 }
+
+func TestCluster_ResolveInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The same nodes are reachable using two different ports, like a rotated SNI proxy address
+	previous := NewMockCluster(net.ParseIP("127.0.0.0"), 9042)
+	defer previous.Shutdown()
+	current := NewMockCluster(net.ParseIP("127.0.0.0"), 9043)
+	defer current.Shutdown()
+	for i := 1; i <= 2; i++ {
+		require.NoError(t, previous.Add(ctx, i))
+		require.NoError(t, current.Add(ctx, i))
+	}
+
+	resolver := &testPortResolver{port: 9042}
+
+	cluster, err := ConnectCluster(ctx, ClusterConfig{
+		Version:           primitive.ProtocolVersion4,
+		Resolver:          resolver,
+		ReconnectPolicy:   NewReconnectPolicyWithDelays(50*time.Millisecond, 100*time.Millisecond),
+		ConnectTimeout:    10 * time.Second,
+		HeartBeatInterval: 30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ResolveInterval:   100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	session, err := ConnectSession(ctx, cluster, SessionConfig{
+		ReconnectPolicy:   NewReconnectPolicyWithDelays(50*time.Millisecond, 100*time.Millisecond),
+		NumConns:          1,
+		Version:           cluster.NegotiatedVersion,
+		ConnectTimeout:    10 * time.Second,
+		HeartBeatInterval: 30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	})
+	require.NoError(t, err)
+
+	updates := make(chan *Host, 2)
+	err = cluster.Listen(ClusterListenerFunc(func(event Event) {
+		if update, ok := event.(*UpdateEvent); ok {
+			updates <- update.Host
+		}
+	}))
+	require.NoError(t, err)
+
+	host := &Host{Endpoint: &testPortEndpoint{ip: "127.0.0.1", port: 9042}}
+	conn := session.leastBusyConn(host)
+	require.NotNil(t, conn)
+
+	atomic.StoreInt32(&resolver.port, 9043)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case updated := <-updates:
+			assert.True(t, strings.HasSuffix(updated.Addr(), ":9043"), "expected updated port")
+		case <-time.After(2 * time.Second):
+			require.Fail(t, "timed out waiting for update event")
+		}
+	}
+
+	// The healthy connection is kept, but new connections use the updated endpoint
+	assert.Same(t, conn, session.leastBusyConn(host))
+
+	previous.Shutdown()
+
+	assert.Eventually(t, func() bool {
+		conn := session.leastBusyConn(host)
+		return conn != nil && conn.conn.conn.RemoteAddr().String() == "127.0.0.1:9043"
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+type testPortResolver struct {
+	port int32 // (atomic)
+}
+
+func (r *testPortResolver) Resolve(_ context.Context) ([]Endpoint, error) {
+	return []Endpoint{&testPortEndpoint{ip: "127.0.0.1", port: int(atomic.LoadInt32(&r.port))}}, nil
+}
+
+func (r *testPortResolver) NewEndpoint(row Row) (Endpoint, error) {
+	ip, err := row.InetByName("rpc_address")
+	if err != nil {
+		return nil, err
+	}
+	return &testPortEndpoint{ip: ip.String(), port: int(atomic.LoadInt32(&r.port))}, nil
+}
+
+// testPortEndpoint uses the host's IP as its key so that it's stable if the port changes.
+type testPortEndpoint struct {
+	ip   string
+	port int
+}
+
+func (e testPortEndpoint) String() string {
+	return e.Addr()
+}
+
+func (e testPortEndpoint) Addr() string {
+	return net.JoinHostPort(e.ip, strconv.Itoa(e.port))
+}
+
+func (e testPortEndpoint) IsResolved() bool {
+	return true
+}
+
+func (e testPortEndpoint) TLSConfig() *tls.Config {
+	return nil
+}
+
+func (e testPortEndpoint) Key() string {
+	return e.ip
+}
+
+func TestCluster_Failover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	preferred := NewMockCluster(net.ParseIP("127.0.0.0"), 9042)
+	defer preferred.Shutdown()
+	alternative := NewMockCluster(net.ParseIP("127.0.1.0"), 9042)
+	alternative.DC = "dc2"
+	defer alternative.Shutdown()
+	for i := 1; i <= 2; i++ {
+		require.NoError(t, preferred.Add(ctx, i))
+		require.NoError(t, alternative.Add(ctx, i))
+	}
+
+	resolver := &testFailoverResolver{resolvers: []EndpointResolver{
+		NewResolver("127.0.0.1:9042"),
+		NewResolver("127.0.1.1:9042"),
+	}}
+
+	cluster, err := ConnectCluster(ctx, ClusterConfig{
+		Version:           primitive.ProtocolVersion4,
+		Resolver:          resolver,
+		ReconnectPolicy:   NewReconnectPolicyWithDelays(50*time.Millisecond, 100*time.Millisecond),
+		ConnectTimeout:    10 * time.Second,
+		HeartBeatInterval: 30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ResolveInterval:   time.Second,
+		FailoverDelay:     200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "dc1", cluster.LocalDC())
+
+	reconnects := make(chan Endpoint, 10)
+	err = cluster.Listen(ClusterListenerFunc(func(event Event) {
+		if reconnect, ok := event.(*ReconnectEvent); ok {
+			reconnects <- reconnect.Endpoint
+		}
+	}))
+	require.NoError(t, err)
+
+	waitReconnect := func() Endpoint {
+		select {
+		case endpoint := <-reconnects:
+			return endpoint
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "timed out waiting for reconnect event")
+		}
+		return nil
+	}
+
+	preferred.Stop(1)
+	preferred.Stop(2)
+
+	endpoint := waitReconnect()
+	assert.Equal(t, "127.0.1.1:9042", endpoint.Addr())
+	assert.Equal(t, 1, resolver.Active())
+	assert.Equal(t, "dc2", cluster.LocalDC())
+	assert.Equal(t, "dc1", cluster.Info.LocalDC)
+
+	require.NoError(t, preferred.Start(ctx, 1))
+	require.NoError(t, preferred.Start(ctx, 2))
+
+	endpoint = waitReconnect()
+	assert.Equal(t, "127.0.0.1:9042", endpoint.Addr())
+	assert.Equal(t, 0, resolver.Active())
+	assert.Equal(t, "dc1", cluster.LocalDC())
+}
+
+type testFailoverResolver struct {
+	resolvers []EndpointResolver
+	active    int32 // (atomic)
+}
+
+func (r *testFailoverResolver) Resolve(ctx context.Context) ([]Endpoint, error) {
+	return r.resolvers[r.Active()].Resolve(ctx)
+}
+
+func (r *testFailoverResolver) NewEndpoint(row Row) (Endpoint, error) {
+	return r.resolvers[r.Active()].NewEndpoint(row)
+}
+
+func (r *testFailoverResolver) Alternatives() int {
+	return len(r.resolvers)
+}
+
+func (r *testFailoverResolver) Alternative(index int) string {
+	return strconv.Itoa(index)
+}
+
+func (r *testFailoverResolver) Active() int {
+	return int(atomic.LoadInt32(&r.active))
+}
+
+func (r *testFailoverResolver) SetActive(index int) {
+	atomic.StoreInt32(&r.active, int32(index))
+}
@@ -20,12 +20,26 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/datastax/go-cassandra-native-protocol/primitive"
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultScaleUpInflight is the average number of inflight requests per connection that causes a pool to grow.
+	DefaultScaleUpInflight = 512
+	// DefaultScaleDownIdle is how long a pool must be idle before it removes a connection.
+	DefaultScaleDownIdle = 2 * time.Minute
+)
+
+var (
+	poolScaleInterval = time.Second
+	maxDrainWait      = 10 * time.Second
+	drainPollInterval = 50 * time.Millisecond
+)
+
 type connPoolConfig struct {
 	Endpoint
 	SessionConfig
@@ -38,23 +52,48 @@ type connPool struct {
 	preparedCache PreparedCache
 	cancel        context.CancelFunc
 	conns         []*ClientConn
+	slotCancels   []context.CancelFunc
 	connsMu       *sync.RWMutex
+	busySince     time.Time // Only accessed by the scaling goroutine
+	idleSince     time.Time // Only accessed by the scaling goroutine
+	needsPrepare  int32     // Set to 1 when queries need to be re-prepared on the next connection (atomic)
+	endpoint      Endpoint  // The endpoint used for new connections, it's updated if the host's address changes
+	endpointMu    *sync.Mutex
 }
 
-// connectPool establishes a pool of connections to a given endpoint within a downstream cluster. These connection pools will
-// be used to proxy requests from the client to the cluster.
-func connectPool(ctx context.Context, config connPoolConfig) (*connPool, error) {
+func newConnPool(ctx context.Context, config connPoolConfig) *connPool {
 	ctx, cancel := context.WithCancel(ctx)
-
-	pool := &connPool{
+	return &connPool{
 		ctx:           ctx,
 		config:        config,
 		logger:        GetOrCreateNopLogger(config.Logger),
 		preparedCache: config.PreparedCache,
 		cancel:        cancel,
 		conns:         make([]*ClientConn, config.NumConns),
+		slotCancels:   make([]context.CancelFunc, config.NumConns),
 		connsMu:       &sync.RWMutex{},
+		endpoint:      config.Endpoint,
+		endpointMu:    &sync.Mutex{},
 	}
+}
+
+// setEndpoint updates the endpoint used for new connections. Existing connections are kept.
+func (p *connPool) setEndpoint(endpoint Endpoint) {
+	p.endpointMu.Lock()
+	p.endpoint = endpoint
+	p.endpointMu.Unlock()
+}
+
+func (p *connPool) currentEndpoint() Endpoint {
+	p.endpointMu.Lock()
+	defer p.endpointMu.Unlock()
+	return p.endpoint
+}
+
+// connectPool establishes a pool of connections to a given endpoint within a downstream cluster. These connection pools will
+// be used to proxy requests from the client to the cluster.
+func connectPool(ctx context.Context, config connPoolConfig) (*connPool, error) {
+	pool := newConnPool(ctx, config)
 
 	errs := make([]error, config.NumConns)
 	wg := sync.WaitGroup{}
@@ -73,35 +112,35 @@ func connectPool(ctx context.Context, config connPoolConfig) (*connPool, error)
 		if err != nil {
 			pool.logger.Error("unable to connect pool", zap.Stringer("endpoint", config.Endpoint), zap.Error(err))
 			if isCriticalErr(err) {
+				pool.cancel()
 				return nil, err
 			}
 		}
 	}
 
-	for i := 0; i < config.NumConns; i++ {
-		go pool.stayConnected(i)
-	}
+	pool.start()
 
 	return pool, nil
 }
 
 func connectPoolNoFail(ctx context.Context, config connPoolConfig) *connPool {
-	ctx, cancel := context.WithCancel(ctx)
-
-	pool := &connPool{
-		ctx:     ctx,
-		config:  config,
-		logger:  GetOrCreateNopLogger(config.Logger),
-		cancel:  cancel,
-		conns:   make([]*ClientConn, config.NumConns),
-		connsMu: &sync.RWMutex{},
+	pool := newConnPool(ctx, config)
+	if config.PrepareOnAllHosts {
+		pool.needsPrepare = 1 // The host was added or came back up
 	}
+	pool.start()
+	return pool
+}
 
-	for i := 0; i < config.NumConns; i++ {
-		go pool.stayConnected(i)
+func (p *connPool) start() {
+	for i := 0; i < p.config.NumConns; i++ {
+		var slotCtx context.Context
+		slotCtx, p.slotCancels[i] = context.WithCancel(p.ctx)
+		go p.stayConnected(slotCtx, i)
+	}
+	if p.config.MaxConns > p.config.NumConns {
+		go p.scaleConnections(poolScaleInterval)
 	}
-
-	return pool
 }
 
 func (p *connPool) leastBusyConn() *ClientConn {
@@ -128,13 +167,138 @@ func (p *connPool) leastBusyConn() *ClientConn {
 	}
 }
 
+// size returns the current number of connection slots in the pool (connected or not).
+func (p *connPool) size() int {
+	p.connsMu.RLock()
+	defer p.connsMu.RUnlock()
+	return len(p.conns)
+}
+
+// load returns the number of connected connections and the total number of inflight requests across them.
+func (p *connPool) load() (connected int, inflight int32) {
+	p.connsMu.RLock()
+	defer p.connsMu.RUnlock()
+	for _, conn := range p.conns {
+		if conn != nil {
+			connected++
+			inflight += conn.Inflight()
+		}
+	}
+	return connected, inflight
+}
+
+// scaleConnections periodically samples the pool's load and grows or shrinks the number of connections between
+// `NumConns` and `MaxConns`.
+func (p *connPool) scaleConnections(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.scale(now)
+		}
+	}
+}
+
+// scale adds a connection when the average number of inflight requests per connection has stayed above the scale up
+// threshold for two consecutive samples, and removes a connection when it has stayed below half of that threshold for
+// the scale down idle period.
+func (p *connPool) scale(now time.Time) {
+	connected, inflight := p.load()
+	if connected == 0 {
+		return
+	}
+
+	threshold := p.config.ScaleUpInflight
+	if threshold <= 0 {
+		threshold = DefaultScaleUpInflight
+	}
+	idlePeriod := getOrUseDefault(p.config.ScaleDownIdle, DefaultScaleDownIdle)
+
+	size := p.size()
+	avg := inflight / int32(connected)
+
+	if avg >= threshold {
+		p.idleSince = time.Time{}
+		if p.busySince.IsZero() {
+			p.busySince = now
+		} else if size < p.config.MaxConns {
+			p.logger.Info("adding pooled connection because of sustained load",
+				zap.Stringer("endpoint", p.config.Endpoint),
+				zap.Int32("avgInflight", avg),
+				zap.Int("size", size+1))
+			p.addConn()
+			p.busySince = time.Time{}
+		}
+	} else if avg < threshold/2 {
+		p.busySince = time.Time{}
+		if size <= p.config.NumConns {
+			p.idleSince = time.Time{}
+		} else if p.idleSince.IsZero() {
+			p.idleSince = now
+		} else if now.Sub(p.idleSince) >= idlePeriod {
+			p.logger.Info("removing idle pooled connection",
+				zap.Stringer("endpoint", p.config.Endpoint),
+				zap.Int32("avgInflight", avg),
+				zap.Int("size", size-1))
+			p.removeConn()
+			p.idleSince = now
+		}
+	} else {
+		p.busySince = time.Time{}
+		p.idleSince = time.Time{}
+	}
+}
+
+func (p *connPool) addConn() {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	slotCtx, cancel := context.WithCancel(p.ctx)
+	p.conns = append(p.conns, nil)
+	p.slotCancels = append(p.slotCancels, cancel)
+	go p.stayConnected(slotCtx, len(p.conns)-1)
+}
+
+// removeConn removes the last connection slot from the pool. The slot is removed before the connection is closed so
+// that no new requests are sent on it and its inflight requests are given a chance to complete.
+func (p *connPool) removeConn() {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	last := len(p.conns) - 1
+	if last < p.config.NumConns {
+		return
+	}
+	p.slotCancels[last]()
+	p.conns = p.conns[:last]
+	p.slotCancels = p.slotCancels[:last]
+}
+
+// drainAndClose waits for a removed connection's inflight requests to complete before closing it.
+func (p *connPool) drainAndClose(conn *ClientConn) {
+	deadline := time.Now().Add(maxDrainWait)
+	for conn.Inflight() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-p.ctx.Done():
+			_ = conn.Close()
+			return
+		case <-conn.IsClosed():
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+	_ = conn.Close()
+}
+
 func (p *connPool) connect() (conn *ClientConn, err error) {
+	endpoint := p.currentEndpoint()
 	p.logger.Debug("creating pooled connection",
-		zap.Stringer("endpoint", p.config.Endpoint),
+		zap.Stringer("endpoint", endpoint),
 		zap.Stringer("connect timeout", p.config.ConnectTimeout))
 	ctx, cancel := context.WithTimeout(p.ctx, p.config.ConnectTimeout)
 	defer cancel()
-	conn, err = ConnectClient(ctx, p.config.Endpoint, ClientConnConfig{
+	conn, err = ConnectClient(ctx, endpoint, ClientConnConfig{
 		PreparedCache: p.preparedCache,
 		Logger:        p.logger})
 	if err != nil {
@@ -155,6 +319,7 @@ func (p *connPool) connect() (conn *ClientConn, err error) {
 	var version primitive.ProtocolVersion
 	version, err = conn.Handshake(ctx, p.config.Version, p.config.Auth, startupKeysAndValues...)
 	if err != nil {
+		maybeReloadAuth(p.config.Auth, err)
 		if errors.Is(err, context.DeadlineExceeded) {
 			return nil, fmt.Errorf("handshake took longer than %s to complete", p.config.ConnectTimeout)
 		}
@@ -177,9 +342,12 @@ func (p *connPool) connect() (conn *ClientConn, err error) {
 }
 
 // stayConnected will attempt to reestablish a disconnected (`connection == nil`) connection within the pool. Reconnect attempts
-// will be made at intervals defined by the ReconnectPolicy.
-func (p *connPool) stayConnected(idx int) {
+// will be made at intervals defined by the ReconnectPolicy. The slot's context is canceled when the pool is closed or when
+// the slot is removed because the pool is scaling down.
+func (p *connPool) stayConnected(ctx context.Context, idx int) {
+	p.connsMu.RLock()
 	conn := p.conns[idx]
+	p.connsMu.RUnlock()
 
 	connectTimer := time.NewTimer(0)
 	reconnectPolicy := p.config.ReconnectPolicy.Clone()
@@ -192,11 +360,11 @@ func (p *connPool) stayConnected(idx int) {
 				delay := reconnectPolicy.NextDelay()
 				p.logger.Info("pool connection attempting to reconnect after delay",
 					zap.Stringer("endpoint", p.config.Endpoint), zap.Duration("delay", delay))
-				connectTimer = time.NewTimer(reconnectPolicy.NextDelay())
+				connectTimer = time.NewTimer(delay)
 				pendingConnect = true
 			} else {
 				select {
-				case <-p.ctx.Done():
+				case <-ctx.Done():
 					done = true
 				case <-connectTimer.C:
 					c, err := p.connect()
@@ -205,8 +373,16 @@ func (p *connPool) stayConnected(idx int) {
 							zap.Stringer("endpoint", p.config.Endpoint), zap.Error(err))
 					} else {
 						p.connsMu.Lock()
-						conn, p.conns[idx] = c, c
+						if ctx.Err() == nil {
+							conn, p.conns[idx] = c, c
+						} else {
+							_ = c.Close()
+							done = true
+						}
 						p.connsMu.Unlock()
+						if !done && atomic.CompareAndSwapInt32(&p.needsPrepare, 1, 0) {
+							go p.reprepare(c)
+						}
 						reconnectPolicy.Reset()
 					}
 					pendingConnect = false
@@ -214,14 +390,26 @@ func (p *connPool) stayConnected(idx int) {
 			}
 		} else {
 			select {
-			case <-p.ctx.Done():
+			case <-ctx.Done():
 				done = true
-				_ = conn.Close()
+				if p.ctx.Err() != nil {
+					_ = conn.Close()
+				} else {
+					p.drainAndClose(conn)
+				}
 			case <-conn.IsClosed():
 				p.logger.Info("pool connection closed", zap.Stringer("endpoint", p.config.Endpoint), zap.Error(conn.Err()))
 				p.connsMu.Lock()
-				conn, p.conns[idx] = nil, nil
+				if ctx.Err() == nil {
+					p.conns[idx] = nil
+				} else {
+					done = true
+				}
+				conn = nil
 				p.connsMu.Unlock()
+				if connected, _ := p.load(); connected == 0 && p.config.PrepareOnAllHosts {
+					atomic.StoreInt32(&p.needsPrepare, 1) // All connections were lost, the host might have restarted
+				}
 				pendingConnect = false
 			}
 		}
@@ -376,3 +376,95 @@ func waitUntil(d time.Duration, check func() bool) bool {
 	}
 	return false
 }
+
+func TestConnectPool_Scale(t *testing.T) {
+	release := make(chan struct{})
+
+	server := &MockServer{
+		Handlers: NewMockRequestHandlers(MockRequestHandlers{
+			primitive.OpCodeQuery: func(cl *MockClient, frm *frame.Frame) message.Message {
+				<-release
+				return &message.RowsResult{
+					Metadata: &message.RowsMetadata{
+						ColumnCount: 0,
+					},
+					Data: message.RowSet{},
+				}
+			},
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const supported = primitive.ProtocolVersion4
+
+	err := server.Serve(ctx, supported, MockHost{
+		IP:   "127.0.0.1",
+		Port: 9042,
+	}, nil)
+	require.NoError(t, err)
+
+	// Disable the background scaler so the test can drive scaling explicitly
+	interval := poolScaleInterval
+	poolScaleInterval = time.Hour
+	defer func() { poolScaleInterval = interval }()
+
+	p, err := connectPool(ctx, connPoolConfig{
+		Endpoint: &defaultEndpoint{addr: "127.0.0.1:9042"},
+		SessionConfig: SessionConfig{
+			ReconnectPolicy:   NewReconnectPolicy(),
+			NumConns:          1,
+			MaxConns:          2,
+			ScaleUpInflight:   2,
+			ScaleDownIdle:     time.Minute,
+			Version:           supported,
+			ConnectTimeout:    10 * time.Second,
+			HeartBeatInterval: 30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+
+	const numRequests = 4
+
+	var wg sync.WaitGroup
+	wg.Add(numRequests)
+
+	cl := p.leastBusyConn()
+	require.NotNil(t, cl)
+	for i := 0; i < numRequests; i++ {
+		err = cl.Send(&testInflightRequest{&wg})
+		require.NoError(t, err)
+	}
+
+	now := time.Now()
+
+	p.scale(now)
+	assert.Equal(t, 1, p.size()) // Load needs to be sustained for more than a single sample
+
+	p.scale(now.Add(time.Second))
+	assert.Equal(t, 2, p.size())
+
+	connected := waitUntil(10*time.Second, func() bool {
+		c, _ := p.load()
+		return c == 2
+	})
+	require.True(t, connected, "expected the added connection to connect")
+
+	p.scale(now.Add(2 * time.Second))
+	assert.Equal(t, 2, p.size()) // Already at max
+
+	close(release)
+	wg.Wait()
+
+	p.scale(now.Add(3 * time.Second))
+	p.scale(now.Add(30 * time.Second))
+	assert.Equal(t, 2, p.size()) // Not idle long enough
+
+	p.scale(now.Add(3*time.Second + time.Minute))
+	assert.Equal(t, 1, p.size())
+
+	p.scale(now.Add(3*time.Second + 3*time.Minute))
+	assert.Equal(t, 1, p.size()) // Never below min
+}
@@ -0,0 +1,183 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxycore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"go.uber.org/zap"
+)
+
+// ReloadableAuthenticator is an authenticator whose credentials can be reloaded, e.g. after they're rejected by a
+// server because they were rotated.
+type ReloadableAuthenticator interface {
+	Authenticator
+	Reload()
+}
+
+// CredentialFile is a secret, e.g. a password or token, read from a file such as a mounted Kubernetes secret. The file
+// is re-read when it changes so that a rotated secret is used without restarting.
+type CredentialFile struct {
+	path    string
+	logger  *zap.Logger
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+// NewCredentialFile reads a secret from a file. A trailing newline is removed from the file's contents.
+func NewCredentialFile(path string, logger *zap.Logger) (*CredentialFile, error) {
+	f := &CredentialFile{path: path, logger: GetOrCreateNopLogger(logger)}
+	if err := f.read(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Value returns the file's current secret. The file is re-read if its modification time or size changed. The previous
+// secret is kept if the file can't be read, e.g. while it's being replaced.
+func (f *CredentialFile) Value() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if info, err := os.Stat(f.path); err != nil || (info.ModTime().Equal(f.modTime) && info.Size() == f.size) {
+		return f.value
+	}
+	f.reload()
+	return f.value
+}
+
+// Reload re-reads the file even if it doesn't appear to have changed.
+func (f *CredentialFile) Reload() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reload()
+}
+
+func (f *CredentialFile) reload() {
+	previous := f.value
+	if err := f.read(); err != nil {
+		f.logger.Warn("unable to reload credential file, using previous value", zap.String("path", f.path), zap.Error(err))
+	} else if f.value != previous {
+		f.logger.Info("reloaded rotated credential file", zap.String("path", f.path))
+	}
+}
+
+func (f *CredentialFile) read() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("unable to read credential file %s: %w", f.path, err)
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("unable to read credential file %s: %w", f.path, err)
+	}
+	value := strings.TrimRight(string(b), "\r\n")
+	if len(value) == 0 {
+		return fmt.Errorf("credential file %s is empty", f.path)
+	}
+	f.value, f.modTime, f.size = value, info.ModTime(), info.Size()
+	return nil
+}
+
+// FilePasswordConfig configures a password authenticator whose credentials are read from files. Either the value or
+// the file of each credential is used.
+type FilePasswordConfig struct {
+	Username     string
+	UsernameFile string
+	Password     string
+	PasswordFile string
+	Logger       *zap.Logger
+}
+
+// filePasswordAuth creates a password authenticator for each handshake using the current contents of the credential
+// files so that new connections use rotated credentials.
+type filePasswordAuth struct {
+	username     string
+	usernameFile *CredentialFile
+	password     string
+	passwordFile *CredentialFile
+}
+
+// NewFilePasswordAuth creates a password authenticator that reads its username, password, or both, from files. The
+// files are checked for changes each time a connection is authenticated, and they're re-read after the server rejects
+// the credentials.
+func NewFilePasswordAuth(cfg FilePasswordConfig) (Authenticator, error) {
+	if len(cfg.UsernameFile) == 0 && len(cfg.PasswordFile) == 0 {
+		return nil, errors.New("a username or password file is required")
+	}
+	auth := &filePasswordAuth{username: cfg.Username, password: cfg.Password}
+	var err error
+	if len(cfg.UsernameFile) > 0 {
+		if auth.usernameFile, err = NewCredentialFile(cfg.UsernameFile, cfg.Logger); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.PasswordFile) > 0 {
+		if auth.passwordFile, err = NewCredentialFile(cfg.PasswordFile, cfg.Logger); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+func (f *filePasswordAuth) NewSession() Authenticator {
+	username, password := f.username, f.password
+	if f.usernameFile != nil {
+		username = f.usernameFile.Value()
+	}
+	if f.passwordFile != nil {
+		password = f.passwordFile.Value()
+	}
+	return NewPasswordAuth(username, password)
+}
+
+func (f *filePasswordAuth) Reload() {
+	if f.usernameFile != nil {
+		f.usernameFile.Reload()
+	}
+	if f.passwordFile != nil {
+		f.passwordFile.Reload()
+	}
+}
+
+func (f *filePasswordAuth) InitialResponse(authenticator string, c *ClientConn) ([]byte, error) {
+	return f.NewSession().InitialResponse(authenticator, c)
+}
+
+func (f *filePasswordAuth) EvaluateChallenge(token []byte) ([]byte, error) {
+	return f.NewSession().EvaluateChallenge(token)
+}
+
+func (f *filePasswordAuth) Success(_ []byte) error {
+	return nil
+}
+
+// maybeReloadAuth reloads an authenticator's credentials if a server rejected them so that the next attempt uses the
+// latest credentials.
+func maybeReloadAuth(auth Authenticator, err error) {
+	var cqlErr *CqlError
+	if reloadable, ok := auth.(ReloadableAuthenticator); ok && errors.As(err, &cqlErr) {
+		if _, ok = cqlErr.Message.(*message.AuthenticationError); ok {
+			reloadable.Reload()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxycore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("secret\n"), 0600))
+
+	f, err := NewCredentialFile(path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", f.Value())
+
+	require.NoError(t, os.WriteFile(path, []byte("rotated\n"), 0600))
+	assert.Equal(t, "rotated", f.Value())
+
+	// The previous value is kept while the file is missing
+	require.NoError(t, os.Remove(path))
+	assert.Equal(t, "rotated", f.Value())
+	f.Reload()
+	assert.Equal(t, "rotated", f.Value())
+}
+
+func TestNewCredentialFile_Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := NewCredentialFile(filepath.Join(dir, "missing"), nil)
+	assert.Error(t, err)
+
+	path := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+	_, err = NewCredentialFile(path, nil)
+	assert.Error(t, err)
+}
+
+func TestFilePasswordAuth_ReloadAfterAuthError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const supported = primitive.ProtocolVersion4
+
+	server := mockServerWithAuth("username", "secret")
+	err := server.Serve(ctx, supported, MockHost{
+		IP:   "127.0.0.1",
+		Port: 9042,
+	}, nil)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("old123"), 0600))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	auth, err := NewFilePasswordAuth(FilePasswordConfig{Username: "username", PasswordFile: path})
+	require.NoError(t, err)
+
+	handshake := func() error {
+		cl, err := ConnectClient(ctx, NewEndpoint("127.0.0.1:9042"), ClientConnConfig{})
+		require.NoError(t, err)
+		defer func() {
+			_ = cl.Close()
+		}()
+		_, err = cl.Handshake(ctx, supported, auth)
+		return err
+	}
+
+	assert.Error(t, handshake())
+
+	// The rotated password has the same size and modification time so it isn't noticed until it's reloaded
+	require.NoError(t, os.WriteFile(path, []byte("secret"), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), info.ModTime()))
+	assert.Error(t, handshake())
+
+	maybeReloadAuth(auth, &CqlError{Message: &message.AuthenticationError{ErrorMessage: "Invalid credentials"}})
+	assert.NoError(t, handshake())
+}
@@ -64,6 +64,20 @@ type EndpointResolver interface {
 	NewEndpoint(row Row) (Endpoint, error)
 }
 
+// FailoverEndpointResolver is an EndpointResolver with an ordered list of alternative endpoints, e.g. the regions of a
+// multi-region database. The first alternative is preferred. Resolve and NewEndpoint use the active alternative.
+type FailoverEndpointResolver interface {
+	EndpointResolver
+	// Alternatives returns the number of alternatives.
+	Alternatives() int
+	// Alternative returns a description of an alternative for logging.
+	Alternative(index int) string
+	// Active returns the index of the active alternative.
+	Active() int
+	// SetActive switches the alternative used by Resolve and NewEndpoint.
+	SetActive(index int)
+}
+
 type defaultEndpointResolver struct {
 	contactPoints []string
 	defaultPort   string
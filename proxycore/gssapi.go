@@ -0,0 +1,244 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxycore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultGSSAPIService = "dse"
+	DefaultKrb5ConfPath  = "/etc/krb5.conf"
+)
+
+const kerberosAuthenticator = "com.datastax.bdp.cassandra.auth.KerberosAuthenticator"
+
+// SASL GSSAPI security layers (RFC 4752)
+const saslNoSecurityLayer = 0x01
+
+// StatefulAuthenticator is an authenticator that keeps state between the challenges of a handshake. A new session is
+// created for each handshake so that concurrent handshakes don't share state.
+type StatefulAuthenticator interface {
+	Authenticator
+	NewSession() Authenticator
+}
+
+// GSSAPIConfig configures Kerberos (GSSAPI) authentication using a keytab.
+type GSSAPIConfig struct {
+	// Principal is the client's principal, e.g. "cassandra@EXAMPLE.COM". The default realm from the Kerberos
+	// configuration is used if the principal doesn't include a realm.
+	Principal string
+	// KeytabPath is the path of the keytab containing the principal's keys.
+	KeytabPath string
+	// Krb5ConfPath is the path of the Kerberos configuration. DefaultKrb5ConfPath is used if not set.
+	Krb5ConfPath string
+	// Service is the service name of the servers' principals, e.g. "dse" for "dse/node1.example.com@EXAMPLE.COM".
+	// DefaultGSSAPIService is used if not set.
+	Service string
+	// ServiceHost overrides the host of the servers' principals. By default, the host is found using a reverse lookup
+	// of the server's address.
+	ServiceHost string
+	// AuthorizationID is the identity to act as, it's sent during the SASL security layer negotiation. The principal's
+	// identity is used if not set.
+	AuthorizationID string
+	// Logger is used to log unknown authenticators.
+	Logger *zap.Logger
+}
+
+type gssapiState int
+
+const (
+	gssapiInitial gssapiState = iota
+	gssapiMechanismSent
+	gssapiContextSent
+	gssapiDone
+)
+
+// gssapiAuth authenticates using Kerberos. The Kerberos client, and its ticket cache, is shared by all sessions.
+type gssapiAuth struct {
+	cl              *client.Client
+	service         string
+	serviceHost     string
+	authorizationID string
+	logger          *zap.Logger
+	state           gssapiState
+	sessionKey      types.EncryptionKey
+}
+
+// NewGSSAPIAuth creates an authenticator that uses Kerberos, via GSSAPI, with the principal's keytab. It supports the
+// "GSSAPI" mechanism of "DseAuthenticator" and the legacy "KerberosAuthenticator". The client logs in to the KDC when
+// it first authenticates.
+func NewGSSAPIAuth(cfg GSSAPIConfig) (Authenticator, error) {
+	krb5ConfPath := cfg.Krb5ConfPath
+	if len(krb5ConfPath) == 0 {
+		krb5ConfPath = DefaultKrb5ConfPath
+	}
+	krb5Conf, err := config.Load(krb5ConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load Kerberos configuration %s: %w", krb5ConfPath, err)
+	}
+	kt, err := keytab.Load(cfg.KeytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load keytab %s: %w", cfg.KeytabPath, err)
+	}
+
+	username, realm := cfg.Principal, krb5Conf.LibDefaults.DefaultRealm
+	if i := strings.LastIndex(cfg.Principal, "@"); i >= 0 {
+		username, realm = cfg.Principal[:i], cfg.Principal[i+1:]
+	}
+	if len(username) == 0 || len(realm) == 0 {
+		return nil, fmt.Errorf("invalid Kerberos principal '%s', it requires a name and a realm", cfg.Principal)
+	}
+
+	service := cfg.Service
+	if len(service) == 0 {
+		service = DefaultGSSAPIService
+	}
+
+	return &gssapiAuth{
+		cl:              client.NewWithKeytab(username, realm, kt, krb5Conf, client.DisablePAFXFAST(true)),
+		service:         service,
+		serviceHost:     cfg.ServiceHost,
+		authorizationID: cfg.AuthorizationID,
+		logger:          GetOrCreateNopLogger(cfg.Logger),
+	}, nil
+}
+
+func (g *gssapiAuth) NewSession() Authenticator {
+	return &gssapiAuth{
+		cl:              g.cl,
+		service:         g.service,
+		serviceHost:     g.serviceHost,
+		authorizationID: g.authorizationID,
+		logger:          g.logger,
+	}
+}
+
+func (g *gssapiAuth) InitialResponse(authenticator string, c *ClientConn) ([]byte, error) {
+	if len(g.serviceHost) == 0 {
+		g.serviceHost = lookupServiceHost(c.conn.RemoteAddr())
+	}
+	if authenticator == dseAuthenticator {
+		g.state = gssapiMechanismSent
+		return []byte("GSSAPI"), nil
+	}
+	if authenticator != kerberosAuthenticator {
+		g.logger.Info("observed unknown authenticator, treating as GSSAPI",
+			zap.String("authenticator", authenticator))
+	}
+	return g.initSecContext()
+}
+
+func (g *gssapiAuth) EvaluateChallenge(token []byte) ([]byte, error) {
+	switch g.state {
+	case gssapiMechanismSent:
+		if string(token) != "GSSAPI-START" {
+			return nil, fmt.Errorf("incorrect SASL challenge from server, expecting GSSAPI-START, got: %v", string(token))
+		}
+		return g.initSecContext()
+	case gssapiContextSent:
+		if isWrapToken(token) {
+			g.state = gssapiDone
+			return g.negotiateSecurityLayer(token)
+		}
+		// The server established the security context, possibly sending an AP-REP, and expects an empty response
+		// before it starts the security layer negotiation.
+		return []byte{}, nil
+	default:
+		return nil, errors.New("unexpected GSSAPI challenge from server")
+	}
+}
+
+func (g *gssapiAuth) Success(_ []byte) error {
+	return nil
+}
+
+// initSecContext creates the initial context token, a Kerberos AP-REQ, using a service ticket for the server.
+func (g *gssapiAuth) initSecContext() ([]byte, error) {
+	if err := g.cl.AffirmLogin(); err != nil {
+		return nil, fmt.Errorf("unable to login to Kerberos: %w", err)
+	}
+	spn := fmt.Sprintf("%s/%s", g.service, g.serviceHost)
+	tkt, sessionKey, err := g.cl.GetServiceTicket(spn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get Kerberos service ticket for %s: %w", spn, err)
+	}
+	token, err := spnego.NewKRB5TokenAPREQ(g.cl, tkt, sessionKey,
+		[]int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GSSAPI token: %w", err)
+	}
+	b, err := token.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal GSSAPI token: %w", err)
+	}
+	g.sessionKey = sessionKey
+	g.state = gssapiContextSent
+	return b, nil
+}
+
+// negotiateSecurityLayer verifies the server's security layers and responds that no security layer is used, as
+// described in RFC 4752.
+func (g *gssapiAuth) negotiateSecurityLayer(token []byte) ([]byte, error) {
+	var wrapToken gssapi.WrapToken
+	if err := wrapToken.Unmarshal(token, true); err != nil {
+		return nil, fmt.Errorf("invalid GSSAPI wrap token from server: %w", err)
+	}
+	if ok, err := wrapToken.Verify(g.sessionKey, keyusage.GSSAPI_ACCEPTOR_SEAL); !ok {
+		return nil, fmt.Errorf("unable to verify GSSAPI wrap token from server: %w", err)
+	}
+	if len(wrapToken.Payload) != 4 {
+		return nil, fmt.Errorf("invalid GSSAPI security layer payload length: %d", len(wrapToken.Payload))
+	}
+	if wrapToken.Payload[0]&saslNoSecurityLayer == 0 {
+		return nil, errors.New("server requires a GSSAPI security layer, which isn't supported")
+	}
+
+	payload := append([]byte{saslNoSecurityLayer, 0, 0, 0}, g.authorizationID...)
+	response, err := gssapi.NewInitiatorWrapToken(payload, g.sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GSSAPI wrap token: %w", err)
+	}
+	return response.Marshal()
+}
+
+// isWrapToken returns true if the token is a GSSAPI wrap token (RFC 4121), otherwise, it's a context token.
+func isWrapToken(token []byte) bool {
+	return len(token) >= 16 && token[0] == 0x05 && token[1] == 0x04
+}
+
+// lookupServiceHost finds the host name of a server's address. The address is used if it can't be found.
+func lookupServiceHost(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if names, err := net.LookupAddr(host); err == nil && len(names) > 0 {
+		return strings.TrimSuffix(names[0], ".")
+	}
+	return host
+}
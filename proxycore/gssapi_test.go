@@ -0,0 +1,421 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxycore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRealm            = "EXAMPLE.COM"
+	testClientPrincipal  = "cassandra"
+	testServicePrincipal = "dse/localhost"
+)
+
+func TestGSSAPIAuth(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := mockServerWithGSSAPI(t, kdc.keytab, dseAuthenticator)
+	err := server.Serve(ctx, primitive.ProtocolVersion4, MockHost{IP: "127.0.0.1", Port: 9042, HostID: mockHostID}, nil)
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	auth, err := NewGSSAPIAuth(GSSAPIConfig{
+		Principal:    testClientPrincipal + "@" + testRealm,
+		KeytabPath:   kdc.keytabPath,
+		Krb5ConfPath: kdc.krb5ConfPath,
+		ServiceHost:  "localhost",
+	})
+	require.NoError(t, err)
+
+	// Handshakes use separate sessions so they can run concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cl, err := ConnectClient(ctx, NewEndpoint("127.0.0.1:9042"), ClientConnConfig{})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer cl.Close()
+			_, err = cl.Handshake(ctx, primitive.ProtocolVersion4, auth)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGSSAPIAuth_KerberosAuthenticator(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := mockServerWithGSSAPI(t, kdc.keytab, kerberosAuthenticator)
+	err := server.Serve(ctx, primitive.ProtocolVersion4, MockHost{IP: "127.0.0.1", Port: 9042, HostID: mockHostID}, nil)
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	auth, err := NewGSSAPIAuth(GSSAPIConfig{
+		Principal:    testClientPrincipal, // Uses the default realm
+		KeytabPath:   kdc.keytabPath,
+		Krb5ConfPath: kdc.krb5ConfPath,
+		ServiceHost:  "localhost",
+	})
+	require.NoError(t, err)
+
+	cl, err := ConnectClient(ctx, NewEndpoint("127.0.0.1:9042"), ClientConnConfig{})
+	require.NoError(t, err)
+	defer cl.Close()
+
+	_, err = cl.Handshake(ctx, primitive.ProtocolVersion4, auth)
+	require.NoError(t, err)
+}
+
+func TestGSSAPIAuth_UnknownService(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := mockServerWithGSSAPI(t, kdc.keytab, dseAuthenticator)
+	err := server.Serve(ctx, primitive.ProtocolVersion4, MockHost{IP: "127.0.0.1", Port: 9042, HostID: mockHostID}, nil)
+	require.NoError(t, err)
+	defer server.Shutdown()
+
+	auth, err := NewGSSAPIAuth(GSSAPIConfig{
+		Principal:    testClientPrincipal + "@" + testRealm,
+		KeytabPath:   kdc.keytabPath,
+		Krb5ConfPath: kdc.krb5ConfPath,
+		Service:      "unknown",
+		ServiceHost:  "localhost",
+	})
+	require.NoError(t, err)
+
+	cl, err := ConnectClient(ctx, NewEndpoint("127.0.0.1:9042"), ClientConnConfig{})
+	require.NoError(t, err)
+	defer cl.Close()
+
+	_, err = cl.Handshake(ctx, primitive.ProtocolVersion4, auth)
+	assert.ErrorContains(t, err, "unable to get Kerberos service ticket for unknown/localhost")
+}
+
+func TestNewGSSAPIAuth_InvalidKeytab(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.close()
+
+	_, err := NewGSSAPIAuth(GSSAPIConfig{
+		Principal:    testClientPrincipal,
+		KeytabPath:   filepath.Join(kdc.dir, "missing.keytab"),
+		Krb5ConfPath: kdc.krb5ConfPath,
+	})
+	assert.ErrorContains(t, err, "unable to load keytab")
+}
+
+// mockServerWithGSSAPI creates a server that authenticates clients using GSSAPI with the service's keytab. It
+// establishes the security context with an empty challenge, like DSE, before negotiating the security layer.
+func mockServerWithGSSAPI(t *testing.T, kt *keytab.Keytab, authenticator string) *MockServer {
+	type state struct {
+		step       int
+		sessionKey types.EncryptionKey
+	}
+	var mu sync.Mutex
+	states := make(map[*MockClient]*state)
+
+	return &MockServer{
+		Handlers: NewMockRequestHandlers(MockRequestHandlers{
+			primitive.OpCodeStartup: func(client *MockClient, frm *frame.Frame) message.Message {
+				return &message.Authenticate{Authenticator: authenticator}
+			},
+			primitive.OpCodeAuthResponse: func(client *MockClient, frm *frame.Frame) message.Message {
+				mu.Lock()
+				defer mu.Unlock()
+				s, ok := states[client]
+				if !ok {
+					s = &state{}
+					states[client] = s
+				}
+				token := frm.Body.Message.(*message.AuthResponse).Token
+
+				if s.step == 0 && authenticator == dseAuthenticator {
+					if string(token) != "GSSAPI" {
+						return &message.AuthenticationError{ErrorMessage: "Unexpected mechanism"}
+					}
+					s.step++
+					return &message.AuthChallenge{Token: []byte("GSSAPI-START")}
+				}
+				if s.step <= 1 {
+					var krb5Token spnego.KRB5Token
+					if err := krb5Token.Unmarshal(token); err != nil {
+						return &message.AuthenticationError{ErrorMessage: fmt.Sprintf("Invalid token: %v", err)}
+					}
+					if ok, _, err := service.VerifyAPREQ(&krb5Token.APReq, service.NewSettings(kt, service.DecodePAC(false))); !ok {
+						return &message.AuthenticationError{ErrorMessage: fmt.Sprintf("Invalid AP-REQ: %v", err)}
+					}
+					s.sessionKey = krb5Token.APReq.Ticket.DecryptedEncPart.Key
+					s.step = 2
+					return &message.AuthChallenge{Token: []byte{}}
+				}
+				if s.step == 2 {
+					if len(token) != 0 {
+						return &message.AuthenticationError{ErrorMessage: "Expected an empty response"}
+					}
+					s.step++
+					wrapToken, err := newTestAcceptorWrapToken([]byte{saslNoSecurityLayer, 0, 0, 0}, s.sessionKey)
+					require.NoError(t, err)
+					return &message.AuthChallenge{Token: wrapToken}
+				}
+				var wrapToken gssapi.WrapToken
+				if err := wrapToken.Unmarshal(token, false); err != nil {
+					return &message.AuthenticationError{ErrorMessage: fmt.Sprintf("Invalid wrap token: %v", err)}
+				}
+				if ok, err := wrapToken.Verify(s.sessionKey, keyusage.GSSAPI_INITIATOR_SEAL); !ok {
+					return &message.AuthenticationError{ErrorMessage: fmt.Sprintf("Invalid wrap token: %v", err)}
+				}
+				if wrapToken.Payload[0] != saslNoSecurityLayer {
+					return &message.AuthenticationError{ErrorMessage: "Unexpected security layer"}
+				}
+				return &message.AuthSuccess{}
+			},
+		}),
+	}
+}
+
+func newTestAcceptorWrapToken(payload []byte, key types.EncryptionKey) ([]byte, error) {
+	encType, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	token := gssapi.WrapToken{
+		Flags:   0x01, // Sent by acceptor
+		EC:      uint16(encType.GetHMACBitLength() / 8),
+		Payload: payload,
+	}
+	if err = token.SetCheckSum(key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+		return nil, err
+	}
+	return token.Marshal()
+}
+
+// testKDC is a KDC stand-in that issues tickets, without pre-authentication, for the principals in its keytab.
+type testKDC struct {
+	listener     net.Listener
+	keytab       *keytab.Keytab
+	dir          string
+	keytabPath   string
+	krb5ConfPath string
+}
+
+func newTestKDC(t *testing.T) *testKDC {
+	kt := keytab.New()
+	now := time.Now()
+	for _, principal := range []string{testClientPrincipal, "krbtgt/" + testRealm, testServicePrincipal} {
+		require.NoError(t, kt.AddEntry(principal, testRealm, "password", now, 1, etypeID.AES256_CTS_HMAC_SHA1_96))
+	}
+
+	dir := t.TempDir()
+	b, err := kt.Marshal()
+	require.NoError(t, err)
+	keytabPath := filepath.Join(dir, "cassandra.keytab")
+	require.NoError(t, os.WriteFile(keytabPath, b, 0600))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	krb5ConfPath := filepath.Join(dir, "krb5.conf")
+	require.NoError(t, os.WriteFile(krb5ConfPath, []byte(fmt.Sprintf(`[libdefaults]
+  default_realm = %s
+  dns_lookup_kdc = false
+  udp_preference_limit = 1
+  default_tkt_enctypes = aes256-cts-hmac-sha1-96
+  default_tgs_enctypes = aes256-cts-hmac-sha1-96
+  permitted_enctypes = aes256-cts-hmac-sha1-96
+
+[realms]
+  %s = {
+    kdc = %s
+  }
+`, testRealm, testRealm, listener.Addr().String())), 0600))
+
+	kdc := &testKDC{
+		listener:     listener,
+		keytab:       kt,
+		dir:          dir,
+		keytabPath:   keytabPath,
+		krb5ConfPath: krb5ConfPath,
+	}
+	go kdc.serve()
+	return kdc
+}
+
+func (k *testKDC) close() {
+	_ = k.listener.Close()
+}
+
+func (k *testKDC) serve() {
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var size [4]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint32(size[:]))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			rep, err := k.handle(req)
+			if err != nil {
+				krbErr := messages.NewKRBError(types.PrincipalName{}, testRealm, errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, err.Error())
+				rep, _ = krbErr.Marshal()
+			}
+			binary.BigEndian.PutUint32(size[:], uint32(len(rep)))
+			_, _ = conn.Write(append(size[:], rep...))
+		}()
+	}
+}
+
+func (k *testKDC) handle(req []byte) ([]byte, error) {
+	var asReq messages.ASReq
+	if err := asReq.Unmarshal(req); err == nil {
+		return k.handleAS(asReq)
+	}
+	var tgsReq messages.TGSReq
+	if err := tgsReq.Unmarshal(req); err == nil {
+		return k.handleTGS(tgsReq)
+	}
+	return nil, fmt.Errorf("unexpected KDC request")
+}
+
+func (k *testKDC) handleAS(asReq messages.ASReq) ([]byte, error) {
+	clientKey, _, err := k.keytab.GetEncryptionKey(asReq.ReqBody.CName, testRealm, 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return nil, err
+	}
+	tkt, encPart, err := k.newTicket(asReq.ReqBody.CName, asReq.ReqBody.SName, asReq.ReqBody.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := k.encryptEncPart(encPart, clientKey, keyusage.AS_REP_ENCPART)
+	if err != nil {
+		return nil, err
+	}
+	asRep := messages.ASRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    5,
+		MsgType: msgtype.KRB_AS_REP,
+		CRealm:  testRealm,
+		CName:   asReq.ReqBody.CName,
+		Ticket:  tkt,
+		EncPart: encrypted,
+	}}
+	return asRep.Marshal()
+}
+
+func (k *testKDC) handleTGS(tgsReq messages.TGSReq) ([]byte, error) {
+	if len(tgsReq.PAData) == 0 {
+		return nil, fmt.Errorf("missing TGT")
+	}
+	var apReq messages.APReq
+	if err := apReq.Unmarshal(tgsReq.PAData[0].PADataValue); err != nil {
+		return nil, err
+	}
+	if err := apReq.Ticket.DecryptEncPart(k.keytab, nil); err != nil {
+		return nil, err
+	}
+	tkt, encPart, err := k.newTicket(tgsReq.ReqBody.CName, tgsReq.ReqBody.SName, tgsReq.ReqBody.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := k.encryptEncPart(encPart, apReq.Ticket.DecryptedEncPart.Key, keyusage.TGS_REP_ENCPART_SESSION_KEY)
+	if err != nil {
+		return nil, err
+	}
+	tgsRep := messages.TGSRep{KDCRepFields: messages.KDCRepFields{
+		PVNO:    5,
+		MsgType: msgtype.KRB_TGS_REP,
+		CRealm:  testRealm,
+		CName:   tgsReq.ReqBody.CName,
+		Ticket:  tkt,
+		EncPart: encrypted,
+	}}
+	return tgsRep.Marshal()
+}
+
+func (k *testKDC) newTicket(cname, sname types.PrincipalName, nonce int) (messages.Ticket, messages.EncKDCRepPart, error) {
+	now := time.Now().UTC()
+	flags := types.NewKrbFlags()
+	tkt, sessionKey, err := messages.NewTicket(cname, testRealm, sname, testRealm, flags, k.keytab,
+		etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		return tkt, messages.EncKDCRepPart{}, err
+	}
+	return tkt, messages.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReqs:  []messages.LastReq{},
+		Nonce:     nonce,
+		Flags:     flags,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(time.Hour),
+		RenewTill: now.Add(time.Hour),
+		SRealm:    testRealm,
+		SName:     sname,
+	}, nil
+}
+
+func (k *testKDC) encryptEncPart(encPart messages.EncKDCRepPart, key types.EncryptionKey, usage uint32) (types.EncryptedData, error) {
+	b, err := encPart.Marshal()
+	if err != nil {
+		return types.EncryptedData{}, err
+	}
+	return crypto.GetEncryptedData(b, key, usage, 1)
+}
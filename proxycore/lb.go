@@ -59,6 +59,15 @@ func (l *roundRobinLoadBalancer) OnEvent(event Event) {
 				break
 			}
 		}
+	case *UpdateEvent:
+		cpy := l.copy()
+		for i, h := range cpy {
+			if h.Key() == evt.Host.Key() {
+				cpy[i] = evt.Host
+				l.hosts.Store(cpy)
+				break
+			}
+		}
 	}
 }
 
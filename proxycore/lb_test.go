@@ -72,3 +72,20 @@ func TestRoundRobinLoadBalancer_NewQueryPlan(t *testing.T) {
 	qp = lb.NewQueryPlan()
 	assert.Nil(t, qp.Next())
 }
+
+func TestRoundRobinLoadBalancer_UpdateEvent(t *testing.T) {
+	lb := NewRoundRobinLoadBalancer()
+
+	lb.OnEvent(&BootstrapEvent{Hosts: []*Host{
+		{Endpoint: &defaultEndpoint{addr: "127.0.0.1"}, DC: "dc1"},
+		{Endpoint: &defaultEndpoint{addr: "127.0.0.2"}, DC: "dc1"},
+	}})
+
+	updated := &Host{Endpoint: &defaultEndpoint{addr: "127.0.0.2"}, DC: "dc2"}
+	lb.OnEvent(&UpdateEvent{Host: updated})
+
+	qp := lb.NewQueryPlan()
+	assert.Equal(t, "dc1", qp.Next().DC)
+	assert.Same(t, updated, qp.Next())
+	assert.Nil(t, qp.Next())
+}
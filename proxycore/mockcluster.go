@@ -301,7 +301,7 @@ func (c *MockClient) makeSystemPeerValues(version primitive.ProtocolVersion, add
 func (c *MockClient) makeSystemValues(version primitive.ProtocolVersion, address net.IP, hostID, schemaVersion *primitive.UUID) map[string]message.Column {
 	values := map[string]message.Column{
 		"rpc_address":     encodeTypeFatal(version, datatype.Inet, address),
-		"data_center":     encodeTypeFatal(version, datatype.Varchar, "dc1"),
+		"data_center":     encodeTypeFatal(version, datatype.Varchar, c.server.dc()),
 		"rack":            encodeTypeFatal(version, datatype.Varchar, "rack1"),
 		"tokens":          encodeTypeFatal(version, datatype.NewList(datatype.Varchar), []string{"0"}),
 		"release_version": encodeTypeFatal(version, datatype.Varchar, "3.11.10"),
@@ -327,9 +327,17 @@ type MockServer struct {
 	peers      []MockHost
 	mu         sync.Mutex
 	DseVersion string
+	DC         string // Defaults to "dc1"
 	Handlers   map[primitive.OpCode]MockRequestHandler
 }
 
+func (s *MockServer) dc() string {
+	if len(s.DC) == 0 {
+		return "dc1"
+	}
+	return s.DC
+}
+
 func (s *MockServer) Add(host MockHost) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -481,6 +489,7 @@ type MockCluster struct {
 	hosts       []MockHost
 	servers     map[string]*MockServer
 	DseVersion  string
+	DC          string // Defaults to "dc1"
 	Handlers    map[primitive.OpCode]MockRequestHandler
 }
 
@@ -525,7 +534,7 @@ func (c *MockCluster) Add(ctx context.Context, n int) error {
 func (c *MockCluster) maybeStart(ctx context.Context, host MockHost) error {
 	key := host.String()
 	if _, ok := c.servers[key]; !ok {
-		server := &MockServer{DseVersion: c.DseVersion, Handlers: c.Handlers}
+		server := &MockServer{DseVersion: c.DseVersion, DC: c.DC, Handlers: c.Handlers}
 		err := server.Serve(ctx, primitive.ProtocolVersion4, host, c.hosts)
 		if err != nil {
 			return err
@@ -0,0 +1,125 @@
+// Copyright (c) DataStax, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxycore
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"go.uber.org/zap"
+)
+
+// DefaultReprepareConcurrency is the default maximum number of inflight requests used to re-prepare queries on a host.
+const DefaultReprepareConcurrency = 8
+
+// backgroundPrepareRequest prepares a query on a single connection. It's never retried and no client waits for its
+// result.
+type backgroundPrepareRequest struct {
+	prepare *frame.RawFrame
+	logger  *zap.Logger
+	onDone  func()
+	once    sync.Once
+}
+
+func newBackgroundPrepareRequest(prepare *frame.RawFrame, logger *zap.Logger, onDone func()) *backgroundPrepareRequest {
+	// The stream ID is set when the request is sent so copy the header to avoid changing the frame in the cache
+	header := *prepare.Header
+	return &backgroundPrepareRequest{
+		prepare: &frame.RawFrame{Header: &header, Body: prepare.Body},
+		logger:  logger,
+		onDone:  onDone,
+	}
+}
+
+func (r *backgroundPrepareRequest) Execute(_ bool) {
+	r.finish()
+}
+
+func (r *backgroundPrepareRequest) Frame() interface{} {
+	return r.prepare
+}
+
+func (r *backgroundPrepareRequest) IsPrepareRequest() bool {
+	return false // The query is already in the prepared cache
+}
+
+func (r *backgroundPrepareRequest) OnClose(_ error) {
+	r.finish()
+}
+
+func (r *backgroundPrepareRequest) OnResult(raw *frame.RawFrame) {
+	if raw.Header.OpCode == primitive.OpCodeError {
+		r.logger.Debug("unable to prepare query in the background", zap.Stringer("response", raw.Header.OpCode))
+	}
+	r.finish()
+}
+
+func (r *backgroundPrepareRequest) finish() {
+	r.once.Do(func() {
+		if r.onDone != nil {
+			r.onDone()
+		}
+	})
+}
+
+// reprepare prepares the queries in the prepared cache on the pool's host. It's used when a host is added or when the
+// pool reconnects after losing all of its connections, e.g. because the host restarted, so that executing previously
+// prepared queries doesn't require an extra round-trip to handle an unprepared error.
+func (p *connPool) reprepare(conn *ClientConn) {
+	ranger, ok := p.preparedCache.(PreparedCacheRanger)
+	if !ok {
+		return
+	}
+
+	concurrency := p.config.ReprepareConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultReprepareConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var count int32
+	sem := make(chan struct{}, concurrency)
+	ranger.Range(func(id string, entry *PreparedEntry) bool {
+		if entry.PreparedFrame.Header.Version != p.config.Version {
+			return true
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-p.ctx.Done():
+			return false
+		}
+		wg.Add(1)
+		done := func() {
+			<-sem
+			wg.Done()
+		}
+		if err := conn.Send(newBackgroundPrepareRequest(entry.PreparedFrame, p.logger, done)); err != nil {
+			done()
+			p.logger.Debug("unable to re-prepare queries on host", zap.Stringer("endpoint", p.config.Endpoint), zap.Error(err))
+			return false
+		}
+		atomic.AddInt32(&count, 1)
+		return true
+	})
+	wg.Wait()
+
+	if count > 0 {
+		p.logger.Info("re-prepared queries on host",
+			zap.Stringer("endpoint", p.config.Endpoint),
+			zap.Int32("count", count))
+	}
+}
@@ -42,6 +42,13 @@ type PreparedCache interface {
 	Load(id string) (entry *PreparedEntry, ok bool)
 }
 
+// PreparedCacheRanger is implemented by prepared caches that can iterate over their entries. It's required to
+// re-prepare queries on hosts that are added or come back up.
+type PreparedCacheRanger interface {
+	// Range calls `f` for each entry in the cache until it returns false.
+	Range(f func(id string, entry *PreparedEntry) bool)
+}
+
 type SessionConfig struct {
 	ReconnectPolicy ReconnectPolicy
 	NumConns        int
@@ -55,10 +62,30 @@ type SessionConfig struct {
 	IdleTimeout       time.Duration
 	Logger            *zap.Logger
 	Compression       string
+	// MaxConns is the maximum number of connections per host a pool will grow to under sustained load. If it's less than
+	// or equal to NumConns the pool stays at a fixed size of NumConns.
+	MaxConns int
+	// LocalDC is the local data center, hosts in other data centers use RemoteNumConns and RemoteMaxConns. If it's not
+	// set, the cluster's current local data center is used so that new pools follow the cluster when it fails over.
+	LocalDC string
+	// RemoteNumConns overrides NumConns for hosts outside of LocalDC (if greater than zero).
+	RemoteNumConns int
+	// RemoteMaxConns overrides MaxConns for hosts outside of LocalDC (if greater than zero).
+	RemoteMaxConns int
+	// ScaleUpInflight is the average number of inflight requests per connection that causes a pool to add a connection.
+	ScaleUpInflight int32
+	// ScaleDownIdle is how long a pool needs to remain idle before a connection is removed.
+	ScaleDownIdle time.Duration
+	// PrepareOnAllHosts re-prepares the queries in PreparedCache on hosts that are added or that reconnect after losing
+	// all of their connections.
+	PrepareOnAllHosts bool
+	// ReprepareConcurrency is the maximum number of inflight requests used to re-prepare queries on a host.
+	ReprepareConcurrency int
 }
 
 type Session struct {
 	ctx       context.Context
+	cluster   *Cluster
 	config    SessionConfig
 	logger    *zap.Logger
 	pools     sync.Map
@@ -69,6 +96,7 @@ type Session struct {
 func ConnectSession(ctx context.Context, cluster *Cluster, config SessionConfig) (*Session, error) {
 	session := &Session{
 		ctx:       ctx,
+		cluster:   cluster,
 		config:    config,
 		logger:    GetOrCreateNopLogger(config.Logger),
 		pools:     sync.Map{},
@@ -99,6 +127,24 @@ func (s *Session) Send(host *Host, request Request) error {
 	return conn.Send(request)
 }
 
+// PrepareOnAllHosts prepares a query on all of the session's hosts, except the host it was already prepared on. The
+// query is prepared in the background and errors are only logged.
+func (s *Session) PrepareOnAllHosts(prepare *frame.RawFrame, except *Host) {
+	s.pools.Range(func(key, value interface{}) bool {
+		if except != nil && key == except.Key() {
+			return true
+		}
+		if pool, ok := value.(*connPool); ok && pool != nil {
+			if conn := pool.leastBusyConn(); conn != nil {
+				if err := conn.Send(newBackgroundPrepareRequest(prepare, s.logger, nil)); err != nil {
+					s.logger.Debug("unable to prepare query on host", zap.Stringer("endpoint", pool.config.Endpoint), zap.Error(err))
+				}
+			}
+		}
+		return true
+	})
+}
+
 func (s *Session) leastBusyConn(host *Host) *ClientConn {
 	if p, ok := s.pools.Load(host.Key()); ok {
 		pool := p.(*connPool)
@@ -107,6 +153,28 @@ func (s *Session) leastBusyConn(host *Host) *ClientConn {
 	return nil
 }
 
+// poolConfig returns the pool configuration for a host, using the remote pool sizes for hosts outside of the local
+// data center.
+func (s *Session) poolConfig(host *Host) connPoolConfig {
+	config := s.config
+	localDC := config.LocalDC
+	if len(localDC) == 0 {
+		localDC = s.cluster.LocalDC()
+	}
+	if len(localDC) > 0 && host.DC != localDC {
+		if config.RemoteNumConns > 0 {
+			config.NumConns = config.RemoteNumConns
+		}
+		if config.RemoteMaxConns > 0 {
+			config.MaxConns = config.RemoteMaxConns
+		}
+	}
+	return connPoolConfig{
+		Endpoint:      host.Endpoint,
+		SessionConfig: config,
+	}
+}
+
 func (s *Session) OnEvent(event Event) {
 	switch evt := event.(type) {
 	case *BootstrapEvent:
@@ -118,10 +186,7 @@ func (s *Session) OnEvent(event Event) {
 
 			for _, host := range evt.Hosts {
 				go func(host *Host) {
-					pool, err := connectPool(s.ctx, connPoolConfig{
-						Endpoint:      host.Endpoint,
-						SessionConfig: s.config,
-					})
+					pool, err := connectPool(s.ctx, s.poolConfig(host))
 					if err != nil {
 						select {
 						case s.failed <- err:
@@ -139,10 +204,7 @@ func (s *Session) OnEvent(event Event) {
 		}()
 	case *AddEvent:
 		// There's no compute if absent for sync.Map, figure a better way to do this if the pool already exists.
-		if pool, loaded := s.pools.LoadOrStore(evt.Host.Key(), connectPoolNoFail(s.ctx, connPoolConfig{
-			Endpoint:      evt.Host.Endpoint,
-			SessionConfig: s.config,
-		})); loaded {
+		if pool, loaded := s.pools.LoadOrStore(evt.Host.Key(), connectPoolNoFail(s.ctx, s.poolConfig(evt.Host))); loaded {
 			p := pool.(*connPool)
 			p.cancel()
 		}
@@ -151,5 +213,9 @@ func (s *Session) OnEvent(event Event) {
 			p := pool.(*connPool)
 			p.cancel()
 		}
+	case *UpdateEvent:
+		if pool, ok := s.pools.Load(evt.Host.Key()); ok && pool != nil {
+			pool.(*connPool).setEndpoint(evt.Host.Endpoint)
+		}
 	}
 }
@@ -113,6 +113,79 @@ func TestConnectSession(t *testing.T) {
 	require.True(t, removed)
 }
 
+func TestSession_PrepareOnAllHosts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const supported = primitive.ProtocolVersion4
+
+	var mu sync.Mutex
+	prepares := make(map[string]int)
+	countPrepares := func(ip string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return prepares[ip]
+	}
+
+	c := NewMockCluster(net.ParseIP("127.0.0.0"), 9042)
+	c.Handlers = NewMockRequestHandlers(MockRequestHandlers{
+		primitive.OpCodePrepare: func(cl *MockClient, frm *frame.Frame) message.Message {
+			mu.Lock()
+			prepares[cl.Local().IP]++
+			mu.Unlock()
+			return MockDefaultPrepareHandler(cl, frm)
+		},
+	})
+	defer c.Shutdown()
+
+	require.NoError(t, c.Add(ctx, 1))
+	require.NoError(t, c.Add(ctx, 2))
+
+	cluster, err := ConnectCluster(ctx, ClusterConfig{
+		Version:           supported,
+		Resolver:          NewResolver("127.0.0.1:9042"),
+		ReconnectPolicy:   NewReconnectPolicyWithDelays(200*time.Millisecond, time.Second),
+		RefreshWindow:     100 * time.Millisecond,
+		ConnectTimeout:    10 * time.Second,
+		HeartBeatInterval: 30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	})
+	require.NoError(t, err)
+
+	prepareFrame, err := codecs.DefaultRawCodec.ConvertToRawFrame(frame.NewFrame(supported, 0, &message.Prepare{Query: "SELECT * FROM test.test"}))
+	require.NoError(t, err)
+
+	var preparedCache testPrepareCache
+	preparedCache.Store("01", &PreparedEntry{prepareFrame})
+
+	session, err := ConnectSession(ctx, cluster, SessionConfig{
+		ReconnectPolicy:   NewReconnectPolicyWithDelays(50*time.Millisecond, 100*time.Millisecond),
+		NumConns:          2,
+		Version:           supported,
+		PreparedCache:     &preparedCache,
+		ConnectTimeout:    10 * time.Second,
+		HeartBeatInterval: 30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		PrepareOnAllHosts: true,
+	})
+	require.NoError(t, err)
+
+	// Prepare on all hosts except the host the query was already prepared on
+	session.PrepareOnAllHosts(prepareFrame, &Host{Endpoint: &defaultEndpoint{addr: "127.0.0.1:9042"}})
+	assert.True(t, waitUntil(10*time.Second, func() bool { return countPrepares("127.0.0.2") == 1 }))
+	assert.Equal(t, 0, countPrepares("127.0.0.1"))
+
+	// Added hosts are prepared using the prepared cache
+	require.NoError(t, c.Add(ctx, 3))
+	assert.True(t, waitUntil(10*time.Second, func() bool { return countPrepares("127.0.0.3") == 1 }))
+
+	// Hosts are re-prepared when they come back up
+	c.Stop(2)
+	require.NoError(t, c.Start(ctx, 2))
+	assert.True(t, waitUntil(10*time.Second, func() bool { return countPrepares("127.0.0.2") == 2 }))
+	assert.Equal(t, 0, countPrepares("127.0.0.1"))
+}
+
 type testSessionRequest struct {
 	t       *testing.T
 	version primitive.ProtocolVersion
@@ -154,3 +227,34 @@ func (r testSessionRequest) OnResult(raw *frame.RawFrame) {
 
 	r.wg.Done()
 }
+
+func TestSession_PoolConfig(t *testing.T) {
+	s := &Session{config: SessionConfig{
+		NumConns:       2,
+		MaxConns:       8,
+		LocalDC:        "dc1",
+		RemoteNumConns: 1,
+		RemoteMaxConns: 2,
+	}}
+
+	local := s.poolConfig(&Host{Endpoint: NewEndpoint("127.0.0.1:9042"), DC: "dc1"})
+	assert.Equal(t, 2, local.NumConns)
+	assert.Equal(t, 8, local.MaxConns)
+
+	remote := s.poolConfig(&Host{Endpoint: NewEndpoint("127.0.0.2:9042"), DC: "dc2"})
+	assert.Equal(t, 1, remote.NumConns)
+	assert.Equal(t, 2, remote.MaxConns)
+}
+
+func TestSession_PoolConfigClusterLocalDC(t *testing.T) {
+	s := &Session{cluster: &Cluster{localDC: "dc2"}, config: SessionConfig{
+		NumConns:       2,
+		RemoteNumConns: 1,
+	}}
+
+	local := s.poolConfig(&Host{Endpoint: NewEndpoint("127.0.0.1:9042"), DC: "dc2"})
+	assert.Equal(t, 2, local.NumConns)
+
+	remote := s.poolConfig(&Host{Endpoint: NewEndpoint("127.0.0.2:9042"), DC: "dc1"})
+	assert.Equal(t, 1, remote.NumConns)
+}